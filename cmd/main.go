@@ -1,30 +1,242 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"io"
 	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
+	alert "github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/alerting"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/api"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/bus"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/config"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/fleet"
 	hook "github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/logger"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/metrics"
 	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/parser"
 	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/session"
 	log "github.com/sirupsen/logrus"
 )
 
+// Process exit codes, flag parsing errors exit with 2
+const (
+	exitOK      = 0
+	exitFailure = 1
+)
+
 func main() {
+	os.Exit(run())
+}
+
+// Runs the subcommand or the capture and returns the exit code, so deferred calls run before main exits
+func run() int {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			return runReplay(os.Args[2:])
+		case "alert-state":
+			return runAlertState(os.Args[2:])
+		case "collector":
+			return runCollector(os.Args[2:])
+		}
+	}
 
 	logLevel := flag.String("loglevel", "info", "Set the log level (debug, info, warn, error, fatal, panic)")
+	recordFile := flag.String("record", "", "Write every event received by the session to the given capture file")
+	duration := flag.Duration("duration", 0, "Stop capturing after the given duration (e.g. 90s, 2h), 0 runs until SIGINT/SIGTERM")
+	ruleInput := flag.String("rule-input", "stream", "Where rules read events from (stream, files)")
+	agentMode := flag.Bool("agent", false, "Forward events and alerts to the collector configured in config/fleet.yml")
+	apiMode := flag.Bool("api", false, "Serve the local REST API configured in config/api.yml")
+	metricsAddr := flag.String("metrics-addr", "", "Serve Prometheus metrics on the given address under /metrics (e.g. 127.0.0.1:9464), disabled when empty")
 	flag.Parse()
 
-	level, logParseErr := log.ParseLevel(*logLevel)
+	setLogLevel(*logLevel)
+	if err := serveMetrics(*metricsAddr); err != nil {
+		log.WithError(err).Fatal("unable to serve metrics; shutting down")
+	}
+
+	// Create session object and init
+	sessionObj, parserObj := initPipeline(*ruleInput, *agentMode, *apiMode)
+
+	if *recordFile != "" {
+		source, sourceErr := session.NewRealTimeSource(sessionObj.Providers)
+		if sourceErr != nil {
+			log.WithError(sourceErr).Fatal("unable to create event source; shutting down")
+		}
+		sessionObj.Source = session.NewRecordingSource(source, *recordFile)
+	}
+
+	ctx := context.Background()
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+
+	return runPipeline(ctx, sessionObj, parserObj)
+}
+
+// Feeds a capture file written with --record back through the session, provider logs and rules
+func runReplay(args []string) int {
+	replayFlags := flag.NewFlagSet("replay", flag.ExitOnError)
+	logLevel := replayFlags.String("loglevel", "info", "Set the log level (debug, info, warn, error, fatal, panic)")
+	speed := replayFlags.Float64("speed", 0, "Replay speed multiplier honouring original timestamps (0 replays as fast as possible)")
+	ruleInput := replayFlags.String("rule-input", "stream", "Where rules read events from (stream, files)")
+	agentMode := replayFlags.Bool("agent", false, "Forward events and alerts to the collector configured in config/fleet.yml")
+	apiMode := replayFlags.Bool("api", false, "Serve the local REST API configured in config/api.yml")
+	metricsAddr := replayFlags.String("metrics-addr", "", "Serve Prometheus metrics on the given address under /metrics (e.g. 127.0.0.1:9464), disabled when empty")
+	replayFlags.Usage = func() {
+		fmt.Fprintf(replayFlags.Output(), "Usage: %s replay [flags] <capture file>\n", os.Args[0])
+		replayFlags.PrintDefaults()
+	}
+	replayFlags.Parse(args)
+
+	if replayFlags.NArg() != 1 {
+		replayFlags.Usage()
+		return 2
+	}
+
+	setLogLevel(*logLevel)
+	if err := serveMetrics(*metricsAddr); err != nil {
+		log.WithError(err).Error("unable to serve metrics")
+		return exitFailure
+	}
+
+	sessionObj, parserObj := initPipeline(*ruleInput, *agentMode, *apiMode)
+	parserObj.UseEventClock()
+
+	source := session.NewFileSource(replayFlags.Arg(0))
+	source.Speed = *speed
+	sessionObj.Source = source
+
+	// The session returns as soon as the file is exhausted
+	return runPipeline(context.Background(), sessionObj, parserObj)
+}
+
+// Prints the persisted alert suppression state, i.e. the offenders alerted and not yet resolved
+func runAlertState(args []string) int {
+	stateFlags := flag.NewFlagSet("alert-state", flag.ExitOnError)
+	stateFile := stateFlags.String("file", "logs/alert_state.json", "Alert state file to inspect")
+	stateFlags.Parse(args)
+
+	entries, loadErr := alert.LoadSuppressionState(*stateFile)
+	if loadErr != nil {
+		log.WithError(loadErr).Error("unable to load alert state")
+		return exitFailure
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "RULE\tSOURCE\tCOUNT\tALERTS\tSUPPRESSED\tFIRST ALERTED\tLAST ALERTED\tLAST SEEN")
+	for _, entry := range entries {
+		fmt.Fprintf(writer, "%s\t%s\t%d\t%d\t%d\t%s\t%s\t%s\n", entry.Rule, entry.Source, entry.Count, entry.Alerts, entry.Suppressed,
+			entry.FirstAlerted.Format(time.RFC3339), entry.LastAlerted.Format(time.RFC3339), entry.LastSeen.Format(time.RFC3339))
+	}
+	writer.Flush()
+
+	return exitOK
+}
+
+// Receives the events and alerts of the agents and runs the rules across the fleet until SIGINT/SIGTERM
+func runCollector(args []string) int {
+	collectorFlags := flag.NewFlagSet("collector", flag.ExitOnError)
+	logLevel := collectorFlags.String("loglevel", "info", "Set the log level (debug, info, warn, error, fatal, panic)")
+	fleetFile := collectorFlags.String("config", "config/fleet.yml", "Fleet configuration file")
+	metricsAddr := collectorFlags.String("metrics-addr", "", "Serve Prometheus metrics on the given address under /metrics (e.g. 127.0.0.1:9464), disabled when empty")
+	collectorFlags.Parse(args)
+
+	setLogLevel(*logLevel)
+	if err := serveMetrics(*metricsAddr); err != nil {
+		log.WithError(err).Error("unable to serve metrics")
+		return exitFailure
+	}
+
+	fleetConfig, fleetParseErr := config.NewFleetFromFile(*fleetFile)
+	if fleetParseErr != nil {
+		log.WithError(fleetParseErr).Error("unable to parse fleet config")
+		return exitFailure
+	}
+
+	var parserObj parser.Parser
+	if err := parserObj.Init("config/rules.yml"); err != nil {
+		log.WithError(err).Error("unable to initialize parser")
+		return exitFailure
+	}
+
+	eventBus := bus.New()
+	parserObj.Subscribe(eventBus)
+
+	collector, collectorErr := fleet.NewCollector(fleetConfig.Collector, eventBus)
+	if collectorErr != nil {
+		log.WithError(collectorErr).Error("unable to initialize collector")
+		return exitFailure
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	exitCode := exitOK
+
+	parserCtx, stopParser := context.WithCancel(context.Background())
+	parserEndChan := make(chan error, 1)
+	go func() {
+		parserEndChan <- parserObj.Run(parserCtx)
+	}()
+
+	if err := collector.Run(ctx); err != nil {
+		log.WithError(err).Error("collector error; shutting down")
+		exitCode = exitFailure
+	}
+
+	eventBus.Close()
+	stopParser()
+	if err := <-parserEndChan; err != nil {
+		log.WithError(err).Error("parser error; shutting down")
+		exitCode = exitFailure
+	}
+
+	if err := parserObj.RunRules(); err != nil {
+		log.WithError(err).Errorf("problem running rules")
+		exitCode = exitFailure
+	}
+	if err := parserObj.Close(); err != nil {
+		log.WithError(err).Errorf("problem closing notifiers")
+		exitCode = exitFailure
+	}
+
+	log.Warn("Collector stopped, exitting...")
+	return exitCode
+}
+
+func setLogLevel(logLevel string) {
+	level, logParseErr := log.ParseLevel(logLevel)
 	if logParseErr != nil {
 		log.WithError(logParseErr).Fatalf("Invalid log level: %v", logParseErr)
 	}
 	log.SetLevel(level)
+}
 
-	// Create session end channel
-	sessionEndChan := make(chan bool)
+// Serves the metrics in the background for the lifetime of the process, nothing is served without an address
+func serveMetrics(addr string) error {
+	if addr == "" {
+		return nil
+	}
 
+	if _, serveErr := metrics.ListenAndServe(addr); serveErr != nil {
+		return serveErr
+	}
+	log.Infof("Serving metrics on http://%s/metrics", addr)
+	return nil
+}
+
+// Streamed rule input publishes every logged event on an in-process bus the parser subscribes to,
+// the files input re-reads the provider log files on every rule pass. Agents forward the bus and their
+// alerts to the collector whichever the rule input, the API keeps the recent ones in memory
+func initPipeline(ruleInput string, agentMode bool, apiMode bool) (*session.Session, *parser.Parser) {
 	// Create session object and init
 	var sessionObj session.Session
 	if err := sessionObj.Init("config/providers.yml"); err != nil {
@@ -37,36 +249,121 @@ func main() {
 		log.WithError(err).Fatal("unable to initialize parser; shutting down")
 	}
 
-	hook := setupLogging(sessionObj)
-	defer hook.TeardownLogging()
+	switch ruleInput {
+	case "stream":
+		sessionObj.Bus = bus.New()
+		parserObj.Subscribe(sessionObj.Bus)
+	case "files":
+	default:
+		log.Fatalf("Invalid rule input: %s", ruleInput)
+	}
 
-	go func() {
-		defer close(sessionEndChan)
+	if agentMode {
+		fleetConfig, fleetParseErr := config.NewFleetFromFile("config/fleet.yml")
+		if fleetParseErr != nil {
+			log.WithError(fleetParseErr).Fatal("unable to parse fleet config; shutting down")
+		}
 
-		// Start session
-		if err := sessionObj.Run(120); err != nil {
-			log.WithError(err).Fatal("fatal session error; shutting down")
+		agent, agentErr := fleet.NewAgent(fleetConfig.Agent)
+		if agentErr != nil {
+			log.WithError(agentErr).Fatal("unable to initialize agent; shutting down")
 		}
 
-		sessionEndChan <- true
-	}()
+		if sessionObj.Bus == nil {
+			sessionObj.Bus = bus.New()
+		}
+		agent.Start(sessionObj.Bus)
+		parserObj.AddNotifier("agent", agent)
+	}
+
+	if apiMode {
+		apiConfig, apiParseErr := config.NewAPIFromFile("config/api.yml")
+		if apiParseErr != nil {
+			log.WithError(apiParseErr).Fatal("unable to parse API config; shutting down")
+		}
 
+		server, serverErr := api.NewServer(*apiConfig, &sessionObj, &parserObj)
+		if serverErr != nil {
+			log.WithError(serverErr).Fatal("unable to initialize API; shutting down")
+		}
+
+		if sessionObj.Bus == nil {
+			sessionObj.Bus = bus.New()
+		}
+		server.Start(sessionObj.Bus)
+		parserObj.AddNotifier("api", server)
+	}
+
+	return &sessionObj, &parserObj
+}
+
+// Runs the session and parser until the context is done, the session ends or SIGINT/SIGTERM is received,
+// then runs a final rule pass over the tail of the capture and closes the provider logs
+func runPipeline(ctx context.Context, sessionObj *session.Session, parserObj *parser.Parser) int {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	hook := setupLogging(sessionObj)
+	exitCode := exitOK
+
+	parserCtx, stopParser := context.WithCancel(context.Background())
+	parserEndChan := make(chan error, 1)
 	go func() {
 		// Start parser
-		if err := parserObj.Run(); err != nil {
-			log.WithError(err).Fatal("fatal parser error; shutting down")
-		}
+		parserEndChan <- parserObj.Run(parserCtx)
 	}()
 
-	<-sessionEndChan
+	// Start session, blocks until shutdown
+	if err := sessionObj.Run(ctx); err != nil {
+		log.WithError(err).Error("session error; shutting down")
+		exitCode = exitFailure
+	}
+
+	// Closing the bus lets the parser drain the last published events before it stops
+	if sessionObj.Bus != nil {
+		sessionObj.Bus.Close()
+	}
+	stopParser()
+	if err := <-parserEndChan; err != nil {
+		log.WithError(err).Error("parser error; shutting down")
+		exitCode = exitFailure
+	}
+
+	// Events captured since the last scheduled pass would otherwise never be evaluated
+	if err := parserObj.RunRules(); err != nil {
+		log.WithError(err).Errorf("problem running rules")
+		exitCode = exitFailure
+	}
+	if err := parserObj.Close(); err != nil {
+		log.WithError(err).Errorf("problem closing notifiers")
+		exitCode = exitFailure
+	}
+
+	if err := hook.TeardownLogging(); err != nil {
+		exitCode = exitFailure
+	}
+
 	log.Warn("Session ended, exitting...")
+	return exitCode
 }
 
-func setupLogging(sessionObj session.Session) *hook.ProviderHook {
+func setupLogging(sessionObj *session.Session) *hook.ProviderHook {
 	customHook := hook.NewProviderHook()
+	if sessionObj.LogFormat == hook.FormatJSON {
+		customHook.Formatter = hook.JSONFormatter{}
+	}
+
+	// Provider logs are appended to across runs and rotated, the rules read the rotated segments too
+	rotation := hook.RotationConfig{
+		MaxSize:      sessionObj.Rotation.MaxSizeMB << 20,
+		Interval:     sessionObj.Rotation.Interval,
+		Compress:     sessionObj.Rotation.Compress,
+		MaxAge:       sessionObj.Rotation.MaxAge,
+		MaxTotalSize: sessionObj.Rotation.MaxTotalSizeMB << 20,
+	}
 
 	for _, provider := range sessionObj.Providers {
-		file, err := os.OpenFile("logs/"+provider.LogFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_SYNC, 0666)
+		file, err := hook.OpenRotatingFile("logs/"+provider.LogFile, rotation)
 		if err == nil {
 			customHook.ProviderWriters[provider.Id] = file
 			customHook.Files = append(customHook.Files, file)
@@ -1,16 +1,168 @@
 package alert
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
-	"os/exec"
+	"strings"
+	"time"
+	"unicode"
+)
+
+type Severity string
 
-	log "github.com/sirupsen/logrus"
+const (
+	SeverityInformational Severity = "informational"
+	SeverityLow           Severity = "low"
+	SeverityMedium        Severity = "medium"
+	SeverityHigh          Severity = "high"
+	SeverityCritical      Severity = "critical"
 )
 
-// Shows the alert to the host
-// Future work: Send alert to domain administrator
-func ShowAlert(message string) error {
-	log.Warn(message)
+// Parses a severity from rules.yml or a Sigma level, empty defaults to medium
+func ParseSeverity(severity string) (Severity, error) {
+	switch Severity(strings.ToLower(severity)) {
+	case "":
+		return SeverityMedium, nil
+	case "info", SeverityInformational:
+		return SeverityInformational, nil
+	case SeverityLow:
+		return SeverityLow, nil
+	case SeverityMedium:
+		return SeverityMedium, nil
+	case SeverityHigh:
+		return SeverityHigh, nil
+	case SeverityCritical:
+		return SeverityCritical, nil
+	default:
+		return "", fmt.Errorf("unknown severity '%s'", severity)
+	}
+}
+
+// Reports whether the severity is at least as severe as min
+func (s Severity) AtLeast(min Severity) bool {
+	return severityRank(s) >= severityRank(min)
+}
+
+func severityRank(severity Severity) int {
+	switch severity {
+	case SeverityInformational:
+		return 0
+	case SeverityLow:
+		return 1
+	case SeverityHigh:
+		return 3
+	case SeverityCritical:
+		return 4
+	default:
+		return 2
+	}
+}
+
+type Status string
+
+const (
+	StatusFiring   Status = "firing"
+	StatusResolved Status = "resolved"
+)
+
+// Alert is raised for every finding that is not suppressed, and once more when the finding is resolved
+type Alert struct {
+	ID          string     `json:"id"`
+	Time        time.Time  `json:"time"`
+	Status      Status     `json:"status"`
+	Rule        string     `json:"rule"`
+	Severity    Severity   `json:"severity"`
+	Entity      string     `json:"entity"` // the offender, usually a source IP
+	Count       int        `json:"count"`
+	Threshold   int        `json:"threshold"`
+	WindowStart time.Time  `json:"window_start"`
+	WindowEnd   time.Time  `json:"window_end"`
+	FirstSeen   time.Time  `json:"first_seen"`
+	LastSeen    time.Time  `json:"last_seen"`
+	Techniques  []string   `json:"mitre_techniques,omitempty"` // MITRE ATT&CK technique IDs, e.g. T1046
+	Message     string     `json:"message"`
+	Evidence    []Evidence `json:"evidence,omitempty"`
+}
+
+// Alert text is capped so a crafted field cannot flood the notifiers
+const maxAlertTextLength = 1024
+
+// Evidence references a log entry that contributed to the alert
+type Evidence struct {
+	Time       time.Time         `json:"time"`
+	EventID    int               `json:"event_id"`
+	ActivityID string            `json:"activity_id,omitempty"`
+	Fields     map[string]string `json:"fields,omitempty"`
+}
+
+// Returns a random identifier for a new alert
+func NewID() string {
+	id := make([]byte, 16)
+	if _, readErr := rand.Read(id); readErr != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(id)
+}
+
+func (a Alert) String() string {
+	return fmt.Sprintf("[%s] %s", strings.ToUpper(string(a.Severity)), a.Message)
+}
+
+// Returns a copy of the alert that is safe to hand to the notifiers. Rule, entity, message and evidence values
+// can carry attacker influenced text parsed from the events, control characters (line breaks, escape
+// sequences, NUL) are replaced and overly long values are truncated
+func (a Alert) Sanitized() Alert {
+	sanitized := a
+	sanitized.ID = sanitizeText(a.ID, maxAlertTextLength)
+	sanitized.Rule = sanitizeText(a.Rule, maxAlertTextLength)
+	sanitized.Entity = sanitizeText(a.Entity, maxAlertTextLength)
+	sanitized.Message = sanitizeText(a.Message, maxAlertTextLength)
+
+	severity, severityErr := ParseSeverity(string(a.Severity))
+	if severityErr != nil {
+		severity = SeverityMedium
+	}
+	sanitized.Severity = severity
+	if a.Status != StatusResolved {
+		sanitized.Status = StatusFiring
+	}
+
+	sanitized.Techniques = make([]string, len(a.Techniques))
+	for i, technique := range a.Techniques {
+		sanitized.Techniques[i] = sanitizeText(technique, maxAlertTextLength)
+	}
+
+	sanitized.Evidence = make([]Evidence, len(a.Evidence))
+	for i, evidence := range a.Evidence {
+		sanitized.Evidence[i] = Evidence{
+			Time:       evidence.Time,
+			EventID:    evidence.EventID,
+			ActivityID: sanitizeText(evidence.ActivityID, maxAlertTextLength),
+			Fields:     make(map[string]string, len(evidence.Fields)),
+		}
+		for field, value := range evidence.Fields {
+			sanitized.Evidence[i].Fields[sanitizeText(field, maxAlertTextLength)] = sanitizeText(value, maxAlertTextLength)
+		}
+	}
+
+	return sanitized
+}
+
+// Replaces control characters with spaces and truncates the text to maxLength runes
+func sanitizeText(text string, maxLength int) string {
+	var sanitized strings.Builder
+	length := 0
+	for _, r := range text {
+		if length == maxLength {
+			break
+		}
+		if unicode.IsControl(r) || r == unicode.ReplacementChar {
+			r = ' '
+		}
+		sanitized.WriteRune(r)
+		length++
+	}
 
-	return exec.Command("powershell", "-Command", fmt.Sprintf("New-BurntToastNotification -Text '%s'", message)).Run()
+	return sanitized.String()
 }
@@ -0,0 +1,29 @@
+package alert
+
+import (
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// ConsoleNotifier writes alerts to the application log
+type ConsoleNotifier struct{}
+
+func newConsoleNotifier(notifierConfig config.NotifierConfig) (Notifier, error) {
+	if decodeErr := notifierConfig.DecodeParams(&struct{}{}); decodeErr != nil {
+		return nil, decodeErr
+	}
+	return ConsoleNotifier{}, nil
+}
+
+func (ConsoleNotifier) Notify(alert Alert) error {
+	log.WithFields(log.Fields{
+		"id":       alert.ID,
+		"rule":     alert.Rule,
+		"severity": alert.Severity,
+		"entity":   alert.Entity,
+		"count":    alert.Count,
+		"status":   alert.Status,
+	}).Warn(alert.Message)
+
+	return nil
+}
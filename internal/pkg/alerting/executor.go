@@ -0,0 +1,23 @@
+package alert
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Executor runs external commands for the responders, tests and dry runs can substitute their own
+type Executor interface {
+	Execute(name string, args ...string) error
+}
+
+// CommandExecutor runs the command directly, without a shell, so arguments are never re-interpreted
+type CommandExecutor struct{}
+
+func (CommandExecutor) Execute(name string, args ...string) error {
+	output, runErr := exec.Command(name, args...).CombinedOutput()
+	if runErr != nil {
+		return fmt.Errorf("%s failed: %w (%s)", name, runErr, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
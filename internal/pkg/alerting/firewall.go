@@ -0,0 +1,434 @@
+package alert
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// Blocks last an hour and are checked for expiry every minute
+const (
+	defaultFirewallTTL           = time.Hour
+	defaultFirewallCheckInterval = time.Minute
+	defaultFirewallAuditLog      = "logs/firewall_audit.log"
+	defaultFirewallStateFile     = "logs/firewall_state.json"
+	firewallRulePrefix           = "ETW-Network-Scanner-Block-"
+)
+
+var defaultFirewallRules = []string{"rdp_brute_force", "scan_detection"}
+
+type FirewallParams struct {
+	Rules         []string      `yaml:"rules"`     // rules whose offenders are blocked, rdp_brute_force and scan_detection by default
+	Allowlist     []string      `yaml:"allowlist"` // addresses or CIDR prefixes that are never blocked
+	TTL           time.Duration `yaml:"ttl"`
+	CheckInterval time.Duration `yaml:"check_interval"`
+	DryRun        bool          `yaml:"dry_run"` // audit what would be done without touching the firewall
+	AuditLog      string        `yaml:"audit_log"`
+	StateFile     string        `yaml:"state_file"` // active blocks, persisted so they are removed even after a restart
+}
+
+// FirewallBlock is an address blocked by the responder
+type FirewallBlock struct {
+	Address string    `json:"address"`
+	Rule    string    `json:"rule"`
+	AlertID string    `json:"alert_id"`
+	Blocked time.Time `json:"blocked"`
+	Expires time.Time `json:"expires"`
+	DryRun  bool      `json:"dry_run"`
+}
+
+// FirewallAuditEntry is one line of the audit log, every block, unblock and refusal is recorded
+type FirewallAuditEntry struct {
+	Time    time.Time `json:"time"`
+	Action  string    `json:"action"` // block, extend, unblock, skip
+	Address string    `json:"address"`
+	Rule    string    `json:"rule,omitempty"`
+	AlertID string    `json:"alert_id,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+	DryRun  bool      `json:"dry_run"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// FirewallResponder blocks the offending addresses of alerts with a Windows Firewall rule and removes the
+// rule once its TTL elapsed
+type FirewallResponder struct {
+	Params   FirewallParams
+	Executor Executor
+
+	allowlist []netip.Prefix
+	rules     map[string]bool
+
+	mu      sync.Mutex
+	blocks  map[string]*FirewallBlock
+	pending map[string]bool // addresses whose firewall rule is being added or removed
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newFirewallResponder(notifierConfig config.NotifierConfig) (Notifier, error) {
+	params := FirewallParams{
+		Rules:         defaultFirewallRules,
+		TTL:           defaultFirewallTTL,
+		CheckInterval: defaultFirewallCheckInterval,
+		AuditLog:      defaultFirewallAuditLog,
+		StateFile:     defaultFirewallStateFile,
+	}
+	if decodeErr := notifierConfig.DecodeParams(&params); decodeErr != nil {
+		return nil, decodeErr
+	}
+
+	responder, responderErr := NewFirewallResponder(params, CommandExecutor{})
+	if responderErr != nil {
+		return nil, responderErr
+	}
+
+	responder.Start()
+	return responder, nil
+}
+
+func NewFirewallResponder(params FirewallParams, executor Executor) (*FirewallResponder, error) {
+	if params.TTL <= 0 {
+		return nil, fmt.Errorf("firewall ttl must be greater than 0")
+	}
+
+	r := &FirewallResponder{
+		Params:   params,
+		Executor: executor,
+		rules:    make(map[string]bool),
+		blocks:   make(map[string]*FirewallBlock),
+		pending:  make(map[string]bool),
+		done:     make(chan struct{}),
+	}
+
+	for _, rule := range params.Rules {
+		r.rules[rule] = true
+	}
+
+	for _, allowed := range params.Allowlist {
+		prefix, prefixErr := parseAddressOrPrefix(allowed)
+		if prefixErr != nil {
+			return nil, fmt.Errorf("invalid allowlist entry '%s': %w", allowed, prefixErr)
+		}
+		r.allowlist = append(r.allowlist, prefix)
+	}
+
+	for _, path := range []string{params.AuditLog, params.StateFile} {
+		if path == "" {
+			continue
+		}
+		if mkdirErr := os.MkdirAll(filepath.Dir(path), 0755); mkdirErr != nil {
+			return nil, fmt.Errorf("unable to create directory for '%s': %w", path, mkdirErr)
+		}
+	}
+
+	if loadErr := r.load(); loadErr != nil {
+		return nil, loadErr
+	}
+
+	return r, nil
+}
+
+// Removes the blocks that expired while the responder was not running, then keeps expiring them until Close
+func (r *FirewallResponder) Start() {
+	r.Expire(time.Now())
+
+	if r.Params.CheckInterval <= 0 {
+		return
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		ticker := time.NewTicker(r.Params.CheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-r.done:
+				return
+			case now := <-ticker.C:
+				r.Expire(now)
+			}
+		}
+	}()
+}
+
+// Stops expiring blocks, active blocks stay in place and are removed by the next run once they expire
+func (r *FirewallResponder) Close() error {
+	close(r.done)
+	r.wg.Wait()
+	return nil
+}
+
+// Blocks the entity of firing alerts raised by one of the configured rules
+func (r *FirewallResponder) Notify(alert Alert) error {
+	if alert.Status != StatusFiring || !r.rules[alert.Rule] {
+		return nil
+	}
+
+	now := time.Now()
+	address, audit, claimed := r.claim(alert, now)
+	if !claimed {
+		return nil
+	}
+
+	// netsh runs without the lock, so expiry and the alerts of other addresses do not wait for it
+	var blockErr error
+	if !r.Params.DryRun {
+		blockErr = r.Executor.Execute("netsh", "advfirewall", "firewall", "add", "rule",
+			"name="+firewallRuleName(address), "dir=in", "action=block", "remoteip="+address.String())
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.pending, address.String())
+	if blockErr != nil {
+		audit.Error = blockErr.Error()
+		r.audit(audit)
+		return fmt.Errorf("unable to block %s: %w", address, blockErr)
+	}
+	r.audit(audit)
+
+	r.blocks[address.String()] = &FirewallBlock{
+		Address: address.String(),
+		Rule:    alert.Rule,
+		AlertID: alert.ID,
+		Blocked: now,
+		Expires: now.Add(r.Params.TTL),
+		DryRun:  r.Params.DryRun,
+	}
+	r.persist()
+
+	log.Warnf("Blocked %s for %s (rule: %s, dry run: %t)", address, r.Params.TTL, alert.Rule, r.Params.DryRun)
+	return nil
+}
+
+// Audits the alerts that need no new block and extends the existing blocks. Otherwise the address is marked
+// pending until Notify recorded its block
+func (r *FirewallResponder) claim(alert Alert, now time.Time) (netip.Addr, FirewallAuditEntry, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	audit := FirewallAuditEntry{Time: now, Address: alert.Entity, Rule: alert.Rule, AlertID: alert.ID, DryRun: r.Params.DryRun}
+
+	address, parseErr := netip.ParseAddr(alert.Entity)
+	if parseErr != nil {
+		audit.Action, audit.Reason = "skip", "entity is not an IP address"
+		r.audit(audit)
+		return address, audit, false
+	}
+	address = address.Unmap()
+	audit.Address = address.String()
+
+	if reason := r.protected(address); reason != "" {
+		audit.Action, audit.Reason = "skip", reason
+		r.audit(audit)
+		return address, audit, false
+	}
+
+	if r.pending[address.String()] {
+		audit.Action, audit.Reason = "skip", "firewall rule change in progress"
+		r.audit(audit)
+		return address, audit, false
+	}
+
+	// A repeat offender keeps its rule, only the expiry moves. A block recorded by a dry run has no rule, it is
+	// blocked for real once dry_run is turned off
+	if block, exists := r.blocks[address.String()]; exists && (!block.DryRun || r.Params.DryRun) {
+		block.Expires = now.Add(r.Params.TTL)
+		block.AlertID = alert.ID
+		audit.Action, audit.Reason = "extend", "already blocked until "+block.Expires.Format(time.RFC3339)
+		r.audit(audit)
+		r.persist()
+		return address, audit, false
+	}
+
+	audit.Action = "block"
+	r.pending[address.String()] = true
+	return address, audit, true
+}
+
+// Removes the firewall rules of the blocks that expired, a failed removal is retried on the next check
+func (r *FirewallResponder) Expire(now time.Time) {
+	r.mu.Lock()
+	var expired []*FirewallBlock
+	for key, block := range r.blocks {
+		if now.Before(block.Expires) || r.pending[key] {
+			continue
+		}
+		r.pending[key] = true
+		expired = append(expired, block)
+	}
+	r.mu.Unlock()
+
+	if len(expired) == 0 {
+		return
+	}
+
+	// Like Notify, netsh runs without the lock. The pending blocks are neither extended nor expired meanwhile
+	unblockErrs := make([]error, len(expired))
+	for i, block := range expired {
+		if !block.DryRun {
+			address, _ := netip.ParseAddr(block.Address)
+			unblockErrs[i] = r.Executor.Execute("netsh", "advfirewall", "firewall", "delete", "rule", "name="+firewallRuleName(address))
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	changed := false
+	for i, block := range expired {
+		delete(r.pending, block.Address)
+
+		audit := FirewallAuditEntry{Time: now, Action: "unblock", Address: block.Address, Rule: block.Rule, AlertID: block.AlertID, Reason: "ttl elapsed", DryRun: block.DryRun}
+		if unblockErr := unblockErrs[i]; unblockErr != nil {
+			audit.Error = unblockErr.Error()
+			r.audit(audit)
+			log.WithError(unblockErr).Warnf("unable to unblock %s", block.Address)
+			continue
+		}
+		r.audit(audit)
+
+		delete(r.blocks, block.Address)
+		changed = true
+	}
+
+	if changed {
+		r.persist()
+	}
+}
+
+// Returns a copy of the active blocks, ordered by address
+func (r *FirewallResponder) Blocks() []FirewallBlock {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	blocks := make([]FirewallBlock, 0, len(r.blocks))
+	for _, block := range r.blocks {
+		blocks = append(blocks, *block)
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].Address < blocks[j].Address })
+
+	return blocks
+}
+
+// Returns why the address must never be blocked, empty if it can be
+func (r *FirewallResponder) protected(address netip.Addr) string {
+	switch {
+	case address.IsLoopback():
+		return "loopback address"
+	case address.IsUnspecified():
+		return "unspecified address"
+	case address.IsMulticast():
+		return "multicast address"
+	}
+
+	for _, prefix := range r.allowlist {
+		if prefix.Contains(address) {
+			return "allowlisted by " + prefix.String()
+		}
+	}
+
+	return ""
+}
+
+// Must be called with the lock held, failures are logged since the firewall change already happened
+func (r *FirewallResponder) audit(entry FirewallAuditEntry) {
+	if r.Params.AuditLog == "" {
+		return
+	}
+
+	line, marshalErr := json.Marshal(entry)
+	if marshalErr != nil {
+		return
+	}
+
+	file, openFileErr := os.OpenFile(r.Params.AuditLog, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if openFileErr != nil {
+		log.WithError(openFileErr).Errorf("unable to write firewall audit log '%s'", r.Params.AuditLog)
+		return
+	}
+	defer file.Close()
+
+	if _, writeErr := file.Write(append(line, '\n')); writeErr != nil {
+		log.WithError(writeErr).Errorf("unable to write firewall audit log '%s'", r.Params.AuditLog)
+	}
+}
+
+// Must be called with the lock held, see Suppressor.persist
+func (r *FirewallResponder) persist() {
+	if r.Params.StateFile == "" {
+		return
+	}
+
+	blocks := make([]FirewallBlock, 0, len(r.blocks))
+	for _, block := range r.blocks {
+		blocks = append(blocks, *block)
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].Address < blocks[j].Address })
+
+	data, marshalErr := json.MarshalIndent(blocks, "", "  ")
+	if marshalErr != nil {
+		return
+	}
+
+	tmpFile := r.Params.StateFile + ".tmp"
+	if writeErr := os.WriteFile(tmpFile, data, 0600); writeErr != nil {
+		log.WithError(writeErr).Errorf("unable to persist firewall blocks to '%s'", r.Params.StateFile)
+		return
+	}
+	if renameErr := os.Rename(tmpFile, r.Params.StateFile); renameErr != nil {
+		log.WithError(renameErr).Errorf("unable to persist firewall blocks to '%s'", r.Params.StateFile)
+	}
+}
+
+func (r *FirewallResponder) load() error {
+	if r.Params.StateFile == "" {
+		return nil
+	}
+
+	data, readFileErr := os.ReadFile(r.Params.StateFile)
+	if errors.Is(readFileErr, os.ErrNotExist) {
+		return nil
+	}
+	if readFileErr != nil {
+		return fmt.Errorf("error reading firewall state '%s': %w", r.Params.StateFile, readFileErr)
+	}
+
+	var blocks []FirewallBlock
+	if unMarshallErr := json.Unmarshal(data, &blocks); unMarshallErr != nil {
+		return fmt.Errorf("error unmarshalling firewall state '%s': %w", r.Params.StateFile, unMarshallErr)
+	}
+
+	for i := range blocks {
+		r.blocks[blocks[i].Address] = &blocks[i]
+	}
+	return nil
+}
+
+func firewallRuleName(address netip.Addr) string { return firewallRulePrefix + address.String() }
+
+func parseAddressOrPrefix(value string) (netip.Prefix, error) {
+	if prefix, prefixErr := netip.ParsePrefix(value); prefixErr == nil {
+		return prefix.Masked(), nil
+	}
+
+	address, addressErr := netip.ParseAddr(value)
+	if addressErr != nil {
+		return netip.Prefix{}, addressErr
+	}
+	address = address.Unmap()
+	return netip.PrefixFrom(address, address.BitLen()), nil
+}
@@ -0,0 +1,307 @@
+package alert
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// recordingExecutor records the commands instead of running them
+type recordingExecutor struct {
+	calls [][]string
+}
+
+func (e *recordingExecutor) Execute(name string, args ...string) error {
+	e.calls = append(e.calls, append([]string{name}, args...))
+	return nil
+}
+
+func (e *recordingExecutor) take() [][]string {
+	calls := e.calls
+	e.calls = nil
+	return calls
+}
+
+func newTestResponder(t *testing.T, dir string, dryRun bool, executor Executor) *FirewallResponder {
+	t.Helper()
+
+	responder, responderErr := NewFirewallResponder(FirewallParams{
+		Rules:     defaultFirewallRules,
+		Allowlist: []string{"10.1.0.0/16", "192.168.1.10"},
+		TTL:       time.Hour,
+		DryRun:    dryRun,
+		AuditLog:  filepath.Join(dir, "audit.log"),
+		StateFile: filepath.Join(dir, "state.json"),
+	}, executor)
+	if responderErr != nil {
+		t.Fatal(responderErr)
+	}
+	return responder
+}
+
+func firingAlert(rule, entity string) Alert {
+	return Alert{ID: NewID(), Status: StatusFiring, Rule: rule, Entity: entity}
+}
+
+func auditActions(t *testing.T, dir string) []string {
+	t.Helper()
+
+	file, openErr := os.Open(filepath.Join(dir, "audit.log"))
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer file.Close()
+
+	var actions []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry FirewallAuditEntry
+		if unmarshalErr := json.Unmarshal(scanner.Bytes(), &entry); unmarshalErr != nil {
+			t.Fatal(unmarshalErr)
+		}
+		actions = append(actions, entry.Action+" "+entry.Address)
+	}
+	return actions
+}
+
+var (
+	blockArgs   = []string{"netsh", "advfirewall", "firewall", "add", "rule", "name=ETW-Network-Scanner-Block-203.0.113.7", "dir=in", "action=block", "remoteip=203.0.113.7"}
+	unblockArgs = []string{"netsh", "advfirewall", "firewall", "delete", "rule", "name=ETW-Network-Scanner-Block-203.0.113.7"}
+)
+
+func TestFirewallBlockExtendExpire(t *testing.T) {
+	dir := t.TempDir()
+	executor := &recordingExecutor{}
+	responder := newTestResponder(t, dir, false, executor)
+
+	if notifyErr := responder.Notify(firingAlert("rdp_brute_force", "203.0.113.7")); notifyErr != nil {
+		t.Fatal(notifyErr)
+	}
+	if calls := executor.take(); !reflect.DeepEqual(calls, [][]string{blockArgs}) {
+		t.Fatalf("block ran %q", calls)
+	}
+	firstExpiry := responder.Blocks()[0].Expires
+
+	// A repeat offender only has its block extended
+	time.Sleep(10 * time.Millisecond)
+	if notifyErr := responder.Notify(firingAlert("scan_detection", "::ffff:203.0.113.7")); notifyErr != nil {
+		t.Fatal(notifyErr)
+	}
+	if calls := executor.take(); len(calls) != 0 {
+		t.Fatalf("extend ran %q", calls)
+	}
+	blocks := responder.Blocks()
+	if len(blocks) != 1 || !blocks[0].Expires.After(firstExpiry) {
+		t.Fatalf("blocks after extend: %+v", blocks)
+	}
+
+	responder.Expire(time.Now())
+	if calls := executor.take(); len(calls) != 0 {
+		t.Fatalf("expired early, ran %q", calls)
+	}
+	responder.Expire(blocks[0].Expires)
+	if calls := executor.take(); !reflect.DeepEqual(calls, [][]string{unblockArgs}) {
+		t.Fatalf("expire ran %q", calls)
+	}
+	if blocks := responder.Blocks(); len(blocks) != 0 {
+		t.Fatalf("blocks after expire: %+v", blocks)
+	}
+
+	want := []string{"block 203.0.113.7", "extend 203.0.113.7", "unblock 203.0.113.7"}
+	if actions := auditActions(t, dir); !reflect.DeepEqual(actions, want) {
+		t.Errorf("audit %q, want %q", actions, want)
+	}
+}
+
+func TestFirewallSkipsProtectedEntities(t *testing.T) {
+	dir := t.TempDir()
+	executor := &recordingExecutor{}
+	responder := newTestResponder(t, dir, false, executor)
+
+	for _, entity := range []string{"10.1.2.3", "192.168.1.10", "127.0.0.1", "::1", "::ffff:127.0.0.1", "224.0.0.251", "ff02::1", "0.0.0.0", "10.0.0.9@host-a", "not an ip"} {
+		if notifyErr := responder.Notify(firingAlert("scan_detection", entity)); notifyErr != nil {
+			t.Fatal(notifyErr)
+		}
+	}
+
+	// Alerts of other rules and resolved alerts are ignored altogether
+	responder.Notify(firingAlert("rdp_session_hijack", "203.0.113.7"))
+	resolved := firingAlert("scan_detection", "203.0.113.7")
+	resolved.Status = StatusResolved
+	responder.Notify(resolved)
+
+	if calls := executor.take(); len(calls) != 0 {
+		t.Fatalf("ran %q", calls)
+	}
+	if blocks := responder.Blocks(); len(blocks) != 0 {
+		t.Fatalf("blocked %+v", blocks)
+	}
+
+	want := []string{"skip 10.1.2.3", "skip 192.168.1.10", "skip 127.0.0.1", "skip ::1", "skip 127.0.0.1", "skip 224.0.0.251", "skip ff02::1", "skip 0.0.0.0", "skip 10.0.0.9@host-a", "skip not an ip"}
+	if actions := auditActions(t, dir); !reflect.DeepEqual(actions, want) {
+		t.Errorf("audit %q, want %q", actions, want)
+	}
+}
+
+func TestFirewallDryRun(t *testing.T) {
+	dir := t.TempDir()
+	executor := &recordingExecutor{}
+	responder := newTestResponder(t, dir, true, executor)
+
+	if notifyErr := responder.Notify(firingAlert("scan_detection", "203.0.113.7")); notifyErr != nil {
+		t.Fatal(notifyErr)
+	}
+	blocks := responder.Blocks()
+	if len(blocks) != 1 || !blocks[0].DryRun {
+		t.Fatalf("blocks %+v", blocks)
+	}
+	responder.Expire(blocks[0].Expires)
+
+	if calls := executor.take(); len(calls) != 0 {
+		t.Fatalf("dry run ran %q", calls)
+	}
+	want := []string{"block 203.0.113.7", "unblock 203.0.113.7"}
+	if actions := auditActions(t, dir); !reflect.DeepEqual(actions, want) {
+		t.Errorf("audit %q, want %q", actions, want)
+	}
+}
+
+func TestFirewallReloadsState(t *testing.T) {
+	dir := t.TempDir()
+	executor := &recordingExecutor{}
+	responder := newTestResponder(t, dir, false, executor)
+	responder.Notify(firingAlert("rdp_brute_force", "203.0.113.7"))
+	responder.Close()
+	executor.take()
+
+	// The next run removes the block it did not create once it expires
+	reloaded := newTestResponder(t, dir, false, executor)
+	blocks := reloaded.Blocks()
+	if len(blocks) != 1 || blocks[0].Address != "203.0.113.7" || blocks[0].Rule != "rdp_brute_force" {
+		t.Fatalf("reloaded %+v", blocks)
+	}
+	reloaded.Expire(blocks[0].Expires)
+	if calls := executor.take(); !reflect.DeepEqual(calls, [][]string{unblockArgs}) {
+		t.Fatalf("expire ran %q", calls)
+	}
+
+	// A block expired while the responder was down is removed when it starts
+	responder = newTestResponder(t, dir, false, executor)
+	responder.Notify(firingAlert("rdp_brute_force", "203.0.113.7"))
+	executor.take()
+	state := []FirewallBlock{responder.Blocks()[0]}
+	state[0].Expires = time.Now().Add(-time.Minute)
+	data, _ := json.Marshal(state)
+	os.WriteFile(filepath.Join(dir, "state.json"), data, 0600)
+
+	restarted := newTestResponder(t, dir, false, executor)
+	restarted.Params.CheckInterval = 0
+	restarted.Start()
+	if calls := executor.take(); !reflect.DeepEqual(calls, [][]string{unblockArgs}) {
+		t.Fatalf("start ran %q", calls)
+	}
+}
+
+func TestFirewallBlocksDryRunEntriesWhenEnforcing(t *testing.T) {
+	dir := t.TempDir()
+	executor := &recordingExecutor{}
+	dryRun := newTestResponder(t, dir, true, executor)
+	dryRun.Notify(firingAlert("scan_detection", "203.0.113.7"))
+
+	enforcing := newTestResponder(t, dir, false, executor)
+	if notifyErr := enforcing.Notify(firingAlert("scan_detection", "203.0.113.7")); notifyErr != nil {
+		t.Fatal(notifyErr)
+	}
+	if calls := executor.take(); !reflect.DeepEqual(calls, [][]string{blockArgs}) {
+		t.Fatalf("ran %q", calls)
+	}
+	if blocks := enforcing.Blocks(); len(blocks) != 1 || blocks[0].DryRun {
+		t.Fatalf("blocks %+v", blocks)
+	}
+
+	// A real block stays real, and is removed on expiry, when dry_run is turned back on
+	dryRun = newTestResponder(t, dir, true, executor)
+	dryRun.Notify(firingAlert("scan_detection", "203.0.113.7"))
+	blocks := dryRun.Blocks()
+	if len(blocks) != 1 || blocks[0].DryRun {
+		t.Fatalf("blocks %+v", blocks)
+	}
+	dryRun.Expire(blocks[0].Expires)
+	if calls := executor.take(); !reflect.DeepEqual(calls, [][]string{unblockArgs}) {
+		t.Fatalf("expire ran %q", calls)
+	}
+}
+
+// blockingExecutor holds every command until released
+type blockingExecutor struct {
+	started chan []string
+	release chan struct{}
+}
+
+func (e *blockingExecutor) Execute(name string, args ...string) error {
+	e.started <- append([]string{name}, args...)
+	<-e.release
+	return nil
+}
+
+func TestFirewallRunsNetshWithoutTheLock(t *testing.T) {
+	dir := t.TempDir()
+	executor := &blockingExecutor{started: make(chan []string, 1), release: make(chan struct{})}
+	responder := newTestResponder(t, dir, false, executor)
+
+	notified := make(chan error, 1)
+	go func() { notified <- responder.Notify(firingAlert("rdp_brute_force", "203.0.113.7")) }()
+	if command := <-executor.started; !reflect.DeepEqual(command, blockArgs) {
+		t.Fatalf("ran %q", command)
+	}
+
+	// While netsh runs, other alerts and the expiry check go on, the address being blocked is skipped
+	checked := make(chan struct{})
+	go func() {
+		defer close(checked)
+		responder.Notify(firingAlert("rdp_brute_force", "203.0.113.7"))
+		responder.Notify(firingAlert("rdp_brute_force", "127.0.0.1"))
+		responder.Expire(time.Now().Add(2 * time.Hour))
+	}()
+	select {
+	case <-checked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("waited for netsh")
+	}
+
+	close(executor.release)
+	if notifyErr := <-notified; notifyErr != nil {
+		t.Fatal(notifyErr)
+	}
+	if blocks := responder.Blocks(); len(blocks) != 1 || blocks[0].Address != "203.0.113.7" {
+		t.Fatalf("blocks %+v", blocks)
+	}
+
+	want := []string{"skip 203.0.113.7", "skip 127.0.0.1", "block 203.0.113.7"}
+	if actions := auditActions(t, dir); !reflect.DeepEqual(actions, want) {
+		t.Errorf("audit %q, want %q", actions, want)
+	}
+
+	// An expiry also runs netsh without the lock
+	executor.release = make(chan struct{})
+	expired := make(chan struct{})
+	go func() {
+		defer close(expired)
+		responder.Expire(time.Now().Add(2 * time.Hour))
+	}()
+	if command := <-executor.started; !reflect.DeepEqual(command, unblockArgs) {
+		t.Fatalf("ran %q", command)
+	}
+	if blocks := responder.Blocks(); len(blocks) != 1 {
+		t.Fatalf("blocks %+v during the expiry", blocks)
+	}
+	close(executor.release)
+	<-expired
+	if blocks := responder.Blocks(); len(blocks) != 0 {
+		t.Errorf("blocks %+v after the expiry", blocks)
+	}
+}
@@ -0,0 +1,128 @@
+package alert
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/config"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/metrics"
+)
+
+// Notifier delivers alerts to a single backend
+type Notifier interface {
+	Notify(alert Alert) error
+}
+
+// Builds a notifier from its configuration, one per supported type
+type notifierFactory func(notifierConfig config.NotifierConfig) (Notifier, error)
+
+var notifierFactories = map[string]notifierFactory{
+	"console":    newConsoleNotifier,
+	"burnttoast": newBurntToastNotifier,
+	"webhook":    newWebhookNotifier,
+	"smtp":       newSMTPNotifier,
+	"syslog":     newSyslogNotifier,
+	"firewall":   newFirewallResponder,
+}
+
+// Notifiers used when rules.yml does not configure any, matching the original log and toast behaviour
+var defaultNotifiers = []config.NotifierConfig{
+	{Type: "console", Enabled: true},
+	{Type: "burnttoast", Enabled: true},
+}
+
+type registeredNotifier struct {
+	name        string
+	minSeverity Severity
+	notifier    Notifier
+}
+
+// Dispatcher sends every alert to each enabled notifier whose minimum severity it meets
+type Dispatcher struct {
+	notifiers []registeredNotifier
+}
+
+func NewDispatcher(notifierConfigs []config.NotifierConfig) (*Dispatcher, error) {
+	if notifierConfigs == nil {
+		notifierConfigs = defaultNotifiers
+	}
+
+	d := &Dispatcher{}
+	names := make(map[string]bool)
+	for _, notifierConfig := range notifierConfigs {
+		name := notifierConfig.Name
+		if name == "" {
+			name = notifierConfig.Type
+		}
+		if names[name] {
+			return nil, fmt.Errorf("notifier %s is configured more than once, give each a unique name", name)
+		}
+		names[name] = true
+
+		factory, ok := notifierFactories[notifierConfig.Type]
+		if !ok {
+			return nil, fmt.Errorf("notifier %s: unknown type '%s'", name, notifierConfig.Type)
+		}
+
+		if !notifierConfig.Enabled {
+			continue
+		}
+
+		minSeverity := SeverityInformational
+		if notifierConfig.MinSeverity != "" {
+			parsedSeverity, severityErr := ParseSeverity(notifierConfig.MinSeverity)
+			if severityErr != nil {
+				return nil, fmt.Errorf("notifier %s: %w", name, severityErr)
+			}
+			minSeverity = parsedSeverity
+		}
+
+		notifier, notifierErr := factory(notifierConfig)
+		if notifierErr != nil {
+			return nil, fmt.Errorf("notifier %s: %w", name, notifierErr)
+		}
+
+		d.notifiers = append(d.notifiers, registeredNotifier{name: name, minSeverity: minSeverity, notifier: notifier})
+	}
+
+	return d, nil
+}
+
+// Registers a notifier that is not configured in rules.yml, e.g. the fleet agent, it receives every alert
+func (d *Dispatcher) Add(name string, notifier Notifier) {
+	d.notifiers = append(d.notifiers, registeredNotifier{name: name, minSeverity: SeverityInformational, notifier: notifier})
+}
+
+// Sends the alert to every matching notifier, a failing notifier does not stop the others
+func (d *Dispatcher) Notify(alert Alert) error {
+	alert = alert.Sanitized()
+
+	var notifyErrs []error
+	for _, registered := range d.notifiers {
+		if !alert.Severity.AtLeast(registered.minSeverity) {
+			continue
+		}
+
+		if notifyErr := registered.notifier.Notify(alert); notifyErr != nil {
+			notifyErrs = append(notifyErrs, fmt.Errorf("%s: %w", registered.name, notifyErr))
+			metrics.NotifierFailures.Inc(registered.name)
+		}
+	}
+
+	return errors.Join(notifyErrs...)
+}
+
+// Releases the notifiers that hold background work or queued alerts
+func (d *Dispatcher) Close() error {
+	var closeErrs []error
+	for _, registered := range d.notifiers {
+		if closer, ok := registered.notifier.(io.Closer); ok {
+			if closeErr := closer.Close(); closeErr != nil {
+				closeErrs = append(closeErrs, fmt.Errorf("%s: %w", registered.name, closeErr))
+			}
+		}
+	}
+
+	return errors.Join(closeErrs...)
+}
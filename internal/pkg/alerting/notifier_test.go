@@ -0,0 +1,171 @@
+package alert
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// testNotifier keeps the alerts it receives and fails with err
+type testNotifier struct {
+	alerts   []Alert
+	err      error
+	closed   bool
+	closeErr error
+}
+
+func (n *testNotifier) Notify(alert Alert) error {
+	n.alerts = append(n.alerts, alert)
+	return n.err
+}
+
+func (n *testNotifier) Close() error {
+	n.closed = true
+	return n.closeErr
+}
+
+// notifierFunc is a notifier without a Close method
+type notifierFunc func(alert Alert) error
+
+func (f notifierFunc) Notify(alert Alert) error { return f(alert) }
+
+func TestNewDispatcher(t *testing.T) {
+	// Without notifiers configured alerts go to the log and toasts, as before notifiers were configurable
+	d, dispatcherErr := NewDispatcher(nil)
+	if dispatcherErr != nil {
+		t.Fatal(dispatcherErr)
+	}
+	var names []string
+	for _, registered := range d.notifiers {
+		names = append(names, registered.name)
+	}
+	if strings.Join(names, ",") != "console,burnttoast" {
+		t.Errorf("default notifiers %v", names)
+	}
+
+	d, dispatcherErr = NewDispatcher([]config.NotifierConfig{
+		{Type: "console", Enabled: true, MinSeverity: "high"},
+		{Name: "audit", Type: "console", Enabled: true},
+		{Type: "burnttoast", Enabled: false},
+	})
+	if dispatcherErr != nil {
+		t.Fatal(dispatcherErr)
+	}
+	if len(d.notifiers) != 2 || d.notifiers[0].minSeverity != SeverityHigh || d.notifiers[1].name != "audit" || d.notifiers[1].minSeverity != SeverityInformational {
+		t.Errorf("notifiers %+v", d.notifiers)
+	}
+
+	tests := []struct {
+		name    string
+		configs []config.NotifierConfig
+	}{
+		{"duplicate name", []config.NotifierConfig{{Type: "console", Enabled: true}, {Type: "console"}}},
+		{"unknown type", []config.NotifierConfig{{Type: "pager", Enabled: false}}},
+		{"invalid min severity", []config.NotifierConfig{{Type: "console", Enabled: true, MinSeverity: "urgent"}}},
+		{"invalid params", []config.NotifierConfig{{Type: "syslog", Enabled: true}}},
+	}
+	for _, test := range tests {
+		if _, dispatcherErr := NewDispatcher(test.configs); dispatcherErr == nil {
+			t.Errorf("%s: accepted", test.name)
+		}
+	}
+}
+
+func TestDispatcherMinSeverity(t *testing.T) {
+	everything, highOnly := &testNotifier{}, &testNotifier{}
+	d := &Dispatcher{notifiers: []registeredNotifier{
+		{name: "everything", minSeverity: SeverityInformational, notifier: everything},
+		{name: "high", minSeverity: SeverityHigh, notifier: highOnly},
+	}}
+
+	for _, severity := range []Severity{SeverityLow, SeverityHigh, SeverityMedium, SeverityCritical} {
+		if notifyErr := d.Notify(Alert{Rule: "scan_detection", Severity: severity}); notifyErr != nil {
+			t.Fatal(notifyErr)
+		}
+	}
+
+	severities := func(n *testNotifier) []Severity {
+		var severities []Severity
+		for _, alert := range n.alerts {
+			severities = append(severities, alert.Severity)
+		}
+		return severities
+	}
+	if got := severities(everything); len(got) != 4 {
+		t.Errorf("informational notifier got %v, want every alert", got)
+	}
+	if got := severities(highOnly); len(got) != 2 || got[0] != SeverityHigh || got[1] != SeverityCritical {
+		t.Errorf("high notifier got %v, want [high critical]", got)
+	}
+}
+
+func TestDispatcherNotifyErrors(t *testing.T) {
+	refused, timedOut := errors.New("connection refused"), errors.New("timed out")
+	first, second := &testNotifier{err: refused}, &testNotifier{}
+	var third []Alert
+	d := &Dispatcher{}
+	d.Add("webhook", first)
+	d.Add("syslog", second)
+	d.Add("smtp", notifierFunc(func(alert Alert) error {
+		third = append(third, alert)
+		return timedOut
+	}))
+
+	// Every notifier is tried and receives the alert sanitized, the failures are joined
+	notifyErr := d.Notify(Alert{Rule: "rdp_brute_force", Entity: "10.0.0.9\n", Severity: "HIGH", Status: "unknown"})
+	if !errors.Is(notifyErr, refused) || !errors.Is(notifyErr, timedOut) {
+		t.Fatalf("notify error %v", notifyErr)
+	}
+	if message := notifyErr.Error(); !strings.Contains(message, "webhook: connection refused") || !strings.Contains(message, "smtp: timed out") {
+		t.Errorf("notify error %q does not name the notifiers", message)
+	}
+	if len(first.alerts) != 1 || len(second.alerts) != 1 || len(third) != 1 {
+		t.Fatalf("notified %d, %d and %d times, want once each", len(first.alerts), len(second.alerts), len(third))
+	}
+	if sanitized := second.alerts[0]; sanitized.Entity != "10.0.0.9 " || sanitized.Severity != SeverityHigh || sanitized.Status != StatusFiring {
+		t.Errorf("notified %+v", sanitized)
+	}
+}
+
+func TestDispatcherClose(t *testing.T) {
+	closeFailed := errors.New("outbox not writable")
+	first, second := &testNotifier{closeErr: closeFailed}, &testNotifier{}
+	d := &Dispatcher{}
+	d.Add("webhook", first)
+	d.Add("console", notifierFunc(func(alert Alert) error { return nil }))
+	d.Add("smtp", second)
+
+	// A failing notifier does not keep the others open
+	closeErr := d.Close()
+	if !errors.Is(closeErr, closeFailed) || !strings.Contains(closeErr.Error(), "webhook: ") {
+		t.Errorf("close error %v", closeErr)
+	}
+	if !first.closed || !second.closed {
+		t.Error("not every notifier was closed")
+	}
+
+	if closeErr := (&Dispatcher{}).Close(); closeErr != nil {
+		t.Errorf("closing no notifiers: %v", closeErr)
+	}
+}
+
+func TestConsoleNotifier(t *testing.T) {
+	var output bytes.Buffer
+	previous := log.StandardLogger().Out
+	log.SetOutput(&output)
+	t.Cleanup(func() { log.SetOutput(previous) })
+
+	notifyErr := ConsoleNotifier{}.Notify(Alert{ID: "a1", Rule: "scan_detection", Severity: SeverityMedium, Entity: "10.0.0.9", Count: 60, Status: StatusFiring, Message: "10.0.0.9 scanned 60 ports"})
+	if notifyErr != nil {
+		t.Fatal(notifyErr)
+	}
+	for _, want := range []string{"level=warning", `msg="10.0.0.9 scanned 60 ports"`, "rule=scan_detection", "entity=10.0.0.9", "count=60", "severity=medium", "status=firing", "id=a1"} {
+		if !strings.Contains(output.String(), want) {
+			t.Errorf("logged %q, missing %s", output.String(), want)
+		}
+	}
+}
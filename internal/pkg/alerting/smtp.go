@@ -0,0 +1,384 @@
+package alert
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/config"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// Digests are capped at 100 alerts, a burst beyond that is sent as several emails. Up to 100 emails wait
+// for the relay, alerts beyond that are dropped
+const (
+	defaultSMTPTimeout   = 30 * time.Second
+	defaultSMTPMaxBatch  = 100
+	defaultSMTPQueueSize = 100
+)
+
+const defaultSMTPSubjectTemplate = `{{if eq (len .Alerts) 1}}{{with index .Alerts 0}}[{{upper .Severity}}] {{.Rule}} alert: {{.Entity}}{{end}}` +
+	`{{else}}[{{upper .Severity}}] {{len .Alerts}} alerts from {{.Hostname}}{{end}}`
+
+const defaultSMTPBodyTemplate = `{{range .Alerts}}{{.Message}}
+
+Alert ID: {{.ID}}
+Status: {{.Status}}
+Rule: {{.Rule}}
+Severity: {{.Severity}}
+Entity: {{.Entity}}
+Count: {{.Count}} (threshold {{.Threshold}})
+Seen: {{rfc3339 .FirstSeen}} - {{rfc3339 .LastSeen}}
+{{if .Techniques}}MITRE ATT&CK: {{join .Techniques ", "}}
+{{end}}
+{{end}}-- 
+Sent by ETW-Network-Scanner on {{.Hostname}}
+`
+
+type SMTPParams struct {
+	Host               string        `yaml:"host"`
+	Port               int           `yaml:"port"`
+	TLS                string        `yaml:"tls"`      // starttls (default), implicit or none
+	Username           string        `yaml:"username"` // PLAIN authentication is used when set
+	Password           string        `yaml:"password"`
+	PasswordEnv        string        `yaml:"password_env"` // environment variable holding the password
+	InsecureSkipVerify bool          `yaml:"insecure_skip_verify"`
+	From               string        `yaml:"from"`
+	To                 []string      `yaml:"to"`
+	Timeout            time.Duration `yaml:"timeout"`
+	SubjectTemplate    string        `yaml:"subject_template"` // Go templates over the batch, see smtpMessage
+	BodyTemplate       string        `yaml:"body_template"`
+	BatchInterval      time.Duration `yaml:"batch_interval"` // alerts raised within this interval are sent as one digest, 0 sends every alert on its own
+	MaxBatch           int           `yaml:"max_batch"`
+}
+
+// Data available to the subject and body templates
+type smtpMessage struct {
+	Alerts   []Alert
+	Severity Severity // highest severity of the alerts
+	Hostname string
+}
+
+// SMTPNotifier emails alerts, e.g. to the on-call or the domain administrators. With a batch interval the
+// alerts raised within it are sent as a single digest. Emails are sent in the background so rules never
+// wait on the relay, failures are logged
+type SMTPNotifier struct {
+	Params   SMTPParams
+	Hostname string
+
+	subject *template.Template
+	body    *template.Template
+
+	// From and To may carry display names, e.g. "SOC <soc@example.com>", the envelope only takes the addresses
+	envelopeFrom string
+	envelopeTo   []string
+
+	name   string // the notifier name in metrics
+	mu     sync.Mutex
+	batch  []Alert
+	timer  *time.Timer
+	closed bool
+	queue  chan []Alert // emails waiting to be sent, one per alert or digest
+	wg     sync.WaitGroup
+}
+
+func newSMTPNotifier(notifierConfig config.NotifierConfig) (Notifier, error) {
+	name := notifierConfig.Name
+	if name == "" {
+		name = notifierConfig.Type
+	}
+
+	params := SMTPParams{TLS: "starttls", Timeout: defaultSMTPTimeout, MaxBatch: defaultSMTPMaxBatch}
+	if decodeErr := notifierConfig.DecodeParams(&params); decodeErr != nil {
+		return nil, decodeErr
+	}
+	if params.PasswordEnv != "" {
+		params.Password = os.Getenv(params.PasswordEnv)
+		if params.Password == "" {
+			return nil, fmt.Errorf("smtp password environment variable %s is not set", params.PasswordEnv)
+		}
+	}
+
+	notifier, notifierErr := NewSMTPNotifier(params)
+	if notifierErr != nil {
+		return nil, notifierErr
+	}
+	notifier.name = name
+	return notifier, nil
+}
+
+// Starts sending in the background until Close
+func NewSMTPNotifier(params SMTPParams) (*SMTPNotifier, error) {
+	if params.Host == "" || params.From == "" || len(params.To) == 0 {
+		return nil, fmt.Errorf("smtp requires a host, from and at least one to address")
+	}
+
+	switch params.TLS {
+	case "starttls", "none":
+		if params.Port == 0 {
+			params.Port = 587
+		}
+	case "implicit":
+		if params.Port == 0 {
+			params.Port = 465
+		}
+	default:
+		return nil, fmt.Errorf("smtp tls must be starttls, implicit or none, got '%s'", params.TLS)
+	}
+
+	var envelope []string
+	for _, address := range append([]string{params.From}, params.To...) {
+		parsed, parseErr := mail.ParseAddress(address)
+		if parseErr != nil {
+			return nil, fmt.Errorf("invalid email address '%s': %w", address, parseErr)
+		}
+		envelope = append(envelope, parsed.Address)
+	}
+
+	if params.SubjectTemplate == "" {
+		params.SubjectTemplate = defaultSMTPSubjectTemplate
+	}
+	if params.BodyTemplate == "" {
+		params.BodyTemplate = defaultSMTPBodyTemplate
+	}
+	if params.MaxBatch <= 0 {
+		params.MaxBatch = defaultSMTPMaxBatch
+	}
+
+	s := &SMTPNotifier{
+		Params:       params,
+		envelopeFrom: envelope[0],
+		envelopeTo:   envelope[1:],
+		name:         "smtp",
+		queue:        make(chan []Alert, defaultSMTPQueueSize),
+	}
+	s.Hostname, _ = os.Hostname()
+
+	functions := template.FuncMap{
+		"upper":   func(value interface{}) string { return strings.ToUpper(fmt.Sprint(value)) },
+		"join":    strings.Join,
+		"rfc3339": func(t time.Time) string { return t.Format(time.RFC3339) },
+	}
+
+	var templateErr error
+	if s.subject, templateErr = template.New("subject").Funcs(functions).Parse(params.SubjectTemplate); templateErr != nil {
+		return nil, fmt.Errorf("invalid subject template: %w", templateErr)
+	}
+	if s.body, templateErr = template.New("body").Funcs(functions).Parse(params.BodyTemplate); templateErr != nil {
+		return nil, fmt.Errorf("invalid body template: %w", templateErr)
+	}
+
+	s.wg.Add(1)
+	go s.sendLoop()
+
+	return s, nil
+}
+
+// Queues the alert, the error only reports a failure to queue it, sending failures are logged
+func (s *SMTPNotifier) Notify(alert Alert) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return errors.New("smtp notifier is closed")
+	}
+	if s.Params.BatchInterval <= 0 {
+		return s.enqueue([]Alert{alert})
+	}
+
+	s.batch = append(s.batch, alert)
+	if len(s.batch) >= s.Params.MaxBatch {
+		return s.flush()
+	}
+
+	// The digest goes out one interval after its first alert
+	if s.timer == nil {
+		s.timer = time.AfterFunc(s.Params.BatchInterval, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			if s.closed {
+				return
+			}
+			if flushErr := s.flush(); flushErr != nil {
+				metrics.NotifierFailures.Inc(s.name)
+				log.WithError(flushErr).Warn("unable to queue alert digest")
+			}
+		})
+	}
+
+	return nil
+}
+
+// Sends the digest still being batched and waits for the queued emails to be sent
+func (s *SMTPNotifier) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	flushErr := s.flush()
+	s.closed = true
+	close(s.queue)
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return flushErr
+}
+
+// Must be called with the lock held
+func (s *SMTPNotifier) flush() error {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if len(s.batch) == 0 {
+		return nil
+	}
+
+	batch := s.batch
+	s.batch = nil
+	return s.enqueue(batch)
+}
+
+// Must be called with the lock held, never waits for the sender
+func (s *SMTPNotifier) enqueue(alerts []Alert) error {
+	select {
+	case s.queue <- alerts:
+		return nil
+	default:
+		return fmt.Errorf("%d emails are waiting for the relay, %d alerts dropped", cap(s.queue), len(alerts))
+	}
+}
+
+func (s *SMTPNotifier) sendLoop() {
+	defer s.wg.Done()
+
+	for alerts := range s.queue {
+		if sendErr := s.send(alerts); sendErr != nil {
+			metrics.NotifierFailures.Add(float64(len(alerts)), s.name)
+			log.WithError(sendErr).Warn("unable to send alert email")
+		}
+	}
+}
+
+func (s *SMTPNotifier) send(alerts []Alert) error {
+	message, renderErr := s.message(alerts)
+	if renderErr != nil {
+		return renderErr
+	}
+
+	if sendErr := s.deliver(message); sendErr != nil {
+		return fmt.Errorf("unable to send alert email (%d alerts): %w", len(alerts), sendErr)
+	}
+
+	return nil
+}
+
+func (s *SMTPNotifier) deliver(message []byte) error {
+	address := net.JoinHostPort(s.Params.Host, strconv.Itoa(s.Params.Port))
+	tlsConfig := &tls.Config{ServerName: s.Params.Host, InsecureSkipVerify: s.Params.InsecureSkipVerify}
+	dialer := &net.Dialer{Timeout: s.Params.Timeout}
+
+	var conn net.Conn
+	var dialErr error
+	if s.Params.TLS == "implicit" {
+		conn, dialErr = tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	} else {
+		conn, dialErr = dialer.Dial("tcp", address)
+	}
+	if dialErr != nil {
+		return dialErr
+	}
+	conn.SetDeadline(time.Now().Add(s.Params.Timeout))
+
+	client, clientErr := smtp.NewClient(conn, s.Params.Host)
+	if clientErr != nil {
+		conn.Close()
+		return clientErr
+	}
+	defer client.Close()
+
+	if s.Params.TLS == "starttls" {
+		if supported, _ := client.Extension("STARTTLS"); !supported {
+			return errors.New("server does not support STARTTLS")
+		}
+		if startTLSErr := client.StartTLS(tlsConfig); startTLSErr != nil {
+			return startTLSErr
+		}
+	}
+
+	if s.Params.Username != "" {
+		if authErr := client.Auth(smtp.PlainAuth("", s.Params.Username, s.Params.Password, s.Params.Host)); authErr != nil {
+			return authErr
+		}
+	}
+
+	if mailErr := client.Mail(s.envelopeFrom); mailErr != nil {
+		return mailErr
+	}
+	for _, to := range s.envelopeTo {
+		if rcptErr := client.Rcpt(to); rcptErr != nil {
+			return rcptErr
+		}
+	}
+
+	writer, dataErr := client.Data()
+	if dataErr != nil {
+		return dataErr
+	}
+	if _, writeErr := writer.Write(message); writeErr != nil {
+		return writeErr
+	}
+	if closeErr := writer.Close(); closeErr != nil {
+		return closeErr
+	}
+
+	return client.Quit()
+}
+
+func (s *SMTPNotifier) message(alerts []Alert) ([]byte, error) {
+	data := smtpMessage{Alerts: alerts, Severity: SeverityInformational, Hostname: s.Hostname}
+	for _, alert := range alerts {
+		if alert.Severity.AtLeast(data.Severity) {
+			data.Severity = alert.Severity
+		}
+	}
+
+	var subject, body strings.Builder
+	if executeErr := s.subject.Execute(&subject, data); executeErr != nil {
+		return nil, fmt.Errorf("unable to render subject template: %w", executeErr)
+	}
+	if executeErr := s.body.Execute(&body, data); executeErr != nil {
+		return nil, fmt.Errorf("unable to render body template: %w", executeErr)
+	}
+
+	var message strings.Builder
+	fmt.Fprintf(&message, "From: %s\r\n", s.Params.From)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(s.Params.To, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", headerSafe(subject.String())))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+
+	// SMTP requires CRLF line endings in the body
+	message.WriteString(strings.ReplaceAll(strings.ReplaceAll(body.String(), "\r\n", "\n"), "\n", "\r\n"))
+
+	return []byte(message.String()), nil
+}
+
+// Alert values can carry attacker controlled text, line breaks would inject extra headers
+func headerSafe(value string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+}
@@ -0,0 +1,367 @@
+package alert
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// smtpSession is what the fake server saw of one connection
+type smtpSession struct {
+	Commands []string // in order, STARTTLS included, AUTH redacted
+	TLS      bool     // the connection was upgraded before MAIL FROM
+	AuthTLS  bool     // AUTH was received over TLS
+	From     string
+	To       []string
+	Data     string
+}
+
+// fakeSMTPServer speaks just enough ESMTP for net/smtp, with STARTTLS and AUTH PLAIN
+type fakeSMTPServer struct {
+	listener net.Listener
+	tls      *tls.Config
+	startTLS bool // advertise STARTTLS
+
+	mu       sync.Mutex
+	sessions []smtpSession
+}
+
+func newFakeSMTPServer(t *testing.T, startTLS bool) *fakeSMTPServer {
+	t.Helper()
+
+	listener, listenErr := net.Listen("tcp", "127.0.0.1:0")
+	if listenErr != nil {
+		t.Fatal(listenErr)
+	}
+	server := &fakeSMTPServer{listener: listener, tls: selfSignedTLSConfig(t), startTLS: startTLS}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, acceptErr := listener.Accept()
+			if acceptErr != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+
+	return server
+}
+
+func (s *fakeSMTPServer) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	var session smtpSession
+	defer func() {
+		s.mu.Lock()
+		s.sessions = append(s.sessions, session)
+		s.mu.Unlock()
+	}()
+
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	reply("220 fake ESMTP")
+
+	for {
+		line, readErr := reader.ReadString('\n')
+		if readErr != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		if verb == "AUTH" {
+			session.Commands = append(session.Commands, "AUTH")
+		} else {
+			session.Commands = append(session.Commands, line)
+		}
+
+		switch {
+		case verb == "EHLO":
+			if s.startTLS && !session.TLS {
+				reply("250-fake")
+				reply("250-STARTTLS")
+				reply("250 AUTH PLAIN")
+			} else {
+				reply("250-fake")
+				reply("250 AUTH PLAIN")
+			}
+		case verb == "STARTTLS":
+			reply("220 ready")
+			tlsConn := tls.Server(conn, s.tls)
+			if handshakeErr := tlsConn.Handshake(); handshakeErr != nil {
+				return
+			}
+			conn, reader, session.TLS = tlsConn, bufio.NewReader(tlsConn), true
+		case verb == "AUTH":
+			session.AuthTLS = session.TLS
+			reply("235 authenticated")
+		case strings.HasPrefix(strings.ToUpper(line), "MAIL FROM:"):
+			session.From = line[len("MAIL FROM:"):]
+			reply("250 ok")
+		case strings.HasPrefix(strings.ToUpper(line), "RCPT TO:"):
+			session.To = append(session.To, line[len("RCPT TO:"):])
+			reply("250 ok")
+		case verb == "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				dataLine, dataErr := reader.ReadString('\n')
+				if dataErr != nil {
+					return
+				}
+				if dataLine == ".\r\n" {
+					break
+				}
+				data.WriteString(dataLine)
+			}
+			session.Data = data.String()
+			reply("250 queued")
+		case verb == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func (s *fakeSMTPServer) waitSessions(t *testing.T, count int) []smtpSession {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		sessions := append([]smtpSession(nil), s.sessions...)
+		s.mu.Unlock()
+
+		if len(sessions) >= count {
+			return sessions
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d emails sent, want %d", len(sessions), count)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func selfSignedTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+
+	key, keyErr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if keyErr != nil {
+		t.Fatal(keyErr)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, certErr := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if certErr != nil {
+		t.Fatal(certErr)
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func newTestSMTPNotifier(t *testing.T, server *fakeSMTPServer, batchInterval time.Duration, maxBatch int) *SMTPNotifier {
+	t.Helper()
+
+	notifier, notifierErr := NewSMTPNotifier(SMTPParams{
+		Host:               "127.0.0.1",
+		Port:               server.port(),
+		TLS:                "starttls",
+		Username:           "etw",
+		Password:           "secret",
+		InsecureSkipVerify: true,
+		From:               `"ETW Alerts" <etw@example.com>`,
+		To:                 []string{"SOC <soc@example.com>", "oncall@example.com"},
+		Timeout:            5 * time.Second,
+		BatchInterval:      batchInterval,
+		MaxBatch:           maxBatch,
+	})
+	if notifierErr != nil {
+		t.Fatal(notifierErr)
+	}
+	notifier.Hostname = "host-a"
+	return notifier
+}
+
+func testAlert(id string) Alert {
+	return Alert{ID: id, Status: StatusFiring, Rule: "rdp_brute_force", Severity: SeverityHigh, Entity: "10.0.0.9", Message: "alert " + id}
+}
+
+func TestSMTPStartTLSAndEnvelope(t *testing.T) {
+	server := newFakeSMTPServer(t, true)
+	notifier := newTestSMTPNotifier(t, server, 0, 0)
+
+	if notifyErr := notifier.Notify(testAlert("a1")); notifyErr != nil {
+		t.Fatal(notifyErr)
+	}
+	session := server.waitSessions(t, 1)[0]
+
+	if !session.TLS || !session.AuthTLS {
+		t.Errorf("tls %t, auth over tls %t", session.TLS, session.AuthTLS)
+	}
+	if len(session.Commands) < 2 || session.Commands[1] != "STARTTLS" {
+		t.Errorf("commands %q, want STARTTLS after EHLO", session.Commands)
+	}
+	if session.From != "<etw@example.com>" {
+		t.Errorf("MAIL FROM %s", session.From)
+	}
+	if strings.Join(session.To, ",") != "<soc@example.com>,<oncall@example.com>" {
+		t.Errorf("RCPT TO %q", session.To)
+	}
+	for _, want := range []string{"From: \"ETW Alerts\" <etw@example.com>\r\n", "To: SOC <soc@example.com>, oncall@example.com\r\n", "Subject: [HIGH] rdp_brute_force alert: 10.0.0.9\r\n", "alert a1\r\n"} {
+		if !strings.Contains(session.Data, want) {
+			t.Errorf("message is missing %q:\n%s", want, session.Data)
+		}
+	}
+}
+
+func TestSMTPRequiresStartTLS(t *testing.T) {
+	server := newFakeSMTPServer(t, false)
+	notifier := newTestSMTPNotifier(t, server, 0, 0)
+
+	// The failure is logged by the sender, Notify only queues the alert
+	if notifyErr := notifier.Notify(testAlert("a1")); notifyErr != nil {
+		t.Fatal(notifyErr)
+	}
+	if closeErr := notifier.Close(); closeErr != nil {
+		t.Fatal(closeErr)
+	}
+	if session := server.waitSessions(t, 1)[0]; session.From != "" || session.Data != "" {
+		t.Errorf("sent MAIL FROM %s without TLS", session.From)
+	}
+}
+
+func TestSMTPNotifyDoesNotWaitForRelay(t *testing.T) {
+	// The relay accepts connections but never greets
+	listener, listenErr := net.Listen("tcp", "127.0.0.1:0")
+	if listenErr != nil {
+		t.Fatal(listenErr)
+	}
+	conns := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, acceptErr := listener.Accept()
+			if acceptErr != nil {
+				return
+			}
+			conns <- conn
+		}
+	}()
+
+	notifier, notifierErr := NewSMTPNotifier(SMTPParams{
+		Host:    "127.0.0.1",
+		Port:    listener.Addr().(*net.TCPAddr).Port,
+		TLS:     "none",
+		From:    "etw@example.com",
+		To:      []string{"soc@example.com"},
+		Timeout: time.Minute,
+	})
+	if notifierErr != nil {
+		t.Fatal(notifierErr)
+	}
+
+	started := time.Now()
+	if notifyErr := notifier.Notify(testAlert("a0")); notifyErr != nil {
+		t.Fatal(notifyErr)
+	}
+	var conn net.Conn
+	select {
+	case conn = <-conns:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no email sent")
+	}
+
+	// The sender waits for the relay, the queue takes the next alerts until it is full
+	for i := 1; i <= defaultSMTPQueueSize; i++ {
+		if notifyErr := notifier.Notify(testAlert(fmt.Sprintf("a%d", i))); notifyErr != nil {
+			t.Fatalf("alert %d: %v", i, notifyErr)
+		}
+	}
+	if notifyErr := notifier.Notify(testAlert("dropped")); notifyErr == nil || !strings.Contains(notifyErr.Error(), "1 alerts dropped") {
+		t.Errorf("error %v, want the alert dropped", notifyErr)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("notified in %s, waiting for the relay", elapsed)
+	}
+
+	// Once the relay is gone the queued emails fail right away
+	listener.Close()
+	conn.Close()
+	if closeErr := notifier.Close(); closeErr != nil {
+		t.Fatal(closeErr)
+	}
+	if notifyErr := notifier.Notify(testAlert("closed")); notifyErr == nil {
+		t.Error("notified after Close")
+	}
+}
+
+func TestSMTPDigest(t *testing.T) {
+	server := newFakeSMTPServer(t, true)
+	notifier := newTestSMTPNotifier(t, server, 100*time.Millisecond, 3)
+
+	// Alerts within the interval are sent together once it elapsed
+	for _, id := range []string{"a1", "a2"} {
+		if notifyErr := notifier.Notify(testAlert(id)); notifyErr != nil {
+			t.Fatal(notifyErr)
+		}
+	}
+	session := server.waitSessions(t, 1)[0]
+	if !strings.Contains(session.Data, "Subject: [HIGH] 2 alerts from host-a\r\n") {
+		t.Errorf("digest subject:\n%s", session.Data)
+	}
+	for _, id := range []string{"a1", "a2"} {
+		if !strings.Contains(session.Data, "Alert ID: "+id+"\r\n") {
+			t.Errorf("digest is missing %s", id)
+		}
+	}
+
+	// A full batch is sent right away, without waiting for the interval
+	for _, id := range []string{"b1", "b2", "b3"} {
+		if notifyErr := notifier.Notify(testAlert(id)); notifyErr != nil {
+			t.Fatal(notifyErr)
+		}
+	}
+	if sessions := server.waitSessions(t, 2); !strings.Contains(sessions[1].Data, "Subject: [HIGH] 3 alerts from host-a\r\n") {
+		t.Errorf("full batch:\n%s", sessions[1].Data)
+	}
+
+	// Close sends what is still batched
+	if notifyErr := notifier.Notify(testAlert("c1")); notifyErr != nil {
+		t.Fatal(notifyErr)
+	}
+	if closeErr := notifier.Close(); closeErr != nil {
+		t.Fatal(closeErr)
+	}
+	sessions := server.waitSessions(t, 3)
+	if len(sessions) != 3 || !strings.Contains(sessions[2].Data, "Alert ID: c1\r\n") {
+		t.Errorf("%d emails, last:\n%s", len(sessions), sessions[len(sessions)-1].Data)
+	}
+
+	for i, session := range sessions {
+		if session.From != "<etw@example.com>" || !session.TLS {
+			t.Errorf("email %d from %s, tls %t", i, session.From, session.TLS)
+		}
+	}
+}
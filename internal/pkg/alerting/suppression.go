@@ -0,0 +1,237 @@
+package alert
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Observations that do not alert are written to the state file at most this often
+const suppressionPersistInterval = 30 * time.Second
+
+// SuppressionEntry is the alert state of one rule and source (offender) pair
+type SuppressionEntry struct {
+	Rule         string    `json:"rule"`
+	Source       string    `json:"source"`
+	FirstAlerted time.Time `json:"first_alerted"`
+	LastAlerted  time.Time `json:"last_alerted"`
+	LastSeen     time.Time `json:"last_seen"`     // last pass the source was above the rule threshold
+	Count        int       `json:"count"`         // count of the last pass the source was above the threshold
+	AlertedCount int       `json:"alerted_count"` // count when last alerted, used to detect escalation
+	Alerts       int       `json:"alerts"`
+	Suppressed   int       `json:"suppressed"`
+}
+
+// Suppressor deduplicates alerts per rule and source. A source is alerted once, then again only after the
+// cooldown or when its count escalates, and is resolved once it stayed below the threshold long enough.
+// The state is persisted to StateFile so a restart does not re-alert ongoing activity
+type Suppressor struct {
+	StateFile        string
+	Cooldown         time.Duration
+	EscalationFactor float64 // re-alert within the cooldown when the count grew by this factor, 0 disables
+	ResolveAfter     time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]*SuppressionEntry
+	dirty     bool      // observations not written to the state file yet
+	persisted time.Time // last write of the state file
+}
+
+func NewSuppressor(stateFile string, cooldown time.Duration, escalationFactor float64, resolveAfter time.Duration) (*Suppressor, error) {
+	s := &Suppressor{
+		StateFile:        stateFile,
+		Cooldown:         cooldown,
+		EscalationFactor: escalationFactor,
+		ResolveAfter:     resolveAfter,
+		entries:          make(map[string]*SuppressionEntry),
+	}
+
+	entries, loadErr := LoadSuppressionState(stateFile)
+	if loadErr != nil {
+		return nil, loadErr
+	}
+	for i := range entries {
+		s.entries[suppressionKey(entries[i].Rule, entries[i].Source)] = &entries[i]
+	}
+
+	return s, nil
+}
+
+// Records that the source is above the rule threshold and reports whether it should be alerted.
+// A cooldown of 0 uses the suppressor default
+func (s *Suppressor) Observe(rule, source string, count int, cooldown time.Duration, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if cooldown <= 0 {
+		cooldown = s.Cooldown
+	}
+
+	key := suppressionKey(rule, source)
+	entry, exists := s.entries[key]
+	if !exists {
+		entry = &SuppressionEntry{Rule: rule, Source: source, FirstAlerted: now}
+		s.entries[key] = entry
+	}
+
+	entry.LastSeen = now
+	entry.Count = count
+
+	alerting := !exists ||
+		now.Sub(entry.LastAlerted) >= cooldown ||
+		(s.EscalationFactor > 0 && float64(count) >= s.EscalationFactor*float64(entry.AlertedCount))
+
+	if alerting {
+		entry.LastAlerted = now
+		entry.AlertedCount = count
+		entry.Alerts++
+		s.persist()
+	} else {
+		// Only LastSeen and the counters changed, the state file may lag behind by the persist interval
+		entry.Suppressed++
+		s.dirty = true
+		if time.Since(s.persisted) >= suppressionPersistInterval {
+			s.persist()
+		}
+	}
+
+	return alerting
+}
+
+// Removes and returns the entries of the rule that have not been above the threshold for ResolveAfter
+func (s *Suppressor) Resolve(rule string, now time.Time) []SuppressionEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var resolved []SuppressionEntry
+	for key, entry := range s.entries {
+		if entry.Rule == rule && now.Sub(entry.LastSeen) >= s.ResolveAfter {
+			resolved = append(resolved, *entry)
+			delete(s.entries, key)
+		}
+	}
+
+	if len(resolved) > 0 {
+		s.persist()
+	}
+
+	sortSuppressionEntries(resolved)
+	return resolved
+}
+
+// Writes the observations not persisted yet, once no rule will run anymore
+func (s *Suppressor) Flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.dirty {
+		s.persist()
+	}
+}
+
+// Reports whether the rule has sources that are alerted but not yet resolved
+func (s *Suppressor) Active(rule string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, entry := range s.entries {
+		if entry.Rule == rule {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a copy of the current state, ordered by rule and source
+func (s *Suppressor) Entries() []SuppressionEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := make([]SuppressionEntry, 0, len(s.entries))
+	for _, entry := range s.entries {
+		entries = append(entries, *entry)
+	}
+
+	sortSuppressionEntries(entries)
+	return entries
+}
+
+// Writes the state next to the state file and renames it over, so a crash never leaves a partial file.
+// Must be called with the lock held. A failure is logged and the state written again on the next change or
+// flush, until then a restart would re-alert ongoing activity
+func (s *Suppressor) persist() {
+	if s.StateFile == "" {
+		return
+	}
+	s.dirty = false
+	s.persisted = time.Now()
+
+	entries := make([]SuppressionEntry, 0, len(s.entries))
+	for _, entry := range s.entries {
+		entries = append(entries, *entry)
+	}
+	sortSuppressionEntries(entries)
+
+	data, marshalErr := json.MarshalIndent(entries, "", "  ")
+	if marshalErr != nil {
+		log.WithError(marshalErr).Errorf("unable to persist alert state to '%s'", s.StateFile)
+		s.dirty = true
+		return
+	}
+
+	tmpFile := s.StateFile + ".tmp"
+	if writeErr := os.WriteFile(tmpFile, data, 0666); writeErr != nil {
+		log.WithError(writeErr).Errorf("unable to persist alert state to '%s'", s.StateFile)
+		os.Remove(tmpFile)
+		s.dirty = true
+		return
+	}
+	if renameErr := os.Rename(tmpFile, s.StateFile); renameErr != nil {
+		log.WithError(renameErr).Errorf("unable to persist alert state to '%s'", s.StateFile)
+		os.Remove(tmpFile)
+		s.dirty = true
+	}
+}
+
+// Reads a persisted suppression state, a missing file is an empty state
+func LoadSuppressionState(stateFile string) ([]SuppressionEntry, error) {
+	if stateFile == "" {
+		return nil, nil
+	}
+
+	data, readFileErr := os.ReadFile(stateFile)
+	if errors.Is(readFileErr, os.ErrNotExist) {
+		if mkdirErr := os.MkdirAll(filepath.Dir(stateFile), 0755); mkdirErr != nil {
+			return nil, fmt.Errorf("unable to create directory for alert state '%s': %w", stateFile, mkdirErr)
+		}
+		return nil, nil
+	}
+	if readFileErr != nil {
+		return nil, fmt.Errorf("error reading alert state '%s': %w", stateFile, readFileErr)
+	}
+
+	var entries []SuppressionEntry
+	if unMarshallErr := json.Unmarshal(data, &entries); unMarshallErr != nil {
+		return nil, fmt.Errorf("error unmarshalling alert state '%s': %w", stateFile, unMarshallErr)
+	}
+
+	return entries, nil
+}
+
+func suppressionKey(rule, source string) string { return rule + "|" + source }
+
+func sortSuppressionEntries(entries []SuppressionEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Rule != entries[j].Rule {
+			return entries[i].Rule < entries[j].Rule
+		}
+		return entries[i].Source < entries[j].Source
+	})
+}
@@ -0,0 +1,91 @@
+package alert
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestSuppressorPersistsStateChanges(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "alert_state.json")
+	suppressor, suppressorErr := NewSuppressor(stateFile, time.Hour, 2, 5*time.Minute)
+	if suppressorErr != nil {
+		t.Fatal(suppressorErr)
+	}
+	now := time.Now()
+	stateWritten := func() bool {
+		_, statErr := os.Stat(stateFile)
+		os.Remove(stateFile)
+		return !errors.Is(statErr, os.ErrNotExist)
+	}
+
+	if !suppressor.Observe("scan_detection", "10.0.0.9", 60, 0, now) || !stateWritten() {
+		t.Fatal("first observation was not alerted and persisted")
+	}
+
+	// Suppressed observations are kept in memory until flushed
+	if suppressor.Observe("scan_detection", "10.0.0.9", 70, 0, now.Add(time.Minute)) || stateWritten() {
+		t.Fatal("suppressed observation was alerted or persisted")
+	}
+	suppressor.Flush()
+	entries, loadErr := LoadSuppressionState(stateFile)
+	if loadErr != nil {
+		t.Fatal(loadErr)
+	}
+	if len(entries) != 1 || entries[0].Count != 70 || entries[0].Suppressed != 1 {
+		t.Fatalf("flushed %+v", entries)
+	}
+	stateWritten()
+	suppressor.Flush()
+	if stateWritten() {
+		t.Fatal("flush rewrote an unchanged state")
+	}
+
+	// Escalating and resolving are persisted right away
+	if !suppressor.Observe("scan_detection", "10.0.0.9", 120, 0, now.Add(2*time.Minute)) || !stateWritten() {
+		t.Fatal("escalation was not alerted and persisted")
+	}
+	if resolved := suppressor.Resolve("scan_detection", now.Add(time.Hour)); len(resolved) != 1 || !stateWritten() {
+		t.Fatalf("resolved %+v", resolved)
+	}
+}
+
+func TestSuppressorPersistFailure(t *testing.T) {
+	var output bytes.Buffer
+	previous := log.StandardLogger().Out
+	log.SetOutput(&output)
+	t.Cleanup(func() { log.SetOutput(previous) })
+
+	// A directory where the state file should be, the rename over it fails
+	stateFile := filepath.Join(t.TempDir(), "alert_state.json")
+	if mkdirErr := os.Mkdir(stateFile, 0755); mkdirErr != nil {
+		t.Fatal(mkdirErr)
+	}
+	// Built directly, loading the state from a directory fails
+	suppressor := &Suppressor{StateFile: stateFile, Cooldown: time.Hour, ResolveAfter: 5 * time.Minute, entries: make(map[string]*SuppressionEntry)}
+
+	if !suppressor.Observe("scan_detection", "10.0.0.9", 60, 0, time.Now()) {
+		t.Fatal("first observation was not alerted")
+	}
+	if !strings.Contains(output.String(), "unable to persist alert state to '"+stateFile+"'") {
+		t.Errorf("logged %q, want the failure", output.String())
+	}
+	if _, statErr := os.Stat(stateFile + ".tmp"); !errors.Is(statErr, os.ErrNotExist) {
+		t.Errorf("temporary state file left behind: %v", statErr)
+	}
+
+	// The state is written again on the next flush once the file can be written
+	if removeErr := os.Remove(stateFile); removeErr != nil {
+		t.Fatal(removeErr)
+	}
+	suppressor.Flush()
+	if entries, loadErr := LoadSuppressionState(stateFile); loadErr != nil || len(entries) != 1 {
+		t.Errorf("flushed %+v: %v", entries, loadErr)
+	}
+}
@@ -0,0 +1,109 @@
+package alert
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/config"
+)
+
+// log/syslog is not available on Windows, messages are formatted (RFC 5424) and sent over the network directly
+type SyslogParams struct {
+	Network  string `yaml:"network"` // udp or tcp
+	Address  string `yaml:"address"` // host:port of the syslog server
+	Facility int    `yaml:"facility"`
+	Tag      string `yaml:"tag"` // the APP-NAME of the messages
+}
+
+// SyslogNotifier forwards alerts to a syslog server, e.g. the SIEM collector
+type SyslogNotifier struct {
+	Params   SyslogParams
+	Hostname string
+}
+
+func newSyslogNotifier(notifierConfig config.NotifierConfig) (Notifier, error) {
+	params := SyslogParams{Network: "udp", Facility: 4, Tag: "etw-network-scanner"} // facility 4 is security/auth
+	if decodeErr := notifierConfig.DecodeParams(&params); decodeErr != nil {
+		return nil, decodeErr
+	}
+	if params.Address == "" {
+		return nil, fmt.Errorf("syslog requires an address")
+	}
+	if params.Network != "udp" && params.Network != "tcp" {
+		return nil, fmt.Errorf("syslog network must be udp or tcp, got '%s'", params.Network)
+	}
+
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+
+	return &SyslogNotifier{Params: params, Hostname: hostname}, nil
+}
+
+func (s *SyslogNotifier) Notify(alert Alert) error {
+	conn, dialErr := net.DialTimeout(s.Params.Network, s.Params.Address, 10*time.Second)
+	if dialErr != nil {
+		return fmt.Errorf("unable to connect to syslog server: %w", dialErr)
+	}
+	defer conn.Close()
+
+	message := s.message(alert)
+	if s.Params.Network == "tcp" {
+		// Octet counting framing (RFC 6587), messages cannot be split on line breaks
+		message = fmt.Sprintf("%d %s", len(message), message)
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, writeErr := conn.Write([]byte(message)); writeErr != nil {
+		return fmt.Errorf("unable to send alert to syslog server: %w", writeErr)
+	}
+
+	return nil
+}
+
+func (s *SyslogNotifier) message(alert Alert) string {
+	priority := s.Params.Facility*8 + syslogSeverity(alert)
+
+	return fmt.Sprintf("<%d>1 %s %s %s - - [alert@32473 id=\"%s\" rule=\"%s\" severity=\"%s\" entity=\"%s\" count=\"%d\" status=\"%s\"] %s",
+		priority,
+		alert.Time.Format(time.RFC3339),
+		s.Hostname,
+		s.Params.Tag,
+		sdEscape(alert.ID),
+		sdEscape(alert.Rule),
+		alert.Severity,
+		sdEscape(alert.Entity),
+		alert.Count,
+		alert.Status,
+		alert.Message,
+	)
+}
+
+// Maps the alert severity to the syslog severity, resolved alerts are notices
+func syslogSeverity(alert Alert) int {
+	if alert.Status == StatusResolved {
+		return 5
+	}
+
+	switch alert.Severity {
+	case SeverityCritical:
+		return 2
+	case SeverityHigh:
+		return 3
+	case SeverityMedium:
+		return 4
+	case SeverityLow:
+		return 5
+	default:
+		return 6
+	}
+}
+
+// Escapes a structured data parameter value (RFC 5424 section 6.3.3)
+func sdEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
@@ -0,0 +1,139 @@
+package alert
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/config"
+)
+
+func newTestSyslog(t *testing.T, network, address string) *SyslogNotifier {
+	t.Helper()
+
+	notifier, notifierErr := newSyslogNotifier(config.NotifierConfig{Type: "syslog", Params: map[string]interface{}{
+		"network": network,
+		"address": address,
+	}})
+	if notifierErr != nil {
+		t.Fatal(notifierErr)
+	}
+	syslog := notifier.(*SyslogNotifier)
+	syslog.Hostname = "host-a"
+	return syslog
+}
+
+// The entity holds every character structured data values escape
+var testSyslogAlert = Alert{
+	ID:       "a1",
+	Time:     time.Date(2026, 10, 17, 9, 30, 15, 0, time.UTC),
+	Status:   StatusFiring,
+	Rule:     "rdp_brute_force",
+	Severity: SeverityHigh,
+	Entity:   `10.0.0.9 ]"\`,
+	Count:    7,
+	Message:  "7 failed RDP logons from 10.0.0.9",
+}
+
+// Facility 4 (security/auth) and severity 3 (error) for a high alert
+const testSyslogMessage = `<35>1 2026-10-17T09:30:15Z host-a etw-network-scanner - - [alert@32473 id="a1" rule="rdp_brute_force" severity="high" entity="10.0.0.9 \]\"\\" count="7" status="firing"] 7 failed RDP logons from 10.0.0.9`
+
+func TestSyslogUDP(t *testing.T) {
+	listener, listenErr := net.ListenPacket("udp", "127.0.0.1:0")
+	if listenErr != nil {
+		t.Fatal(listenErr)
+	}
+	defer listener.Close()
+
+	if notifyErr := newTestSyslog(t, "udp", listener.LocalAddr().String()).Notify(testSyslogAlert); notifyErr != nil {
+		t.Fatal(notifyErr)
+	}
+
+	// One datagram per message, without framing
+	buffer := make([]byte, 4096)
+	listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, readErr := listener.ReadFrom(buffer)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	if got := string(buffer[:n]); got != testSyslogMessage {
+		t.Errorf("sent\n%s\nwant\n%s", got, testSyslogMessage)
+	}
+}
+
+func TestSyslogTCP(t *testing.T) {
+	listener, listenErr := net.Listen("tcp", "127.0.0.1:0")
+	if listenErr != nil {
+		t.Fatal(listenErr)
+	}
+	defer listener.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		conn, acceptErr := listener.Accept()
+		if acceptErr != nil {
+			received <- acceptErr.Error()
+			return
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		frame, _ := io.ReadAll(conn)
+		received <- string(frame)
+	}()
+
+	alert := testSyslogAlert
+	alert.Message = "line one\nline two"
+	if notifyErr := newTestSyslog(t, "tcp", listener.Addr().String()).Notify(alert); notifyErr != nil {
+		t.Fatal(notifyErr)
+	}
+
+	// Octet counted, the message length in bytes comes first so line breaks do not split it
+	want := `187 <35>1 2026-10-17T09:30:15Z host-a etw-network-scanner - - [alert@32473 id="a1" rule="rdp_brute_force" severity="high" entity="10.0.0.9 \]\"\\" count="7" status="firing"] line one` + "\nline two"
+	if got := <-received; got != want {
+		t.Errorf("sent\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestSyslogSeverity(t *testing.T) {
+	tests := []struct {
+		severity Severity
+		status   Status
+		want     int
+	}{
+		{SeverityCritical, StatusFiring, 2},
+		{SeverityHigh, StatusFiring, 3},
+		{SeverityMedium, StatusFiring, 4},
+		{SeverityLow, StatusFiring, 5},
+		{SeverityInformational, StatusFiring, 6},
+		{SeverityCritical, StatusResolved, 5},
+	}
+
+	for _, test := range tests {
+		if got := syslogSeverity(Alert{Severity: test.severity, Status: test.status}); got != test.want {
+			t.Errorf("%s %s: syslog severity %d, want %d", test.status, test.severity, got, test.want)
+		}
+	}
+}
+
+func TestSyslogConfigErrors(t *testing.T) {
+	for _, params := range []map[string]interface{}{
+		{},
+		{"address": "siem.example.com:514", "network": "tls"},
+	} {
+		if _, notifierErr := newSyslogNotifier(config.NotifierConfig{Type: "syslog", Params: params}); notifierErr == nil {
+			t.Errorf("params %v accepted", params)
+		}
+	}
+
+	// Nothing listens there, the error is returned to the dispatcher
+	listener, listenErr := net.Listen("tcp", "127.0.0.1:0")
+	if listenErr != nil {
+		t.Fatal(listenErr)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	if notifyErr := newTestSyslog(t, "tcp", address).Notify(testSyslogAlert); notifyErr == nil {
+		t.Error("no error without a syslog server")
+	}
+}
@@ -0,0 +1,57 @@
+package alert
+
+import (
+	"encoding/base64"
+	"os"
+	"os/exec"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/config"
+)
+
+// Toasts only show a few lines, longer text is cut off by Windows anyway
+const maxToastTextLength = 200
+
+// The script never changes, the alert text is handed over in environment variables which PowerShell reads
+// as plain strings, so quotes, $() or ; in attacker influenced values (e.g. a parsed user name) are shown
+// literally instead of being executed
+const toastScript = `New-BurntToastNotification -Text $env:ETW_ALERT_TITLE, $env:ETW_ALERT_MESSAGE`
+
+// BurntToastNotifier shows alerts as a Windows toast, it requires the BurntToast PowerShell module and an
+// interactive desktop session
+type BurntToastNotifier struct{}
+
+func newBurntToastNotifier(notifierConfig config.NotifierConfig) (Notifier, error) {
+	if decodeErr := notifierConfig.DecodeParams(&struct{}{}); decodeErr != nil {
+		return nil, decodeErr
+	}
+	return BurntToastNotifier{}, nil
+}
+
+func (t BurntToastNotifier) Notify(alert Alert) error {
+	return t.command(alert).Run()
+}
+
+func (BurntToastNotifier) command(alert Alert) *exec.Cmd {
+	title := "[" + strings.ToUpper(string(alert.Severity)) + "] " + alert.Rule
+
+	cmd := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-EncodedCommand", encodePowerShell(toastScript))
+	cmd.Env = append(os.Environ(),
+		"ETW_ALERT_TITLE="+sanitizeText(title, maxToastTextLength),
+		"ETW_ALERT_MESSAGE="+sanitizeText(alert.Message, maxToastTextLength),
+	)
+
+	return cmd
+}
+
+// -EncodedCommand takes the script as base64 of its UTF-16LE encoding
+func encodePowerShell(script string) string {
+	encoded := utf16.Encode([]rune(script))
+	raw := make([]byte, 0, len(encoded)*2)
+	for _, unit := range encoded {
+		raw = append(raw, byte(unit), byte(unit>>8))
+	}
+
+	return base64.StdEncoding.EncodeToString(raw)
+}
@@ -0,0 +1,128 @@
+package alert
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+func decodePowerShell(t *testing.T, encoded string) string {
+	t.Helper()
+
+	raw, decodeErr := base64.StdEncoding.DecodeString(encoded)
+	if decodeErr != nil {
+		t.Fatal(decodeErr)
+	}
+	units := make([]uint16, len(raw)/2)
+	for i := range units {
+		units[i] = uint16(raw[2*i]) | uint16(raw[2*i+1])<<8
+	}
+	return string(utf16.Decode(units))
+}
+
+func toastEnv(t *testing.T, env []string, name string) string {
+	t.Helper()
+
+	value, found := "", false
+	for _, variable := range env {
+		if rest, ok := strings.CutPrefix(variable, name+"="); ok {
+			value, found = rest, true
+		}
+	}
+	if !found {
+		t.Fatalf("%s is not set", name)
+	}
+	return value
+}
+
+func TestToastPassesHostileTextLiterally(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    string
+		message string
+		title   string // expected, after sanitization
+		text    string
+	}{
+		{
+			name:    "statement separator",
+			rule:    `rdp"; Remove-Item -Recurse C:\ #`,
+			message: `Host is currently being RDP Brute Forced by "; Remove-Item -Recurse C:\ #`,
+			title:   `[HIGH] rdp"; Remove-Item -Recurse C:\ #`,
+			text:    `Host is currently being RDP Brute Forced by "; Remove-Item -Recurse C:\ #`,
+		},
+		{
+			name:    "subexpression",
+			rule:    "rdp_session_hijack",
+			message: `Host is currently being RDP Session Hijacked by $(calc) ${env:PATH} @(1)`,
+			title:   "[HIGH] rdp_session_hijack",
+			text:    `Host is currently being RDP Session Hijacked by $(calc) ${env:PATH} @(1)`,
+		},
+		{
+			name:    "backtick escapes",
+			rule:    "scan`detection",
+			message: "scanned by `\"10.0.0.9`\" `$x '; calc; '",
+			title:   "[HIGH] scan`detection",
+			text:    "scanned by `\"10.0.0.9`\" `$x '; calc; '",
+		},
+		{
+			name:    "control characters and newlines",
+			rule:    "scan_detection",
+			message: "line one\r\nNew-Item evil\x00\x1b[31m\ttab",
+			title:   "[HIGH] scan_detection",
+			text:    "line one  New-Item evil  [31m tab",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			alert := Alert{Severity: SeverityHigh, Rule: test.rule, Message: test.message}.Sanitized()
+			cmd := BurntToastNotifier{}.command(alert)
+
+			if !strings.EqualFold(cmd.Args[0], "powershell") {
+				t.Fatalf("runs %s", cmd.Args[0])
+			}
+			if len(cmd.Args) != 5 || cmd.Args[3] != "-EncodedCommand" {
+				t.Fatalf("unexpected arguments %q", cmd.Args)
+			}
+			if script := decodePowerShell(t, cmd.Args[4]); script != toastScript {
+				t.Errorf("script %q, want the constant toast script", script)
+			}
+			for _, arg := range cmd.Args {
+				if strings.Contains(arg, "calc") || strings.Contains(arg, "Remove-Item") {
+					t.Errorf("alert text reached the command line: %q", arg)
+				}
+			}
+
+			if got := toastEnv(t, cmd.Env, "ETW_ALERT_TITLE"); got != test.title {
+				t.Errorf("title %q, want %q", got, test.title)
+			}
+			if got := toastEnv(t, cmd.Env, "ETW_ALERT_MESSAGE"); got != test.text {
+				t.Errorf("message %q, want %q", got, test.text)
+			}
+		})
+	}
+}
+
+func TestSanitizedReplacesControlCharacters(t *testing.T) {
+	alert := Alert{
+		Rule:     "rule\nname",
+		Entity:   "10.0.0.9\x00",
+		Message:  strings.Repeat("a", maxAlertTextLength+10),
+		Severity: "bogus",
+		Evidence: []Evidence{{Fields: map[string]string{"User\r": "$(calc)\x1b"}}},
+	}.Sanitized()
+
+	if alert.Rule != "rule name" || alert.Entity != "10.0.0.9 " {
+		t.Errorf("rule %q, entity %q", alert.Rule, alert.Entity)
+	}
+	if len(alert.Message) != maxAlertTextLength {
+		t.Errorf("message of %d characters, want %d", len(alert.Message), maxAlertTextLength)
+	}
+	if alert.Severity != SeverityMedium {
+		t.Errorf("severity %s, want medium", alert.Severity)
+	}
+	if got := alert.Evidence[0].Fields["User "]; got != "$(calc) " {
+		t.Errorf("evidence %q", got)
+	}
+}
@@ -0,0 +1,286 @@
+package alert
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/config"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/metrics"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/outbox"
+	log "github.com/sirupsen/logrus"
+)
+
+// Delivery is retried 3 times, 1s, 2s then 4s apart, before the alert waits in the outbox. The outbox is
+// redelivered every 30 seconds and whenever a new alert is queued
+const (
+	defaultWebhookTimeout           = 10 * time.Second
+	defaultWebhookRetries           = 3
+	defaultWebhookInitialBackoff    = time.Second
+	defaultWebhookMaxBackoff        = 30 * time.Second
+	defaultWebhookRedeliverInterval = 30 * time.Second
+	defaultWebhookOutboxDir         = "logs/outbox"
+)
+
+// The receiver verifies hex(HMAC-SHA256(secret, timestamp + "." + body)) and rejects stale timestamps
+const (
+	webhookSignatureHeader = "X-ETW-Signature"
+	webhookTimestampHeader = "X-ETW-Timestamp"
+)
+
+type WebhookParams struct {
+	URL               string            `yaml:"url"`
+	Headers           map[string]string `yaml:"headers"` // e.g. an Authorization header expected by the receiver
+	Timeout           time.Duration     `yaml:"timeout"`
+	Secret            string            `yaml:"secret"`     // signs every request when set
+	SecretEnv         string            `yaml:"secret_env"` // environment variable holding the secret, keeps it out of rules.yml
+	Retries           int               `yaml:"retries"`
+	InitialBackoff    time.Duration     `yaml:"initial_backoff"` // doubled after every failed attempt
+	MaxBackoff        time.Duration     `yaml:"max_backoff"`
+	Outbox            string            `yaml:"outbox"` // directory of undelivered alerts, logs/outbox/<name> by default
+	RedeliverInterval time.Duration     `yaml:"redeliver_interval"`
+}
+
+// WebhookNotifier posts every alert as JSON to an HTTP endpoint. Alerts are queued in an outbox on disk and
+// delivered, oldest first, in the background so rules never wait on the endpoint or its retries
+type WebhookNotifier struct {
+	Params WebhookParams
+	Client *http.Client
+
+	name   string // the notifier name in metrics
+	outbox *outbox.Outbox
+	wake   chan struct{}
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newWebhookNotifier(notifierConfig config.NotifierConfig) (Notifier, error) {
+	name := notifierConfig.Name
+	if name == "" {
+		name = notifierConfig.Type
+	}
+
+	params := WebhookParams{
+		Timeout:           defaultWebhookTimeout,
+		Retries:           defaultWebhookRetries,
+		InitialBackoff:    defaultWebhookInitialBackoff,
+		MaxBackoff:        defaultWebhookMaxBackoff,
+		Outbox:            filepath.Join(defaultWebhookOutboxDir, name),
+		RedeliverInterval: defaultWebhookRedeliverInterval,
+	}
+	if decodeErr := notifierConfig.DecodeParams(&params); decodeErr != nil {
+		return nil, decodeErr
+	}
+	if params.URL == "" {
+		return nil, fmt.Errorf("webhook requires a url")
+	}
+	if params.SecretEnv != "" {
+		params.Secret = os.Getenv(params.SecretEnv)
+		if params.Secret == "" {
+			return nil, fmt.Errorf("webhook secret environment variable %s is not set", params.SecretEnv)
+		}
+	}
+
+	notifier, notifierErr := NewWebhookNotifier(params, &http.Client{Timeout: params.Timeout})
+	if notifierErr != nil {
+		return nil, notifierErr
+	}
+	notifier.name = name
+	return notifier, nil
+}
+
+// Creates the outbox and starts delivering it in the background until Close, alerts left in the outbox by a
+// previous run are delivered first
+func NewWebhookNotifier(params WebhookParams, client *http.Client) (*WebhookNotifier, error) {
+	queue, outboxErr := outbox.New(params.Outbox)
+	if outboxErr != nil {
+		return nil, fmt.Errorf("unable to create webhook outbox '%s': %w", params.Outbox, outboxErr)
+	}
+
+	w := &WebhookNotifier{
+		Params: params,
+		Client: client,
+		name:   "webhook",
+		outbox: queue,
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	w.wake <- struct{}{}
+
+	w.wg.Add(1)
+	go w.deliverLoop()
+
+	return w, nil
+}
+
+// Queues the alert, the error only reports a failure to queue it, delivery failures are logged
+func (w *WebhookNotifier) Notify(alert Alert) error {
+	body, marshalErr := json.Marshal(alert)
+	if marshalErr != nil {
+		return fmt.Errorf("unable to marshal alert: %w", marshalErr)
+	}
+
+	if _, writeErr := w.outbox.Write(alert.ID, body); writeErr != nil {
+		return fmt.Errorf("unable to queue alert %s in the outbox: %w", alert.ID, writeErr)
+	}
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+		// a delivery pass is already due and will pick the alert up
+	}
+	return nil
+}
+
+// Stops the delivery loop after a last attempt without retries, what is left is kept on disk for the next run
+func (w *WebhookNotifier) Close() error {
+	close(w.done)
+	w.wg.Wait()
+	return nil
+}
+
+func (w *WebhookNotifier) deliverLoop() {
+	defer w.wg.Done()
+
+	var tick <-chan time.Time
+	if w.Params.RedeliverInterval > 0 {
+		ticker := time.NewTicker(w.Params.RedeliverInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-w.done:
+			w.deliverOutbox()
+			return
+		case <-w.wake:
+		case <-tick:
+		}
+		w.deliverOutbox()
+	}
+}
+
+// Delivers the outbox oldest first, stopping at the first alert the endpoint still cannot take after its
+// retries. Alerts the endpoint rejects outright are moved to the rejected directory so they neither hold
+// back the ones behind them nor get posted again
+func (w *WebhookNotifier) deliverOutbox() {
+	pending, listErr := w.outbox.Pending()
+	if listErr != nil {
+		log.WithError(listErr).Warn("unable to read webhook outbox")
+		return
+	}
+
+	for _, fileName := range pending {
+		body, readFileErr := os.ReadFile(fileName)
+		if readFileErr != nil {
+			log.WithError(readFileErr).Warnf("unable to read queued alert %s", fileName)
+			continue
+		}
+
+		deliverErr := w.deliverWithRetries(body)
+		if outbox.IsPermanent(deliverErr) {
+			metrics.NotifierFailures.Inc(w.name)
+			rejectedFile, rejectErr := w.outbox.Reject(fileName)
+			log.WithError(deliverErr).Warnf("webhook rejected alert %s, moved to %s", filepath.Base(fileName), rejectedFile)
+			if rejectErr != nil {
+				log.WithError(rejectErr).Warnf("unable to move rejected alert %s out of the outbox", fileName)
+				return
+			}
+			continue
+		}
+		if deliverErr != nil {
+			metrics.NotifierFailures.Inc(w.name)
+			log.WithError(deliverErr).Warnf("unable to deliver alert %s, %d alerts waiting in the outbox", filepath.Base(fileName), len(pending))
+			return
+		}
+
+		if removeErr := os.Remove(fileName); removeErr != nil {
+			log.WithError(removeErr).Warnf("unable to remove delivered alert %s from the outbox", fileName)
+		}
+		log.Debugf("Delivered alert %s to the webhook", filepath.Base(fileName))
+	}
+}
+
+// Waits between attempts, false once the notifier is closing
+func (w *WebhookNotifier) wait(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+func (w *WebhookNotifier) deliverWithRetries(body []byte) error {
+	backoff := w.Params.InitialBackoff
+
+	var deliverErr error
+	for attempt := 0; attempt <= w.Params.Retries; attempt++ {
+		if attempt > 0 {
+			if !w.wait(backoff) {
+				return deliverErr
+			}
+			backoff *= 2
+			if w.Params.MaxBackoff > 0 && backoff > w.Params.MaxBackoff {
+				backoff = w.Params.MaxBackoff
+			}
+		}
+
+		deliverErr = w.deliver(body)
+		if deliverErr == nil || outbox.IsPermanent(deliverErr) {
+			return deliverErr
+		}
+	}
+
+	return deliverErr
+}
+
+func (w *WebhookNotifier) deliver(body []byte) error {
+	request, requestErr := http.NewRequest(http.MethodPost, w.Params.URL, bytes.NewReader(body))
+	if requestErr != nil {
+		return outbox.PermanentError{Err: fmt.Errorf("unable to create webhook request: %w", requestErr)}
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for header, value := range w.Params.Headers {
+		request.Header.Set(header, value)
+	}
+
+	if w.Params.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		request.Header.Set(webhookTimestampHeader, timestamp)
+		request.Header.Set(webhookSignatureHeader, "sha256="+SignWebhook(w.Params.Secret, timestamp, body))
+	}
+
+	response, postErr := w.Client.Do(request)
+	if postErr != nil {
+		return fmt.Errorf("unable to post alert to webhook: %w", postErr)
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+
+	return outbox.CheckResponse("webhook", response)
+}
+
+// Returns the hex encoded HMAC-SHA256 of the timestamp and body, as sent in the signature header
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
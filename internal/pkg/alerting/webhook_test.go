@@ -0,0 +1,198 @@
+package alert
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/outbox"
+)
+
+// webhookServer answers every request with the next status, repeating the last one
+type webhookServer struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (s *webhookServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, r)
+	s.bodies = append(s.bodies, body)
+
+	status := s.statuses[0]
+	if len(s.statuses) > 1 {
+		s.statuses = s.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func (s *webhookServer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.requests)
+}
+
+func newTestWebhook(t *testing.T, url, outboxDir string) *WebhookNotifier {
+	t.Helper()
+
+	notifier, notifierErr := NewWebhookNotifier(WebhookParams{
+		URL:            url,
+		Secret:         "s3cret",
+		Retries:        3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     5 * time.Millisecond,
+		Outbox:         outboxDir,
+	}, &http.Client{Timeout: time.Second})
+	if notifierErr != nil {
+		t.Fatal(notifierErr)
+	}
+	return notifier
+}
+
+func outboxFiles(t *testing.T, dir string) []string {
+	t.Helper()
+
+	fileNames, globErr := filepath.Glob(filepath.Join(dir, "*.json"))
+	if globErr != nil {
+		t.Fatal(globErr)
+	}
+	return fileNames
+}
+
+func waitUntil(t *testing.T, what string, done func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWebhookSignsRequests(t *testing.T) {
+	server := &webhookServer{statuses: []int{http.StatusNoContent}}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	outboxDir := t.TempDir()
+	notifier := newTestWebhook(t, httpServer.URL, outboxDir)
+	defer notifier.Close()
+
+	if notifyErr := notifier.Notify(Alert{ID: "a1", Rule: "scan_detection", Entity: "10.0.0.9"}); notifyErr != nil {
+		t.Fatal(notifyErr)
+	}
+	waitUntil(t, "delivery", func() bool { return server.count() == 1 && len(outboxFiles(t, outboxDir)) == 0 })
+
+	request, body := server.requests[0], server.bodies[0]
+	timestamp := request.Header.Get(webhookTimestampHeader)
+	if timestamp == "" {
+		t.Fatal("missing timestamp header")
+	}
+	if got, want := request.Header.Get(webhookSignatureHeader), "sha256="+SignWebhook("s3cret", timestamp, body); got != want {
+		t.Errorf("signature %q, want %q", got, want)
+	}
+	if got := request.Header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("content type %q", got)
+	}
+}
+
+func TestWebhookRetriesServerErrors(t *testing.T) {
+	server := &webhookServer{statuses: []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusOK}}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	outboxDir := t.TempDir()
+	notifier := newTestWebhook(t, httpServer.URL, outboxDir)
+	defer notifier.Close()
+
+	if notifyErr := notifier.Notify(Alert{ID: "a1"}); notifyErr != nil {
+		t.Fatal(notifyErr)
+	}
+	waitUntil(t, "delivery", func() bool { return len(outboxFiles(t, outboxDir)) == 0 })
+
+	if got := server.count(); got != 3 {
+		t.Errorf("%d requests, want 3", got)
+	}
+}
+
+func TestWebhookDoesNotRetryRejectedAlerts(t *testing.T) {
+	server := &webhookServer{statuses: []int{http.StatusBadRequest, http.StatusOK}}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	outboxDir := t.TempDir()
+	notifier := newTestWebhook(t, httpServer.URL, outboxDir)
+
+	if notifyErr := notifier.Notify(Alert{ID: "rejected"}); notifyErr != nil {
+		t.Fatal(notifyErr)
+	}
+	waitUntil(t, "rejection", func() bool { return len(outboxFiles(t, outboxDir)) == 0 })
+
+	// The next alert is delivered without the rejected one being posted again
+	if notifyErr := notifier.Notify(Alert{ID: "accepted"}); notifyErr != nil {
+		t.Fatal(notifyErr)
+	}
+	waitUntil(t, "delivery", func() bool { return server.count() == 2 && len(outboxFiles(t, outboxDir)) == 0 })
+	notifier.Close()
+
+	if got := server.count(); got != 2 {
+		t.Errorf("%d requests, want 2", got)
+	}
+	if rejected := outboxFiles(t, filepath.Join(outboxDir, outbox.RejectedDir)); len(rejected) != 1 {
+		t.Errorf("%d rejected alerts, want 1", len(rejected))
+	}
+}
+
+func TestWebhookRedeliversOutbox(t *testing.T) {
+	down := &webhookServer{statuses: []int{http.StatusServiceUnavailable}}
+	downServer := httptest.NewServer(down)
+	defer downServer.Close()
+
+	outboxDir := t.TempDir()
+	notifier := newTestWebhook(t, downServer.URL, outboxDir)
+	for _, id := range []string{"first", "second"} {
+		if notifyErr := notifier.Notify(Alert{ID: id}); notifyErr != nil {
+			t.Fatal(notifyErr)
+		}
+	}
+	notifier.Close()
+
+	if queued := outboxFiles(t, outboxDir); len(queued) != 2 {
+		t.Fatalf("%d queued alerts, want 2", len(queued))
+	}
+
+	// The next run delivers the outbox oldest first
+	up := &webhookServer{statuses: []int{http.StatusOK}}
+	upServer := httptest.NewServer(up)
+	defer upServer.Close()
+
+	notifier = newTestWebhook(t, upServer.URL, outboxDir)
+	defer notifier.Close()
+	waitUntil(t, "redelivery", func() bool { return len(outboxFiles(t, outboxDir)) == 0 })
+
+	if got := up.count(); got != 2 {
+		t.Fatalf("%d requests, want 2", got)
+	}
+	for i, id := range []string{"first", "second"} {
+		if !strings.Contains(string(up.bodies[i]), `"id":"`+id+`"`) {
+			t.Errorf("request %d is %s, want %s", i, up.bodies[i], id)
+		}
+	}
+
+	if _, statErr := os.Stat(filepath.Join(outboxDir, outbox.RejectedDir)); !os.IsNotExist(statErr) {
+		t.Error("unexpected rejected alerts")
+	}
+}
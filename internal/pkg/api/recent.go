@@ -0,0 +1,203 @@
+package api
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	alert "github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/alerting"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/bus"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/eventfield"
+)
+
+// Event rates are averaged over the last minute in one second buckets
+const rateBuckets = 60
+
+// recentEvents keeps the last events published on the bus and the per-provider event rates
+type recentEvents struct {
+	mu     sync.Mutex
+	events []bus.Event // ring buffer, next is the oldest once full
+	next   int
+	full   bool
+	rates  map[string]*providerRate
+}
+
+type providerRate struct {
+	total   uint64
+	last    time.Time
+	counts  [rateBuckets]uint64
+	seconds [rateBuckets]int64 // unix second each bucket counts, stale buckets are ignored
+}
+
+func newRecentEvents(max int) *recentEvents {
+	return &recentEvents{events: make([]bus.Event, max), rates: make(map[string]*providerRate)}
+}
+
+func (r *recentEvents) Add(event bus.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.events[r.next] = event
+	r.next = (r.next + 1) % len(r.events)
+	if r.next == 0 {
+		r.full = true
+	}
+
+	rate, exists := r.rates[event.Provider]
+	if !exists {
+		rate = &providerRate{}
+		r.rates[event.Provider] = rate
+	}
+	second := event.Time.Unix()
+	bucket := int(second % rateBuckets)
+	if rate.seconds[bucket] != second {
+		rate.seconds[bucket] = second
+		rate.counts[bucket] = 0
+	}
+	rate.counts[bucket]++
+	rate.total++
+	if event.Time.After(rate.last) {
+		rate.last = event.Time
+	}
+}
+
+// Most recent events first, at most limit of them matching the filter
+func (r *recentEvents) Query(filter eventFilter, limit int) []bus.Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	size := r.next
+	if r.full {
+		size = len(r.events)
+	}
+
+	matches := []bus.Event{}
+	for i := 1; i <= size && len(matches) < limit; i++ {
+		event := r.events[(r.next-i+len(r.events))%len(r.events)]
+		if filter.matches(event) {
+			matches = append(matches, event)
+		}
+	}
+	return matches
+}
+
+type providerStats struct {
+	Events          uint64     `json:"events"`
+	EventsPerSecond float64    `json:"events_per_second"` // over the last minute
+	LastEvent       *time.Time `json:"last_event,omitempty"`
+}
+
+func (r *recentEvents) Stats(now time.Time) map[string]providerStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := make(map[string]providerStats, len(r.rates))
+	for provider, rate := range r.rates {
+		var lastMinute uint64
+		for i, second := range rate.seconds {
+			if now.Unix()-second < rateBuckets {
+				lastMinute += rate.counts[i]
+			}
+		}
+		lastEvent := rate.last
+		stats[provider] = providerStats{Events: rate.total, EventsPerSecond: float64(lastMinute) / rateBuckets, LastEvent: &lastEvent}
+	}
+	return stats
+}
+
+type eventFilter struct {
+	provider string
+	eventID  int // -1 matches every event ID
+	ip       string
+}
+
+func (f eventFilter) matches(event bus.Event) bool {
+	if f.provider != "" && event.Provider != f.provider {
+		return false
+	}
+	if f.eventID >= 0 && event.EventID != f.eventID {
+		return false
+	}
+	if f.ip == "" {
+		return true
+	}
+
+	// Addresses are logged alone (split by the session into *_IP fields) or as host:port
+	for _, value := range event.Fields {
+		strValue := eventfield.String(value)
+		if strValue == f.ip {
+			return true
+		}
+		if host, _, splitHostPortErr := net.SplitHostPort(strValue); splitHostPortErr == nil && host == f.ip {
+			return true
+		}
+	}
+	return false
+}
+
+// alertHistory keeps the alerts sent to the notifiers, the firing ones until they are resolved
+type alertHistory struct {
+	mu      sync.Mutex
+	max     int
+	history []alert.Alert // oldest first
+	active  map[string]alert.Alert
+}
+
+func newAlertHistory(max int) *alertHistory {
+	return &alertHistory{max: max, active: make(map[string]alert.Alert)}
+}
+
+func (h *alertHistory) Add(a alert.Alert) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.history = append(h.history, a)
+	if len(h.history) > h.max {
+		h.history = append([]alert.Alert(nil), h.history[len(h.history)-h.max:]...)
+	}
+
+	key := a.Rule + "\x00" + a.Entity
+	if a.Status == alert.StatusResolved {
+		delete(h.active, key)
+	} else {
+		h.active[key] = a
+	}
+}
+
+// Marks the alerts as firing without adding them to the history, they were sent before the restart
+func (h *alertHistory) Restore(alerts []alert.Alert) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, a := range alerts {
+		h.active[a.Rule+"\x00"+a.Entity] = a
+	}
+}
+
+// Most recent alerts first
+func (h *alertHistory) Recent(limit int) []alert.Alert {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	alerts := []alert.Alert{}
+	for i := len(h.history) - 1; i >= 0 && len(alerts) < limit; i-- {
+		alerts = append(alerts, h.history[i])
+	}
+	return alerts
+}
+
+// Firing alerts, most recent first
+func (h *alertHistory) Active() []alert.Alert {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	alerts := make([]alert.Alert, 0, len(h.active))
+	for _, a := range h.active {
+		alerts = append(alerts, a)
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		return alerts[i].Time.After(alerts[j].Time)
+	})
+	return alerts
+}
@@ -0,0 +1,167 @@
+package api
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	alert "github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/alerting"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/bus"
+)
+
+func eventIDs(events []bus.Event) []int {
+	ids := []int{}
+	for _, event := range events {
+		ids = append(ids, event.EventID)
+	}
+	return ids
+}
+
+func TestRecentEventsRingBuffer(t *testing.T) {
+	recent := newRecentEvents(3)
+	all := eventFilter{eventID: -1}
+
+	if got := eventIDs(recent.Query(all, 10)); len(got) != 0 {
+		t.Errorf("empty buffer returned %v", got)
+	}
+
+	recent.Add(bus.Event{EventID: 1})
+	recent.Add(bus.Event{EventID: 2})
+	if got := eventIDs(recent.Query(all, 10)); !reflect.DeepEqual(got, []int{2, 1}) {
+		t.Errorf("before wrapping %v, want [2 1]", got)
+	}
+
+	// Once full the oldest events are overwritten
+	for eventID := 3; eventID <= 7; eventID++ {
+		recent.Add(bus.Event{EventID: eventID})
+	}
+	if got := eventIDs(recent.Query(all, 10)); !reflect.DeepEqual(got, []int{7, 6, 5}) {
+		t.Errorf("after wrapping %v, want [7 6 5]", got)
+	}
+	if got := eventIDs(recent.Query(all, 2)); !reflect.DeepEqual(got, []int{7, 6}) {
+		t.Errorf("limited to 2 %v, want [7 6]", got)
+	}
+	if got := eventIDs(recent.Query(eventFilter{eventID: 5}, 10)); !reflect.DeepEqual(got, []int{5}) {
+		t.Errorf("filtered %v, want [5]", got)
+	}
+}
+
+func TestEventFilter(t *testing.T) {
+	event := bus.Event{
+		Provider: "Microsoft-Windows-TCPIP",
+		EventID:  1017,
+		Fields: map[string]interface{}{
+			"RemoteSockAddr_IP":  netip.MustParseAddr("10.0.0.9"),
+			"LocalSockAddr_PORT": uint16(3389),
+			"ClientAddress":      "[fe80::1]:51000",
+			"ServerAddress":      "192.168.1.5:3389",
+		},
+	}
+
+	tests := []struct {
+		name    string
+		filter  eventFilter
+		matches bool
+	}{
+		{"no filter", eventFilter{eventID: -1}, true},
+		{"provider", eventFilter{provider: "Microsoft-Windows-TCPIP", eventID: -1}, true},
+		{"other provider", eventFilter{provider: "Microsoft-Windows-TerminalServices-RemoteConnectionManager", eventID: -1}, false},
+		{"event id", eventFilter{eventID: 1017}, true},
+		{"other event id", eventFilter{eventID: 1033}, false},
+		{"event id 0", eventFilter{eventID: 0}, false},
+		{"typed address", eventFilter{eventID: -1, ip: "10.0.0.9"}, true},
+		{"host and port", eventFilter{eventID: -1, ip: "192.168.1.5"}, true},
+		{"IPv6 host and port", eventFilter{eventID: -1, ip: "fe80::1"}, true},
+		{"other address", eventFilter{eventID: -1, ip: "10.0.0.10"}, false},
+		{"every filter", eventFilter{provider: "Microsoft-Windows-TCPIP", eventID: 1017, ip: "10.0.0.9"}, true},
+		{"one filter off", eventFilter{provider: "Microsoft-Windows-TCPIP", eventID: 1033, ip: "10.0.0.9"}, false},
+	}
+
+	for _, test := range tests {
+		if got := test.filter.matches(event); got != test.matches {
+			t.Errorf("%s: matches %t, want %t", test.name, got, test.matches)
+		}
+	}
+}
+
+func TestRecentEventsStats(t *testing.T) {
+	now := time.Now()
+	recent := newRecentEvents(10)
+
+	// Events older than a minute count in the total, not in the rate
+	recent.Add(bus.Event{Provider: "tcpip", Time: now.Add(-90 * time.Second)})
+	for i := 0; i < 6; i++ {
+		recent.Add(bus.Event{Provider: "tcpip", Time: now.Add(-time.Duration(i) * time.Second)})
+	}
+	recent.Add(bus.Event{Provider: "rdp", Time: now.Add(-30 * time.Second)})
+
+	stats := recent.Stats(now)
+	if len(stats) != 2 {
+		t.Fatalf("stats for %d providers, want 2", len(stats))
+	}
+	tcpip := stats["tcpip"]
+	if tcpip.Events != 7 || tcpip.EventsPerSecond != 0.1 || !tcpip.LastEvent.Equal(now) {
+		t.Errorf("tcpip stats %+v, last event %s", tcpip, tcpip.LastEvent)
+	}
+	if rdp := stats["rdp"]; rdp.Events != 1 || !rdp.LastEvent.Equal(now.Add(-30*time.Second)) {
+		t.Errorf("rdp stats %+v", rdp)
+	}
+
+	// A minute later nothing is recent
+	if later := recent.Stats(now.Add(time.Minute)); later["tcpip"].EventsPerSecond != 0 || later["tcpip"].Events != 7 {
+		t.Errorf("stats a minute later %+v", later["tcpip"])
+	}
+}
+
+func TestAlertHistory(t *testing.T) {
+	history := newAlertHistory(2)
+	now := time.Now()
+
+	history.Add(alert.Alert{ID: "a1", Rule: "scan_detection", Entity: "10.0.0.9", Status: alert.StatusFiring, Time: now})
+	history.Add(alert.Alert{ID: "a2", Rule: "rdp_brute_force", Entity: "10.0.0.9", Status: alert.StatusFiring, Time: now.Add(time.Second)})
+	history.Add(alert.Alert{ID: "a3", Rule: "rdp_brute_force", Entity: "10.0.0.10", Status: alert.StatusFiring, Time: now.Add(2 * time.Second)})
+	history.Add(alert.Alert{ID: "a4", Rule: "rdp_brute_force", Entity: "10.0.0.9", Status: alert.StatusResolved, Time: now.Add(3 * time.Second)})
+
+	ids := func(alerts []alert.Alert) []string {
+		ids := []string{}
+		for _, a := range alerts {
+			ids = append(ids, a.ID)
+		}
+		return ids
+	}
+
+	// The history is capped, the alerts still firing are kept whatever their age
+	if got := ids(history.Recent(10)); !reflect.DeepEqual(got, []string{"a4", "a3"}) {
+		t.Errorf("recent %v, want [a4 a3]", got)
+	}
+	if got := ids(history.Recent(1)); !reflect.DeepEqual(got, []string{"a4"}) {
+		t.Errorf("recent limited to 1 %v, want [a4]", got)
+	}
+	if got := ids(history.Active()); !reflect.DeepEqual(got, []string{"a3", "a1"}) {
+		t.Errorf("active %v, want [a3 a1]", got)
+	}
+}
+
+func TestAlertHistoryRestore(t *testing.T) {
+	history := newAlertHistory(10)
+	now := time.Now()
+
+	// Alerts firing before the restart are active without being part of the history of this run
+	history.Restore([]alert.Alert{
+		{ID: "a1", Rule: "scan_detection", Entity: "10.0.0.9", Status: alert.StatusFiring, Time: now},
+		{ID: "a2", Rule: "scan_detection", Entity: "10.0.0.10", Status: alert.StatusFiring, Time: now.Add(time.Second)},
+	})
+	if recent := history.Recent(10); len(recent) != 0 {
+		t.Errorf("%d alerts in the history, want none", len(recent))
+	}
+	if active := history.Active(); len(active) != 2 || active[0].ID != "a2" || active[1].ID != "a1" {
+		t.Errorf("active %+v, want a2 and a1", active)
+	}
+
+	// Resolved in this run, as if it had fired in it
+	history.Add(alert.Alert{ID: "a3", Rule: "scan_detection", Entity: "10.0.0.9", Status: alert.StatusResolved, Time: now.Add(2 * time.Second)})
+	if active := history.Active(); len(active) != 1 || active[0].ID != "a2" {
+		t.Errorf("active %+v, want a2", active)
+	}
+}
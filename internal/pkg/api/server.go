@@ -0,0 +1,317 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	alert "github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/alerting"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/bus"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/config"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/parser"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/session"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultAPIListen    = "127.0.0.1:8470"
+	defaultAPITokenFile = "config/api_token"
+	defaultMaxEvents    = 1000
+	defaultMaxAlerts    = 500
+
+	// Responses list at most this many events or alerts unless a limit is asked for
+	defaultQueryLimit = 100
+)
+
+// Server answers the local REST API from the events published on the bus and the alerts it is notified of,
+// so tooling can poll a host without parsing the provider logs
+type Server struct {
+	Config config.API
+
+	session *session.Session
+	parser  *parser.Parser
+	token   string
+	started time.Time
+	events  *recentEvents
+	alerts  *alertHistory
+
+	listener net.Listener
+	server   *http.Server
+}
+
+func NewServer(apiConfig config.API, sessionObj *session.Session, parserObj *parser.Parser) (*Server, error) {
+	if apiConfig.Listen == "" {
+		apiConfig.Listen = defaultAPIListen
+	}
+	if apiConfig.TokenFile == "" {
+		apiConfig.TokenFile = defaultAPITokenFile
+	}
+	if apiConfig.MaxEvents <= 0 {
+		apiConfig.MaxEvents = defaultMaxEvents
+	}
+	if apiConfig.MaxAlerts <= 0 {
+		apiConfig.MaxAlerts = defaultMaxAlerts
+	}
+
+	token, tokenErr := loadToken(apiConfig)
+	if tokenErr != nil {
+		return nil, tokenErr
+	}
+
+	s := &Server{
+		Config:  apiConfig,
+		session: sessionObj,
+		parser:  parserObj,
+		token:   token,
+		started: time.Now(),
+		events:  newRecentEvents(apiConfig.MaxEvents),
+		alerts:  newAlertHistory(apiConfig.MaxAlerts),
+	}
+	// The history starts empty on every run, alerts still firing are restored from the alert state
+	s.alerts.Restore(parserObj.ActiveAlerts())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/status", s.handleStatus)
+	mux.HandleFunc("/api/v1/events", s.handleEvents)
+	mux.HandleFunc("/api/v1/alerts", s.handleAlerts)
+	mux.HandleFunc("/api/v1/rules", s.handleRules)
+	s.server = &http.Server{Handler: s.authenticate(mux), ReadHeaderTimeout: 10 * time.Second}
+
+	// Listening right away reports an address already in use before the session starts
+	listener, listenErr := net.Listen("tcp", apiConfig.Listen)
+	if listenErr != nil {
+		return nil, fmt.Errorf("unable to listen on %s: %w", apiConfig.Listen, listenErr)
+	}
+	s.listener = listener
+
+	return s, nil
+}
+
+// Keeps the events published on the bus and serves the API until Close
+func (s *Server) Start(b *bus.Bus) {
+	events := b.Subscribe("api", 4096)
+	go func() {
+		for event := range events {
+			s.events.Add(event)
+		}
+	}()
+
+	go func() {
+		log.Infof("API listening on %s", s.listener.Addr())
+		if serveErr := s.server.Serve(s.listener); !errors.Is(serveErr, http.ErrServerClosed) {
+			log.WithError(serveErr).Error("API stopped")
+		}
+	}()
+}
+
+// Keeps the alert for the alerts endpoint, the server is registered as a notifier
+func (s *Server) Notify(a alert.Alert) error {
+	s.alerts.Add(a)
+	return nil
+}
+
+func (s *Server) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.server.Shutdown(ctx)
+}
+
+// The token is read from the environment if set, otherwise from the token file, which is created with a random
+// token the first time so the API is never left open
+func loadToken(apiConfig config.API) (string, error) {
+	if apiConfig.TokenEnv != "" {
+		if token := strings.TrimSpace(os.Getenv(apiConfig.TokenEnv)); token != "" {
+			return token, nil
+		}
+	}
+
+	content, readFileErr := os.ReadFile(apiConfig.TokenFile)
+	if readFileErr == nil {
+		token := strings.TrimSpace(string(content))
+		if token == "" {
+			return "", fmt.Errorf("API token file '%s' is empty", apiConfig.TokenFile)
+		}
+		return token, nil
+	}
+	if !errors.Is(readFileErr, os.ErrNotExist) {
+		return "", fmt.Errorf("unable to read API token file: %w", readFileErr)
+	}
+
+	random := make([]byte, 32)
+	if _, randErr := rand.Read(random); randErr != nil {
+		return "", fmt.Errorf("unable to generate API token: %w", randErr)
+	}
+	token := hex.EncodeToString(random)
+
+	if mkdirErr := os.MkdirAll(filepath.Dir(apiConfig.TokenFile), 0755); mkdirErr != nil {
+		return "", fmt.Errorf("unable to create API token file: %w", mkdirErr)
+	}
+	if writeFileErr := os.WriteFile(apiConfig.TokenFile, []byte(token+"\n"), 0600); writeFileErr != nil {
+		return "", fmt.Errorf("unable to create API token file: %w", writeFileErr)
+	}
+	log.Warnf("Generated an API token in %s", apiConfig.TokenFile)
+
+	return token, nil
+}
+
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="etw"`)
+			writeError(w, http.StatusUnauthorized, "missing or invalid token")
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+type providerStatus struct {
+	Name     string   `json:"name"`
+	LogFile  string   `json:"log_file"`
+	EventIDs []int    `json:"event_ids"`
+	Fields   []string `json:"fields"`
+	providerStats
+}
+
+type status struct {
+	Hostname      string           `json:"hostname"`
+	Started       time.Time        `json:"started"`
+	UptimeSeconds float64          `json:"uptime_seconds"`
+	Providers     []providerStatus `json:"providers"`
+	ActiveAlerts  int              `json:"active_alerts"`
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	hostname, _ := os.Hostname()
+	stats := s.events.Stats(now)
+
+	response := status{
+		Hostname:      hostname,
+		Started:       s.started,
+		UptimeSeconds: now.Sub(s.started).Seconds(),
+		Providers:     []providerStatus{},
+		ActiveAlerts:  len(s.alerts.Active()),
+	}
+	for _, provider := range s.session.Providers {
+		providerResponse := providerStatus{
+			Name:          provider.Id,
+			LogFile:       provider.LogFile,
+			EventIDs:      []int{},
+			Fields:        []string{},
+			providerStats: stats[provider.Id],
+		}
+		for eventID := range provider.TrackableEvents {
+			providerResponse.EventIDs = append(providerResponse.EventIDs, int(eventID))
+		}
+		for field := range provider.TrackableFields {
+			providerResponse.Fields = append(providerResponse.Fields, field)
+		}
+		sort.Ints(providerResponse.EventIDs)
+		sort.Strings(providerResponse.Fields)
+
+		response.Providers = append(response.Providers, providerResponse)
+	}
+
+	writeJSON(w, response)
+}
+
+// GET /api/v1/events?limit=&provider=&event_id=&ip=
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	limit, limitErr := parseLimit(query.Get("limit"))
+	if limitErr != nil {
+		writeError(w, http.StatusBadRequest, limitErr.Error())
+		return
+	}
+
+	filter := eventFilter{provider: query.Get("provider"), eventID: -1, ip: query.Get("ip")}
+	if eventID := query.Get("event_id"); eventID != "" {
+		parsedEventID, parseErr := strconv.Atoi(eventID)
+		if parseErr != nil || parsedEventID < 0 {
+			writeError(w, http.StatusBadRequest, "event_id must be a non-negative integer")
+			return
+		}
+		filter.eventID = parsedEventID
+	}
+	if filter.ip != "" && net.ParseIP(filter.ip) == nil {
+		writeError(w, http.StatusBadRequest, "ip must be an IP address")
+		return
+	}
+
+	writeJSON(w, s.events.Query(filter, limit))
+}
+
+// GET /api/v1/alerts?state=active|all&limit=. The history only holds the alerts of this run, the active ones
+// include those still firing from before the restart
+func (s *Server) handleAlerts(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	limit, limitErr := parseLimit(query.Get("limit"))
+	if limitErr != nil {
+		writeError(w, http.StatusBadRequest, limitErr.Error())
+		return
+	}
+
+	switch query.Get("state") {
+	case "", "all":
+		writeJSON(w, s.alerts.Recent(limit))
+	case "active":
+		alerts := s.alerts.Active()
+		if len(alerts) > limit {
+			alerts = alerts[:limit]
+		}
+		writeJSON(w, alerts)
+	default:
+		writeError(w, http.StatusBadRequest, "state must be active or all")
+	}
+}
+
+func (s *Server) handleRules(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.parser.Rules())
+}
+
+func parseLimit(value string) (int, error) {
+	if value == "" {
+		return defaultQueryLimit, nil
+	}
+
+	limit, parseErr := strconv.Atoi(value)
+	if parseErr != nil || limit <= 0 {
+		return 0, fmt.Errorf("limit must be a positive integer")
+	}
+	return limit, nil
+}
+
+func writeJSON(w http.ResponseWriter, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if encodeErr := json.NewEncoder(w).Encode(response); encodeErr != nil {
+		log.WithError(encodeErr).Warn("unable to write API response")
+	}
+}
+
+func writeError(w http.ResponseWriter, statusCode int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
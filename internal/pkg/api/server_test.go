@@ -0,0 +1,324 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	alert "github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/alerting"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/bus"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/config"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/parser"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/session"
+)
+
+const testToken = "test-token"
+
+func newTestServer(t *testing.T, maxEvents int) *Server {
+	t.Helper()
+
+	dir := t.TempDir()
+	rules := fmt.Sprintf(`tail_state_file: %s
+alerting:
+  state_file: %s
+rules:
+  scan_detection:
+    enabled: true
+    alert_threshold: 50
+    window: 1m
+    files:
+      - tcp-ip.log
+  rdp_brute_force:
+    enabled: false
+    alert_threshold: 5
+    window: 1m
+    files:
+      - rdp_core_ts.log
+`, filepath.Join(dir, "tail_state.json"), filepath.Join(dir, "alert_state.json"))
+	rulesFile := filepath.Join(dir, "rules.yml")
+	if writeErr := os.WriteFile(rulesFile, []byte(rules), 0600); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	var parserObj parser.Parser
+	if initErr := parserObj.Init(rulesFile); initErr != nil {
+		t.Fatal(initErr)
+	}
+
+	var provider session.Provider
+	provider.Set("Microsoft-Windows-TCPIP", []uint16{1033, 1017}, map[string]interface{}{"RemoteSockAddr": nil, "LocalSockAddr": nil})
+	provider.LogFile = "tcp-ip.log"
+	sessionObj := &session.Session{Providers: []session.Provider{provider}}
+
+	t.Setenv("ETW_TEST_API_TOKEN", testToken)
+	server, serverErr := NewServer(config.API{
+		Listen:    "127.0.0.1:0",
+		TokenEnv:  "ETW_TEST_API_TOKEN",
+		TokenFile: filepath.Join(dir, "api_token"),
+		MaxEvents: maxEvents,
+	}, sessionObj, &parserObj)
+	if serverErr != nil {
+		t.Fatal(serverErr)
+	}
+	t.Cleanup(func() { server.listener.Close() })
+	return server
+}
+
+// Serves the request with the token, the response body is decoded into response when given
+func get(t *testing.T, server *Server, target string, response interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	request := httptest.NewRequest(http.MethodGet, target, nil)
+	request.Header.Set("Authorization", "Bearer "+testToken)
+	recorder := httptest.NewRecorder()
+	server.server.Handler.ServeHTTP(recorder, request)
+
+	if response != nil && recorder.Code == http.StatusOK {
+		if decodeErr := json.Unmarshal(recorder.Body.Bytes(), response); decodeErr != nil {
+			t.Fatalf("%s: %v", target, decodeErr)
+		}
+	}
+	return recorder
+}
+
+func TestServerAuthentication(t *testing.T) {
+	server := newTestServer(t, 10)
+
+	tests := []struct {
+		name          string
+		method        string
+		authorization string
+		status        int
+	}{
+		{"no token", http.MethodGet, "", http.StatusUnauthorized},
+		{"wrong token", http.MethodGet, "Bearer wrong", http.StatusUnauthorized},
+		{"not a bearer token", http.MethodGet, testToken, http.StatusUnauthorized},
+		{"read only", http.MethodPost, "Bearer " + testToken, http.StatusMethodNotAllowed},
+		{"token", http.MethodGet, "Bearer " + testToken, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest(test.method, "/api/v1/status", nil)
+		if test.authorization != "" {
+			request.Header.Set("Authorization", test.authorization)
+		}
+		recorder := httptest.NewRecorder()
+		server.server.Handler.ServeHTTP(recorder, request)
+
+		if recorder.Code != test.status {
+			t.Errorf("%s: status %d, want %d", test.name, recorder.Code, test.status)
+		}
+		if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("%s: content type %s", test.name, contentType)
+		}
+		if test.status == http.StatusUnauthorized && recorder.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: no WWW-Authenticate challenge", test.name)
+		}
+	}
+
+	if recorder := get(t, server, "/api/v1/unknown", nil); recorder.Code != http.StatusNotFound {
+		t.Errorf("unknown endpoint status %d", recorder.Code)
+	}
+}
+
+func TestServerEvents(t *testing.T) {
+	server := newTestServer(t, 5)
+	for i := 0; i < 7; i++ {
+		provider, eventID := "Microsoft-Windows-TCPIP", 1017
+		if i%2 == 1 {
+			provider, eventID = "Microsoft-Windows-TerminalServices-RemoteConnectionManager", 1149
+		}
+		server.events.Add(bus.Event{
+			Time:     time.Now(),
+			Provider: provider,
+			EventID:  eventID,
+			Fields:   map[string]interface{}{"RemoteSockAddr_IP": netip.MustParseAddr(fmt.Sprintf("10.0.0.%d", i))},
+		})
+	}
+
+	tests := []struct {
+		query string
+		want  []string // the addresses of the events returned
+	}{
+		{"", []string{"10.0.0.6", "10.0.0.5", "10.0.0.4", "10.0.0.3", "10.0.0.2"}},
+		{"?limit=2", []string{"10.0.0.6", "10.0.0.5"}},
+		{"?provider=Microsoft-Windows-TCPIP", []string{"10.0.0.6", "10.0.0.4", "10.0.0.2"}},
+		{"?event_id=1149", []string{"10.0.0.5", "10.0.0.3"}},
+		{"?event_id=1149&limit=1", []string{"10.0.0.5"}},
+		{"?ip=10.0.0.4", []string{"10.0.0.4"}},
+		{"?ip=10.0.0.1", []string{}},
+		{"?provider=Microsoft-Windows-TCPIP&event_id=1149", []string{}},
+	}
+
+	for _, test := range tests {
+		var events []bus.Event
+		if recorder := get(t, server, "/api/v1/events"+test.query, &events); recorder.Code != http.StatusOK {
+			t.Errorf("%s: status %d", test.query, recorder.Code)
+			continue
+		}
+		addresses := []string{}
+		for _, event := range events {
+			addresses = append(addresses, fmt.Sprint(event.Fields["RemoteSockAddr_IP"]))
+		}
+		if !reflect.DeepEqual(addresses, test.want) {
+			t.Errorf("%s: events %v, want %v", test.query, addresses, test.want)
+		}
+	}
+}
+
+func TestServerBadRequests(t *testing.T) {
+	server := newTestServer(t, 5)
+
+	for _, target := range []string{
+		"/api/v1/events?limit=0",
+		"/api/v1/events?limit=ten",
+		"/api/v1/events?event_id=-1",
+		"/api/v1/events?event_id=x",
+		"/api/v1/events?ip=10.0.0",
+		"/api/v1/alerts?limit=-5",
+		"/api/v1/alerts?state=resolved",
+	} {
+		recorder := get(t, server, target, nil)
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", target, recorder.Code)
+			continue
+		}
+		var response map[string]string
+		if decodeErr := json.Unmarshal(recorder.Body.Bytes(), &response); decodeErr != nil || response["error"] == "" {
+			t.Errorf("%s: body %s", target, recorder.Body)
+		}
+	}
+}
+
+func TestServerAlerts(t *testing.T) {
+	server := newTestServer(t, 5)
+	now := time.Now()
+	server.Notify(alert.Alert{ID: "a1", Rule: "scan_detection", Entity: "10.0.0.9", Status: alert.StatusFiring, Time: now})
+	server.Notify(alert.Alert{ID: "a2", Rule: "rdp_brute_force", Entity: "10.0.0.9", Status: alert.StatusFiring, Time: now.Add(time.Second)})
+	server.Notify(alert.Alert{ID: "a3", Rule: "scan_detection", Entity: "10.0.0.9", Status: alert.StatusResolved, Time: now.Add(2 * time.Second)})
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"a3", "a2", "a1"}},
+		{"?state=all&limit=2", []string{"a3", "a2"}},
+		{"?state=active", []string{"a2"}},
+		{"?state=active&limit=1", []string{"a2"}},
+	}
+
+	for _, test := range tests {
+		var alerts []alert.Alert
+		if recorder := get(t, server, "/api/v1/alerts"+test.query, &alerts); recorder.Code != http.StatusOK {
+			t.Errorf("%s: status %d", test.query, recorder.Code)
+			continue
+		}
+		ids := []string{}
+		for _, a := range alerts {
+			ids = append(ids, a.ID)
+		}
+		if !reflect.DeepEqual(ids, test.want) {
+			t.Errorf("%s: alerts %v, want %v", test.query, ids, test.want)
+		}
+	}
+}
+
+func TestServerStatusAndRules(t *testing.T) {
+	server := newTestServer(t, 5)
+	server.events.Add(bus.Event{Time: time.Now(), Provider: "Microsoft-Windows-TCPIP", EventID: 1017})
+	server.Notify(alert.Alert{ID: "a1", Rule: "scan_detection", Entity: "10.0.0.9", Status: alert.StatusFiring, Time: time.Now()})
+
+	var response status
+	if recorder := get(t, server, "/api/v1/status", &response); recorder.Code != http.StatusOK {
+		t.Fatalf("status %d", recorder.Code)
+	}
+	if response.ActiveAlerts != 1 || len(response.Providers) != 1 {
+		t.Fatalf("status %+v", response)
+	}
+	provider := response.Providers[0]
+	if provider.Name != "Microsoft-Windows-TCPIP" || provider.LogFile != "tcp-ip.log" || provider.Events != 1 || provider.LastEvent == nil {
+		t.Errorf("provider %+v", provider)
+	}
+	if !reflect.DeepEqual(provider.EventIDs, []int{1017, 1033}) || !reflect.DeepEqual(provider.Fields, []string{"LocalSockAddr", "RemoteSockAddr"}) {
+		t.Errorf("provider tracks %v and %v", provider.EventIDs, provider.Fields)
+	}
+
+	// Only the enabled rules are listed
+	var rules []parser.RuleInfo
+	if recorder := get(t, server, "/api/v1/rules", &rules); recorder.Code != http.StatusOK {
+		t.Fatalf("rules status %d", recorder.Code)
+	}
+	if len(rules) != 1 || rules[0].Name != "scan_detection" || rules[0].Threshold != 50 || rules[0].Window != "1m0s" {
+		t.Errorf("rules %+v", rules)
+	}
+}
+
+func TestServerServesBusEvents(t *testing.T) {
+	server := newTestServer(t, 5)
+	eventBus := bus.New()
+	server.Start(eventBus)
+	defer server.Close()
+
+	eventBus.Publish(bus.Event{Time: time.Now(), Provider: "Microsoft-Windows-TCPIP", EventID: 1017})
+	eventBus.Close()
+
+	request, _ := http.NewRequest(http.MethodGet, "http://"+server.listener.Addr().String()+"/api/v1/events", nil)
+	request.Header.Set("Authorization", "Bearer "+testToken)
+
+	// Published events are kept asynchronously
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		response, getErr := http.DefaultClient.Do(request)
+		if getErr != nil {
+			t.Fatal(getErr)
+		}
+		var events []bus.Event
+		decodeErr := json.NewDecoder(response.Body).Decode(&events)
+		response.Body.Close()
+		if decodeErr != nil {
+			t.Fatal(decodeErr)
+		}
+		if len(events) == 1 && events[0].EventID == 1017 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("events %+v", events)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLoadToken(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "config", "api_token")
+
+	// A missing token file is generated once and read back afterwards
+	generated, generateErr := loadToken(config.API{TokenFile: tokenFile})
+	if generateErr != nil || len(generated) != 64 {
+		t.Fatalf("generated %q, %v", generated, generateErr)
+	}
+	if info, statErr := os.Stat(tokenFile); statErr != nil || info.Mode().Perm()&0077 != 0 {
+		t.Errorf("token file %v, %v", info, statErr)
+	}
+	if read, readErr := loadToken(config.API{TokenFile: tokenFile}); read != generated || readErr != nil {
+		t.Errorf("read back %q, %v", read, readErr)
+	}
+
+	// The environment takes precedence, an empty file is an error
+	t.Setenv("ETW_TEST_API_TOKEN", " from-env\n")
+	if token, _ := loadToken(config.API{TokenEnv: "ETW_TEST_API_TOKEN", TokenFile: tokenFile}); token != "from-env" {
+		t.Errorf("token %q, want from-env", token)
+	}
+	emptyFile := filepath.Join(dir, "empty")
+	os.WriteFile(emptyFile, []byte("\n"), 0600)
+	if _, emptyErr := loadToken(config.API{TokenFile: emptyFile}); emptyErr == nil || !strings.Contains(emptyErr.Error(), "empty") {
+		t.Errorf("error %v, want empty token file", emptyErr)
+	}
+}
@@ -0,0 +1,115 @@
+package bus
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// A second is long enough for a busy subscriber to catch up, not long enough to stall the capture for good
+const defaultPublishTimeout = time.Second
+
+// Event is a provider event after filtering and field extraction, as published by the session.
+// Fields carry typed values (see eventfield) and are shared by every subscriber, they must be treated as read-only
+type Event struct {
+	Time     time.Time              `json:"time"`
+	Host     string                 `json:"host,omitempty"` // the agent that captured the event, empty for local events
+	Provider string                 `json:"provider"`
+	LogFile  string                 `json:"log_file"`
+	EventID  int                    `json:"event_id"`
+	Fields   map[string]interface{} `json:"fields"`
+}
+
+// Bus fans out published events to every subscriber. Once a subscriber's buffer is full Publish waits for it,
+// as backpressure on the publisher, for at most PublishTimeout. The event is then dropped for that subscriber
+// and counted in etw_bus_events_dropped_total, and later events are dropped for it without waiting until its
+// buffer has room again, so a stuck subscriber costs the capture a single wait. Dropped events never reach the
+// subscriber, a warning is logged when it starts lagging and once it caught up again
+type Bus struct {
+	PublishTimeout time.Duration
+
+	mu          sync.RWMutex
+	subscribers []*subscriber
+	closed      bool
+}
+
+type subscriber struct {
+	name    string
+	events  chan Event
+	lagging atomic.Bool  // the last event timed out, events are dropped without waiting until one fits
+	dropped atomic.Int64 // events dropped since the subscriber started lagging
+}
+
+func New() *Bus {
+	return &Bus{PublishTimeout: defaultPublishTimeout}
+}
+
+// Subscribes to every event published from now on, the name labels the events dropped for the subscriber
+func (b *Bus) Subscribe(name string, buffer int) <-chan Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	events := make(chan Event, buffer)
+	if b.closed {
+		close(events)
+		return events
+	}
+
+	b.subscribers = append(b.subscribers, &subscriber{name: name, events: events})
+	return events
+}
+
+func (b *Bus) Publish(event Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		return
+	}
+
+	for _, subscriber := range b.subscribers {
+		select {
+		case subscriber.events <- event:
+			if subscriber.lagging.Swap(false) {
+				log.Warnf("Bus subscriber %s caught up, %d events were dropped for it", subscriber.name, subscriber.dropped.Swap(0))
+			}
+			continue
+		default:
+		}
+
+		if subscriber.lagging.Load() {
+			subscriber.dropped.Add(1)
+			metrics.BusEventsDropped.Inc(subscriber.name)
+			continue
+		}
+
+		timer := time.NewTimer(b.PublishTimeout)
+		select {
+		case subscriber.events <- event:
+		case <-timer.C:
+			subscriber.lagging.Store(true)
+			subscriber.dropped.Add(1)
+			metrics.BusEventsDropped.Inc(subscriber.name)
+			log.Warnf("Bus subscriber %s is lagging, its buffer stayed full for %s, dropping its events until it catches up", subscriber.name, b.PublishTimeout)
+		}
+		timer.Stop()
+	}
+}
+
+// Closes every subscriber channel, events already buffered remain readable
+func (b *Bus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+
+	b.closed = true
+	for _, subscriber := range b.subscribers {
+		close(subscriber.events)
+	}
+}
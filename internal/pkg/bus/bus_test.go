@@ -0,0 +1,58 @@
+package bus
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPublishDropsForFullSubscriber(t *testing.T) {
+	b := New()
+	b.PublishTimeout = 50 * time.Millisecond
+
+	stuck := b.Subscribe("stuck", 1)
+	reading := b.Subscribe("reading", 10)
+	received := make(chan int, 10)
+	go func() {
+		for event := range reading {
+			received <- event.EventID
+		}
+		close(received)
+	}()
+
+	// Only the first event fits the stuck subscriber, the second waits for it once, the rest are dropped right away
+	start := time.Now()
+	for id := 1; id <= 5; id++ {
+		b.Publish(Event{EventID: id})
+	}
+	if elapsed := time.Since(start); elapsed < b.PublishTimeout || elapsed >= 3*b.PublishTimeout {
+		t.Errorf("published in %s, want a single wait of %s", elapsed, b.PublishTimeout)
+	}
+
+	// Once read, the stuck subscriber receives events again
+	if event := <-stuck; event.EventID != 1 {
+		t.Errorf("stuck subscriber received %d, want 1", event.EventID)
+	}
+	b.Publish(Event{EventID: 6})
+	if event := <-stuck; event.EventID != 6 {
+		t.Errorf("stuck subscriber received %d, want 6", event.EventID)
+	}
+
+	b.Close()
+	var ids []int
+	for id := range received {
+		ids = append(ids, id)
+	}
+	if len(ids) != 6 {
+		t.Errorf("reading subscriber received %v, want every event", ids)
+	}
+}
+
+func TestSubscribeAfterClose(t *testing.T) {
+	b := New()
+	b.Close()
+
+	if _, ok := <-b.Subscribe("late", 1); ok {
+		t.Error("subscribed to a closed bus")
+	}
+	b.Publish(Event{EventID: 1})
+}
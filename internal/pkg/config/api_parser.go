@@ -0,0 +1,31 @@
+package config
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// API is the configuration of the local REST API, see the api package
+type API struct {
+	Listen    string `yaml:"listen"`     // defaults to 127.0.0.1:8470, only reachable from the host
+	TokenEnv  string `yaml:"token_env"`  // environment variable holding the bearer token, preferred over token_file
+	TokenFile string `yaml:"token_file"` // generated with a random token if missing
+	MaxEvents int    `yaml:"max_events"` // most recent events kept in memory
+	MaxAlerts int    `yaml:"max_alerts"` // most recent alerts kept in memory, active alerts are always kept
+}
+
+func NewAPIFromFile(filePath string) (*API, error) {
+	file, readFileErr := os.ReadFile(filePath)
+	if readFileErr != nil {
+		return nil, fmt.Errorf("error reading YAML file '%s': %w", filePath, readFileErr)
+	}
+
+	api := &API{}
+	unMarshallErr := yaml.Unmarshal(file, api)
+	if unMarshallErr != nil {
+		return nil, fmt.Errorf("error unmarshalling YAML data: %w", unMarshallErr)
+	}
+	return api, nil
+}
@@ -0,0 +1,51 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Fleet is the agent and collector configuration, see the fleet package
+type Fleet struct {
+	Agent     AgentConfig     `yaml:"agent"`
+	Collector CollectorConfig `yaml:"collector"`
+}
+
+type AgentConfig struct {
+	CollectorURL  string        `yaml:"collector_url"`
+	HostID        string        `yaml:"host_id"`   // defaults to the hostname, must match the CN of the client certificate
+	CertFile      string        `yaml:"cert_file"` // client certificate and key presented to the collector
+	KeyFile       string        `yaml:"key_file"`
+	CAFile        string        `yaml:"ca_file"` // verifies the collector certificate, the system roots if empty
+	BatchSize     int           `yaml:"batch_size"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	Timeout       time.Duration `yaml:"timeout"`
+	SpoolDir      string        `yaml:"spool_dir"` // batches the collector did not accept, sent once it is reachable again
+	MaxSpoolFiles int           `yaml:"max_spool_files"`
+}
+
+type CollectorConfig struct {
+	Listen        string `yaml:"listen"`
+	CertFile      string `yaml:"cert_file"`
+	KeyFile       string `yaml:"key_file"`
+	ClientCAFile  string `yaml:"client_ca_file"` // only agents with a certificate issued by this CA are accepted
+	StorageDir    string `yaml:"storage_dir"`    // events and alerts are stored per host under this directory
+	MaxBatchBytes int64  `yaml:"max_batch_bytes"`
+}
+
+func NewFleetFromFile(filePath string) (*Fleet, error) {
+	file, readFileErr := os.ReadFile(filePath)
+	if readFileErr != nil {
+		return nil, fmt.Errorf("error reading YAML file '%s': %w", filePath, readFileErr)
+	}
+
+	fleet := &Fleet{}
+	unMarshallErr := yaml.Unmarshal(file, fleet)
+	if unMarshallErr != nil {
+		return nil, fmt.Errorf("error unmarshalling YAML data: %w", unMarshallErr)
+	}
+	return fleet, nil
+}
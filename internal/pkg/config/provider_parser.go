@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -16,6 +17,17 @@ type Provider struct {
 
 type Providers struct {
 	Providers map[string]Provider `yaml:"providers"`
+	LogFormat string              `yaml:"logFormat"` // text (default) or json
+	Rotation  LogRotation         `yaml:"rotation"`
+}
+
+// Provider logs are appended to across runs, these bound them. Zero values disable the limit
+type LogRotation struct {
+	MaxSizeMB      int64         `yaml:"maxSizeMB"`
+	Interval       time.Duration `yaml:"interval"`
+	Compress       bool          `yaml:"compress"`
+	MaxAge         time.Duration `yaml:"maxAge"` // rotated segments older than this are removed
+	MaxTotalSizeMB int64         `yaml:"maxTotalSizeMB"`
 }
 
 func NewProvidersFromYaml(filePath string) (*Providers, error) {
@@ -40,10 +52,18 @@ func SliceToBoolMap(slice []uint16) map[uint16]bool {
 	return resultMap
 }
 
+// FieldNotFound is the value of a configured field until it is extracted from an event. It has its own type so
+// an event value of "NA" is not mistaken for it, it still prints as NA
+var FieldNotFound interface{} = fieldNotFound{}
+
+type fieldNotFound struct{}
+
+func (fieldNotFound) String() string { return "NA" }
+
 func SliceToStringMap(slice []string) map[string]interface{} {
 	resultMap := make(map[string]interface{})
 	for _, v := range slice {
-		resultMap[v] = "NA"
+		resultMap[v] = FieldNotFound
 	}
 
 	return resultMap
@@ -1,20 +1,118 @@
 package config
 
 import (
+	"bytes"
 	"fmt"
 	"os"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 type Rule struct {
-	Enabled        bool     `yaml:"enabled"`
-	AlertThreshold int      `yaml:"alert_threshold"`
-	FileNames      []string `yaml:"files"`
+	Enabled        bool                   `yaml:"enabled"`
+	AlertThreshold int                    `yaml:"alert_threshold"`
+	FileNames      []string               `yaml:"files"`
+	Window         time.Duration          `yaml:"window"`   // how far back the rule looks, built-in rules have a default
+	Interval       time.Duration          `yaml:"interval"` // how often the rule runs, defaults depend on the rule input
+	Params         map[string]interface{} `yaml:"params"`   // rule specific parameters, see DecodeParams
+	Cooldown       time.Duration          `yaml:"cooldown"` // overrides the alerting cooldown for this rule
+	Severity       string                 `yaml:"severity"` // informational, low, medium, high or critical
+	Techniques     []string               `yaml:"mitre_techniques"`
+
+	// Declarative rules (type: threshold), built-in rules are matched by name and ignore these
+	Type        string          `yaml:"type"`
+	EventIDs    []int           `yaml:"event_ids"`
+	Conditions  []RuleCondition `yaml:"conditions"`
+	GroupBy     []string        `yaml:"group_by"`
+	Aggregation RuleAggregation `yaml:"aggregation"`
+	Message     string          `yaml:"message"`
+}
+
+type RuleCondition struct {
+	Field    string   `yaml:"field"`
+	Operator string   `yaml:"op"` // equals, not_equals, contains, startswith, endswith, regex, in, gt, gte, lt, lte, between, cidr
+	Value    string   `yaml:"value"`
+	Values   []string `yaml:"values"` // used by the in, between and cidr operators
+}
+
+type RuleAggregation struct {
+	Function string `yaml:"function"` // count, distinct_count
+	Field    string `yaml:"field"`    // only used by distinct_count
 }
 
 type RuleSet struct {
-	Rules map[string]Rule `yaml:"rules"`
+	Rules         map[string]Rule `yaml:"rules"`
+	Sigma         SigmaConfig     `yaml:"sigma"`
+	Alerting      AlertingConfig  `yaml:"alerting"`
+	TailStateFile string          `yaml:"tail_state_file"` // read offsets of the provider log files with --rule-input files
+}
+
+// Alerts are deduplicated per rule and source, see alert.Suppressor, and sent to every enabled notifier
+type AlertingConfig struct {
+	Cooldown         time.Duration    `yaml:"cooldown"`
+	EscalationFactor float64          `yaml:"escalation_factor"`
+	ResolveAfter     time.Duration    `yaml:"resolve_after"`
+	StateFile        string           `yaml:"state_file"`
+	Notifiers        []NotifierConfig `yaml:"notifiers"` // console and burnttoast if omitted
+}
+
+type NotifierConfig struct {
+	Name        string                 `yaml:"name"` // defaults to the type, tells several notifiers of the same type apart
+	Type        string                 `yaml:"type"` // console, burnttoast, webhook, smtp, syslog, firewall
+	Enabled     bool                   `yaml:"enabled"`
+	MinSeverity string                 `yaml:"min_severity"` // alerts below this severity are not sent, all if empty
+	Params      map[string]interface{} `yaml:"params"`       // notifier specific settings, see DecodeParams
+}
+
+// Sigma rules are loaded from RulesDir, their logsource is mapped to providers.yml entries and their
+// field names to the fields the session extracts
+type SigmaConfig struct {
+	Enabled       bool                `yaml:"enabled"`
+	Interval      time.Duration       `yaml:"interval"`
+	RulesDir      string              `yaml:"rules_dir"`
+	ProvidersFile string              `yaml:"providers_file"`
+	LogSources    []SigmaLogSource    `yaml:"logsources"`
+	FieldMapping  map[string][]string `yaml:"field_mapping"` // Sigma field name -> candidate extracted field names
+}
+
+type SigmaLogSource struct {
+	Product   string   `yaml:"product"`
+	Category  string   `yaml:"category"`
+	Service   string   `yaml:"service"`
+	Providers []string `yaml:"providers"` // keys of the providers map in providers.yml
+}
+
+// Decodes the free-form params block into a rule specific struct using its yaml tags,
+// unknown parameters are rejected so typos do not silently fall back to defaults
+func (r Rule) DecodeParams(out interface{}) error {
+	if decodeErr := decodeParams(r.Params, out); decodeErr != nil {
+		return fmt.Errorf("error decoding rule params: %w", decodeErr)
+	}
+	return nil
+}
+
+// Decodes the free-form params block into a notifier specific struct, see Rule.DecodeParams
+func (n NotifierConfig) DecodeParams(out interface{}) error {
+	if decodeErr := decodeParams(n.Params, out); decodeErr != nil {
+		return fmt.Errorf("error decoding notifier params: %w", decodeErr)
+	}
+	return nil
+}
+
+func decodeParams(params map[string]interface{}, out interface{}) error {
+	if len(params) == 0 {
+		return nil
+	}
+
+	raw, marshalErr := yaml.Marshal(params)
+	if marshalErr != nil {
+		return marshalErr
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(raw))
+	decoder.KnownFields(true)
+	return decoder.Decode(out)
 }
 
 func NewRuleSetFromFile(filePath string) (*RuleSet, error) {
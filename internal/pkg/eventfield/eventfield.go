@@ -0,0 +1,180 @@
+package eventfield
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event field values are typed once at capture, and again whenever they are read back from a provider log or
+// received from an agent, by looking at their content:
+//   - addresses are netip.Addr, the _PORT half split from an address by the session is a uint16
+//   - integers are int64, uint64 above the int64 range, GUIDs are GUID and RFC3339 timestamps are Timestamp
+//   - anything else stays a string
+//
+// A value is only typed if it renders back exactly as it was written, so the text of a field is the same whether
+// it was typed or not and typing it again gives the same value
+
+// GUID is kept as written, e.g. {00000001-0000-0000-0000-000000000000}
+type GUID string
+
+var guidPattern = regexp.MustCompile(`^\{?[0-9A-Fa-f]{8}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{12}\}?$`)
+
+// Timestamp renders as RFC3339 with nanoseconds, unlike time.Time, so it reads back as the same timestamp
+type Timestamp struct {
+	time.Time
+}
+
+func (t Timestamp) String() string {
+	return t.Time.Format(time.RFC3339Nano)
+}
+
+func (t Timestamp) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// Fields with this suffix hold the port split from an address by the session
+const portSuffix = "_PORT"
+
+// Returns the value with the type its content implies, values of other types are returned as is
+func Typed(key string, value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return typedString(key, v)
+	case json.Number:
+		// Decoded with UseNumber, the number is kept as written
+		if typed := typedString(key, v.String()); typed != v.String() {
+			return typed
+		}
+		if f, parseErr := v.Float64(); parseErr == nil {
+			return f
+		}
+		return v.String()
+	case float64:
+		// Decoded without UseNumber, integers come back as floats
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return Typed(key, json.Number(strconv.FormatInt(int64(v), 10)))
+		}
+		return v
+	case time.Time:
+		return Timestamp{v}
+	case uint16:
+		if strings.HasSuffix(key, portSuffix) {
+			return v
+		}
+		return int64(v)
+	case int:
+		return int64(v)
+	case int8:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case uint8:
+		return int64(v)
+	case uint32:
+		return int64(v)
+	case uint64:
+		if v <= math.MaxInt64 {
+			return int64(v)
+		}
+		return v
+	default:
+		return value
+	}
+}
+
+func typedString(key, value string) interface{} {
+	if value == "" {
+		return value
+	}
+
+	if strings.HasSuffix(key, portSuffix) {
+		if port, parseErr := strconv.ParseUint(value, 10, 16); parseErr == nil && strconv.FormatUint(port, 10) == value {
+			return uint16(port)
+		}
+	}
+
+	if integer, parseErr := strconv.ParseInt(value, 10, 64); parseErr == nil && strconv.FormatInt(integer, 10) == value {
+		return integer
+	}
+	// Kept as uint64 at capture when above the int64 range
+	if integer, parseErr := strconv.ParseUint(value, 10, 64); parseErr == nil && strconv.FormatUint(integer, 10) == value {
+		return integer
+	}
+
+	if guidPattern.MatchString(value) {
+		return GUID(value)
+	}
+
+	if addr, parseErr := netip.ParseAddr(value); parseErr == nil && addr.String() == value {
+		return addr
+	}
+
+	if strings.Contains(value, "T") {
+		if parsedTime, parseErr := time.Parse(time.RFC3339Nano, value); parseErr == nil && parsedTime.Format(time.RFC3339Nano) == value {
+			return Timestamp{parsedTime}
+		}
+	}
+
+	return value
+}
+
+// Types every field in place
+func TypeAll(fields map[string]interface{}) {
+	for key, value := range fields {
+		fields[key] = Typed(key, value)
+	}
+}
+
+// The text of a value, as written to the text provider logs
+func String(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	if s, ok := value.(string); ok {
+		return s
+	}
+	return fmt.Sprint(value)
+}
+
+// The value as an integer, for integer, port and numeric text values
+func Int(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return v, true
+	case uint16:
+		return int64(v), true
+	case int:
+		return int64(v), true
+	case float64:
+		if v == math.Trunc(v) {
+			return int64(v), true
+		}
+		return 0, false
+	case string, json.Number:
+		integer, parseErr := strconv.ParseInt(String(v), 10, 64)
+		return integer, parseErr == nil
+	default:
+		return 0, false
+	}
+}
+
+// The value as an address, for address and address text values
+func Addr(value interface{}) (netip.Addr, bool) {
+	switch v := value.(type) {
+	case netip.Addr:
+		return v, true
+	case string:
+		addr, parseErr := netip.ParseAddr(v)
+		return addr, parseErr == nil
+	default:
+		return netip.Addr{}, false
+	}
+}
@@ -0,0 +1,45 @@
+package eventfield
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestTypedReadsBackLargeIntegers(t *testing.T) {
+	for _, captured := range []interface{}{uint64(math.MaxUint64), uint64(math.MaxInt64) + 1, int64(math.MinInt64), int64(7)} {
+		typed := Typed("Value", captured)
+
+		data, marshalErr := json.Marshal(map[string]interface{}{"Value": typed})
+		if marshalErr != nil {
+			t.Fatal(marshalErr)
+		}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		var fields map[string]interface{}
+		if decodeErr := decoder.Decode(&fields); decodeErr != nil {
+			t.Fatal(decodeErr)
+		}
+
+		fromJSON := Typed("Value", fields["Value"])
+		fromText := Typed("Value", String(typed))
+		if fromJSON != typed || fromText != typed {
+			t.Errorf("%v (%T) read back as %v (%T) from json and %v (%T) from text", typed, typed, fromJSON, fromJSON, fromText, fromText)
+		}
+		if String(fromJSON) != String(typed) {
+			t.Errorf("%v renders as %s", typed, String(fromJSON))
+		}
+	}
+}
+
+func TestIntReadsPortsAndText(t *testing.T) {
+	for _, value := range []interface{}{Typed("LocalSockAddr_PORT", "3389"), "3389", json.Number("3389"), float64(3389), int64(3389)} {
+		if port, ok := Int(value); !ok || port != 3389 {
+			t.Errorf("%v (%T) is %d, %t", value, value, port, ok)
+		}
+	}
+	if _, ok := Int(Typed("Value", "3389.5")); ok {
+		t.Error("3389.5 is an integer")
+	}
+}
@@ -0,0 +1,291 @@
+package fleet
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	alert "github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/alerting"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/bus"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/config"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/outbox"
+	log "github.com/sirupsen/logrus"
+)
+
+// Batches are sent every 5 seconds or once they hold 500 events, whichever comes first. Up to 10000 undelivered
+// batches are spooled, the oldest are dropped beyond that
+const (
+	defaultAgentBatchSize     = 500
+	defaultAgentFlushInterval = 5 * time.Second
+	defaultAgentTimeout       = 10 * time.Second
+	defaultAgentSpoolDir      = "logs/agent_spool"
+	defaultAgentMaxSpoolFiles = 10000
+)
+
+// Agent forwards the events published on the bus and the alerts raised locally to the collector. It is
+// registered as a notifier so alerts reach it through the dispatcher like any other backend.
+// Every batch is written to the spool first and sent from there, so a slow or unreachable collector never
+// holds up the session publishing events
+type Agent struct {
+	Config config.AgentConfig
+	Client *http.Client
+
+	mu      sync.Mutex // guards the pending batch
+	pending Batch
+	outbox  *outbox.Outbox // the spool
+	spoolMu sync.Mutex     // guards the spool directory while batches are spooled or listed
+	wake    chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func NewAgent(agentConfig config.AgentConfig) (*Agent, error) {
+	if agentConfig.CollectorURL == "" {
+		return nil, fmt.Errorf("agent requires a collector_url")
+	}
+	if agentConfig.CertFile == "" || agentConfig.KeyFile == "" {
+		return nil, fmt.Errorf("agent requires a client certificate and key for mutual TLS")
+	}
+
+	if agentConfig.HostID == "" {
+		hostname, hostnameErr := os.Hostname()
+		if hostnameErr != nil {
+			return nil, fmt.Errorf("unable to determine host id: %w", hostnameErr)
+		}
+		agentConfig.HostID = hostname
+	}
+	if !ValidHostID(agentConfig.HostID) {
+		return nil, fmt.Errorf("invalid host id '%s'", agentConfig.HostID)
+	}
+
+	if agentConfig.BatchSize <= 0 {
+		agentConfig.BatchSize = defaultAgentBatchSize
+	}
+	if agentConfig.FlushInterval <= 0 {
+		agentConfig.FlushInterval = defaultAgentFlushInterval
+	}
+	if agentConfig.Timeout <= 0 {
+		agentConfig.Timeout = defaultAgentTimeout
+	}
+	if agentConfig.SpoolDir == "" {
+		agentConfig.SpoolDir = defaultAgentSpoolDir
+	}
+	if agentConfig.MaxSpoolFiles <= 0 {
+		agentConfig.MaxSpoolFiles = defaultAgentMaxSpoolFiles
+	}
+
+	certificate, certificateErr := loadCertificate(agentConfig.CertFile, agentConfig.KeyFile)
+	if certificateErr != nil {
+		return nil, certificateErr
+	}
+	// The collector attributes records to the certificate, a mismatch would get every batch rejected
+	if certificate.Leaf.Subject.CommonName != agentConfig.HostID {
+		return nil, fmt.Errorf("host id '%s' does not match the client certificate CN '%s'", agentConfig.HostID, certificate.Leaf.Subject.CommonName)
+	}
+
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12}
+	if agentConfig.CAFile != "" {
+		pool, poolErr := loadCertPool(agentConfig.CAFile)
+		if poolErr != nil {
+			return nil, poolErr
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	spool, spoolErr := outbox.New(agentConfig.SpoolDir)
+	if spoolErr != nil {
+		return nil, fmt.Errorf("unable to create agent spool '%s': %w", agentConfig.SpoolDir, spoolErr)
+	}
+
+	return &Agent{
+		Config: agentConfig,
+		Client: &http.Client{
+			Timeout:   agentConfig.Timeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+		pending: Batch{Host: agentConfig.HostID},
+		outbox:  spool,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// Starts forwarding the events published on the bus until the bus is closed
+func (a *Agent) Start(b *bus.Bus) {
+	events := b.Subscribe("agent", 4096)
+
+	a.wg.Add(2)
+	go func() {
+		defer a.wg.Done()
+
+		ticker := time.NewTicker(a.Config.FlushInterval)
+		defer ticker.Stop()
+
+		// Runs until the bus is closed rather than until Close, so the events still buffered are batched too
+		for {
+			select {
+			case <-ticker.C:
+				a.cut()
+			case event, ok := <-events:
+				if !ok {
+					// Bus closed, the remaining batch is sent on Close
+					return
+				}
+
+				event.Host = a.Config.HostID
+				a.mu.Lock()
+				a.pending.Events = append(a.pending.Events, event)
+				full := len(a.pending.Events) >= a.Config.BatchSize
+				a.mu.Unlock()
+
+				if full {
+					a.cut()
+				}
+			}
+		}
+	}()
+
+	go func() {
+		defer a.wg.Done()
+
+		// Retries the spool on every interval even when nothing new was cut
+		ticker := time.NewTicker(a.Config.FlushInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-a.done:
+				return
+			case <-ticker.C:
+			case <-a.wake:
+			}
+
+			if sendErr := a.sendSpooled(); sendErr != nil {
+				log.WithError(sendErr).Debug("collector unreachable, keeping batches spooled")
+			}
+		}
+	}()
+}
+
+// Queues the alert for the collector, it goes out with the next batch
+func (a *Agent) Notify(alert alert.Alert) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.pending.Alerts = append(a.pending.Alerts, alert)
+	return nil
+}
+
+// Waits for the events published on the bus and makes a last attempt at sending everything, what cannot be sent
+// stays spooled for the next run. The bus must be closed first
+func (a *Agent) Close() error {
+	close(a.done)
+	a.wg.Wait()
+
+	a.cut()
+	if sendErr := a.sendSpooled(); sendErr != nil {
+		return fmt.Errorf("batches left in the agent spool '%s': %w", a.Config.SpoolDir, sendErr)
+	}
+	return nil
+}
+
+// Moves the pending batch to the spool and wakes the sender
+func (a *Agent) cut() {
+	a.mu.Lock()
+	batch := a.pending
+	a.pending = Batch{Host: a.Config.HostID}
+	a.mu.Unlock()
+
+	if len(batch.Events) == 0 && len(batch.Alerts) == 0 {
+		return
+	}
+
+	batch.ID = newBatchID()
+	batch.Sent = time.Now().Format(time.RFC3339)
+	body, marshalErr := json.Marshal(batch)
+	if marshalErr != nil {
+		log.WithError(marshalErr).Errorf("unable to marshal batch, dropping %d events and %d alerts", len(batch.Events), len(batch.Alerts))
+		return
+	}
+
+	if spoolErr := a.spool(body); spoolErr != nil {
+		log.WithError(spoolErr).Errorf("dropping %d events and %d alerts", len(batch.Events), len(batch.Alerts))
+		return
+	}
+
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Sends the spooled batches oldest first, stopping at the first batch the collector cannot take yet. Batches
+// it rejects are moved to the rejected directory so they do not hold back the ones behind them
+func (a *Agent) sendSpooled() error {
+	a.spoolMu.Lock()
+	fileNames, pendingErr := a.outbox.Pending()
+	a.spoolMu.Unlock()
+	if pendingErr != nil {
+		return pendingErr
+	}
+
+	for _, fileName := range fileNames {
+		body, readFileErr := os.ReadFile(fileName)
+		if readFileErr != nil {
+			log.WithError(readFileErr).Warnf("unable to read spooled batch %s, dropping it", fileName)
+			os.Remove(fileName)
+			continue
+		}
+
+		sendErr := a.send(body)
+		if outbox.IsPermanent(sendErr) {
+			rejectedFile, rejectErr := a.outbox.Reject(fileName)
+			log.WithError(sendErr).Warnf("collector rejected batch %s, moved to %s", filepath.Base(fileName), rejectedFile)
+			if rejectErr != nil {
+				return fmt.Errorf("unable to move rejected batch %s out of the spool: %w", fileName, rejectErr)
+			}
+			continue
+		}
+		if sendErr != nil {
+			return sendErr
+		}
+		os.Remove(fileName)
+		log.Infof("Sent spooled batch %s", filepath.Base(fileName))
+	}
+
+	return nil
+}
+
+func (a *Agent) send(body []byte) error {
+	response, postErr := a.Client.Post(a.Config.CollectorURL, "application/json", bytes.NewReader(body))
+	if postErr != nil {
+		return fmt.Errorf("unable to post batch to collector: %w", postErr)
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+
+	return outbox.CheckResponse("collector", response)
+}
+
+func (a *Agent) spool(body []byte) error {
+	a.spoolMu.Lock()
+	defer a.spoolMu.Unlock()
+
+	fileNames, _ := a.outbox.Pending()
+	if len(fileNames) >= a.Config.MaxSpoolFiles {
+		log.Warnf("Agent spool is full, dropping the oldest batch %s", filepath.Base(fileNames[0]))
+		os.Remove(fileNames[0])
+	}
+
+	if _, writeErr := a.outbox.Write("", body); writeErr != nil {
+		return fmt.Errorf("unable to spool batch: %w", writeErr)
+	}
+	return nil
+}
@@ -0,0 +1,429 @@
+package fleet
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	alert "github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/alerting"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/bus"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/config"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/outbox"
+)
+
+// testPKI is a CA with the collector certificate and one client certificate per host, written as PEM files
+type testPKI struct {
+	dir    string
+	ca     *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	serial int64
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+
+	pki := &testPKI{dir: t.TempDir()}
+	key, keyErr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if keyErr != nil {
+		t.Fatal(keyErr)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test fleet CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, certErr := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if certErr != nil {
+		t.Fatal(certErr)
+	}
+	pki.ca, _ = x509.ParseCertificate(der)
+	pki.caKey = key
+	pki.serial = 1
+	pki.write(t, "ca.pem", "CERTIFICATE", der)
+
+	return pki
+}
+
+func (p *testPKI) write(t *testing.T, name, blockType string, der []byte) string {
+	t.Helper()
+
+	fileName := filepath.Join(p.dir, name)
+	if writeErr := os.WriteFile(fileName, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	return fileName
+}
+
+// Issues a certificate for the common name, returns the certificate and key files
+func (p *testPKI) issue(t *testing.T, commonName string, server bool) (string, string) {
+	t.Helper()
+
+	key, keyErr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if keyErr != nil {
+		t.Fatal(keyErr)
+	}
+	p.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(p.serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+	der, certErr := x509.CreateCertificate(rand.Reader, template, p.ca, &key.PublicKey, p.caKey)
+	if certErr != nil {
+		t.Fatal(certErr)
+	}
+	keyDer, marshalErr := x509.MarshalECPrivateKey(key)
+	if marshalErr != nil {
+		t.Fatal(marshalErr)
+	}
+
+	return p.write(t, commonName+".pem", "CERTIFICATE", der), p.write(t, commonName+"-key.pem", "EC PRIVATE KEY", keyDer)
+}
+
+func freeAddress(t *testing.T) string {
+	t.Helper()
+
+	listener, listenErr := net.Listen("tcp", "127.0.0.1:0")
+	if listenErr != nil {
+		t.Fatal(listenErr)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// Runs a collector on the address until the test ends
+func startCollector(t *testing.T, pki *testPKI, address, storageDir string, b *bus.Bus) {
+	t.Helper()
+
+	certFile, keyFile := pki.issue(t, "collector", true)
+	collector, collectorErr := NewCollector(config.CollectorConfig{
+		Listen:       address,
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientCAFile: filepath.Join(pki.dir, "ca.pem"),
+		StorageDir:   storageDir,
+	}, b)
+	if collectorErr != nil {
+		t.Fatal(collectorErr)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- collector.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if runErr := <-stopped; runErr != nil {
+			t.Error(runErr)
+		}
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, dialErr := net.Dial("tcp", address)
+		if dialErr == nil {
+			conn.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("collector not listening: %v", dialErr)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newTestAgent(t *testing.T, pki *testPKI, hostID, address, spoolDir string) *Agent {
+	t.Helper()
+
+	certFile, keyFile := pki.issue(t, hostID, false)
+	agent, agentErr := NewAgent(config.AgentConfig{
+		CollectorURL:  "https://" + address + BatchPath,
+		HostID:        hostID,
+		CertFile:      certFile,
+		KeyFile:       keyFile,
+		CAFile:        filepath.Join(pki.dir, "ca.pem"),
+		FlushInterval: time.Hour, // batches are cut on Close
+		Timeout:       2 * time.Second,
+		SpoolDir:      spoolDir,
+	})
+	if agentErr != nil {
+		t.Fatal(agentErr)
+	}
+	return agent
+}
+
+func storedEvents(t *testing.T, storageDir, host string) []bus.Event {
+	t.Helper()
+
+	file, openErr := os.Open(filepath.Join(storageDir, host, "events.ndjson"))
+	if os.IsNotExist(openErr) {
+		return nil
+	}
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer file.Close()
+
+	var events []bus.Event
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event bus.Event
+		if unmarshalErr := json.Unmarshal(scanner.Bytes(), &event); unmarshalErr != nil {
+			t.Fatal(unmarshalErr)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func spooled(t *testing.T, dir string) []string {
+	t.Helper()
+
+	fileNames, globErr := filepath.Glob(filepath.Join(dir, "*.json"))
+	if globErr != nil {
+		t.Fatal(globErr)
+	}
+	return fileNames
+}
+
+// Publishes the events on a bus the agent forwards, then closes the bus and the agent, which sends them
+func forward(t *testing.T, agent *Agent, events ...bus.Event) error {
+	t.Helper()
+
+	eventBus := bus.New()
+	agent.Start(eventBus)
+	for _, event := range events {
+		eventBus.Publish(event)
+	}
+
+	eventBus.Close()
+	return agent.Close()
+}
+
+func testEvent(eventID int) bus.Event {
+	return bus.Event{
+		Time:     time.Now(),
+		Provider: "Microsoft-Windows-TCPIP",
+		EventID:  eventID,
+		Fields:   map[string]interface{}{"RemoteSockAddr_IP": "10.0.0.9", "LocalSockAddr_PORT": 3389},
+	}
+}
+
+func TestAgentForwardsOverMutualTLS(t *testing.T) {
+	pki := newTestPKI(t)
+	address, storageDir := freeAddress(t), t.TempDir()
+	startCollector(t, pki, address, storageDir, nil)
+
+	agent := newTestAgent(t, pki, "host-a", address, t.TempDir())
+	agent.Notify(alert.Alert{ID: "a1", Rule: "scan_detection", Entity: "10.0.0.9"})
+	if forwardErr := forward(t, agent, testEvent(1017), testEvent(1033)); forwardErr != nil {
+		t.Fatal(forwardErr)
+	}
+
+	events := storedEvents(t, storageDir, "host-a")
+	if len(events) != 2 || events[0].EventID != 1017 || events[1].EventID != 1033 {
+		t.Fatalf("stored %+v", events)
+	}
+	if events[0].Host != "host-a" || events[0].Fields["LocalSockAddr_PORT"] != float64(3389) {
+		t.Errorf("stored %+v", events[0])
+	}
+	if _, statErr := os.Stat(filepath.Join(storageDir, "host-a", "alerts.ndjson")); statErr != nil {
+		t.Errorf("alert not stored: %v", statErr)
+	}
+	if left := spooled(t, agent.Config.SpoolDir); len(left) != 0 {
+		t.Errorf("%d batches left in the spool", len(left))
+	}
+}
+
+func TestAgentSendsBufferedEventsOnClose(t *testing.T) {
+	pki := newTestPKI(t)
+	address, storageDir := freeAddress(t), t.TempDir()
+	startCollector(t, pki, address, storageDir, nil)
+
+	// Close comes right after the last publish, most events are still buffered in the subscription
+	agent := newTestAgent(t, pki, "host-a", address, t.TempDir())
+	events := make([]bus.Event, 1200)
+	for i := range events {
+		events[i] = testEvent(i)
+	}
+	if forwardErr := forward(t, agent, events...); forwardErr != nil {
+		t.Fatal(forwardErr)
+	}
+
+	stored := storedEvents(t, storageDir, "host-a")
+	if len(stored) != len(events) {
+		t.Fatalf("stored %d events, want %d", len(stored), len(events))
+	}
+	for i, event := range stored {
+		if event.EventID != i {
+			t.Fatalf("event %d is %d, want %d", i, event.EventID, i)
+		}
+	}
+	if left := spooled(t, agent.Config.SpoolDir); len(left) != 0 {
+		t.Errorf("%d batches left in the spool", len(left))
+	}
+}
+
+func TestAgentHostMustMatchCertificate(t *testing.T) {
+	pki := newTestPKI(t)
+	address, storageDir := freeAddress(t), t.TempDir()
+	startCollector(t, pki, address, storageDir, nil)
+
+	// The agent refuses to start with a host id other than its certificate CN
+	certFile, keyFile := pki.issue(t, "host-a", false)
+	if _, agentErr := NewAgent(config.AgentConfig{CollectorURL: "https://" + address + BatchPath, HostID: "host-b", CertFile: certFile, KeyFile: keyFile}); agentErr == nil {
+		t.Fatal("agent started with a host id not matching its certificate")
+	}
+
+	// The collector rejects a batch claiming another host, it is moved aside and the next batch still goes out
+	spoolDir := t.TempDir()
+	agent := newTestAgent(t, pki, "host-a", address, spoolDir)
+	forged, _ := json.Marshal(Batch{Host: "host-b", Events: []bus.Event{testEvent(1017)}})
+	os.WriteFile(filepath.Join(spoolDir, "00000000000000000001.json"), forged, 0600)
+
+	if forwardErr := forward(t, agent, testEvent(1033)); forwardErr != nil {
+		t.Fatal(forwardErr)
+	}
+
+	if events := storedEvents(t, storageDir, "host-b"); len(events) != 0 {
+		t.Errorf("stored %d events for the forged host", len(events))
+	}
+	if events := storedEvents(t, storageDir, "host-a"); len(events) != 1 || events[0].EventID != 1033 {
+		t.Errorf("stored %+v for host-a", events)
+	}
+	if rejected := spooled(t, filepath.Join(spoolDir, outbox.RejectedDir)); len(rejected) != 1 {
+		t.Errorf("%d rejected batches, want 1", len(rejected))
+	}
+	if left := spooled(t, spoolDir); len(left) != 0 {
+		t.Errorf("%d batches left in the spool", len(left))
+	}
+}
+
+func TestAgentReplaysSpool(t *testing.T) {
+	pki := newTestPKI(t)
+	address, storageDir, spoolDir := freeAddress(t), t.TempDir(), t.TempDir()
+
+	// The collector is down, batches stay spooled across runs
+	for _, eventID := range []int{1, 2} {
+		agent := newTestAgent(t, pki, "host-a", address, spoolDir)
+		if forwardErr := forward(t, agent, testEvent(eventID)); forwardErr == nil {
+			t.Fatal("sent to a collector that is down")
+		}
+	}
+	if left := spooled(t, spoolDir); len(left) != 2 {
+		t.Fatalf("%d batches spooled, want 2", len(left))
+	}
+
+	// Once it is up they are sent oldest first, ahead of the new batch
+	startCollector(t, pki, address, storageDir, nil)
+	agent := newTestAgent(t, pki, "host-a", address, spoolDir)
+	if forwardErr := forward(t, agent, testEvent(3)); forwardErr != nil {
+		t.Fatal(forwardErr)
+	}
+
+	events := storedEvents(t, storageDir, "host-a")
+	if len(events) != 3 {
+		t.Fatalf("stored %d events, want 3", len(events))
+	}
+	for i, event := range events {
+		if event.EventID != i+1 {
+			t.Errorf("event %d is %d, want %d", i, event.EventID, i+1)
+		}
+	}
+	if left := spooled(t, spoolDir); len(left) != 0 {
+		t.Errorf("%d batches left in the spool", len(left))
+	}
+}
+
+func TestCollectorDropsDuplicateBatches(t *testing.T) {
+	pki := newTestPKI(t)
+	address, storageDir, spoolDir := freeAddress(t), t.TempDir(), t.TempDir()
+
+	// The collector stored the batch but the agent never saw the response, it is still spooled
+	agent := newTestAgent(t, pki, "host-a", address, spoolDir)
+	if forwardErr := forward(t, agent, testEvent(1)); forwardErr == nil {
+		t.Fatal("sent to a collector that is down")
+	}
+	left := spooled(t, spoolDir)
+	if len(left) != 1 {
+		t.Fatalf("%d batches spooled, want 1", len(left))
+	}
+	body, readFileErr := os.ReadFile(left[0])
+	if readFileErr != nil {
+		t.Fatal(readFileErr)
+	}
+	if writeErr := os.WriteFile(strings.TrimSuffix(left[0], ".json")+"-retry.json", body, 0600); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+
+	b := bus.New()
+	published := b.Subscribe("test", 10)
+	startCollector(t, pki, address, storageDir, b)
+	agent = newTestAgent(t, pki, "host-a", address, spoolDir)
+	if forwardErr := forward(t, agent, testEvent(2)); forwardErr != nil {
+		t.Fatal(forwardErr)
+	}
+
+	// Both copies are acknowledged, only the first is stored and published
+	events := storedEvents(t, storageDir, "host-a")
+	if len(events) != 2 || events[0].EventID != 1 || events[1].EventID != 2 {
+		t.Fatalf("stored %+v, want events 1 and 2 once", events)
+	}
+	if left := spooled(t, spoolDir); len(left) != 0 {
+		t.Errorf("%d batches left in the spool", len(left))
+	}
+	b.Close()
+	var eventIDs []int
+	for event := range published {
+		eventIDs = append(eventIDs, event.EventID)
+	}
+	if len(eventIDs) != 2 || eventIDs[0] != 1 || eventIDs[1] != 2 {
+		t.Errorf("published events %v, want [1 2]", eventIDs)
+	}
+}
+
+func TestCollectorRejectsUnknownCA(t *testing.T) {
+	pki := newTestPKI(t)
+	address, storageDir, spoolDir := freeAddress(t), t.TempDir(), t.TempDir()
+	startCollector(t, pki, address, storageDir, nil)
+
+	// A certificate from another CA fails the handshake, the batch is kept since it is not the batch at fault
+	other := newTestPKI(t)
+	agent := newTestAgent(t, other, "host-a", address, spoolDir)
+	agent.Client.Transport.(*http.Transport).TLSClientConfig.RootCAs = nil
+	agent.Client.Transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify = true
+	if forwardErr := forward(t, agent, testEvent(1017)); forwardErr == nil {
+		t.Fatal("collector accepted a certificate from another CA")
+	}
+
+	if events := storedEvents(t, storageDir, "host-a"); len(events) != 0 {
+		t.Errorf("stored %d events", len(events))
+	}
+	if left := spooled(t, spoolDir); len(left) != 1 {
+		t.Errorf("%d batches spooled, want 1", len(left))
+	}
+}
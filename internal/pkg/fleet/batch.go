@@ -0,0 +1,69 @@
+package fleet
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	alert "github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/alerting"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/bus"
+)
+
+// Agents post their batches to this path of the collector
+const BatchPath = "/v1/batches"
+
+// Batch is what an agent sends to the collector, every event and alert is stamped with the agent host
+type Batch struct {
+	ID     string        `json:"id"` // random, a batch sent again keeps its ID so the collector stores it once
+	Host   string        `json:"host"`
+	Sent   string        `json:"sent"` // RFC 3339 time of the first delivery attempt
+	Events []bus.Event   `json:"events,omitempty"`
+	Alerts []alert.Alert `json:"alerts,omitempty"`
+}
+
+// Host identities end up in directory names on the collector
+var validHostID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,253}$`)
+
+func ValidHostID(hostID string) bool { return validHostID.MatchString(hostID) }
+
+// Returns a random identifier for a new batch
+func newBatchID() string {
+	id := make([]byte, 16)
+	if _, readErr := rand.Read(id); readErr != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(id)
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, readFileErr := os.ReadFile(caFile)
+	if readFileErr != nil {
+		return nil, fmt.Errorf("error reading CA file '%s': %w", caFile, readFileErr)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA file '%s'", caFile)
+	}
+	return pool, nil
+}
+
+func loadCertificate(certFile, keyFile string) (tls.Certificate, error) {
+	certificate, loadErr := tls.LoadX509KeyPair(certFile, keyFile)
+	if loadErr != nil {
+		return tls.Certificate{}, fmt.Errorf("error loading certificate '%s': %w", certFile, loadErr)
+	}
+
+	leaf, parseErr := x509.ParseCertificate(certificate.Certificate[0])
+	if parseErr != nil {
+		return tls.Certificate{}, fmt.Errorf("error parsing certificate '%s': %w", certFile, parseErr)
+	}
+	certificate.Leaf = leaf
+
+	return certificate, nil
+}
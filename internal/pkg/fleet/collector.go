@@ -0,0 +1,253 @@
+package fleet
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	alert "github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/alerting"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/bus"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/config"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/eventfield"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultCollectorListen        = ":8443"
+	defaultCollectorStorageDir    = "logs/fleet"
+	defaultCollectorMaxBatchBytes = 32 << 20
+)
+
+// The IDs of the last 1024 batches of each host are remembered in memory. An agent sends a batch again when
+// the response to it was lost, or when it replays its spool, and agents send their spool oldest first
+const collectorRecentBatches = 1024
+
+// Collector receives batches from the agents over mutual TLS, stores them per host and publishes the events on
+// its bus so the rules run across the fleet
+type Collector struct {
+	Config config.CollectorConfig
+	Bus    *bus.Bus
+
+	server *http.Server
+	mu     sync.Mutex                // serializes writes to the host stores
+	recent map[string]*recentBatches // batches last stored per host, guarded by mu
+}
+
+// recentBatches is a bounded set of batch IDs, the oldest is forgotten first
+type recentBatches struct {
+	ids   map[string]bool
+	order []string
+}
+
+func (r *recentBatches) add(id string) {
+	if len(r.order) == collectorRecentBatches {
+		delete(r.ids, r.order[0])
+		r.order = r.order[1:]
+	}
+	r.ids[id] = true
+	r.order = append(r.order, id)
+}
+
+func NewCollector(collectorConfig config.CollectorConfig, b *bus.Bus) (*Collector, error) {
+	if collectorConfig.CertFile == "" || collectorConfig.KeyFile == "" || collectorConfig.ClientCAFile == "" {
+		return nil, fmt.Errorf("collector requires a certificate, key and client CA for mutual TLS")
+	}
+	if collectorConfig.Listen == "" {
+		collectorConfig.Listen = defaultCollectorListen
+	}
+	if collectorConfig.StorageDir == "" {
+		collectorConfig.StorageDir = defaultCollectorStorageDir
+	}
+	if collectorConfig.MaxBatchBytes <= 0 {
+		collectorConfig.MaxBatchBytes = defaultCollectorMaxBatchBytes
+	}
+
+	certificate, certificateErr := loadCertificate(collectorConfig.CertFile, collectorConfig.KeyFile)
+	if certificateErr != nil {
+		return nil, certificateErr
+	}
+	clientCAs, poolErr := loadCertPool(collectorConfig.ClientCAFile)
+	if poolErr != nil {
+		return nil, poolErr
+	}
+
+	c := &Collector{Config: collectorConfig, Bus: b, recent: make(map[string]*recentBatches)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(BatchPath, c.handleBatch)
+
+	c.server = &http.Server{
+		Addr:    collectorConfig.Listen,
+		Handler: mux,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{certificate},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    clientCAs,
+			MinVersion:   tls.VersionTLS12,
+		},
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	return c, nil
+}
+
+// Serves the agents until the context is cancelled
+func (c *Collector) Run(ctx context.Context) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		log.Infof("Collector listening on %s", c.Config.Listen)
+		serveErr <- c.server.ListenAndServeTLS("", "")
+	}()
+
+	select {
+	case err := <-serveErr:
+		return fmt.Errorf("collector stopped: %w", err)
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if shutdownErr := c.server.Shutdown(shutdownCtx); shutdownErr != nil {
+		return fmt.Errorf("unable to cleanly stop the collector: %w", shutdownErr)
+	}
+
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (c *Collector) handleBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The verified client certificate is the host identity, whatever the batch claims
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		http.Error(w, "client certificate required", http.StatusUnauthorized)
+		return
+	}
+	host := r.TLS.PeerCertificates[0].Subject.CommonName
+	if !ValidHostID(host) {
+		http.Error(w, "invalid host identity", http.StatusForbidden)
+		return
+	}
+
+	var batch Batch
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, c.Config.MaxBatchBytes))
+	decoder.UseNumber() // numbers are typed like the fields they came from, not as floats
+	if decodeErr := decoder.Decode(&batch); decodeErr != nil {
+		http.Error(w, "invalid batch", http.StatusBadRequest)
+		return
+	}
+	if batch.Host != host {
+		log.Warnf("Collector rejected a batch for host '%s' sent with the certificate of '%s'", batch.Host, host)
+		http.Error(w, "batch host does not match the client certificate", http.StatusForbidden)
+		return
+	}
+
+	for i := range batch.Events {
+		batch.Events[i].Host = host
+		eventfield.TypeAll(batch.Events[i].Fields)
+	}
+
+	stored, storeErr := c.store(host, batch)
+	if storeErr != nil {
+		log.WithError(storeErr).Errorf("unable to store batch of %s", host)
+		http.Error(w, "unable to store batch", http.StatusInternalServerError)
+		return
+	}
+	if !stored {
+		// Acknowledged so the agent drops it from its spool, the events were published the first time
+		log.Debugf("Collector dropped batch %s from %s, it was already stored", batch.ID, host)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if c.Bus != nil {
+		for _, event := range batch.Events {
+			c.Bus.Publish(event)
+		}
+	}
+
+	log.Debugf("Collector received %d events and %d alerts from %s", len(batch.Events), len(batch.Alerts), host)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Appends the events and alerts of the batch to the NDJSON stores of the host, unless the batch was already
+// stored. Reports whether it was stored now
+func (c *Collector) store(host string, batch Batch) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	recent, exists := c.recent[host]
+	if !exists {
+		recent = &recentBatches{ids: make(map[string]bool)}
+		c.recent[host] = recent
+	}
+	// Batches of agents predating batch IDs are always stored
+	if batch.ID != "" && recent.ids[batch.ID] {
+		return false, nil
+	}
+
+	hostDir := filepath.Join(c.Config.StorageDir, host)
+	if mkdirErr := os.MkdirAll(hostDir, 0755); mkdirErr != nil {
+		return false, mkdirErr
+	}
+
+	events := make([]interface{}, len(batch.Events))
+	for i := range batch.Events {
+		events[i] = batch.Events[i]
+	}
+	if appendErr := appendRecords(filepath.Join(hostDir, "events.ndjson"), events); appendErr != nil {
+		return false, appendErr
+	}
+
+	alerts := make([]interface{}, len(batch.Alerts))
+	for i := range batch.Alerts {
+		alerts[i] = hostAlert{Host: host, Alert: batch.Alerts[i]}
+	}
+	if appendErr := appendRecords(filepath.Join(hostDir, "alerts.ndjson"), alerts); appendErr != nil {
+		return false, appendErr
+	}
+
+	if batch.ID != "" {
+		recent.add(batch.ID)
+	}
+	return true, nil
+}
+
+// Alerts are stored with the host that raised them
+type hostAlert struct {
+	Host string `json:"host"`
+	alert.Alert
+}
+
+func appendRecords(fileName string, records []interface{}) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	file, openFileErr := os.OpenFile(fileName, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if openFileErr != nil {
+		return openFileErr
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	for _, record := range records {
+		if encodeErr := encoder.Encode(record); encodeErr != nil {
+			return encodeErr
+		}
+	}
+
+	return file.Sync()
+}
@@ -5,16 +5,25 @@ import (
 	"os"
 	"sync"
 
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/metrics"
 	log "github.com/sirupsen/logrus"
 )
 
 type ProviderHook struct {
 	ProviderWriters map[string]io.Writer
 	StdOutWriter    io.Writer
-	Files           []*os.File // keeping track of open files
+	Files           []LogFile     // keeping track of open files
+	Formatter       log.Formatter // formats the provider log lines, the logger formatter if nil
 	mu              sync.Mutex
 }
 
+// LogFile is a provider log file, a plain or rotating file
+type LogFile interface {
+	io.Writer
+	Sync() error
+	Close() error
+}
+
 func NewProviderHook() *ProviderHook {
 	return &ProviderHook{
 		ProviderWriters: make(map[string]io.Writer),
@@ -34,6 +43,8 @@ func (h *ProviderHook) Fire(entry *log.Entry) error {
 	// Assuming provider entry is added as a field in the log entry
 	// If any log is not info, write to StdOut, otherwise check if its a specific provider
 	var target io.Writer
+	targetName := "stdout"
+	formatter := entry.Logger.Formatter
 	if entry.Level != log.InfoLevel {
 		target = h.StdOutWriter
 	} else {
@@ -46,24 +57,48 @@ func (h *ProviderHook) Fire(entry *log.Entry) error {
 			if !ok {
 				// Provider writer not found, write to StdOut
 				target = h.StdOutWriter
+			} else {
+				targetName = provider
+				if h.Formatter != nil {
+					formatter = h.Formatter
+				}
 			}
 		}
 	}
 
-	line, err := entry.String()
+	line, err := formatter.Format(entry)
 	if err != nil {
+		metrics.LogWriteErrors.Inc(targetName)
 		return err
 	}
 
-	_, err = target.Write([]byte(line))
+	if _, err = target.Write(line); err != nil {
+		metrics.LogWriteErrors.Inc(targetName)
+	}
 	return err
 }
 
-func (h *ProviderHook) TeardownLogging() {
-	for _, file := range h.Files {
+// Flushes and closes the provider log files, any later provider logs fall back to StdOut
+func (h *ProviderHook) TeardownLogging() error {
+	// Detach the files under lock but close them outside of it, logging an error fires this hook again
+	h.mu.Lock()
+	files := h.Files
+	h.Files = nil
+	h.ProviderWriters = make(map[string]io.Writer)
+	h.mu.Unlock()
+
+	var teardownErr error
+	for _, file := range files {
+		if err := file.Sync(); err != nil {
+			log.Errorf("failed to flush file: %v", err)
+		}
+
 		err := file.Close()
 		if err != nil {
 			log.Errorf("failed to close file: %v", err)
+			teardownErr = err
 		}
 	}
+
+	return teardownErr
 }
@@ -0,0 +1,77 @@
+package hook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Provider log formats, text is the logrus text format
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+type eventMetaKey struct{}
+
+// EventMeta is attached by the session to provider log entries, the text format has it in the message
+type EventMeta struct {
+	ID   int
+	Time time.Time // when the provider raised the event, the entry time is when it was received
+}
+
+func WithEvent(entry *log.Entry, meta EventMeta) *log.Entry {
+	return entry.WithContext(context.WithValue(context.Background(), eventMetaKey{}, meta))
+}
+
+// JSONRecord is one line of a JSON Lines provider log
+type JSONRecord struct {
+	Time      time.Time              `json:"time"`
+	EventTime *time.Time             `json:"event_time,omitempty"`
+	Provider  string                 `json:"provider"`
+	EventID   int                    `json:"event_id"`
+	Message   string                 `json:"msg"`
+	Fields    map[string]interface{} `json:"fields"`
+}
+
+// JSONFormatter writes provider log entries as JSON Lines, keeping the types and nesting of the field values
+type JSONFormatter struct{}
+
+func (JSONFormatter) Format(entry *log.Entry) ([]byte, error) {
+	record := JSONRecord{
+		Time:    entry.Time,
+		Message: entry.Message,
+		Fields:  make(map[string]interface{}, len(entry.Data)),
+	}
+
+	for key, value := range entry.Data {
+		if key == "provider" {
+			record.Provider, _ = value.(string)
+			continue
+		}
+
+		// Errors have no exported fields and would be written as {}
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		record.Fields[key] = value
+	}
+
+	if entry.Context != nil {
+		if meta, ok := entry.Context.Value(eventMetaKey{}).(EventMeta); ok {
+			record.EventID = meta.ID
+			if !meta.Time.IsZero() {
+				record.EventTime = &meta.Time
+			}
+		}
+	}
+
+	line, marshalErr := json.Marshal(record)
+	if marshalErr != nil {
+		return nil, fmt.Errorf("unable to format provider log entry as JSON: %w", marshalErr)
+	}
+	return append(line, '\n'), nil
+}
@@ -0,0 +1,334 @@
+package hook
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Rotated segments are named <log file>.<rotation time>[.gz], the time being when the segment was closed, so
+// readers can tell which segments fall within a window from the name alone
+const segmentTimeLayout = "20060102T150405.000000Z"
+
+// RotationConfig bounds a provider log file, zero values disable the corresponding limit
+type RotationConfig struct {
+	MaxSize      int64         // rotate once the active file reaches this many bytes
+	Interval     time.Duration // rotate once the active file is this old
+	Compress     bool          // gzip rotated segments
+	MaxAge       time.Duration // remove segments closed longer ago than this
+	MaxTotalSize int64         // remove the oldest segments until they take at most this many bytes
+}
+
+// RotatingFile appends to a provider log file, rotating and pruning its segments as configured
+type RotatingFile struct {
+	path   string
+	config RotationConfig
+
+	mu        sync.Mutex
+	file      *os.File
+	size      int64
+	opened    time.Time
+	cleanup   sync.WaitGroup // compression and retention of rotated segments
+	cleanupMu sync.Mutex     // one rotation is cleaned up at a time
+}
+
+func OpenRotatingFile(path string, rotationConfig RotationConfig) (*RotatingFile, error) {
+	r := &RotatingFile{path: path, config: rotationConfig}
+	if openErr := r.open(); openErr != nil {
+		return nil, openErr
+	}
+
+	// A file left by a previous run is rotated if it is already past its limits
+	if r.due(0) {
+		if rotateErr := r.rotate(); rotateErr != nil {
+			r.file.Close()
+			return nil, rotateErr
+		}
+	}
+
+	return r, nil
+}
+
+// The age of an existing file counts from its last modification, previous runs appended to it
+func (r *RotatingFile) open() error {
+	file, openFileErr := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND|os.O_SYNC, 0666)
+	if openFileErr != nil {
+		return openFileErr
+	}
+
+	info, statErr := file.Stat()
+	if statErr != nil {
+		file.Close()
+		return statErr
+	}
+
+	r.file = file
+	r.size = info.Size()
+	r.opened = time.Now()
+	if r.size > 0 {
+		r.opened = info.ModTime()
+	}
+	return nil
+}
+
+func (r *RotatingFile) due(pending int) bool {
+	if r.size == 0 {
+		return false
+	}
+	if r.config.MaxSize > 0 && r.size+int64(pending) > r.config.MaxSize {
+		return true
+	}
+	return r.config.Interval > 0 && time.Since(r.opened) >= r.config.Interval
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	if r.due(len(p)) {
+		if rotateErr := r.rotate(); rotateErr != nil {
+			// Keep logging to the oversized file rather than losing events
+			log.WithError(rotateErr).Warnf("unable to rotate %s", r.path)
+		}
+	}
+
+	n, writeErr := r.file.Write(p)
+	r.size += int64(n)
+	return n, writeErr
+}
+
+// Moves the active file to a segment and starts a new one, the segment is compressed and pruned in the
+// background
+func (r *RotatingFile) rotate() error {
+	if closeErr := r.file.Close(); closeErr != nil {
+		return closeErr
+	}
+
+	segment := r.path + "." + time.Now().UTC().Format(segmentTimeLayout)
+	if renameErr := os.Rename(r.path, segment); renameErr != nil {
+		// Reopen the active file whatever happened so writes can carry on
+		if openErr := r.open(); openErr != nil {
+			r.file = nil
+		}
+		return renameErr
+	}
+
+	if openErr := r.open(); openErr != nil {
+		r.file = nil
+		return openErr
+	}
+
+	r.cleanup.Add(1)
+	go func() {
+		defer r.cleanup.Done()
+		r.cleanupMu.Lock()
+		defer r.cleanupMu.Unlock()
+
+		if r.config.Compress {
+			if compressErr := compressSegment(segment); compressErr != nil {
+				log.WithError(compressErr).Warnf("unable to compress %s", segment)
+			}
+		}
+		if pruneErr := r.prune(); pruneErr != nil {
+			log.WithError(pruneErr).Warnf("unable to apply retention to %s", r.path)
+		}
+	}()
+
+	return nil
+}
+
+// Removes the segments past the retention, oldest first
+func (r *RotatingFile) prune() error {
+	if r.config.MaxAge <= 0 && r.config.MaxTotalSize <= 0 {
+		return nil
+	}
+
+	segments, listErr := listSegments(r.path)
+	if listErr != nil {
+		return listErr
+	}
+
+	var totalSize int64
+	sizes := make([]int64, len(segments))
+	for i, segment := range segments {
+		if info, statErr := os.Stat(segment.path); statErr == nil {
+			sizes[i] = info.Size()
+			totalSize += sizes[i]
+		}
+	}
+
+	for i, segment := range segments {
+		expired := r.config.MaxAge > 0 && time.Since(segment.closed) > r.config.MaxAge
+		oversized := r.config.MaxTotalSize > 0 && totalSize > r.config.MaxTotalSize
+		if !expired && !oversized {
+			break
+		}
+
+		if removeErr := os.Remove(segment.path); removeErr != nil && !os.IsNotExist(removeErr) {
+			return removeErr
+		}
+		totalSize -= sizes[i]
+	}
+
+	return nil
+}
+
+func (r *RotatingFile) Sync() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return os.ErrClosed
+	}
+	return r.file.Sync()
+}
+
+// Closes the active file and waits for the rotated segments to be compressed and pruned
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	file := r.file
+	r.file = nil
+	r.mu.Unlock()
+
+	r.cleanup.Wait()
+	if file == nil {
+		return os.ErrClosed
+	}
+	return file.Close()
+}
+
+func compressSegment(segment string) error {
+	source, openFileErr := os.Open(segment)
+	if openFileErr != nil {
+		return openFileErr
+	}
+	defer source.Close()
+
+	// Written under a temporary name so readers never see a partial archive
+	temporary := segment + ".gz.tmp"
+	target, createErr := os.OpenFile(temporary, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if createErr != nil {
+		return createErr
+	}
+
+	writer := gzip.NewWriter(target)
+	_, copyErr := io.Copy(writer, source)
+	if closeErr := writer.Close(); copyErr == nil {
+		copyErr = closeErr
+	}
+	if closeErr := target.Close(); copyErr == nil {
+		copyErr = closeErr
+	}
+	if copyErr != nil {
+		os.Remove(temporary)
+		return copyErr
+	}
+
+	if renameErr := os.Rename(temporary, segment+".gz"); renameErr != nil {
+		os.Remove(temporary)
+		return renameErr
+	}
+	source.Close()
+	return os.Remove(segment)
+}
+
+type logSegment struct {
+	path   string
+	closed time.Time
+}
+
+// Rotated segments of the log file, oldest first. A segment that is being compressed is listed once
+func listSegments(path string) ([]logSegment, error) {
+	matches, globErr := filepath.Glob(path + ".*")
+	if globErr != nil {
+		return nil, globErr
+	}
+
+	// The archive wins, the uncompressed segment is about to be removed
+	seen := make(map[time.Time]int)
+	var segments []logSegment
+	for _, match := range matches {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(match, path+"."), ".gz")
+		closed, parseErr := time.Parse(segmentTimeLayout, stamp)
+		if parseErr != nil {
+			continue
+		}
+		if idx, exists := seen[closed]; exists {
+			if strings.HasSuffix(match, ".gz") {
+				segments[idx].path = match
+			}
+			continue
+		}
+		seen[closed] = len(segments)
+		segments = append(segments, logSegment{path: match, closed: closed})
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].closed.Before(segments[j].closed)
+	})
+	return segments, nil
+}
+
+// Segments of the log file that may hold entries logged at or after the given time, oldest first, followed by
+// the active file. Segments hold the entries logged before they were closed
+func Segments(path string, since time.Time) ([]string, error) {
+	segments, listErr := listSegments(path)
+	if listErr != nil {
+		return nil, fmt.Errorf("unable to list rotated segments of %s: %w", path, listErr)
+	}
+
+	var paths []string
+	for _, segment := range segments {
+		if since.IsZero() || !segment.closed.Before(since) {
+			paths = append(paths, segment.path)
+		}
+	}
+	return append(paths, path), nil
+}
+
+// Opens a segment or the active file, decompressing gzipped segments. A segment compressed since it was listed
+// is opened from its archive
+func OpenSegment(path string) (io.ReadCloser, error) {
+	file, openFileErr := os.Open(path)
+	if errors.Is(openFileErr, os.ErrNotExist) && !strings.HasSuffix(path, ".gz") {
+		if archive, archiveErr := os.Open(path + ".gz"); archiveErr == nil {
+			file, openFileErr, path = archive, nil, path+".gz"
+		}
+	}
+	if openFileErr != nil {
+		return nil, openFileErr
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return file, nil
+	}
+
+	reader, gzipErr := gzip.NewReader(file)
+	if gzipErr != nil {
+		file.Close()
+		return nil, fmt.Errorf("unable to decompress %s: %w", path, gzipErr)
+	}
+	return gzipSegment{Reader: reader, file: file}, nil
+}
+
+type gzipSegment struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (g gzipSegment) Close() error {
+	g.Reader.Close()
+	return g.file.Close()
+}
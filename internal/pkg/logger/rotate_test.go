@@ -0,0 +1,166 @@
+package hook
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A 20 byte log line
+func testLine(i int) string {
+	return fmt.Sprintf("event line %08d\n", i)
+}
+
+func writeLines(t *testing.T, file *RotatingFile, from, to int) {
+	t.Helper()
+
+	for i := from; i < to; i++ {
+		if _, writeErr := file.Write([]byte(testLine(i))); writeErr != nil {
+			t.Fatal(writeErr)
+		}
+		// Segment names have microsecond precision
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// The content of every segment and the active file, oldest first
+func readSegments(t *testing.T, path string) []string {
+	t.Helper()
+
+	segments, segmentsErr := Segments(path, time.Time{})
+	if segmentsErr != nil {
+		t.Fatal(segmentsErr)
+	}
+
+	var contents []string
+	for _, segment := range segments {
+		source, openErr := OpenSegment(segment)
+		if openErr != nil {
+			t.Fatal(openErr)
+		}
+		content, readErr := io.ReadAll(source)
+		source.Close()
+		if readErr != nil {
+			t.Fatal(readErr)
+		}
+		contents = append(contents, string(content))
+	}
+	return contents
+}
+
+func linesOf(from, to int) string {
+	var lines strings.Builder
+	for i := from; i < to; i++ {
+		lines.WriteString(testLine(i))
+	}
+	return lines.String()
+}
+
+func TestRotateBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tcp-ip.log")
+	file, openErr := OpenRotatingFile(path, RotationConfig{MaxSize: 50})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	writeLines(t, file, 0, 5)
+	file.Close()
+
+	want := []string{linesOf(0, 2), linesOf(2, 4), linesOf(4, 5)}
+	if contents := readSegments(t, path); !reflect.DeepEqual(contents, want) {
+		t.Errorf("segments %q, want %q", contents, want)
+	}
+}
+
+func TestRotateByInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tcp-ip.log")
+	file, openErr := OpenRotatingFile(path, RotationConfig{Interval: 50 * time.Millisecond})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	writeLines(t, file, 0, 2)
+	time.Sleep(60 * time.Millisecond)
+	writeLines(t, file, 2, 3)
+	file.Close()
+
+	want := []string{linesOf(0, 2), linesOf(2, 3)}
+	if contents := readSegments(t, path); !reflect.DeepEqual(contents, want) {
+		t.Errorf("segments %q, want %q", contents, want)
+	}
+
+	// A file left by a previous run past the interval is rotated when it is opened again
+	time.Sleep(60 * time.Millisecond)
+	file, openErr = OpenRotatingFile(path, RotationConfig{Interval: 50 * time.Millisecond})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	file.Close()
+
+	want = []string{linesOf(0, 2), linesOf(2, 3), ""}
+	if contents := readSegments(t, path); !reflect.DeepEqual(contents, want) {
+		t.Errorf("segments after reopening %q, want %q", contents, want)
+	}
+}
+
+func TestRotatePrunesSegments(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tcp-ip.log")
+
+	// Closed longer ago than the maximum age
+	expired := path + "." + time.Now().Add(-2*time.Hour).UTC().Format(segmentTimeLayout)
+	if writeErr := os.WriteFile(expired, []byte(testLine(-1)), 0666); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+
+	// Each segment holds two 20 byte lines, three of them exceed the total size
+	file, openErr := OpenRotatingFile(path, RotationConfig{MaxSize: 50, MaxAge: time.Hour, MaxTotalSize: 100})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	writeLines(t, file, 0, 7)
+	file.Close()
+
+	if _, statErr := os.Stat(expired); !os.IsNotExist(statErr) {
+		t.Errorf("expired segment was kept: %v", statErr)
+	}
+	want := []string{linesOf(2, 4), linesOf(4, 6), linesOf(6, 7)}
+	if contents := readSegments(t, path); !reflect.DeepEqual(contents, want) {
+		t.Errorf("segments %q, want %q", contents, want)
+	}
+}
+
+func TestRotateCompressesSegments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tcp-ip.log")
+	file, openErr := OpenRotatingFile(path, RotationConfig{MaxSize: 50, Compress: true})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	writeLines(t, file, 0, 5)
+	file.Close()
+
+	segments, segmentsErr := Segments(path, time.Time{})
+	if segmentsErr != nil {
+		t.Fatal(segmentsErr)
+	}
+	if len(segments) != 3 || !strings.HasSuffix(segments[0], ".gz") || !strings.HasSuffix(segments[1], ".gz") {
+		t.Fatalf("segments %q, want two archives and the active file", segments)
+	}
+	want := []string{linesOf(0, 2), linesOf(2, 4), linesOf(4, 5)}
+	if contents := readSegments(t, path); !reflect.DeepEqual(contents, want) {
+		t.Errorf("segments %q, want %q", contents, want)
+	}
+
+	// A reader that listed the segment before it was compressed still opens it
+	source, openSegmentErr := OpenSegment(strings.TrimSuffix(segments[0], ".gz"))
+	if openSegmentErr != nil {
+		t.Fatal(openSegmentErr)
+	}
+	defer source.Close()
+	if content, readErr := io.ReadAll(source); readErr != nil || string(content) != want[0] {
+		t.Errorf("read %q (%v), want %q", content, readErr, want[0])
+	}
+}
@@ -0,0 +1,28 @@
+package metrics
+
+// Metrics of the sensor, all prefixed etw_. A sensor that went quiet shows in etw_last_event_timestamp_seconds
+var (
+	EventsReceived = NewCounter("etw_events_received_total",
+		"Events received from a configured provider, before event ID filtering.", "provider", "event_id")
+	EventsUnknownProvider = NewCounter("etw_events_unknown_provider_total",
+		"Events dropped because their provider is not configured.")
+	LastEventTimestamp = NewGauge("etw_last_event_timestamp_seconds",
+		"Unix time of the last event received from the provider.", "provider")
+	FieldExtractionErrors = NewCounter("etw_field_extraction_errors_total",
+		"Logged events none of the configured fields could be extracted from.", "provider", "event_id")
+	LogWriteErrors = NewCounter("etw_log_write_errors_total",
+		"Log lines that could not be formatted or written.", "target")
+	BusEventsDropped = NewCounter("etw_bus_events_dropped_total",
+		"Events a bus subscriber missed because its buffer stayed full.", "subscriber")
+
+	RuleEvaluationSeconds = NewHistogram("etw_rule_evaluation_seconds",
+		"Time taken by a rule pass, including alerting.", []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30}, "rule")
+	RuleHits = NewCounter("etw_rule_hits_total",
+		"Findings of a rule above its alert threshold, suppressed or not.", "rule")
+	AlertsFired = NewCounter("etw_alerts_fired_total",
+		"Alerts sent to the notifiers.", "rule", "severity", "status")
+	AlertsSuppressed = NewCounter("etw_alerts_suppressed_total",
+		"Alerts held back by the cooldown.", "rule")
+	NotifierFailures = NewCounter("etw_notifier_failures_total",
+		"Alerts a notifier failed to deliver.", "notifier")
+)
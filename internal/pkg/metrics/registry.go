@@ -0,0 +1,272 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal implementation of the Prometheus text exposition format, enough for counters, gauges and
+// histograms with labels without pulling in the client library
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []metric
+)
+
+func register(m metric) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, m)
+}
+
+// labelled holds one value per combination of label values
+type labelled struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string][]string // series key -> label values
+}
+
+func (l *labelled) key(labelValues []string) string {
+	if len(labelValues) != len(l.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", l.name, len(l.labels), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	if _, exists := l.series[key]; !exists {
+		l.series[key] = append([]string(nil), labelValues...)
+	}
+	return key
+}
+
+// Series keys in a stable order so scrapes are diffable
+func (l *labelled) keys() []string {
+	keys := make([]string, 0, len(l.series))
+	for key := range l.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (l *labelled) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", l.name, escapeHelp(l.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", l.name, l.kind)
+}
+
+// Renders {label="value",...} with the extra pairs appended, empty when there are no labels at all
+func (l *labelled) labelString(key string, extra ...string) string {
+	var pairs []string
+	for i, value := range l.series[key] {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, l.labels[i], escapeLabel(value)))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], escapeLabel(extra[i+1])))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Counter is a monotonically increasing value per combination of label values
+type Counter struct {
+	labelled
+	values map[string]float64
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{
+		labelled: labelled{name: name, help: help, kind: "counter", labels: labels, series: make(map[string][]string)},
+		values:   make(map[string]float64),
+	}
+	// Without labels there is a single series, exposed from the start like the client libraries do
+	if len(labels) == 0 {
+		c.values[c.key(nil)] = 0
+	}
+	register(c)
+	return c
+}
+
+func (c *Counter) Inc(labelValues ...string) { c.Add(1, labelValues...) }
+
+func (c *Counter) Add(value float64, labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[c.key(labelValues)] += value
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.header(w)
+	for _, key := range c.keys() {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelString(key), formatValue(c.values[key]))
+	}
+}
+
+// Gauge is a value that can go up and down per combination of label values
+type Gauge struct {
+	labelled
+	values map[string]float64
+}
+
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{
+		labelled: labelled{name: name, help: help, kind: "gauge", labels: labels, series: make(map[string][]string)},
+		values:   make(map[string]float64),
+	}
+	if len(labels) == 0 {
+		g.values[g.key(nil)] = 0
+	}
+	register(g)
+	return g
+}
+
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.values[g.key(labelValues)] = value
+}
+
+// Sets the gauge to the current unix time, e.g. the last time an event was received
+func (g *Gauge) SetToCurrentTime(labelValues ...string) {
+	g.Set(float64(time.Now().UnixNano())/1e9, labelValues...)
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.header(w)
+	for _, key := range g.keys() {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, g.labelString(key), formatValue(g.values[key]))
+	}
+}
+
+// Histogram counts observations into cumulative buckets per combination of label values
+type Histogram struct {
+	labelled
+	buckets []float64
+	counts  map[string][]uint64 // per bucket, not cumulative
+	sums    map[string]float64
+	totals  map[string]uint64
+}
+
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		labelled: labelled{name: name, help: help, kind: "histogram", labels: labels, series: make(map[string][]string)},
+		buckets:  buckets,
+		counts:   make(map[string][]uint64),
+		sums:     make(map[string]float64),
+		totals:   make(map[string]uint64),
+	}
+	register(h)
+	return h
+}
+
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := h.key(labelValues)
+	if h.counts[key] == nil {
+		h.counts[key] = make([]uint64, len(h.buckets))
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[key][i]++
+			break
+		}
+	}
+	h.sums[key] += value
+	h.totals[key]++
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.header(w)
+	for _, key := range h.keys() {
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += h.counts[key][i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(key, "le", formatValue(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(key, "le", "+Inf"), h.totals[key])
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelString(key), formatValue(h.sums[key]))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelString(key), h.totals[key])
+	}
+}
+
+// Writes every registered metric in the Prometheus text format
+func WriteText(w io.Writer) {
+	registryMu.Lock()
+	metrics := append([]metric(nil), registry...)
+	registryMu.Unlock()
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteText(w)
+	})
+}
+
+// Serves /metrics on the address in the background, the listener is opened before returning so an address
+// already in use is reported right away
+func ListenAndServe(addr string) (*http.Server, error) {
+	listener, listenErr := net.Listen("tcp", addr)
+	if listenErr != nil {
+		return nil, fmt.Errorf("unable to listen on %s: %w", addr, listenErr)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go server.Serve(listener)
+	return server, nil
+}
+
+// Help texts escape backslashes and newlines, label values quotes as well
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
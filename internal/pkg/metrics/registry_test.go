@@ -0,0 +1,138 @@
+package metrics
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func render(m metric) string {
+	var b strings.Builder
+	m.write(&b)
+	return b.String()
+}
+
+func TestCounterText(t *testing.T) {
+	counter := NewCounter("test_requests_total", "Requests received.", "path", "code")
+	counter.Inc("/b", "200")
+	counter.Add(2.5, "/a", "500")
+	counter.Inc("/a", "500")
+	counter.Add(3, `C:\logs\"quoted"`+"\nnext", "200")
+
+	want := `# HELP test_requests_total Requests received.
+# TYPE test_requests_total counter
+test_requests_total{path="/a",code="500"} 3.5
+test_requests_total{path="/b",code="200"} 1
+test_requests_total{path="C:\\logs\\\"quoted\"\nnext",code="200"} 3
+`
+	if got := render(counter); got != want {
+		t.Errorf("rendered\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestUnlabelledText(t *testing.T) {
+	// Series without labels are exposed before anything was counted
+	counter := NewCounter("test_dropped_total", "Events dropped.")
+	gauge := NewGauge("test_queue_length", "Queue length.")
+
+	want := "# HELP test_dropped_total Events dropped.\n# TYPE test_dropped_total counter\ntest_dropped_total 0\n"
+	if got := render(counter); got != want {
+		t.Errorf("rendered\n%s\nwant\n%s", got, want)
+	}
+
+	gauge.Set(12)
+	gauge.Set(-4.25)
+	want = "# HELP test_queue_length Queue length.\n# TYPE test_queue_length gauge\ntest_queue_length -4.25\n"
+	if got := render(gauge); got != want {
+		t.Errorf("rendered\n%s\nwant\n%s", got, want)
+	}
+
+	gauge.Set(math.Inf(1))
+	if got := render(gauge); !strings.HasSuffix(got, "test_queue_length +Inf\n") {
+		t.Errorf("rendered\n%s", got)
+	}
+}
+
+func TestHelpText(t *testing.T) {
+	counter := NewCounter("test_escaped_total", `Counts \ and`+"\nnewlines.")
+	want := `# HELP test_escaped_total Counts \\ and\nnewlines.` + "\n"
+	if got := render(counter); !strings.HasPrefix(got, want) {
+		t.Errorf("rendered\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestHistogramText(t *testing.T) {
+	histogram := NewHistogram("test_duration_seconds", "Time taken.", []float64{0.1, 1, 10}, "rule")
+	for _, value := range []float64{0.05, 0.1, 0.5, 2, 20} {
+		histogram.Observe(value, "scan")
+	}
+	histogram.Observe(0.25, `rdp"`)
+
+	want := `# HELP test_duration_seconds Time taken.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{rule="rdp\"",le="0.1"} 0
+test_duration_seconds_bucket{rule="rdp\"",le="1"} 1
+test_duration_seconds_bucket{rule="rdp\"",le="10"} 1
+test_duration_seconds_bucket{rule="rdp\"",le="+Inf"} 1
+test_duration_seconds_sum{rule="rdp\""} 0.25
+test_duration_seconds_count{rule="rdp\""} 1
+test_duration_seconds_bucket{rule="scan",le="0.1"} 2
+test_duration_seconds_bucket{rule="scan",le="1"} 3
+test_duration_seconds_bucket{rule="scan",le="10"} 4
+test_duration_seconds_bucket{rule="scan",le="+Inf"} 5
+test_duration_seconds_sum{rule="scan"} 22.65
+test_duration_seconds_count{rule="scan"} 5
+`
+	if got := render(histogram); got != want {
+		t.Errorf("rendered\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestUnlabelledHistogramText(t *testing.T) {
+	histogram := NewHistogram("test_size_bytes", "Sizes.", []float64{100})
+	histogram.Observe(100)
+
+	want := `# HELP test_size_bytes Sizes.
+# TYPE test_size_bytes histogram
+test_size_bytes_bucket{le="100"} 1
+test_size_bytes_bucket{le="+Inf"} 1
+test_size_bytes_sum 100
+test_size_bytes_count 1
+`
+	if got := render(histogram); got != want {
+		t.Errorf("rendered\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestLabelValueCountPanics(t *testing.T) {
+	counter := NewCounter("test_labels_total", "Labels.", "rule")
+	defer func() {
+		if recover() == nil {
+			t.Error("no panic on a missing label value")
+		}
+	}()
+	counter.Inc()
+}
+
+func TestHandler(t *testing.T) {
+	NewCounter("test_handler_total", "Served by the handler.", "notifier").Inc("smtp")
+
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("content type %s", contentType)
+	}
+	body := recorder.Body.String()
+	for _, line := range []string{
+		"# TYPE etw_events_received_total counter\n",
+		"# TYPE etw_rule_evaluation_seconds histogram\n",
+		"\ntest_handler_total{notifier=\"smtp\"} 1\n",
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("scrape is missing %q", line)
+		}
+	}
+}
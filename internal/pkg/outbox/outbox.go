@@ -0,0 +1,92 @@
+package outbox
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Files the endpoint refused outright are moved out of the outbox, into this directory of it, for inspection
+const RejectedDir = "rejected"
+
+// PermanentError is a failure the endpoint will not recover from by retrying the same request, e.g. 400 for an
+// invalid body or 403 for a client it does not accept
+type PermanentError struct{ Err error }
+
+func (e PermanentError) Error() string { return e.Err.Error() }
+func (e PermanentError) Unwrap() error { return e.Err }
+
+func IsPermanent(err error) bool {
+	var permanent PermanentError
+	return errors.As(err, &permanent)
+}
+
+// Outbox is a directory of request bodies waiting to be posted to an endpoint. Files are named after the time
+// they were queued so the outbox sorts oldest first, and written to a temporary file first so a crash never
+// leaves a partial body behind
+type Outbox struct {
+	Dir string
+}
+
+func New(dir string) (*Outbox, error) {
+	if mkdirErr := os.MkdirAll(dir, 0755); mkdirErr != nil {
+		return nil, mkdirErr
+	}
+	return &Outbox{Dir: dir}, nil
+}
+
+// Queues the body, the suffix (e.g. an alert ID) only makes the file easier to find. Returns the file name
+func (o *Outbox) Write(suffix string, body []byte) (string, error) {
+	if suffix != "" {
+		suffix = "-" + suffix
+	}
+	fileName := filepath.Join(o.Dir, fmt.Sprintf("%020d%s.json", time.Now().UnixNano(), suffix))
+
+	tmpFile := fileName + ".tmp"
+	if writeErr := os.WriteFile(tmpFile, body, 0600); writeErr != nil {
+		return "", writeErr
+	}
+	if renameErr := os.Rename(tmpFile, fileName); renameErr != nil {
+		os.Remove(tmpFile)
+		return "", renameErr
+	}
+
+	return fileName, nil
+}
+
+// Returns the queued files, oldest first
+func (o *Outbox) Pending() ([]string, error) {
+	fileNames, globErr := filepath.Glob(filepath.Join(o.Dir, "*.json"))
+	if globErr != nil {
+		return nil, globErr
+	}
+
+	sort.Strings(fileNames)
+	return fileNames, nil
+}
+
+// Moves a queued file to the rejected directory, returns its new name
+func (o *Outbox) Reject(fileName string) (string, error) {
+	rejectedFile := filepath.Join(o.Dir, RejectedDir, filepath.Base(fileName))
+	if mkdirErr := os.MkdirAll(filepath.Dir(rejectedFile), 0755); mkdirErr != nil {
+		return rejectedFile, mkdirErr
+	}
+	return rejectedFile, os.Rename(fileName, rejectedFile)
+}
+
+// Classifies the response to a post, the endpoint names it in the error. 408, 429 and 5xx are worth retrying,
+// any other response but 2xx is a PermanentError
+func CheckResponse(endpoint string, response *http.Response) error {
+	switch {
+	case response.StatusCode >= 200 && response.StatusCode <= 299:
+		return nil
+	case response.StatusCode == http.StatusRequestTimeout || response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500:
+		return fmt.Errorf("%s responded with %s", endpoint, response.Status)
+	default:
+		return PermanentError{fmt.Errorf("%s responded with %s", endpoint, response.Status)}
+	}
+}
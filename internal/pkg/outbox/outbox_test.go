@@ -0,0 +1,86 @@
+package outbox
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckResponse(t *testing.T) {
+	tests := []struct {
+		status    int
+		err       bool
+		permanent bool
+	}{
+		{http.StatusOK, false, false},
+		{http.StatusAccepted, false, false},
+		{http.StatusNoContent, false, false},
+		{http.StatusRequestTimeout, true, false},
+		{http.StatusTooManyRequests, true, false},
+		{http.StatusInternalServerError, true, false},
+		{http.StatusServiceUnavailable, true, false},
+		{http.StatusBadRequest, true, true},
+		{http.StatusUnauthorized, true, true},
+		{http.StatusForbidden, true, true},
+		{http.StatusRequestEntityTooLarge, true, true},
+		{http.StatusFound, true, true},
+	}
+
+	for _, test := range tests {
+		response := &http.Response{StatusCode: test.status, Status: http.StatusText(test.status)}
+		checkErr := CheckResponse("collector", response)
+		if (checkErr != nil) != test.err || IsPermanent(checkErr) != test.permanent {
+			t.Errorf("%d: error %v, permanent %t, want error %t, permanent %t", test.status, checkErr, IsPermanent(checkErr), test.err, test.permanent)
+		}
+		if checkErr != nil && !strings.HasPrefix(checkErr.Error(), "collector responded with") {
+			t.Errorf("%d: error %v does not name the endpoint", test.status, checkErr)
+		}
+	}
+}
+
+func TestOutboxOrderAndReject(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "outbox")
+	queue, newErr := New(dir)
+	if newErr != nil {
+		t.Fatal(newErr)
+	}
+
+	var written []string
+	for _, suffix := range []string{"a1", "", "a3"} {
+		fileName, writeErr := queue.Write(suffix, []byte(`{"id":"`+suffix+`"}`))
+		if writeErr != nil {
+			t.Fatal(writeErr)
+		}
+		written = append(written, fileName)
+	}
+	if !strings.HasSuffix(written[0], "-a1.json") || strings.Contains(filepath.Base(written[1]), "-") {
+		t.Errorf("written %q", written)
+	}
+
+	pending, pendingErr := queue.Pending()
+	if pendingErr != nil {
+		t.Fatal(pendingErr)
+	}
+	if strings.Join(pending, ",") != strings.Join(written, ",") {
+		t.Fatalf("pending %q, want %q", pending, written)
+	}
+	if tmpFiles, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(tmpFiles) != 0 {
+		t.Errorf("temporary files left %q", tmpFiles)
+	}
+
+	rejectedFile, rejectErr := queue.Reject(written[0])
+	if rejectErr != nil {
+		t.Fatal(rejectErr)
+	}
+	if rejectedFile != filepath.Join(dir, RejectedDir, filepath.Base(written[0])) {
+		t.Errorf("rejected to %s", rejectedFile)
+	}
+	if body, readErr := os.ReadFile(rejectedFile); readErr != nil || string(body) != `{"id":"a1"}` {
+		t.Errorf("rejected file %q, %v", body, readErr)
+	}
+	if pending, _ := queue.Pending(); len(pending) != 2 || pending[0] != written[1] {
+		t.Errorf("pending %q after the rejection", pending)
+	}
+}
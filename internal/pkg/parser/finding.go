@@ -0,0 +1,65 @@
+package parser
+
+import (
+	"sort"
+	"time"
+
+	alert "github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/alerting"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/eventfield"
+)
+
+// Findings keep a handful of the contributing entries, enough to investigate without bloating alerts
+const maxFindingEvidence = 10
+
+// Finding is a single offender reported by a rule, every finding crossing the alert threshold is alerted
+type Finding struct {
+	Source    string
+	Count     int
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Evidence  []alert.Evidence // e.g. the connections to each scanned port or the failed attempts
+	Message   string           // human readable description, set by the rule
+}
+
+// Widens the seen interval of the finding to include t
+func (f *Finding) Observe(t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	if f.FirstSeen.IsZero() || t.Before(f.FirstSeen) {
+		f.FirstSeen = t
+	}
+	if t.After(f.LastSeen) {
+		f.LastSeen = t
+	}
+}
+
+// References the entry as evidence of the finding, until the finding holds maxFindingEvidence entries
+func (f *Finding) AddEvidence(entry LogEntry) {
+	if len(f.Evidence) >= maxFindingEvidence {
+		return
+	}
+
+	evidence := alert.Evidence{
+		Time:    entry.Time,
+		EventID: entry.EventID,
+		Fields:  make(map[string]string, len(entry.Fields)),
+	}
+	for field, value := range entry.Fields {
+		evidence.Fields[field] = eventfield.String(value)
+	}
+	evidence.ActivityID = evidence.Fields["ActivityID"]
+	delete(evidence.Fields, "ActivityID")
+
+	f.Evidence = append(f.Evidence, evidence)
+}
+
+// Orders findings by count, highest first, ties are ordered by source so results are stable between passes
+func sortFindings(findings []Finding) {
+	sort.SliceStable(findings, func(i, j int) bool {
+		if findings[i].Count != findings[j].Count {
+			return findings[i].Count > findings[j].Count
+		}
+		return findings[i].Source < findings[j].Source
+	})
+}
@@ -0,0 +1,176 @@
+package parser
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Fleet rules span the hosts of the collector, entries without a Host field (a standalone instance) all
+// belong to the local host so fleet rules never see more than one host there
+
+// Messages list the first few hosts, the evidence holds the rest
+const maxMessageHosts = 5
+
+type FleetScanParams struct {
+	PortsOfInterest []uint16 `yaml:"ports_of_interest"` // only count these local ports, all ports if empty
+}
+
+type FleetRDPBruteForceParams struct {
+	ReasonCodes        []int64 `yaml:"reason_codes"`
+	MinAttemptsPerHost int     `yaml:"min_attempts_per_host"` // hosts with fewer failed attempts from the source are not counted
+}
+
+type PasswordSprayParams struct {
+	ReasonCodes        []int64 `yaml:"reason_codes"`
+	MaxAttemptsPerHost int     `yaml:"max_attempts_per_host"` // a spray stays low on each host, more is a brute force
+}
+
+func entriesByHost(le LogEntries) map[string]LogEntries {
+	hosts := make(map[string]LogEntries)
+	for _, entry := range le.Entries {
+		host, _ := entry.Text("Host")
+		hostEntries := hosts[host]
+		hostEntries.Insert(entry)
+		hosts[host] = hostEntries
+	}
+
+	return hosts
+}
+
+func rule_FleetHorizontalScan(le LogEntries, params FleetScanParams) []Finding {
+	// the same remote IP connecting to the same local port on many hosts, each host may only see a port or two
+	// so scan_detection stays silent locally. The count of a source is the number of hosts of its widest port
+	type sourcePort struct {
+		ip   string
+		port int64
+	}
+	var hosts = make(map[sourcePort]map[string]bool)
+	var scans = make(map[sourcePort]*Finding)
+
+	for _, entry := range le.Entries {
+		port, portOk := entry.Int("LocalSockAddr_PORT")
+		ip, ipOk := entry.Text("RemoteSockAddr_IP")
+		if !portOk || !ipOk {
+			continue
+		}
+		if len(params.PortsOfInterest) > 0 && !containsPort(params.PortsOfInterest, port) {
+			continue
+		}
+		host, _ := entry.Text("Host")
+
+		key := sourcePort{ip: ip, port: port}
+		finding, exists := scans[key]
+		if !exists {
+			finding = &Finding{Source: ip}
+			scans[key] = finding
+			hosts[key] = make(map[string]bool)
+		}
+		finding.Observe(entry.Time)
+
+		if !hosts[key][host] {
+			hosts[key][host] = true
+			finding.Count++
+			finding.AddEvidence(entry)
+		}
+	}
+
+	widest := make(map[string]sourcePort)
+	for key, finding := range scans {
+		current, exists := widest[key.ip]
+		if !exists || finding.Count > scans[current].Count || (finding.Count == scans[current].Count && key.port < current.port) {
+			widest[key.ip] = key
+		}
+	}
+
+	var findings []Finding
+	for ip, key := range widest {
+		finding := *scans[key]
+		finding.Message = fmt.Sprintf("%s is scanning port %d across %d hosts (%s)", ip, key.port, finding.Count, formatHosts(hosts[key]))
+		findings = append(findings, finding)
+	}
+
+	sortFindings(findings)
+	return findings
+}
+
+func rule_FleetRDPBruteForce(le LogEntries, params FleetRDPBruteForceParams) []Finding {
+	// the same source failing RDP logons on several hosts, correlated per host like rdp_brute_force
+	findings, hosts := fleetRDPFailures(le, params.ReasonCodes, func(attempts int) bool {
+		return attempts >= params.MinAttemptsPerHost
+	})
+
+	for i := range findings {
+		findings[i].Message = fmt.Sprintf("%s is RDP Brute Forcing %d hosts (%s)", findings[i].Source, findings[i].Count, formatHosts(hosts[findings[i].Source]))
+	}
+	return findings
+}
+
+func rule_PasswordSpray(le LogEntries, params PasswordSprayParams) []Finding {
+	// the same source failing a few RDP logons on each of many hosts, staying below the brute force
+	// threshold of every single host
+	findings, hosts := fleetRDPFailures(le, params.ReasonCodes, func(attempts int) bool {
+		return params.MaxAttemptsPerHost <= 0 || attempts <= params.MaxAttemptsPerHost
+	})
+
+	for i := range findings {
+		findings[i].Message = fmt.Sprintf("%s is password spraying RDP across %d hosts (%s)", findings[i].Source, findings[i].Count, formatHosts(hosts[findings[i].Source]))
+	}
+	return findings
+}
+
+// Runs the rdp_brute_force correlation on every host and groups the sources across hosts. The count of a
+// finding is the number of hosts whose failed attempts satisfy counted, the hosts are returned per source
+func fleetRDPFailures(le LogEntries, reasonCodes []int64, counted func(attempts int) bool) ([]Finding, map[string]map[string]bool) {
+	var hosts = make(map[string]map[string]bool)
+	var sources = make(map[string]*Finding)
+
+	for host, hostEntries := range entriesByHost(le) {
+		for _, hostFinding := range rule_RDPBruteForce(hostEntries, RDPBruteForceParams{ReasonCodes: reasonCodes}) {
+			if !counted(hostFinding.Count) {
+				continue
+			}
+
+			finding, exists := sources[hostFinding.Source]
+			if !exists {
+				finding = &Finding{Source: hostFinding.Source}
+				sources[hostFinding.Source] = finding
+				hosts[hostFinding.Source] = make(map[string]bool)
+			}
+
+			hosts[hostFinding.Source][host] = true
+			finding.Count++
+			finding.Observe(hostFinding.FirstSeen)
+			finding.Observe(hostFinding.LastSeen)
+			for _, evidence := range hostFinding.Evidence {
+				if len(finding.Evidence) < maxFindingEvidence {
+					finding.Evidence = append(finding.Evidence, evidence)
+				}
+			}
+		}
+	}
+
+	var findings []Finding
+	for _, finding := range sources {
+		findings = append(findings, *finding)
+	}
+
+	sortFindings(findings)
+	return findings, hosts
+}
+
+func formatHosts(hosts map[string]bool) string {
+	names := make([]string, 0, len(hosts))
+	for host := range hosts {
+		if host == "" {
+			host = "local"
+		}
+		names = append(names, host)
+	}
+	sort.Strings(names)
+
+	if len(names) > maxMessageHosts {
+		return fmt.Sprintf("%s and %d more", strings.Join(names[:maxMessageHosts], ", "), len(names)-maxMessageHosts)
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,308 @@
+package parser
+
+import (
+	"fmt"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fleetTestLog builds the events agents forward, one second apart
+type fleetTestLog struct {
+	le       LogEntries
+	start    time.Time
+	activity int
+}
+
+func newFleetTestLog() *fleetTestLog {
+	return &fleetTestLog{start: time.Now().Add(-time.Hour)}
+}
+
+func (l *fleetTestLog) add(eventID int, host string, fields map[string]interface{}) {
+	if host != "" {
+		fields["Host"] = host
+	}
+	l.le.Insert(LogEntry{Time: l.start.Add(time.Duration(len(l.le.Entries)) * time.Second), EventID: eventID, Fields: fields})
+}
+
+func (l *fleetTestLog) connect(host, source string, ports ...uint16) {
+	for _, port := range ports {
+		l.add(1017, host, map[string]interface{}{"RemoteSockAddr_IP": netip.MustParseAddr(source), "LocalSockAddr_PORT": port})
+	}
+}
+
+// Failed RDP logons, a 131 connection followed by a 103 disconnect with the reason code of the same activity
+func (l *fleetTestLog) failRDP(host, source string, attempts int, reasonCode int64) {
+	for i := 0; i < attempts; i++ {
+		l.activity++
+		activityID := fmt.Sprintf("{%08d-0000-0000-0000-000000000000}", l.activity)
+		l.add(131, host, map[string]interface{}{"ClientIP_IP": netip.MustParseAddr(source), "ActivityID": activityID})
+		l.add(103, host, map[string]interface{}{"ReasonCode": reasonCode, "ActivityID": activityID})
+	}
+}
+
+type fleetResult struct {
+	Source  string
+	Count   int
+	Message string
+}
+
+func fleetResults(findings []Finding) []fleetResult {
+	var results []fleetResult
+	for _, finding := range findings {
+		results = append(results, fleetResult{Source: finding.Source, Count: finding.Count, Message: finding.Message})
+	}
+	return results
+}
+
+func TestEntriesByHost(t *testing.T) {
+	events := newFleetTestLog()
+	events.connect("web01", "10.0.0.9", 22)
+	events.connect("db01", "10.0.0.9", 1433)
+	events.connect("", "10.0.0.9", 3389)
+	events.connect("web01", "10.0.0.10", 80)
+
+	hosts := entriesByHost(events.le)
+	want := map[string][]int64{"web01": {22, 80}, "db01": {1433}, "": {3389}}
+	if len(hosts) != len(want) {
+		t.Fatalf("%d hosts, want %d", len(hosts), len(want))
+	}
+	for host, ports := range want {
+		var got []int64
+		for _, entry := range hosts[host].Entries {
+			port, _ := entry.Int("LocalSockAddr_PORT")
+			got = append(got, port)
+		}
+		if !reflect.DeepEqual(got, ports) {
+			t.Errorf("host %q has ports %v, want %v", host, got, ports)
+		}
+	}
+}
+
+func TestFleetHorizontalScan(t *testing.T) {
+	tests := []struct {
+		name   string
+		params FleetScanParams
+		events func(events *fleetTestLog)
+		want   []fleetResult
+	}{
+		{
+			name: "single host",
+			events: func(events *fleetTestLog) {
+				events.connect("web01", "10.0.0.9", 22, 80, 443, 3389)
+			},
+			want: []fleetResult{{"10.0.0.9", 1, "10.0.0.9 is scanning port 22 across 1 hosts (web01)"}},
+		},
+		{
+			name: "below threshold",
+			events: func(events *fleetTestLog) {
+				for _, host := range []string{"web01", "web02", "db01"} {
+					events.connect(host, "10.0.0.9", 3389, 3389)
+				}
+			},
+			want: []fleetResult{{"10.0.0.9", 3, "10.0.0.9 is scanning port 3389 across 3 hosts (db01, web01, web02)"}},
+		},
+		{
+			name: "above threshold",
+			events: func(events *fleetTestLog) {
+				for i := 1; i <= 7; i++ {
+					events.connect(fmt.Sprintf("ws%02d", i), "10.0.0.9", 445)
+				}
+			},
+			want: []fleetResult{{"10.0.0.9", 7, "10.0.0.9 is scanning port 445 across 7 hosts (ws01, ws02, ws03, ws04, ws05 and 2 more)"}},
+		},
+		{
+			name: "mixed hosts",
+			events: func(events *fleetTestLog) {
+				// The widest port of a source counts, another source only reaching a host or two stays low
+				events.connect("web01", "10.0.0.9", 22, 445)
+				events.connect("web02", "10.0.0.9", 445)
+				events.connect("db01", "10.0.0.9", 22, 445)
+				events.connect("", "10.0.0.9", 445)
+				events.connect("web01", "10.0.0.10", 443)
+				events.connect("web02", "10.0.0.10", 443)
+			},
+			want: []fleetResult{
+				{"10.0.0.9", 4, "10.0.0.9 is scanning port 445 across 4 hosts (db01, local, web01, web02)"},
+				{"10.0.0.10", 2, "10.0.0.10 is scanning port 443 across 2 hosts (web01, web02)"},
+			},
+		},
+		{
+			name:   "ports of interest",
+			params: FleetScanParams{PortsOfInterest: []uint16{3389}},
+			events: func(events *fleetTestLog) {
+				for _, host := range []string{"web01", "web02", "db01"} {
+					events.connect(host, "10.0.0.9", 445)
+				}
+				events.connect("web01", "10.0.0.9", 3389)
+			},
+			want: []fleetResult{{"10.0.0.9", 1, "10.0.0.9 is scanning port 3389 across 1 hosts (web01)"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			events := newFleetTestLog()
+			test.events(events)
+
+			if got := fleetResults(rule_FleetHorizontalScan(events.le, test.params)); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("findings %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFleetRDPBruteForce(t *testing.T) {
+	params := FleetRDPBruteForceParams{ReasonCodes: []int64{14}, MinAttemptsPerHost: 3}
+	tests := []struct {
+		name   string
+		events func(events *fleetTestLog)
+		want   []fleetResult
+	}{
+		{
+			name: "single host",
+			events: func(events *fleetTestLog) {
+				events.failRDP("web01", "10.0.0.9", 20, 14)
+			},
+			want: []fleetResult{{"10.0.0.9", 1, "10.0.0.9 is RDP Brute Forcing 1 hosts (web01)"}},
+		},
+		{
+			name: "below the attempts of a host",
+			events: func(events *fleetTestLog) {
+				for _, host := range []string{"web01", "web02", "db01"} {
+					events.failRDP(host, "10.0.0.9", 2, 14)
+				}
+			},
+		},
+		{
+			name: "above the attempts of a host",
+			events: func(events *fleetTestLog) {
+				for _, host := range []string{"web01", "web02", "db01"} {
+					events.failRDP(host, "10.0.0.9", 3, 14)
+				}
+			},
+			want: []fleetResult{{"10.0.0.9", 3, "10.0.0.9 is RDP Brute Forcing 3 hosts (db01, web01, web02)"}},
+		},
+		{
+			name: "mixed hosts",
+			events: func(events *fleetTestLog) {
+				// Hosts below the attempts and other reason codes are not counted, local entries are a host
+				events.failRDP("web01", "10.0.0.9", 5, 14)
+				events.failRDP("web02", "10.0.0.9", 2, 14)
+				events.failRDP("db01", "10.0.0.9", 4, 14)
+				events.failRDP("db02", "10.0.0.9", 4, 2)
+				events.failRDP("", "10.0.0.9", 3, 14)
+				events.failRDP("web02", "10.0.0.10", 6, 14)
+			},
+			want: []fleetResult{
+				{"10.0.0.9", 3, "10.0.0.9 is RDP Brute Forcing 3 hosts (db01, local, web01)"},
+				{"10.0.0.10", 1, "10.0.0.10 is RDP Brute Forcing 1 hosts (web02)"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			events := newFleetTestLog()
+			test.events(events)
+
+			if got := fleetResults(rule_FleetRDPBruteForce(events.le, params)); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("findings %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPasswordSpray(t *testing.T) {
+	params := PasswordSprayParams{ReasonCodes: []int64{14}, MaxAttemptsPerHost: 2}
+	tests := []struct {
+		name   string
+		events func(events *fleetTestLog)
+		want   []fleetResult
+	}{
+		{
+			name: "single host",
+			events: func(events *fleetTestLog) {
+				events.failRDP("web01", "10.0.0.9", 2, 14)
+			},
+			want: []fleetResult{{"10.0.0.9", 1, "10.0.0.9 is password spraying RDP across 1 hosts (web01)"}},
+		},
+		{
+			name: "below the attempts of a host",
+			events: func(events *fleetTestLog) {
+				for i := 1; i <= 6; i++ {
+					events.failRDP(fmt.Sprintf("ws%02d", i), "10.0.0.9", 1+i%2, 14)
+				}
+			},
+			want: []fleetResult{{"10.0.0.9", 6, "10.0.0.9 is password spraying RDP across 6 hosts (ws01, ws02, ws03, ws04, ws05 and 1 more)"}},
+		},
+		{
+			name: "above the attempts of a host",
+			events: func(events *fleetTestLog) {
+				// A brute force on every host is not a spray
+				for _, host := range []string{"web01", "web02", "db01"} {
+					events.failRDP(host, "10.0.0.9", 3, 14)
+				}
+			},
+		},
+		{
+			name: "mixed hosts",
+			events: func(events *fleetTestLog) {
+				events.failRDP("web01", "10.0.0.9", 1, 14)
+				events.failRDP("web02", "10.0.0.9", 2, 14)
+				events.failRDP("db01", "10.0.0.9", 5, 14)
+				events.failRDP("db02", "10.0.0.9", 1, 2)
+				events.failRDP("", "10.0.0.9", 1, 14)
+				events.failRDP("web01", "10.0.0.10", 1, 14)
+			},
+			want: []fleetResult{
+				{"10.0.0.9", 3, "10.0.0.9 is password spraying RDP across 3 hosts (local, web01, web02)"},
+				{"10.0.0.10", 1, "10.0.0.10 is password spraying RDP across 1 hosts (web01)"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			events := newFleetTestLog()
+			test.events(events)
+
+			if got := fleetResults(rule_PasswordSpray(events.le, params)); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("findings %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFleetRDPFailures(t *testing.T) {
+	events := newFleetTestLog()
+	events.failRDP("web01", "10.0.0.9", 4, 14)
+	events.failRDP("web02", "10.0.0.9", 1, 14)
+	events.failRDP("web02", "10.0.0.10", 2, 14)
+
+	// Every host with failures is counted, the evidence holds the failed attempts of every host up to the cap
+	findings, hosts := fleetRDPFailures(events.le, []int64{14}, func(int) bool { return true })
+	if got := fleetResults(findings); !reflect.DeepEqual(got, []fleetResult{{"10.0.0.9", 2, ""}, {"10.0.0.10", 1, ""}}) {
+		t.Fatalf("findings %+v", got)
+	}
+	if !reflect.DeepEqual(hosts, map[string]map[string]bool{"10.0.0.9": {"web01": true, "web02": true}, "10.0.0.10": {"web02": true}}) {
+		t.Errorf("hosts %v", hosts)
+	}
+	if evidence := len(findings[0].Evidence); evidence != 5 {
+		t.Errorf("%d evidence entries, want 5", evidence)
+	}
+	if !findings[0].FirstSeen.Equal(events.le.Entries[1].Time) || !findings[0].LastSeen.Equal(events.le.Entries[9].Time) {
+		t.Errorf("seen %s to %s", findings[0].FirstSeen, findings[0].LastSeen)
+	}
+
+	// The attempts of a host decide whether it is counted
+	findings, _ = fleetRDPFailures(events.le, []int64{14}, func(attempts int) bool { return attempts >= 2 })
+	if got := fleetResults(findings); !reflect.DeepEqual(got, []fleetResult{{"10.0.0.10", 1, ""}, {"10.0.0.9", 1, ""}}) {
+		t.Errorf("findings %+v", got)
+	}
+	findings, _ = fleetRDPFailures(events.le, []int64{2}, func(int) bool { return true })
+	if len(findings) != 0 {
+		t.Errorf("findings %+v for another reason code", fleetResults(findings))
+	}
+}
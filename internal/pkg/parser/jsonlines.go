@@ -0,0 +1,45 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/eventfield"
+	hook "github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/logger"
+)
+
+// Decodes a line of a JSON Lines provider log, see hook.JSONFormatter
+func processJSONLine(line string) (LogEntry, error) {
+	var record hook.JSONRecord
+
+	// Numbers are kept as written, e.g. a reason code 14 is not turned into 14.0
+	decoder := json.NewDecoder(strings.NewReader(line))
+	decoder.UseNumber()
+	if decodeErr := decoder.Decode(&record); decodeErr != nil {
+		return LogEntry{}, fmt.Errorf("could not decode JSON log line: %w", decodeErr)
+	}
+	if record.Time.IsZero() {
+		return LogEntry{}, fmt.Errorf("JSON log line has no time, skipping log line")
+	}
+
+	// The provider is a field of the entries read from the text format and the bus too
+	entry := LogEntry{
+		Time:    record.Time,
+		EventID: record.EventID,
+		Fields:  typedFields(record.Fields),
+	}
+	entry.Fields["provider"] = record.Provider
+
+	return entry, nil
+}
+
+// Rules see the same typed values whatever format or source the event came from, values read back from a log
+// or received from an agent are typed again as they were at capture
+func typedFields(fields map[string]interface{}) map[string]interface{} {
+	values := make(map[string]interface{}, len(fields))
+	for key, value := range fields {
+		values[key] = eventfield.Typed(key, value)
+	}
+	return values
+}
@@ -0,0 +1,121 @@
+package parser
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/eventfield"
+	hook "github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/logger"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestJSONLinesRoundTrip(t *testing.T) {
+	received := time.Date(2026, 10, 17, 9, 30, 15, 123456789, time.UTC)
+	raised := received.Add(-1500 * time.Millisecond)
+
+	// Typed as the session types the fields it logs
+	entry := hook.WithEvent(log.WithFields(log.Fields{
+		"provider":           "Microsoft-Windows-TCPIP",
+		"RemoteSockAddr_IP":  netip.MustParseAddr("fe80::1"),
+		"LocalSockAddr_PORT": uint16(3389),
+		"ReasonCode":         int64(14),
+		"Offset":             int64(-42),
+		"Sequence":           uint64(math.MaxUint64),
+		"ActivityID":         eventfield.GUID("{6F1B4C2A-0000-0000-0000-3A9D1E7C5B10}"),
+		"LogonTime":          eventfield.Timestamp{Time: raised},
+		"UserName":           `CORP\alice "admin"`,
+		"Ratio":              0.5,
+		"Error":              errors.New("access denied"),
+	}), hook.EventMeta{ID: 1017, Time: raised})
+	entry.Time = received
+	entry.Message = "Event ID: 1017"
+
+	line, formatErr := hook.JSONFormatter{}.Format(entry)
+	if formatErr != nil {
+		t.Fatal(formatErr)
+	}
+	if !strings.HasSuffix(string(line), "}\n") || strings.Count(string(line), "\n") != 1 {
+		t.Fatalf("not a JSON line: %q", line)
+	}
+
+	// The record keeps when the provider raised the event next to when it was received
+	var record hook.JSONRecord
+	if unmarshalErr := json.Unmarshal(line, &record); unmarshalErr != nil {
+		t.Fatal(unmarshalErr)
+	}
+	if record.EventTime == nil || !record.EventTime.Equal(raised) || !record.Time.Equal(received) {
+		t.Errorf("time %s, event time %v", record.Time, record.EventTime)
+	}
+	if record.Provider != "Microsoft-Windows-TCPIP" || record.EventID != 1017 || record.Message != "Event ID: 1017" {
+		t.Errorf("record %+v", record)
+	}
+	if _, exists := record.Fields["provider"]; exists {
+		t.Error("provider written as a field too")
+	}
+
+	// Rules window on the receive time, like the text format and the bus, and see the values typed as captured
+	parsed, parseErr := processJSONLine(strings.TrimSuffix(string(line), "\n"))
+	if parseErr != nil {
+		t.Fatal(parseErr)
+	}
+	if !parsed.Time.Equal(received) || parsed.EventID != 1017 {
+		t.Errorf("parsed time %s, event id %d", parsed.Time, parsed.EventID)
+	}
+	want := map[string]interface{}{
+		"provider":           "Microsoft-Windows-TCPIP",
+		"RemoteSockAddr_IP":  netip.MustParseAddr("fe80::1"),
+		"LocalSockAddr_PORT": uint16(3389),
+		"ReasonCode":         int64(14),
+		"Offset":             int64(-42),
+		"Sequence":           uint64(math.MaxUint64),
+		"ActivityID":         eventfield.GUID("{6F1B4C2A-0000-0000-0000-3A9D1E7C5B10}"),
+		"LogonTime":          eventfield.Timestamp{Time: raised},
+		"UserName":           `CORP\alice "admin"`,
+		"Ratio":              0.5,
+		"Error":              "access denied",
+	}
+	for field, value := range want {
+		if got := parsed.Fields[field]; !reflect.DeepEqual(got, value) {
+			t.Errorf("%s is %#v (%T), want %#v (%T)", field, got, got, value, value)
+		}
+	}
+	if len(parsed.Fields) != len(want) {
+		t.Errorf("parsed %d fields, want %d: %v", len(parsed.Fields), len(want), parsed.Fields)
+	}
+}
+
+func TestJSONLinesWithoutEventTime(t *testing.T) {
+	// Entries logged without event metadata, e.g. by an older version, have no event_time or event_id
+	entry := log.WithField("provider", "Microsoft-Windows-TCPIP")
+	entry.Time = time.Now()
+	entry.Message = "Event ID: 1017"
+
+	line, formatErr := hook.JSONFormatter{}.Format(entry)
+	if formatErr != nil {
+		t.Fatal(formatErr)
+	}
+	if strings.Contains(string(line), "event_time") {
+		t.Errorf("wrote an event time: %s", line)
+	}
+
+	parsed, parseErr := processJSONLine(strings.TrimSpace(string(line)))
+	if parseErr != nil {
+		t.Fatal(parseErr)
+	}
+	if !parsed.Time.Equal(entry.Time) || parsed.EventID != 0 {
+		t.Errorf("parsed %+v", parsed)
+	}
+
+	if _, noTimeErr := processJSONLine(`{"provider":"Microsoft-Windows-TCPIP","event_id":1017,"fields":{}}`); noTimeErr == nil {
+		t.Error("parsed a line without a time")
+	}
+	if _, malformedErr := processJSONLine(`{"time":`); malformedErr == nil {
+		t.Error("parsed a truncated line")
+	}
+}
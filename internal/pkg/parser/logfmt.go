@@ -0,0 +1,100 @@
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// logfmtDecoder walks the key=value pairs of a line written by the logrus TextFormatter. Values are either
+// bare (up to the next space, possibly empty) or Go quoted strings as written with %q, keys and bare values
+// are slices of the line so only quoted values with escapes allocate
+type logfmtDecoder struct {
+	line  string
+	pos   int
+	key   string
+	value string
+	err   error
+}
+
+func newLogfmtDecoder(line string) *logfmtDecoder {
+	return &logfmtDecoder{line: line}
+}
+
+// Advances to the next pair, false at the end of the line or on a malformed value
+func (d *logfmtDecoder) Next() bool {
+	if d.err != nil {
+		return false
+	}
+
+	for d.pos < len(d.line) && d.line[d.pos] == ' ' {
+		d.pos++
+	}
+	if d.pos >= len(d.line) {
+		return false
+	}
+
+	// A key without = is a flag with no value
+	start := d.pos
+	for d.pos < len(d.line) && d.line[d.pos] != '=' && d.line[d.pos] != ' ' {
+		d.pos++
+	}
+	d.key = d.line[start:d.pos]
+	d.value = ""
+	if d.pos >= len(d.line) || d.line[d.pos] == ' ' {
+		return true
+	}
+	d.pos++ // =
+
+	if d.pos < len(d.line) && d.line[d.pos] == '"' {
+		return d.quoted()
+	}
+
+	start = d.pos
+	for d.pos < len(d.line) && d.line[d.pos] != ' ' {
+		d.pos++
+	}
+	d.value = d.line[start:d.pos]
+	return true
+}
+
+func (d *logfmtDecoder) quoted() bool {
+	start := d.pos
+	escaped := false
+	for d.pos++; d.pos < len(d.line); d.pos++ {
+		switch d.line[d.pos] {
+		case '\\':
+			escaped = true
+			d.pos++ // the escaped character can't close the value
+		case '"':
+			d.pos++
+			if !escaped {
+				d.value = d.line[start+1 : d.pos-1]
+				return true
+			}
+
+			value, unquoteErr := strconv.Unquote(d.line[start:d.pos])
+			if unquoteErr != nil {
+				d.err = fmt.Errorf("invalid quoted value for %s: %w", d.key, unquoteErr)
+				return false
+			}
+			d.value = value
+			return true
+		}
+	}
+
+	d.err = fmt.Errorf("unterminated quoted value for %s", d.key)
+	return false
+}
+
+func (d *logfmtDecoder) Key() string   { return d.key }
+func (d *logfmtDecoder) Value() string { return d.value }
+func (d *logfmtDecoder) Err() error    { return d.err }
+
+// The TextFormatter renames fields clashing with its own keys (time, msg, level...) to fields.<key>
+func logfmtFieldKey(key string) string {
+	if field, ok := strings.CutPrefix(key, "fields."); ok {
+		return field
+	}
+	return key
+}
@@ -0,0 +1,170 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/netip"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/eventfield"
+	log "github.com/sirupsen/logrus"
+)
+
+// Formats the fields as a provider log line, the way the session writes them with the default formatter
+func formatLogLine(t testing.TB, eventID int, fields log.Fields) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	logger := log.New()
+	logger.Out = &buf
+	logger.Formatter = &log.TextFormatter{}
+	logger.WithFields(fields).Infof("Event ID: %d", eventID)
+
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+func FuzzLogfmtRoundTrip(f *testing.F) {
+	f.Add("DOMAIN\\user", "10.0.0.9:3389", "plain", uint16(1149), []byte{10, 0, 0, 9}, uint16(3389), int64(14), []byte("guid"))
+	f.Add(`"; Remove-Item C:\ #`, `$(calc) a=b`, "", uint16(4625), []byte{0xfe, 0x80, 15: 1}, uint16(0), int64(-1), []byte{})
+	f.Add("tab\there", "new\nline", "`backtick`", uint16(0), []byte{10: 0xff, 11: 0xff, 192, 168, 1, 5}, uint16(65535), int64(math.MaxInt64), []byte{0xff, 15: 0xff})
+	f.Add("quote\"inside", "\x00\xff invalid", "=", uint16(65535), []byte{}, uint16(1), int64(math.MinInt64), []byte{1, 2, 3})
+	f.Add("", " ", "Event ID: 7", uint16(21), []byte{0, 0, 0, 0}, uint16(80), int64(0), []byte{0x6f, 0x1b, 0x4c, 0x2a})
+
+	f.Fuzz(func(t *testing.T, user, address, clashing string, eventID uint16, ip []byte, port uint16, offset int64, guid []byte) {
+		// Typed like the session types the fields it logs, up to 4 bytes are an IPv4 address
+		var addr netip.Addr
+		if len(ip) <= 4 {
+			var raw [4]byte
+			copy(raw[:], ip)
+			addr = netip.AddrFrom4(raw)
+		} else {
+			var raw [16]byte
+			copy(raw[:], ip)
+			addr = netip.AddrFrom16(raw)
+		}
+		var rawGUID [16]byte
+		copy(rawGUID[:], guid)
+		activityID := eventfield.GUID(fmt.Sprintf("{%08X-%04X-%04X-%04X-%012X}", binary.BigEndian.Uint32(rawGUID[0:4]),
+			binary.BigEndian.Uint16(rawGUID[4:6]), binary.BigEndian.Uint16(rawGUID[6:8]), binary.BigEndian.Uint16(rawGUID[8:10]), rawGUID[10:16]))
+		typed := log.Fields{"ClientIP_IP": addr, "LocalSockAddr_PORT": port, "Offset": offset, "ActivityID": activityID}
+
+		// msg clashes with the key of the formatter and is written as fields.msg
+		fields := log.Fields{"User": user, "Address": address, "msg": clashing}
+		logged := log.Fields{}
+		for key, value := range fields {
+			logged[key] = value
+		}
+		for key, value := range typed {
+			logged[key] = value
+		}
+		line := formatLogLine(t, int(eventID), logged)
+
+		var le LogEntries
+		entry, processErr := le.processLogLine(line)
+		if processErr != nil {
+			t.Fatalf("%s: %v", line, processErr)
+		}
+		if entry.EventID != int(eventID) {
+			t.Errorf("%s: event id %d, want %d", line, entry.EventID, eventID)
+		}
+		if entry.Time.IsZero() {
+			t.Errorf("%s: no time", line)
+		}
+
+		for key, value := range fields {
+			got, ok := entry.Fields[key]
+			if !ok {
+				t.Errorf("%s: missing %s", line, key)
+				continue
+			}
+			if text := eventfield.String(got); text != value {
+				t.Errorf("%s: %s is %q, want %q", line, key, text, value)
+			}
+		}
+		for key, value := range typed {
+			if got := entry.Fields[key]; !reflect.DeepEqual(got, value) {
+				t.Errorf("%s: %s is %#v (%T), want %#v (%T)", line, key, got, got, value, value)
+			}
+		}
+		if len(entry.Fields) != len(logged) {
+			t.Errorf("%s: %d fields, want %d", line, len(entry.Fields), len(logged))
+		}
+	})
+}
+
+// The regex the decoder replaced, kept to compare both
+const oldLogLinePattern = `(\w+)="(.*?)"|\w+=\S+`
+
+func processLogLineRegex(pattern *regexp.Regexp, line string) (LogEntry, error) {
+	entry := LogEntry{
+		Fields: make(map[string]interface{}),
+	}
+
+	for _, match := range pattern.FindAllStringSubmatch(line, -1) {
+		key, value := match[1], match[2]
+		if key == "" {
+			pair := strings.SplitN(match[0], "=", 2)
+			key, value = pair[0], pair[1]
+		}
+
+		switch key {
+		case "time":
+			parsedTime, parseTimeErr := time.Parse(time.RFC3339, value)
+			if parseTimeErr != nil {
+				return LogEntry{}, fmt.Errorf("could not parse time, skipping log line: %w", parseTimeErr)
+			}
+			entry.Time = parsedTime
+		case "msg":
+			parts := strings.SplitN(value, " ", 3)
+			if len(parts) == 3 {
+				id, convertToIntErr := strconv.Atoi(parts[2])
+				if convertToIntErr != nil {
+					return LogEntry{}, fmt.Errorf("could not parse event id, skipping log line: %w", convertToIntErr)
+				}
+				entry.EventID = id
+			}
+		default:
+			entry.Fields[key] = value
+		}
+	}
+
+	return entry, nil
+}
+
+func BenchmarkProcessLogLine(b *testing.B) {
+	line := formatLogLine(b, 1149, log.Fields{
+		"provider": "{C76BAA63-AE81-421C-B425-340B4B24157F}",
+		"Param1":   "administrator",
+		"Param2":   "CORP",
+		"Param3":   "10.20.9.66",
+		"User":     `CORP\administrator`,
+	})
+
+	b.Run("decoder", func(b *testing.B) {
+		b.ReportAllocs()
+		var le LogEntries
+		for i := 0; i < b.N; i++ {
+			if _, processErr := le.processLogLine(line); processErr != nil {
+				b.Fatal(processErr)
+			}
+		}
+	})
+
+	// The regex was compiled on every line, as it was in processLogLine
+	b.Run("regex", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			pattern := regexp.MustCompile(oldLogLinePattern)
+			if _, processErr := processLogLineRegex(pattern, line); processErr != nil {
+				b.Fatal(processErr)
+			}
+		}
+	})
+}
@@ -1,28 +1,106 @@
 package parser
 
 import (
-	"bufio"
+	"context"
 	"fmt"
-	"os"
-	"regexp"
+	"math"
+	"net"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	alert "github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/alerting"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/bus"
 	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/config"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/eventfield"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/metrics"
 	log "github.com/sirupsen/logrus"
 )
 
 type Parser struct {
 	RuleConfig *config.RuleSet
+
+	schedule   []*scheduledRule // every enabled rule, built at Init
+	suppressor *alert.Suppressor
+	dispatcher *alert.Dispatcher
+	source     entrySource      // where rules read entries from, the provider log files unless subscribed to a bus
+	events     <-chan bus.Event // nil when rules are evaluated from the provider log files
+}
+
+// Lookback windows of the built-in rules when rules.yml does not set one
+var builtinRuleWindows = map[string]time.Duration{
+	"scan_detection":     1 * time.Minute,
+	"rdp_brute_force":    1 * time.Minute,
+	"rdp_session_hijack": 30 * time.Minute,
+
+	// Fleet rules look further back, a spray or horizontal scan is spread out to stay below local thresholds
+	"fleet_horizontal_scan": 10 * time.Minute,
+	"fleet_rdp_brute_force": 30 * time.Minute,
+	"fleet_password_spray":  30 * time.Minute,
+}
+
+// Severity and MITRE ATT&CK techniques of the built-in rules when rules.yml does not set them
+var builtinRuleSeverities = map[string]alert.Severity{
+	"scan_detection":     alert.SeverityMedium,
+	"rdp_brute_force":    alert.SeverityHigh,
+	"rdp_session_hijack": alert.SeverityCritical,
+
+	"fleet_horizontal_scan": alert.SeverityHigh,
+	"fleet_rdp_brute_force": alert.SeverityHigh,
+	"fleet_password_spray":  alert.SeverityHigh,
+}
+
+var builtinRuleTechniques = map[string][]string{
+	"scan_detection":     {"T1046"},
+	"rdp_brute_force":    {"T1110.001", "T1021.001"},
+	"rdp_session_hijack": {"T1563.002"},
+
+	"fleet_horizontal_scan": {"T1046"},
+	"fleet_rdp_brute_force": {"T1110.001", "T1021.001"},
+	"fleet_password_spray":  {"T1110.003", "T1021.001"},
+}
+
+// An ongoing offender is re-alerted at most every 15 minutes (unless it escalates) and resolved once it
+// stayed below the threshold for 5 minutes
+const (
+	defaultAlertCooldown     = 15 * time.Minute
+	defaultAlertResolveAfter = 5 * time.Minute
+	defaultAlertStateFile    = "logs/alert_state.json"
+)
+
+type ScanDetectionParams struct {
+	MinPorts        int      `yaml:"min_ports"`         // sources touching fewer distinct ports are ignored
+	PortsOfInterest []uint16 `yaml:"ports_of_interest"` // only count these local ports, all ports if empty
+}
+
+type RDPBruteForceParams struct {
+	ReasonCodes []int64 `yaml:"reason_codes"` // 103 reason codes counted as a failed attempt
 }
 
 type LogEntry struct {
 	Time    time.Time
 	EventID int
-	Fields  map[string]interface{}
+	Fields  map[string]interface{} // typed values, see eventfield
+}
+
+// The text of a field whatever its type, as written to the text provider logs
+func (e LogEntry) Text(field string) (string, bool) {
+	value, ok := e.Fields[field]
+	if !ok {
+		return "", false
+	}
+	return eventfield.String(value), true
+}
+
+// The integer value of a field, false if the entry does not carry it or it is not an integer
+func (e LogEntry) Int(field string) (int64, bool) {
+	value, ok := e.Fields[field]
+	if !ok {
+		return 0, false
+	}
+	return eventfield.Int(value)
 }
 
 type LogEntries struct {
@@ -38,119 +116,498 @@ func (p *Parser) Init(ruleSetConfigFilePath string) error {
 
 	//Populating the Parser struct with the rules
 	p.RuleConfig = rulesConfig
+
+	alerting := rulesConfig.Alerting
+	if alerting.Cooldown <= 0 {
+		alerting.Cooldown = defaultAlertCooldown
+	}
+	if alerting.ResolveAfter <= 0 {
+		alerting.ResolveAfter = defaultAlertResolveAfter
+	}
+	if alerting.StateFile == "" {
+		alerting.StateFile = defaultAlertStateFile
+	}
+	if alerting.EscalationFactor != 0 && !(alerting.EscalationFactor > 1) {
+		return fmt.Errorf("invalid alerting escalation_factor %g, expected a factor above 1 or 0 to disable escalation", alerting.EscalationFactor)
+	}
+
+	suppressor, suppressorErr := alert.NewSuppressor(alerting.StateFile, alerting.Cooldown, alerting.EscalationFactor, alerting.ResolveAfter)
+	if suppressorErr != nil {
+		return fmt.Errorf("unable to load alert state, cannot continue: %w", suppressorErr)
+	}
+	p.suppressor = suppressor
+
+	dispatcher, dispatcherErr := alert.NewDispatcher(alerting.Notifiers)
+	if dispatcherErr != nil {
+		return fmt.Errorf("unable to configure notifiers, cannot continue: %w", dispatcherErr)
+	}
+	p.dispatcher = dispatcher
+
+	names := make([]string, 0, len(rulesConfig.Rules))
+	for name := range rulesConfig.Rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		rule := rulesConfig.Rules[name]
+		if !rule.Enabled {
+			continue
+		}
+
+		scheduled, scheduleErr := p.newScheduledRule(name, rule)
+		if scheduleErr != nil {
+			return fmt.Errorf("unable to load rule, cannot continue: %w", scheduleErr)
+		}
+		if scheduled == nil {
+			log.Warnf("Rule: %s does not have a matching detection algorithm, skipping...", name)
+			continue
+		}
+		p.schedule = append(p.schedule, scheduled)
+	}
+
+	if rulesConfig.Sigma.Enabled {
+		sigmaRules, sigmaLoadErr := loadSigmaRules(rulesConfig.Sigma)
+		if sigmaLoadErr != nil {
+			return fmt.Errorf("unable to load sigma rules, cannot continue: %w", sigmaLoadErr)
+		}
+		for _, sigmaRule := range sigmaRules {
+			p.schedule = append(p.schedule, p.newScheduledSigmaRule(sigmaRule, rulesConfig.Sigma.Interval))
+		}
+		log.Debugf("Loaded %d sigma rules", len(sigmaRules))
+	}
+
+	// Rules read the provider log files unless the parser is subscribed to a bus
+	stateFile := rulesConfig.TailStateFile
+	if stateFile == "" {
+		stateFile = defaultTailStateFile
+	}
+	tailer, tailerErr := newFileTailer(retentionOf(p.schedule), stateFile)
+	if tailerErr != nil {
+		return fmt.Errorf("unable to load log offsets, cannot continue: %w", tailerErr)
+	}
+	p.source = tailer
+
 	return nil
 }
 
-func (p *Parser) Run() error {
-	// Run rules every 30 sec, no reason to run on first pass, session doesn't have enough data captured yet
-	ruleRunningTicker := time.NewTicker(30 * time.Second)
+// Binds a rule from rules.yml to its detection algorithm, returns nil if there is none
+func (p *Parser) newScheduledRule(name string, rule config.Rule) (*scheduledRule, error) {
+	var evaluate func(le LogEntries) []Finding
 
-	//Infinite program loop (session package will still cause program to end, but we want rules to run throughout running program)
-	for {
-		select {
-		case <-ruleRunningTicker.C:
-			if err := p.RunRules(); err != nil {
-				log.WithError(err).Errorf("problem running rules")
+	// Built-in rules describe each finding, declarative rules render their own message template
+	describe := func(le LogEntries, detect func(le LogEntries) []Finding, format string) []Finding {
+		return perHost(le, func(le LogEntries) []Finding {
+			findings := detect(le)
+			for i := range findings {
+				findings[i].Message = fmt.Sprintf(format, findings[i].Source)
 			}
+			return findings
+		})
+	}
+
+	switch name {
+	case "scan_detection":
+		params := ScanDetectionParams{}
+		if decodeErr := rule.DecodeParams(&params); decodeErr != nil {
+			return nil, fmt.Errorf("rule %s: %w", name, decodeErr)
 		}
+
+		evaluate = func(le LogEntries) []Finding {
+			return describe(le, func(le LogEntries) []Finding {
+				return rule_ScanDetection(le, params)
+			}, "Host is currently being scanned by %s")
+		}
+	case "rdp_brute_force":
+		params := RDPBruteForceParams{ReasonCodes: []int64{14}}
+		if decodeErr := rule.DecodeParams(&params); decodeErr != nil {
+			return nil, fmt.Errorf("rule %s: %w", name, decodeErr)
+		}
+
+		evaluate = func(le LogEntries) []Finding {
+			return describe(le, func(le LogEntries) []Finding {
+				return rule_RDPBruteForce(le, params)
+			}, "Host is currently being RDP Brute Forced by %s")
+		}
+	case "rdp_session_hijack":
+		evaluate = func(le LogEntries) []Finding {
+			return describe(le, rule_RDPSessionHijack, "Host is currently being RDP Session Hijacked by %s")
+		}
+	case "fleet_horizontal_scan":
+		params := FleetScanParams{}
+		if decodeErr := rule.DecodeParams(&params); decodeErr != nil {
+			return nil, fmt.Errorf("rule %s: %w", name, decodeErr)
+		}
+
+		// Fleet rules describe their findings themselves, the hosts involved are part of the message
+		evaluate = func(le LogEntries) []Finding {
+			return rule_FleetHorizontalScan(le, params)
+		}
+	case "fleet_rdp_brute_force":
+		params := FleetRDPBruteForceParams{ReasonCodes: []int64{14}, MinAttemptsPerHost: 3}
+		if decodeErr := rule.DecodeParams(&params); decodeErr != nil {
+			return nil, fmt.Errorf("rule %s: %w", name, decodeErr)
+		}
+
+		evaluate = func(le LogEntries) []Finding {
+			return rule_FleetRDPBruteForce(le, params)
+		}
+	case "fleet_password_spray":
+		params := PasswordSprayParams{ReasonCodes: []int64{14}, MaxAttemptsPerHost: 2}
+		if decodeErr := rule.DecodeParams(&params); decodeErr != nil {
+			return nil, fmt.Errorf("rule %s: %w", name, decodeErr)
+		}
+
+		evaluate = func(le LogEntries) []Finding {
+			return rule_PasswordSpray(le, params)
+		}
+	default:
+		if rule.Type != "threshold" {
+			return nil, nil
+		}
+
+		thresholdRule, compileErr := newThresholdRule(name, rule)
+		if compileErr != nil {
+			return nil, compileErr
+		}
+		evaluate = thresholdRule.evaluate
+	}
+
+	window := rule.Window
+	if window <= 0 {
+		window = builtinRuleWindows[name]
+	}
+
+	severity := builtinRuleSeverities[name]
+	if rule.Severity != "" || severity == "" {
+		parsedSeverity, severityErr := alert.ParseSeverity(rule.Severity)
+		if severityErr != nil {
+			return nil, fmt.Errorf("rule %s: %w", name, severityErr)
+		}
+		severity = parsedSeverity
+	}
+
+	techniques := rule.Techniques
+	if len(techniques) == 0 {
+		techniques = builtinRuleTechniques[name]
+	}
+
+	scheduled := &scheduledRule{
+		name:       name,
+		fileNames:  rule.FileNames,
+		window:     window,
+		interval:   rule.Interval,
+		threshold:  rule.AlertThreshold,
+		severity:   severity,
+		techniques: techniques,
+		cooldown:   rule.Cooldown,
+	}
+
+	scheduled.run = func() {
+		endTime := p.now()
+		startTime := endTime.Add(-scheduled.window)
+
+		logEntries := p.entries(rule.FileNames, startTime, endTime)
+
+		// Every offender crossing the threshold is alerted, not just the largest
+		var findings []Finding
+		for _, finding := range evaluate(logEntries) {
+			if finding.Count >= rule.AlertThreshold {
+				findings = append(findings, finding)
+			}
+		}
+		p.alertFindings(scheduled, findings, startTime, endTime)
 	}
+
+	return scheduled, nil
 }
 
-func (p *Parser) RunRules() error {
-	for name, rule := range p.RuleConfig.Rules {
-		if rule.Enabled {
-			hits := 0
-			alertMessage := ""
-			switch name {
-			case "scan_detection":
-				// var zeroTime time.Time                                             // Default time struct is zero time
-				startTime := time.Now().Add(-1 * time.Minute)
-				endTime := time.Now()
-				logEntries := processRuleFiles(rule.FileNames, startTime, endTime) //providing zeroTime will process all logs
-
-				var adversary string
-				hits, adversary = rule_ScanDetection(logEntries)
-				alertMessage = fmt.Sprintf("Host is currently being scanned by %s", adversary)
-			case "rdp_brute_force":
-				startTime := time.Now().Add(-1 * time.Minute) // 1 minute ago
-				endTime := time.Now()
-
-				logEntries := processRuleFiles(rule.FileNames, startTime, endTime)
-
-				var adversary string
-				hits, adversary = rule_RDPBruteForce(logEntries)
-				alertMessage = fmt.Sprintf("Host is currently being RDP Brute Forced by %s", adversary)
-			case "rdp_session_hijack":
-				startTime := time.Now().Add(-30 * time.Minute) // 30 minutes ago
-				endTime := time.Now()
-
-				var adversary string
-				logEntries := processRuleFiles(rule.FileNames, startTime, endTime)
-				hits, adversary = rule_RDPSessionHijack(logEntries)
-				alertMessage = fmt.Sprintf("Host is currently being RDP Session Hijacked by %s", adversary)
-			default:
-				log.Warnf("Rule: %s does not have a matching detection algorithm, skipping...", name)
+// Built-in and Sigma rules correlate the events of a single host, so on the collector they run per agent and
+// the host is part of the entity, e.g. 10.0.0.9@host-a
+func perHost(le LogEntries, detect func(le LogEntries) []Finding) []Finding {
+	var findings []Finding
+	for host, hostEntries := range entriesByHost(le) {
+		for _, finding := range detect(hostEntries) {
+			if host != "" {
+				finding.Source += "@" + host
+				finding.Message = host + ": " + finding.Message
 			}
+			findings = append(findings, finding)
+		}
+	}
+	sortFindings(findings)
+	return findings
+}
+
+// Sigma rule matches go through the same alerting path as the built-in rules. Rules are named by their id,
+// titles are not unique, and by their title only when they have no id
+func (p *Parser) newScheduledSigmaRule(sigmaRule *sigmaRule, interval time.Duration) *scheduledRule {
+	name := sigmaRule.id
+	if name == "" {
+		name = sigmaRule.title
+	}
+
+	scheduled := &scheduledRule{
+		name:       "sigma:" + name,
+		fileNames:  sigmaRule.fileNames,
+		window:     sigmaRule.window,
+		interval:   interval,
+		threshold:  1,
+		severity:   sigmaRule.severity,
+		techniques: sigmaRule.techniques,
+	}
+	if sigmaRule.aggregation != nil {
+		scheduled.threshold = sigmaRule.aggregation.threshold()
+	}
+
+	scheduled.run = func() {
+		endTime := p.now()
+		startTime := endTime.Add(-sigmaRule.window)
+
+		var logEntries LogEntries
+		if sigmaRule.aggregation == nil {
+			// Single event rules would otherwise alert on the same events on every pass. They look at every entry
+			// that arrived since the previous pass whatever its event time: events are stamped before they arrive
+			// and forwarded events carry the clock of their agent
+			logEntries, sigmaRule.lastArrival = p.source.EntriesSince(sigmaRule.fileNames, sigmaRule.lastArrival, time.Time{}, time.Time{})
+		} else {
+			logEntries = p.entries(sigmaRule.fileNames, startTime, endTime)
+		}
+		p.alertFindings(scheduled, perHost(logEntries, sigmaRule.evaluate), startTime, endTime)
+	}
+
+	return scheduled
+}
+
+// Alerts the findings that are not suppressed and notifies the sources of the rule that were resolved
+func (p *Parser) alertFindings(rule *scheduledRule, findings []Finding, startTime, endTime time.Time) {
+	metrics.RuleHits.Add(float64(len(findings)), rule.name)
+
+	for _, finding := range findings {
+		if !p.suppressor.Observe(rule.name, finding.Source, finding.Count, rule.cooldown, endTime) {
+			log.Debugf("Rule: %s alert for %s suppressed", rule.name, finding.Source)
+			metrics.AlertsSuppressed.Inc(rule.name)
+			continue
+		}
 
-			if hits >= rule.AlertThreshold {
-				alertingErr := alert.ShowAlert(alertMessage)
-				if alertingErr != nil {
-					log.WithError(alertingErr).Warn("unable to alert")
+		metrics.AlertsFired.Inc(rule.name, string(rule.severity), string(alert.StatusFiring))
+
+		alertingErr := p.dispatcher.Notify(alert.Alert{
+			ID:          alert.NewID(),
+			Time:        endTime,
+			Status:      alert.StatusFiring,
+			Rule:        rule.name,
+			Severity:    rule.severity,
+			Entity:      finding.Source,
+			Count:       finding.Count,
+			Threshold:   rule.threshold,
+			WindowStart: startTime,
+			WindowEnd:   endTime,
+			FirstSeen:   finding.FirstSeen,
+			LastSeen:    finding.LastSeen,
+			Techniques:  rule.techniques,
+			Message:     finding.Message,
+			Evidence:    finding.Evidence,
+		})
+		if alertingErr != nil {
+			log.WithError(alertingErr).Warn("unable to alert")
+		}
+	}
+
+	for _, resolved := range p.suppressor.Resolve(rule.name, endTime) {
+		metrics.AlertsFired.Inc(rule.name, string(rule.severity), string(alert.StatusResolved))
+		alertingErr := p.dispatcher.Notify(alert.Alert{
+			ID:          alert.NewID(),
+			Time:        endTime,
+			Status:      alert.StatusResolved,
+			Rule:        rule.name,
+			Severity:    rule.severity,
+			Entity:      resolved.Source,
+			Count:       resolved.Count,
+			Threshold:   rule.threshold,
+			WindowStart: startTime,
+			WindowEnd:   endTime,
+			FirstSeen:   resolved.FirstAlerted,
+			LastSeen:    resolved.LastSeen,
+			Techniques:  rule.techniques,
+			Message:     fmt.Sprintf("Resolved: %s is no longer triggering %s (last seen %s)", resolved.Source, resolved.Rule, resolved.LastSeen.Format(time.RFC3339)),
+		})
+		if alertingErr != nil {
+			log.WithError(alertingErr).Warn("unable to alert")
+		}
+	}
+}
+
+// Evaluates rules against the events published on the bus instead of re-reading the provider log files
+func (p *Parser) Subscribe(b *bus.Bus) {
+	// Streamed events are kept for as long as the largest rule window needs them
+	p.events = b.Subscribe("rules", 4096)
+	p.source = newStreamWindow(retentionOf(p.schedule))
+}
+
+// Runs the rules on the timeline of the streamed events instead of the wall clock, for replays: the clock is
+// the time of the latest event and each rule runs whenever that clock passed its interval, so a capture
+// correlates the same whatever the replay speed. Does nothing unless subscribed to a bus
+func (p *Parser) UseEventClock() {
+	if window, ok := p.source.(*streamWindow); ok {
+		window.eventClock = true
+	}
+}
+
+// The time rules evaluate their window up to, the wall clock unless replaying on the event clock
+func (p *Parser) now() time.Time {
+	if window, ok := p.source.(*streamWindow); ok {
+		return window.Now()
+	}
+	return time.Now()
+}
+
+// Runs every rule on its own schedule until the context is cancelled
+func (p *Parser) Run(ctx context.Context) error {
+	scheduleEnded := make(chan struct{})
+	go func() {
+		defer close(scheduleEnded)
+		p.runSchedule(ctx)
+	}()
+
+	if p.events != nil {
+		p.runStream(ctx)
+	}
+
+	<-scheduleEnded
+	return nil
+}
+
+// Keeps the bus events in memory for the rules to evaluate
+func (p *Parser) runStream(ctx context.Context) {
+	window := p.source.(*streamWindow)
+	// The schedule reads p.events to pick the rule intervals, the closed subscription is only cleared here
+	events := p.events
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Keep whatever was published before shutdown for the final rule pass, the bus is closed by then
+			if events != nil {
+				for event := range events {
+					window.Insert(event)
+					if window.eventClock {
+						p.runDue(window.Now())
+					}
 				}
 			}
+			return
+		case event, ok := <-events:
+			if !ok {
+				// Bus closed, nothing new will arrive but the window can still be evaluated
+				events = nil
+				continue
+			}
+			window.Insert(event)
+			if window.eventClock {
+				p.runDue(window.Now())
+			}
 		}
 	}
+}
+
+// Runs every enabled rule once, waiting for any scheduled run still in progress
+func (p *Parser) RunRules() error {
+	for _, rule := range p.schedule {
+		rule.mu.Lock()
+		rule.lastRun = p.now()
+		rule.evaluate()
+		rule.mu.Unlock()
+	}
+
 	return nil
 }
 
-func rule_ScanDetection(le LogEntries) (int, string) {
-	// create a map of remoteIP, for each map, number of unique ports
-	// instead a map[remoteIP][]string key.count()
-	// ignore time, return max key.count() <-- alertThreshold.
-	var uniquePort = make(map[string][]string)
+// Sends every alert to the notifier as well as the configured ones
+func (p *Parser) AddNotifier(name string, notifier alert.Notifier) {
+	p.dispatcher.Add(name, notifier)
+}
+
+// Closes the notifiers once no rule will run anymore
+func (p *Parser) Close() error {
+	if p.suppressor != nil {
+		p.suppressor.Flush()
+	}
+	if p.dispatcher == nil {
+		return nil
+	}
+	return p.dispatcher.Close()
+}
+
+func (p *Parser) entries(fileNames []string, startTime, endTime time.Time) LogEntries {
+	return p.source.Entries(fileNames, startTime, endTime)
+}
+
+func rule_ScanDetection(le LogEntries, params ScanDetectionParams) []Finding {
+	// create a map of remoteIP, for each map, the set of unique ports
+	// every IP touching at least min_ports ports is a finding, the caller compares counts to the alert threshold
+	var uniquePort = make(map[string]map[int64]bool)
+	var scanners = make(map[string]*Finding)
 
 	for _, entry := range le.Entries {
-		port, portOk := entry.Fields["LocalSockAddr_PORT"].(string)
-		ip, ipOk := entry.Fields["RemoteSockAddr_IP"].(string)
+		port, portOk := entry.Int("LocalSockAddr_PORT")
+		ip, ipOk := entry.Text("RemoteSockAddr_IP")
+
+		if len(params.PortsOfInterest) > 0 && !containsPort(params.PortsOfInterest, port) {
+			continue
+		}
 
 		if portOk && ipOk {
-			// check if the port is not already in the slice for this IP
-			if !contains(uniquePort[ip], port) {
-				uniquePort[ip] = append(uniquePort[ip], port)
+			finding, exists := scanners[ip]
+			if !exists {
+				finding = &Finding{Source: ip}
+				scanners[ip] = finding
+				uniquePort[ip] = make(map[int64]bool)
+			}
+			finding.Observe(entry.Time)
+
+			// check if the port is not already counted for this IP
+			if !uniquePort[ip][port] {
+				uniquePort[ip][port] = true
+				finding.Count++
+				finding.AddEvidence(entry)
 			}
 		}
 	}
 
-	max := 0
-	sourceMaxIp := ""
-	for ip, ports := range uniquePort {
-		if len(ports) > max {
-			max = len(ports)
-			sourceMaxIp = ip
+	var findings []Finding
+	for _, finding := range scanners {
+		if finding.Count < params.MinPorts {
+			continue
 		}
+		findings = append(findings, *finding)
 	}
 
-	return max, sourceMaxIp
+	sortFindings(findings)
+	return findings
 }
 
 type RDPInfo struct {
 	ActivityId []string
 	Count      int
+	FirstSeen  time.Time
+	LastSeen   time.Time
+	Failed     []LogEntry // the 103 events of the terminated attempts
 }
 
-func rule_RDPBruteForce(le LogEntries) (int, string) {
+func rule_RDPBruteForce(le LogEntries, params RDPBruteForceParams) []Finding {
 	// when someone tries to connect, we just need 2 events, 131, 103
 	// create a map map[IP]struct{ []activityID, count} (number of connections attempted)
 	// number of connections is calculated by:
 	// 131 -> add IP to the map with activityID, count = 0, if the IP is already in the map,
-	// 103 -> 103 event, with the same activity ID and reason code 14
+	// 103 -> 103 event, with the same activity ID and one of the configured reason codes (14 by default)
 
 	var terminatedRDP = make(map[string]RDPInfo)
 	for _, entry := range le.Entries {
 		if entry.EventID == 131 {
 			// Check if the IP is already in the map
-			ip, ipOk := entry.Fields["ClientIP_IP"].(string)
-			activityId, aIdOk := entry.Fields["ActivityID"].(string)
+			ip, ipOk := entry.Text("ClientIP_IP")
+			activityId, aIdOk := entry.Text("ActivityID")
 
 			if !aIdOk {
 				continue
@@ -171,22 +628,27 @@ func rule_RDPBruteForce(le LogEntries) (int, string) {
 				terminatedRDP[ip] = rdpInfo
 			}
 		} else if entry.EventID == 103 {
-			// Check if reason code is 14.
-			reasonCode, reasonCodeOk := entry.Fields["ReasonCode"].(string)
-			activityId, aIdOk := entry.Fields["ActivityID"].(string)
+			// Check if the reason code is one of interest
+			reasonCode, reasonCodeOk := entry.Int("ReasonCode")
+			activityId, aIdOk := entry.Text("ActivityID")
 
 			// No reason code or activity id, we cannot update count safely
 			if !reasonCodeOk || !aIdOk {
 				continue
 			}
 
-			if reasonCode == "14" {
+			if slices.Contains(params.ReasonCodes, reasonCode) {
 				// Check if the activityId exists for a map
 				for ip, info := range terminatedRDP {
 					if contains(info.ActivityId, activityId) {
 						// Update the entry directly in the terminatedRDP map
 						updatedInfo := info
 						updatedInfo.Count++
+						if updatedInfo.FirstSeen.IsZero() {
+							updatedInfo.FirstSeen = entry.Time
+						}
+						updatedInfo.LastSeen = entry.Time
+						updatedInfo.Failed = append(updatedInfo.Failed, entry)
 						terminatedRDP[ip] = updatedInfo
 
 					}
@@ -196,20 +658,140 @@ func rule_RDPBruteForce(le LogEntries) (int, string) {
 		}
 	}
 
-	max := 0
-	sourceMaxIp := ""
+	var findings []Finding
 	for ip, rdpInfo := range terminatedRDP {
-		if rdpInfo.Count > max {
-			max = rdpInfo.Count
-			sourceMaxIp = ip
+		if rdpInfo.Count == 0 {
+			continue
+		}
+
+		finding := Finding{
+			Source:    ip,
+			Count:     rdpInfo.Count,
+			FirstSeen: rdpInfo.FirstSeen,
+			LastSeen:  rdpInfo.LastSeen,
+		}
+		for _, failed := range rdpInfo.Failed {
+			finding.AddEvidence(failed)
+		}
+		findings = append(findings, finding)
+	}
+
+	sortFindings(findings)
+	return findings
+}
+
+type RDPSession struct {
+	User    string
+	Address string
+}
+
+func rule_RDPSessionHijack(le LogEntries) []Finding {
+	// correlate RemoteConnectionManager authentications (1149) with LocalSessionManager session events
+	// 21 -> logon, remember the user and source address of the session
+	// 39 -> session <TargetSession> was disconnected by session <Source>, a tscon style session switch
+	// 25 -> reconnection, suspicious if the session was switched to by another session, is now owned by a
+	//       different user, or comes from a remote address that did not authenticate (1149) beforehand
+	// 24/40 (disconnects) carry nothing the correlation needs, they are captured for investigation
+
+	var sessions = make(map[string]RDPSession)
+	var switchedBy = make(map[string]string)      // target session -> session that took it over
+	var authenticated = make(map[string][]string) // source IP -> users that authenticated from it
+	var hijacks = make(map[string]*Finding)
+
+	for _, entry := range le.Entries {
+		switch entry.EventID {
+		case 1149:
+			user, userOk := entry.Text("Param1")
+			ip, ipOk := entry.Text("Param3")
+			if !userOk || !ipOk {
+				continue
+			}
+			domain, _ := entry.Text("Param2")
+			authenticated[ip] = append(authenticated[ip], normalizeRDPUser(domain, user))
+		case 21:
+			sessionId, sessionOk := entry.Text("SessionID")
+			if !sessionOk {
+				continue
+			}
+			user, _ := entry.Text("User")
+			address, _ := entry.Text("Address")
+			sessions[sessionId] = RDPSession{User: normalizeRDPUser("", user), Address: address}
+		case 39:
+			target, targetOk := entry.Text("TargetSession")
+			source, sourceOk := entry.Text("Source")
+			if targetOk && sourceOk && target != source {
+				switchedBy[target] = source
+			}
+		case 25:
+			sessionId, sessionOk := entry.Text("SessionID")
+			if !sessionOk {
+				continue
+			}
+			user, _ := entry.Text("User")
+			user = normalizeRDPUser("", user)
+			address, _ := entry.Text("Address")
+
+			previous, known := sessions[sessionId]
+			switcher, switched := switchedBy[sessionId]
+			delete(switchedBy, sessionId)
+
+			suspicious := switched ||
+				(known && previous.User != "" && user != "" && previous.User != user) ||
+				(isRemoteAddress(address) && !authenticatedFrom(authenticated[address], user))
+
+			if suspicious {
+				adversary := address
+				if !isRemoteAddress(address) {
+					// A console or local reconnection, the adversary is whoever owns the switching session
+					adversary = fmt.Sprintf("%s (session %s)", address, sessionId)
+					if switcherSession, ok := sessions[switcher]; switched && ok {
+						adversary = fmt.Sprintf("%s (session %s, %s)", switcherSession.Address, switcher, switcherSession.User)
+					}
+				}
+
+				finding, exists := hijacks[adversary]
+				if !exists {
+					finding = &Finding{Source: adversary}
+					hijacks[adversary] = finding
+				}
+				finding.Count++
+				finding.Observe(entry.Time)
+				finding.AddEvidence(entry)
+			}
+
+			sessions[sessionId] = RDPSession{User: user, Address: address}
 		}
 	}
 
-	return max, sourceMaxIp
+	var findings []Finding
+	for _, finding := range hijacks {
+		findings = append(findings, *finding)
+	}
+
+	sortFindings(findings)
+	return findings
+}
+
+// LocalSessionManager reports users as DOMAIN\user while 1149 splits them into Param1 and Param2
+func normalizeRDPUser(domain, user string) string {
+	if domain != "" && !strings.Contains(user, `\`) {
+		user = domain + `\` + user
+	}
+	return strings.ToLower(user)
+}
+
+// Without a user on the reconnection any authentication from the address will do
+func authenticatedFrom(users []string, user string) bool {
+	if user == "" {
+		return len(users) > 0
+	}
+	return contains(users, user)
 }
 
-// Future work, add RDP Session Hijack rule
-func rule_RDPSessionHijack(le LogEntries) (int, string) { return 0, "" }
+func isRemoteAddress(address string) bool {
+	ip := net.ParseIP(address)
+	return ip != nil && !ip.IsLoopback()
+}
 
 func (le *LogEntries) Insert(entry LogEntry) { le.Entries = append(le.Entries, entry) }
 
@@ -221,26 +803,18 @@ func (le *LogEntries) Sort() {
 }
 
 func (le *LogEntries) processLogLine(line string) (LogEntry, error) {
-	re := regexp.MustCompile(`(\w+)="(.*?)"|\w+=\S+`)
-	matches := re.FindAllStringSubmatch(line, -1)
+	// Provider logs are written as text or JSON Lines, a file may hold both after the format was changed
+	if strings.HasPrefix(line, "{") {
+		return processJSONLine(line)
+	}
 
 	entry := LogEntry{
 		Fields: make(map[string]interface{}),
 	}
 
-	for _, match := range matches {
-		key := match[1]
-		value := match[2]
-
-		if key == "" && len(match) > 0 {
-			// Handle non-quoted key-value pairs
-			pair := strings.SplitN(match[0], "=", 2)
-			if len(pair) == 2 {
-				key, value = pair[0], pair[1]
-			}
-		}
-
-		switch key {
+	decoder := newLogfmtDecoder(line)
+	for decoder.Next() {
+		switch key, value := decoder.Key(), decoder.Value(); key {
 		case "time":
 			// Assuming time follows RFC3339 format
 			parsedTime, parseTimeErr := time.Parse(time.RFC3339, value)
@@ -249,68 +823,37 @@ func (le *LogEntries) processLogLine(line string) (LogEntry, error) {
 			}
 			entry.Time = parsedTime
 		case "msg":
-			// Assuming msg contains "Event ID: <id>"
-			parts := strings.SplitN(value, " ", 3)
-			if len(parts) == 3 {
-				id, convertToIntErr := strconv.Atoi(parts[2])
+			// The session logs events as "Event ID: <id>"
+			if eventID, ok := strings.CutPrefix(value, "Event ID: "); ok {
+				id, convertToIntErr := strconv.Atoi(eventID)
 				if convertToIntErr != nil {
 					return LogEntry{}, fmt.Errorf("could not parse event id, skipping log line: %w", convertToIntErr)
 				}
 				entry.EventID = id
 			}
+		case "level":
 		default:
-			// Assuming fields that are not applicable have a value of NA
-			if value != "NA" {
-				//Add other fields to the map
-				entry.Fields[key] = value
-			}
-
+			field := logfmtFieldKey(key)
+			entry.Fields[field] = eventfield.Typed(field, value)
 		}
 	}
+	if decodeErr := decoder.Err(); decodeErr != nil {
+		return LogEntry{}, fmt.Errorf("could not decode log line: %w", decodeErr)
+	}
 
 	return entry, nil
-
 }
 
-func (le *LogEntries) processLogFile(fileName string, startTime, endTime time.Time) error {
-	file, openFileErr := os.Open("logs/" + fileName)
-	if openFileErr != nil {
-		return openFileErr
-	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		entry, processLineErr := le.processLogLine(line)
-		if processLineErr != nil {
-			log.WithError(processLineErr).Warnf("could not process line: (%s) from logfile: %s", line, fileName)
-			continue
-		}
-
-		// Check if the entry is within the specified time interval (between or equal)
-		if (startTime.IsZero() && endTime.IsZero()) ||
-			((entry.Time.After(startTime) || entry.Time.Equal(startTime)) &&
-				(entry.Time.Before(endTime) || entry.Time.Equal(endTime))) {
-			le.Insert(entry)
-		}
-	}
-
-	// Sort log entries and return any error collected by the scanner
-	le.Sort()
-	return scanner.Err()
+// Check if the time is within the specified time interval (between or equal), zero times match everything
+func inWindow(t, startTime, endTime time.Time) bool {
+	return (startTime.IsZero() && endTime.IsZero()) ||
+		((t.After(startTime) || t.Equal(startTime)) &&
+			(t.Before(endTime) || t.Equal(endTime)))
 }
 
-func processRuleFiles(fileNames []string, startTime, endTime time.Time) LogEntries {
-	var logEntries LogEntries
-	for _, fileName := range fileNames {
-		processLogFileErr := logEntries.processLogFile(fileName, startTime, endTime)
-		if processLogFileErr != nil {
-			log.WithError(processLogFileErr).Warnf("error processing file: %s", fileName)
-		}
-	}
-
-	return logEntries
+// Ports are compared as numbers, a value outside the port range is never one of them
+func containsPort(ports []uint16, port int64) bool {
+	return port >= 0 && port <= math.MaxUint16 && slices.Contains(ports, uint16(port))
 }
 
 func contains(slice []string, str string) bool {
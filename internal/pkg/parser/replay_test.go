@@ -0,0 +1,241 @@
+package parser
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/0xrawsec/golang-etw/etw"
+	alert "github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/alerting"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/bus"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/session"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	testConfigDir = "../../../config"
+	testDataDir   = "../../../testdata"
+)
+
+// recordingNotifier keeps the alerts instead of delivering them
+type recordingNotifier struct {
+	mu     sync.Mutex
+	alerts []alert.Alert
+}
+
+func (r *recordingNotifier) Notify(alert alert.Alert) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.alerts = append(r.alerts, alert)
+	return nil
+}
+
+// The firing alerts as "rule entity", sorted
+func (r *recordingNotifier) firing() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var firing []string
+	for _, a := range r.alerts {
+		if a.Status == alert.StatusFiring {
+			firing = append(firing, a.Rule+" "+a.Entity)
+		}
+	}
+	sort.Strings(firing)
+	return firing
+}
+
+// Writes the shipped rules.yml without its notifiers and with its state files in dir
+func testRulesFile(t *testing.T, dir string) string {
+	t.Helper()
+
+	data, readErr := os.ReadFile(filepath.Join(testConfigDir, "rules.yml"))
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	var rules map[string]interface{}
+	if unmarshalErr := yaml.Unmarshal(data, &rules); unmarshalErr != nil {
+		t.Fatal(unmarshalErr)
+	}
+
+	rules["tail_state_file"] = filepath.Join(dir, "tail_state.json")
+	alerting := rules["alerting"].(map[string]interface{})
+	alerting["state_file"] = filepath.Join(dir, "alert_state.json")
+	alerting["notifiers"] = []interface{}{}
+
+	data, marshalErr := yaml.Marshal(rules)
+	if marshalErr != nil {
+		t.Fatal(marshalErr)
+	}
+	path := filepath.Join(dir, "rules.yml")
+	if writeErr := os.WriteFile(path, data, 0600); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	return path
+}
+
+// Runs the source through the session and the rules streamed from its bus, the way replay does, and returns
+// the firing alerts
+func replayPipeline(t *testing.T, source session.EventSource) []string {
+	t.Helper()
+
+	// The provider log lines would otherwise go to stderr, there is no provider hook
+	output := log.StandardLogger().Out
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(output) })
+
+	var sessionObj session.Session
+	if initErr := sessionObj.Init(filepath.Join(testConfigDir, "providers.yml")); initErr != nil {
+		t.Fatal(initErr)
+	}
+	var parserObj Parser
+	if initErr := parserObj.Init(testRulesFile(t, t.TempDir())); initErr != nil {
+		t.Fatal(initErr)
+	}
+	notifier := &recordingNotifier{}
+	parserObj.AddNotifier("test", notifier)
+
+	sessionObj.Bus = bus.New()
+	parserObj.Subscribe(sessionObj.Bus)
+	parserObj.UseEventClock()
+	sessionObj.Source = source
+
+	parserCtx, stopParser := context.WithCancel(context.Background())
+	parserEnded := make(chan error, 1)
+	go func() { parserEnded <- parserObj.Run(parserCtx) }()
+
+	if runErr := sessionObj.Run(context.Background()); runErr != nil {
+		t.Fatal(runErr)
+	}
+	sessionObj.Bus.Close()
+	stopParser()
+	if runErr := <-parserEnded; runErr != nil {
+		t.Fatal(runErr)
+	}
+
+	if runErr := parserObj.RunRules(); runErr != nil {
+		t.Fatal(runErr)
+	}
+	if closeErr := parserObj.Close(); closeErr != nil {
+		t.Fatal(closeErr)
+	}
+	return notifier.firing()
+}
+
+func TestReplayFixtures(t *testing.T) {
+	tests := []struct {
+		fixture string
+		firing  []string
+	}{
+		{"rdp_session_hijack_tscon", []string{"rdp_session_hijack 10.20.9.66"}},
+		{"rdp_session_hijack_new_source", []string{"rdp_session_hijack 10.20.7.201"}},
+		{"rdp_session_reconnect_benign", nil},
+		{"rdp_brute_force_concurrent", []string{"rdp_brute_force 10.0.0.30", "rdp_brute_force 10.0.0.31"}},
+		{"scan_distributed", []string{"scan_detection 10.0.0.10", "scan_detection 10.0.0.11", "scan_detection 10.0.0.9"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.fixture, func(t *testing.T) {
+			source := session.NewFileSource(filepath.Join(testDataDir, test.fixture+".ndjson"))
+			if firing := replayPipeline(t, source); !reflect.DeepEqual(firing, test.firing) {
+				t.Errorf("fired %q, want %q", firing, test.firing)
+			}
+		})
+	}
+}
+
+// A TCPIP connection event, as the live consumer yields it
+func tcpEvent(provider string, eventID uint16, local, remote string) *etw.Event {
+	event := etw.NewEvent()
+	event.System.Provider.Name = provider
+	event.System.EventID = eventID
+	event.System.TimeCreated.SystemTime = time.Now()
+	event.EventData["LocalSockAddr"] = local
+	event.EventData["RemoteSockAddr"] = remote
+	return event
+}
+
+// Writes the events to a capture file, as --record does
+func writeCapture(t *testing.T, events []*etw.Event) string {
+	t.Helper()
+
+	var lines []byte
+	for _, event := range events {
+		line, marshalErr := json.Marshal(event)
+		if marshalErr != nil {
+			t.Fatal(marshalErr)
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+	path := filepath.Join(t.TempDir(), "capture.ndjson")
+	if writeErr := os.WriteFile(path, lines, 0600); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	return path
+}
+
+func TestReplayKeepsCaptureTimeline(t *testing.T) {
+	// 60 ports probed by one source, captured long ago, scan_detection alerts on 50 ports within a minute
+	captured := time.Date(2020, 3, 1, 9, 0, 0, 0, time.UTC)
+	scan := func(spacing time.Duration) []*etw.Event {
+		var events []*etw.Event
+		for i := 0; i < 60; i++ {
+			event := tcpEvent("Microsoft-Windows-TCPIP", 1017, fmt.Sprintf("10.0.0.5:%d", 1000+i), "10.0.0.9:4444")
+			event.System.TimeCreated.SystemTime = captured.Add(time.Duration(i) * spacing)
+			events = append(events, event)
+		}
+		return events
+	}
+
+	tests := []struct {
+		name    string
+		spacing time.Duration
+		speed   float64
+		firing  []string
+	}{
+		{"within the window", 500 * time.Millisecond, 0, []string{"scan_detection 10.0.0.9"}},
+		{"within the window sped up", 500 * time.Millisecond, 1000, []string{"scan_detection 10.0.0.9"}},
+		// At most 30 ports within any minute
+		{"wider than the window", 2 * time.Second, 0, nil},
+		{"wider than the window sped up", 2 * time.Second, 1000, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source := session.NewFileSource(writeCapture(t, scan(test.spacing)))
+			source.Speed = test.speed
+			if firing := replayPipeline(t, source); !reflect.DeepEqual(firing, test.firing) {
+				t.Errorf("fired %q, want %q", firing, test.firing)
+			}
+		})
+	}
+}
+
+func TestReplayMemorySource(t *testing.T) {
+	var events []*etw.Event
+	for port := 1000; port < 1060; port++ {
+		events = append(events, tcpEvent("Microsoft-Windows-TCPIP", 1017, fmt.Sprintf("10.0.0.5:%d", port), "10.0.0.50:4444"))
+	}
+	// Below the threshold, from an unknown provider and an event id that is not captured
+	for port := 1000; port < 1040; port++ {
+		events = append(events, tcpEvent("Microsoft-Windows-TCPIP", 1017, fmt.Sprintf("10.0.0.5:%d", port), "10.0.0.51:4444"))
+	}
+	for port := 1000; port < 1060; port++ {
+		events = append(events, tcpEvent("Microsoft-Windows-Unknown", 1017, fmt.Sprintf("10.0.0.5:%d", port), "10.0.0.52:4444"))
+		events = append(events, tcpEvent("Microsoft-Windows-TCPIP", 9999, fmt.Sprintf("10.0.0.5:%d", port), "10.0.0.53:4444"))
+	}
+
+	want := []string{"scan_detection 10.0.0.50"}
+	if firing := replayPipeline(t, session.NewMemorySource(events)); !reflect.DeepEqual(firing, want) {
+		t.Errorf("fired %q, want %q", firing, want)
+	}
+}
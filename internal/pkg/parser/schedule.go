@@ -0,0 +1,212 @@
+package parser
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	alert "github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/alerting"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// Rules without an interval run every 30 seconds against the log files, or shortly after new events arrive
+// when streamed from the bus
+const (
+	defaultFileRuleInterval   = 30 * time.Second
+	defaultStreamRuleInterval = time.Second
+)
+
+// scheduledRule is an enabled rule (built-in, declarative or Sigma) running on its own interval
+type scheduledRule struct {
+	name      string
+	fileNames []string
+	window    time.Duration
+	interval  time.Duration // 0 uses the default of the rule input
+	run       func()        // evaluates the rule over its window and alerts on hits
+
+	// Copied onto every alert of the rule
+	threshold  int
+	severity   alert.Severity
+	techniques []string
+	cooldown   time.Duration // 0 uses the alerting cooldown
+
+	mu      sync.Mutex // held while the rule evaluates, guards against overlapping runs
+	lastRun time.Time
+}
+
+// Runs every rule on its own ticker until the context is cancelled
+func (p *Parser) runSchedule(ctx context.Context) {
+	// Replays run the rules from the stream as the time of their events passes, see runDue
+	if window, ok := p.source.(*streamWindow); ok && window.eventClock {
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, rule := range p.schedule {
+		interval := p.intervalOf(rule)
+
+		wg.Add(1)
+		go func(rule *scheduledRule, interval time.Duration) {
+			defer wg.Done()
+
+			// Passes still evaluating are waited for once cancelled
+			var running sync.WaitGroup
+			defer running.Wait()
+
+			// no reason to run on first pass, session doesn't have enough data captured yet
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					// Evaluated aside so the ticks keep coming, tryRun skips those that overlap a slow pass
+					// instead of the ticker holding one back until the pass ends
+					running.Add(1)
+					go func() {
+						defer running.Done()
+						p.tryRun(rule)
+					}()
+				}
+			}
+		}(rule, interval)
+	}
+
+	wg.Wait()
+}
+
+// Runs the rules whose interval passed on the replay clock, the first event starts every interval like the
+// tickers do. Only called from the stream, nothing else runs the rules during a replay
+func (p *Parser) runDue(now time.Time) {
+	for _, rule := range p.schedule {
+		rule.mu.Lock()
+		due := !rule.lastRun.IsZero() && now.Sub(rule.lastRun) >= p.intervalOf(rule)
+		if rule.lastRun.IsZero() {
+			rule.lastRun = now
+		}
+		rule.mu.Unlock()
+
+		if due {
+			p.tryRun(rule)
+		}
+	}
+}
+
+// The interval of the rule, defaults applied
+func (p *Parser) intervalOf(rule *scheduledRule) time.Duration {
+	if rule.interval > 0 {
+		return rule.interval
+	}
+	if p.events != nil {
+		return defaultStreamRuleInterval
+	}
+	return defaultFileRuleInterval
+}
+
+// Skips the pass if the previous one is still evaluating, or if nothing new was streamed for the rule and
+// none of its alerts are waiting to be resolved
+func (p *Parser) tryRun(rule *scheduledRule) {
+	if !rule.mu.TryLock() {
+		log.Warnf("Rule: %s is still running from its previous interval, skipping...", rule.name)
+		return
+	}
+	defer rule.mu.Unlock()
+
+	now := p.now()
+	if window, ok := p.source.(*streamWindow); ok && !window.UpdatedSince(rule.fileNames, rule.lastRun) && !p.suppressor.Active(rule.name) {
+		return
+	}
+	rule.lastRun = now
+
+	rule.evaluate()
+}
+
+// Runs one pass of the rule and records how long it took, the caller holds the rule lock
+func (r *scheduledRule) evaluate() {
+	started := time.Now()
+	r.run()
+	metrics.RuleEvaluationSeconds.Observe(time.Since(started).Seconds(), r.name)
+}
+
+// RuleInfo describes an enabled rule as it is scheduled, defaults applied
+type RuleInfo struct {
+	Name       string                 `json:"name"`
+	Files      []string               `json:"files"`
+	Window     string                 `json:"window"`
+	Interval   string                 `json:"interval"`
+	Threshold  int                    `json:"alert_threshold"`
+	Severity   alert.Severity         `json:"severity"`
+	Techniques []string               `json:"mitre_techniques"`
+	Cooldown   string                 `json:"cooldown"`
+	Params     map[string]interface{} `json:"params,omitempty"` // as configured in rules.yml
+}
+
+// Alerts of the sources alerted but not yet resolved, rebuilt from the alert state so they survive a restart.
+// The message and evidence of the original alert are not kept, sources of rules no longer enabled are left out
+func (p *Parser) ActiveAlerts() []alert.Alert {
+	if p.suppressor == nil {
+		return nil
+	}
+
+	rules := make(map[string]*scheduledRule, len(p.schedule))
+	for _, rule := range p.schedule {
+		rules[rule.name] = rule
+	}
+
+	var alerts []alert.Alert
+	for _, entry := range p.suppressor.Entries() {
+		rule, enabled := rules[entry.Rule]
+		if !enabled {
+			continue
+		}
+		alerts = append(alerts, alert.Alert{
+			ID:         alert.NewID(),
+			Time:       entry.LastAlerted,
+			Status:     alert.StatusFiring,
+			Rule:       rule.name,
+			Severity:   rule.severity,
+			Entity:     entry.Source,
+			Count:      entry.Count,
+			Threshold:  rule.threshold,
+			FirstSeen:  entry.FirstAlerted,
+			LastSeen:   entry.LastSeen,
+			Techniques: rule.techniques,
+			Message:    fmt.Sprintf("%s is triggering %s (last seen %s)", entry.Source, rule.name, entry.LastSeen.Format(time.RFC3339)),
+		})
+	}
+	return alerts
+}
+
+// Lists the enabled rules, built-in, declarative and Sigma
+func (p *Parser) Rules() []RuleInfo {
+	infos := make([]RuleInfo, 0, len(p.schedule))
+	for _, rule := range p.schedule {
+		interval := p.intervalOf(rule)
+
+		cooldown := rule.cooldown
+		if cooldown <= 0 {
+			cooldown = p.RuleConfig.Alerting.Cooldown
+		}
+		if cooldown <= 0 {
+			cooldown = defaultAlertCooldown
+		}
+
+		infos = append(infos, RuleInfo{
+			Name:       rule.name,
+			Files:      rule.fileNames,
+			Window:     rule.window.String(),
+			Interval:   interval.String(),
+			Threshold:  rule.threshold,
+			Severity:   rule.severity,
+			Techniques: rule.techniques,
+			Cooldown:   cooldown.String(),
+			Params:     p.RuleConfig.Rules[rule.name].Params,
+		})
+	}
+
+	return infos
+}
@@ -0,0 +1,140 @@
+package parser
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	alert "github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/alerting"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestScheduleSkipsOverlappingPasses(t *testing.T) {
+	// Every skipped pass is logged as a warning
+	var warnings bytes.Buffer
+	output := log.StandardLogger().Out
+	log.SetOutput(&warnings)
+	t.Cleanup(func() { log.SetOutput(output) })
+
+	var slowRuns, fastRuns, hourlyRuns atomic.Int32
+	started, release := make(chan struct{}), make(chan struct{})
+	slow := &scheduledRule{name: "slow", interval: 10 * time.Millisecond, run: func() {
+		if slowRuns.Add(1) == 1 {
+			close(started)
+			<-release
+		}
+	}}
+	fast := &scheduledRule{name: "fast", interval: 10 * time.Millisecond, run: func() { fastRuns.Add(1) }}
+	hourly := &scheduledRule{name: "hourly", interval: time.Hour, run: func() { hourlyRuns.Add(1) }}
+	p := &Parser{schedule: []*scheduledRule{slow, fast, hourly}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	scheduleEnded := make(chan struct{})
+	go func() {
+		defer close(scheduleEnded)
+		p.runSchedule(ctx)
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the slow rule never ran")
+	}
+	fastBefore := fastRuns.Load()
+	time.Sleep(100 * time.Millisecond)
+
+	// About ten ticks of the slow rule fell within its first pass, none of them ran
+	if runs := slowRuns.Load(); runs != 1 {
+		t.Errorf("%d passes of the slow rule while it was evaluating, want 1", runs)
+	}
+	// The other rules keep their own cadence
+	if runs := fastRuns.Load() - fastBefore; runs < 3 {
+		t.Errorf("%d passes of the fast rule while the slow one was evaluating, want about 10", runs)
+	}
+	if runs := hourlyRuns.Load(); runs != 0 {
+		t.Errorf("%d passes of the hourly rule, want none", runs)
+	}
+
+	// The skipped ticks were not queued, releasing the pass does not run them one after the other
+	close(release)
+	cancel()
+	<-scheduleEnded
+	if runs := slowRuns.Load(); runs > 2 {
+		t.Errorf("%d passes of the slow rule once released, the skipped ticks were queued", runs)
+	}
+	if skipped := strings.Count(warnings.String(), "Rule: slow is still running from its previous interval, skipping..."); skipped < 3 {
+		t.Errorf("%d passes of the slow rule skipped, want about 10", skipped)
+	}
+	if strings.Contains(warnings.String(), "Rule: fast") {
+		t.Error("passes of the fast rule were skipped")
+	}
+}
+
+func TestTryRunWithActiveAlerts(t *testing.T) {
+	suppressor, suppressorErr := alert.NewSuppressor(filepath.Join(t.TempDir(), "alert_state.json"), time.Minute, 0, time.Minute)
+	if suppressorErr != nil {
+		t.Fatal(suppressorErr)
+	}
+	p := &Parser{source: newStreamWindow(time.Hour), suppressor: suppressor}
+
+	runs := 0
+	rule := &scheduledRule{name: "test", fileNames: []string{"network.log"}, window: time.Hour, run: func() { runs++ }}
+
+	// Nothing streamed, the pass is skipped
+	p.tryRun(rule)
+	if runs != 0 {
+		t.Fatalf("%d runs without events, want 0", runs)
+	}
+
+	// An alert waiting to be resolved still needs passes without new events
+	suppressor.Observe("test", "10.0.0.9", 60, 0, time.Now())
+	p.tryRun(rule)
+	p.tryRun(rule)
+	if runs != 2 {
+		t.Errorf("%d runs with an active alert, want 2", runs)
+	}
+
+	// Files are read on every pass, there is no stream to tell whether they changed
+	filePass := &Parser{}
+	filePass.tryRun(rule)
+	if runs != 3 {
+		t.Errorf("%d runs reading the files, want 3", runs)
+	}
+}
+
+func TestActiveAlertsAfterRestart(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "alert_state.json")
+	suppressor, suppressorErr := alert.NewSuppressor(stateFile, time.Minute, 0, time.Minute)
+	if suppressorErr != nil {
+		t.Fatal(suppressorErr)
+	}
+	alerted := time.Now().Add(-time.Minute).Truncate(time.Second)
+	suppressor.Observe("scan_detection", "10.0.0.9", 60, 0, alerted)
+	suppressor.Observe("rdp_brute_force", "10.0.0.10", 7, 0, alerted)
+
+	// Restarted with rdp_brute_force disabled, the alert state was persisted when alerting
+	restored, restoredErr := alert.NewSuppressor(stateFile, time.Minute, 0, time.Minute)
+	if restoredErr != nil {
+		t.Fatal(restoredErr)
+	}
+	p := &Parser{
+		schedule:   []*scheduledRule{{name: "scan_detection", threshold: 50, severity: alert.SeverityMedium, techniques: []string{"T1046"}}},
+		suppressor: restored,
+	}
+
+	alerts := p.ActiveAlerts()
+	if len(alerts) != 1 {
+		t.Fatalf("%d active alerts, want 1", len(alerts))
+	}
+	if a := alerts[0]; a.Rule != "scan_detection" || a.Entity != "10.0.0.9" || a.Status != alert.StatusFiring || a.Severity != alert.SeverityMedium || a.Count != 60 || a.Threshold != 50 || !a.Time.Equal(alerted) || a.ID == "" {
+		t.Errorf("active alert %+v", a)
+	}
+
+	if alerts := (&Parser{}).ActiveAlerts(); len(alerts) != 0 {
+		t.Errorf("%d active alerts before Init", len(alerts))
+	}
+}
@@ -0,0 +1,555 @@
+package parser
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	alert "github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/alerting"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/config"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/eventfield"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// Sigma rules without a timeframe look back as far as the built-in rules do
+const defaultSigmaWindow = time.Minute
+
+// sigmaDocument is the subset of the Sigma rule format the parser understands
+type sigmaDocument struct {
+	Title     string                 `yaml:"title"`
+	ID        string                 `yaml:"id"`
+	Status    string                 `yaml:"status"`
+	Level     string                 `yaml:"level"`
+	Tags      []string               `yaml:"tags"`
+	LogSource config.SigmaLogSource  `yaml:"logsource"`
+	Detection map[string]interface{} `yaml:"detection"`
+}
+
+type sigmaRule struct {
+	title       string
+	id          string
+	level       string
+	tags        []string
+	severity    alert.Severity
+	techniques  []string // MITRE ATT&CK technique IDs taken from the attack.tXXXX tags
+	fileNames   []string
+	condition   sigmaExpr
+	aggregation *sigmaAggregation
+	window      time.Duration
+	entity      []string // fields naming the offender of a match when the rule does not group by one
+
+	lastArrival uint64 // rules without an aggregation only look at entries that arrived after the previous pass
+}
+
+// Loads every .yml/.yaml Sigma rule in the configured directory. Rules that cannot be mapped to a provider
+// or use unsupported features are skipped with a warning so one bad rule does not stop the others
+func loadSigmaRules(sigmaConfig config.SigmaConfig) ([]*sigmaRule, error) {
+	providersFile := sigmaConfig.ProvidersFile
+	if providersFile == "" {
+		providersFile = "config/providers.yml"
+	}
+
+	providersConfig, providerParseErr := config.NewProvidersFromYaml(providersFile)
+	if providerParseErr != nil {
+		return nil, fmt.Errorf("unable to load providers for sigma logsource mapping: %w", providerParseErr)
+	}
+
+	paths, globErr := filepath.Glob(filepath.Join(sigmaConfig.RulesDir, "*.y*ml"))
+	if globErr != nil {
+		return nil, fmt.Errorf("unable to list sigma rules in '%s': %w", sigmaConfig.RulesDir, globErr)
+	}
+	sort.Strings(paths)
+
+	var rules []*sigmaRule
+	for _, rulePath := range paths {
+		rule, loadErr := loadSigmaRule(rulePath, sigmaConfig, providersConfig)
+		if loadErr != nil {
+			log.WithError(loadErr).Warnf("Sigma rule: %s cannot be used, skipping...", rulePath)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+func loadSigmaRule(rulePath string, sigmaConfig config.SigmaConfig, providersConfig *config.Providers) (*sigmaRule, error) {
+	file, readFileErr := os.ReadFile(rulePath)
+	if readFileErr != nil {
+		return nil, readFileErr
+	}
+
+	var document sigmaDocument
+	if unMarshallErr := yaml.Unmarshal(file, &document); unMarshallErr != nil {
+		return nil, fmt.Errorf("error unmarshalling YAML data: %w", unMarshallErr)
+	}
+
+	severity, severityErr := alert.ParseSeverity(document.Level)
+	if severityErr != nil {
+		return nil, severityErr
+	}
+
+	rule := &sigmaRule{
+		title:    document.Title,
+		id:       document.ID,
+		level:    document.Level,
+		tags:     document.Tags,
+		severity: severity,
+		window:   defaultSigmaWindow,
+	}
+	rule.entity = append(rule.entity, mapSigmaField("SourceIp", sigmaConfig.FieldMapping)...)
+	rule.entity = append(rule.entity, mapSigmaField("User", sigmaConfig.FieldMapping)...)
+
+	for _, tag := range document.Tags {
+		if technique, ok := strings.CutPrefix(strings.ToLower(tag), "attack.t"); ok && technique != "" && unicode.IsDigit(rune(technique[0])) {
+			rule.techniques = append(rule.techniques, "T"+strings.ToUpper(technique))
+		}
+	}
+
+	fileNames, mappingErr := mapSigmaLogSource(document.LogSource, sigmaConfig.LogSources, providersConfig)
+	if mappingErr != nil {
+		return nil, mappingErr
+	}
+	rule.fileNames = fileNames
+
+	selections := make(map[string]sigmaExpr)
+	var conditions []string
+	for name, value := range document.Detection {
+		switch name {
+		case "condition":
+			switch condition := value.(type) {
+			case string:
+				conditions = append(conditions, condition)
+			case []interface{}:
+				for _, c := range condition {
+					conditions = append(conditions, fmt.Sprint(c))
+				}
+			}
+		case "timeframe":
+			timeframe, timeframeErr := parseSigmaTimeframe(fmt.Sprint(value))
+			if timeframeErr != nil {
+				return nil, timeframeErr
+			}
+			rule.window = timeframe
+		default:
+			selection, selectionErr := newSigmaSelection(value, sigmaConfig.FieldMapping)
+			if selectionErr != nil {
+				return nil, fmt.Errorf("selection %s: %w", name, selectionErr)
+			}
+			selections[name] = selection
+		}
+	}
+
+	if len(conditions) == 0 {
+		return nil, fmt.Errorf("rule has no condition")
+	}
+
+	// A list of conditions is equivalent to or-ing them, an aggregation is only supported on a single condition
+	var exprs sigmaOr
+	for _, condition := range conditions {
+		expr, aggregation, conditionErr := parseSigmaCondition(condition, selections)
+		if conditionErr != nil {
+			return nil, conditionErr
+		}
+		if aggregation != nil {
+			if len(conditions) > 1 {
+				return nil, fmt.Errorf("aggregations are only supported with a single condition")
+			}
+			aggregation.fieldCandidates = mapSigmaField(aggregation.field, sigmaConfig.FieldMapping)
+			aggregation.groupByCandidates = mapSigmaField(aggregation.groupBy, sigmaConfig.FieldMapping)
+			rule.aggregation = aggregation
+		}
+		exprs = append(exprs, expr)
+	}
+	rule.condition = exprs
+
+	return rule, nil
+}
+
+// Finds the provider log files whose logsource mapping agrees with every logsource attribute the rule sets
+func mapSigmaLogSource(logSource config.SigmaLogSource, mappings []config.SigmaLogSource, providersConfig *config.Providers) ([]string, error) {
+	agrees := func(ruleValue, mappingValue string) bool {
+		return ruleValue == "" || strings.EqualFold(ruleValue, mappingValue)
+	}
+
+	var fileNames []string
+	for _, mapping := range mappings {
+		if !agrees(logSource.Product, mapping.Product) || !agrees(logSource.Category, mapping.Category) || !agrees(logSource.Service, mapping.Service) {
+			continue
+		}
+
+		for _, providerKey := range mapping.Providers {
+			provider, ok := providersConfig.Providers[providerKey]
+			if !ok {
+				return nil, fmt.Errorf("logsource mapping references unknown provider '%s'", providerKey)
+			}
+			if !contains(fileNames, provider.LogFile) {
+				fileNames = append(fileNames, provider.LogFile)
+			}
+		}
+	}
+
+	if len(fileNames) == 0 {
+		return nil, fmt.Errorf("no provider is mapped to logsource product=%s category=%s service=%s", logSource.Product, logSource.Category, logSource.Service)
+	}
+
+	return fileNames, nil
+}
+
+// Sigma field names resolve to the first mapped field an entry carries, unmapped names are used as is
+func mapSigmaField(field string, fieldMapping map[string][]string) []string {
+	if field == "" {
+		return nil
+	}
+	if mapped, ok := fieldMapping[field]; ok && len(mapped) > 0 {
+		return mapped
+	}
+	return []string{field}
+}
+
+// Returns the value of the first candidate field the entry carries, EventID is not a field but is available to rules
+func sigmaFieldValue(entry LogEntry, candidates []string) (interface{}, bool) {
+	for _, field := range candidates {
+		if field == "EventID" {
+			return int64(entry.EventID), true
+		}
+		if value, ok := entry.Fields[field]; ok {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+// Sigma timeframes use s, m, h and d suffixes
+func parseSigmaTimeframe(timeframe string) (time.Duration, error) {
+	if strings.HasSuffix(timeframe, "d") {
+		days, convertErr := strconv.Atoi(strings.TrimSuffix(timeframe, "d"))
+		if convertErr != nil {
+			return 0, fmt.Errorf("invalid timeframe '%s': %w", timeframe, convertErr)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+
+	duration, parseErr := time.ParseDuration(timeframe)
+	if parseErr != nil {
+		return 0, fmt.Errorf("invalid timeframe '%s': %w", timeframe, parseErr)
+	}
+	return duration, nil
+}
+
+// A selection is either a map of field conditions that must all hold, a list of such maps where any may
+// hold, or a list of keywords matched against every field value
+func newSigmaSelection(value interface{}, fieldMapping map[string][]string) (sigmaExpr, error) {
+	switch selection := value.(type) {
+	case map[string]interface{}:
+		return newSigmaFieldSelection(selection, fieldMapping)
+	case []interface{}:
+		var or sigmaOr
+		var keywords []string
+		for _, item := range selection {
+			if fieldMap, ok := item.(map[string]interface{}); ok {
+				expr, selectionErr := newSigmaFieldSelection(fieldMap, fieldMapping)
+				if selectionErr != nil {
+					return nil, selectionErr
+				}
+				or = append(or, expr)
+			} else {
+				keywords = append(keywords, fmt.Sprint(item))
+			}
+		}
+
+		if len(keywords) > 0 {
+			matchers, matcherErr := newSigmaValueMatchers(keywords, []string{"contains"})
+			if matcherErr != nil {
+				return nil, matcherErr
+			}
+			or = append(or, sigmaKeywords(matchers))
+		}
+		return or, nil
+	default:
+		return nil, fmt.Errorf("unsupported selection type %T", value)
+	}
+}
+
+func newSigmaFieldSelection(selection map[string]interface{}, fieldMapping map[string][]string) (sigmaExpr, error) {
+	var and sigmaAnd
+	for key, value := range selection {
+		parts := strings.Split(key, "|")
+		field, modifiers := parts[0], parts[1:]
+
+		var values []string
+		isNull := false
+		switch v := value.(type) {
+		case nil:
+			isNull = true
+		case []interface{}:
+			for _, item := range v {
+				values = append(values, fmt.Sprint(item))
+			}
+		default:
+			values = append(values, fmt.Sprint(v))
+		}
+
+		matchAll := false
+		var valueModifiers []string
+		for _, modifier := range modifiers {
+			if modifier == "all" {
+				matchAll = true
+			} else {
+				valueModifiers = append(valueModifiers, modifier)
+			}
+		}
+
+		matcher := sigmaFieldMatcher{
+			fields:   mapSigmaField(field, fieldMapping),
+			isNull:   isNull,
+			matchAll: matchAll,
+		}
+
+		if !isNull {
+			matchers, matcherErr := newSigmaValueMatchers(values, valueModifiers)
+			if matcherErr != nil {
+				return nil, fmt.Errorf("field %s: %w", field, matcherErr)
+			}
+			matcher.values = matchers
+		}
+
+		and = append(and, matcher)
+	}
+
+	return and, nil
+}
+
+type sigmaFieldMatcher struct {
+	fields   []string // mapped candidates for the Sigma field name
+	values   []func(interface{}) bool
+	isNull   bool // field: null matches entries that do not carry the field
+	matchAll bool
+}
+
+func (m sigmaFieldMatcher) match(entry LogEntry) bool {
+	value, ok := sigmaFieldValue(entry, m.fields)
+	if m.isNull {
+		return !ok || eventfield.String(value) == ""
+	}
+	if !ok {
+		return false
+	}
+
+	for _, matchValue := range m.values {
+		matched := matchValue(value)
+		if matched && !m.matchAll {
+			return true
+		}
+		if !matched && m.matchAll {
+			return false
+		}
+	}
+
+	return m.matchAll
+}
+
+type sigmaKeywords []func(interface{}) bool
+
+func (k sigmaKeywords) match(entry LogEntry) bool {
+	for _, value := range entry.Fields {
+		for _, matchValue := range k {
+			if matchValue(value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Builds a matcher per value, supporting the contains, startswith, endswith, re, cidr, gt, gte, lt and lte
+// modifiers. Plain values support the Sigma * and ? wildcards and, like Sigma, match case-insensitively
+func newSigmaValueMatchers(values []string, modifiers []string) ([]func(interface{}) bool, error) {
+	mode := ""
+	for _, modifier := range modifiers {
+		switch modifier {
+		case "contains", "startswith", "endswith", "re", "cidr", "gt", "gte", "lt", "lte":
+			if mode != "" {
+				return nil, fmt.Errorf("modifiers %s and %s cannot be combined", mode, modifier)
+			}
+			mode = modifier
+		default:
+			return nil, fmt.Errorf("unsupported modifier '%s'", modifier)
+		}
+	}
+
+	var matchers []func(interface{}) bool
+	for _, value := range values {
+		switch mode {
+		case "re":
+			re, compileErr := regexp.Compile(value)
+			if compileErr != nil {
+				return nil, fmt.Errorf("invalid regex '%s': %w", value, compileErr)
+			}
+			matchers = append(matchers, textMatcher(re.MatchString))
+		case "cidr":
+			prefix, parseErr := netip.ParsePrefix(value)
+			if parseErr != nil {
+				return nil, fmt.Errorf("invalid cidr '%s': %w", value, parseErr)
+			}
+			matchers = append(matchers, func(v interface{}) bool {
+				addr, ok := eventfield.Addr(v)
+				return ok && prefix.Contains(addr.Unmap())
+			})
+		case "gt", "gte", "lt", "lte":
+			bound, parseErr := strconv.ParseInt(value, 10, 64)
+			if parseErr != nil {
+				return nil, fmt.Errorf("modifier %s requires an integer, got '%s'", mode, value)
+			}
+			matchers = append(matchers, intMatcher(mode, bound))
+		default:
+			pattern := sigmaWildcardPattern(value)
+			switch mode {
+			case "contains":
+				pattern = ".*" + pattern + ".*"
+			case "startswith":
+				pattern = pattern + ".*"
+			case "endswith":
+				pattern = ".*" + pattern
+			}
+
+			re, compileErr := regexp.Compile("(?is)^" + pattern + "$")
+			if compileErr != nil {
+				return nil, fmt.Errorf("invalid value '%s': %w", value, compileErr)
+			}
+			matchers = append(matchers, textMatcher(re.MatchString))
+		}
+	}
+
+	return matchers, nil
+}
+
+// Translates a Sigma value into a regular expression, * and ? are wildcards unless escaped with a backslash.
+// Like Sigma, a backslash only escapes *, ? and itself, e.g. CORP\admin* keeps its backslash
+func sigmaWildcardPattern(value string) string {
+	var pattern strings.Builder
+	runes := []rune(value)
+	for i := 0; i < len(runes); i++ {
+		switch r := runes[i]; {
+		case r == '\\' && i+1 < len(runes) && strings.ContainsRune(`*?\`, runes[i+1]):
+			i++
+			pattern.WriteString(regexp.QuoteMeta(string(runes[i])))
+		case r == '*':
+			pattern.WriteString(".*")
+		case r == '?':
+			pattern.WriteString(".")
+		default:
+			pattern.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+
+	return pattern.String()
+}
+
+// Evaluates the rule over its window. Without an aggregation the matches of each source address (or user)
+// make up a finding, otherwise every group satisfying the aggregation is a finding
+func (r *sigmaRule) evaluate(le LogEntries) []Finding {
+	if r.aggregation == nil {
+		entityFindings := make(map[string]*Finding)
+		for _, entry := range le.Entries {
+			if !r.condition.match(entry) {
+				continue
+			}
+
+			entity := ""
+			if value, ok := sigmaFieldValue(entry, r.entity); ok {
+				entity = eventfield.String(value)
+			}
+			finding, exists := entityFindings[entity]
+			if !exists {
+				finding = &Finding{Source: entity}
+				entityFindings[entity] = finding
+			}
+			finding.Count++
+			finding.Observe(entry.Time)
+			finding.AddEvidence(entry)
+		}
+
+		var findings []Finding
+		for entity, finding := range entityFindings {
+			if entity == "" {
+				finding.Message = fmt.Sprintf("Sigma rule '%s' matched %d events (level: %s)", r.title, finding.Count, r.level)
+			} else {
+				finding.Message = fmt.Sprintf("Sigma rule '%s' matched %d events from %s (level: %s)", r.title, finding.Count, entity, r.level)
+			}
+			findings = append(findings, *finding)
+		}
+
+		sortFindings(findings)
+		return findings
+	}
+
+	groupFindings := make(map[string]*Finding)
+	distinct := make(map[string]map[string]bool)
+	for _, entry := range le.Entries {
+		if !r.condition.match(entry) {
+			continue
+		}
+
+		group := ""
+		if r.aggregation.groupBy != "" {
+			value, ok := sigmaFieldValue(entry, r.aggregation.groupByCandidates)
+			if !ok {
+				continue
+			}
+			group = eventfield.String(value)
+		}
+
+		finding, exists := groupFindings[group]
+		if !exists {
+			finding = &Finding{Source: group}
+			groupFindings[group] = finding
+		}
+
+		if r.aggregation.field == "" {
+			finding.Count++
+			finding.Observe(entry.Time)
+			finding.AddEvidence(entry)
+			continue
+		}
+
+		value, ok := sigmaFieldValue(entry, r.aggregation.fieldCandidates)
+		if !ok {
+			continue
+		}
+		if distinct[group] == nil {
+			distinct[group] = make(map[string]bool)
+		}
+		if text := eventfield.String(value); !distinct[group][text] {
+			distinct[group][text] = true
+			finding.Count++
+			finding.AddEvidence(entry)
+		}
+		finding.Observe(entry.Time)
+	}
+
+	var findings []Finding
+	for group, finding := range groupFindings {
+		if !r.aggregation.compare(finding.Count) {
+			continue
+		}
+
+		if group == "" {
+			finding.Message = fmt.Sprintf("Sigma rule '%s' matched (count %d, level: %s)", r.title, finding.Count, r.level)
+		} else {
+			finding.Message = fmt.Sprintf("Sigma rule '%s' matched for %s (count %d, level: %s)", r.title, group, finding.Count, r.level)
+		}
+		findings = append(findings, *finding)
+	}
+
+	sortFindings(findings)
+	return findings
+}
@@ -0,0 +1,309 @@
+package parser
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// sigmaExpr is a compiled Sigma condition evaluated against a single log entry
+type sigmaExpr interface {
+	match(entry LogEntry) bool
+}
+
+type sigmaAnd []sigmaExpr
+
+func (e sigmaAnd) match(entry LogEntry) bool {
+	for _, expr := range e {
+		if !expr.match(entry) {
+			return false
+		}
+	}
+	return true
+}
+
+type sigmaOr []sigmaExpr
+
+func (e sigmaOr) match(entry LogEntry) bool {
+	for _, expr := range e {
+		if expr.match(entry) {
+			return true
+		}
+	}
+	return false
+}
+
+type sigmaNot struct{ expr sigmaExpr }
+
+func (e sigmaNot) match(entry LogEntry) bool { return !e.expr.match(entry) }
+
+// sigmaAggregation is the part of a condition after the pipe, e.g. count(LocalSockAddr_PORT) by SourceIp > 10
+type sigmaAggregation struct {
+	field    string // empty for count()
+	groupBy  string // empty when not grouped
+	operator string
+	value    int
+
+	fieldCandidates   []string // field and groupBy after the field mapping is applied
+	groupByCandidates []string
+}
+
+func (a *sigmaAggregation) compare(count int) bool {
+	switch a.operator {
+	case ">":
+		return count > a.value
+	case ">=":
+		return count >= a.value
+	case "<":
+		return count < a.value
+	case "<=":
+		return count <= a.value
+	default:
+		return count == a.value
+	}
+}
+
+// The count the aggregation fires at, the upper bound for < and <=, e.g. 21 for count() > 20
+func (a *sigmaAggregation) threshold() int {
+	switch a.operator {
+	case ">":
+		return a.value + 1
+	case "<":
+		return a.value - 1
+	default:
+		return a.value
+	}
+}
+
+// Parses a condition such as "selection and not 1 of filter_*" or "selection | count() by SourceIp > 5",
+// resolving selection names against the compiled selections of the rule
+func parseSigmaCondition(condition string, selections map[string]sigmaExpr) (sigmaExpr, *sigmaAggregation, error) {
+	expression, aggregation, _ := strings.Cut(condition, "|")
+
+	p := &sigmaConditionParser{tokens: tokenizeSigma(expression), selections: selections}
+	expr, parseErr := p.parseOr()
+	if parseErr != nil {
+		return nil, nil, fmt.Errorf("invalid condition '%s': %w", condition, parseErr)
+	}
+	if p.pos != len(p.tokens) {
+		return nil, nil, fmt.Errorf("invalid condition '%s': unexpected '%s'", condition, p.tokens[p.pos])
+	}
+
+	if strings.TrimSpace(aggregation) == "" {
+		return expr, nil, nil
+	}
+
+	agg, aggErr := parseSigmaAggregation(aggregation)
+	if aggErr != nil {
+		return nil, nil, fmt.Errorf("invalid condition '%s': %w", condition, aggErr)
+	}
+
+	return expr, agg, nil
+}
+
+func tokenizeSigma(expression string) []string {
+	var tokens []string
+	var current strings.Builder
+
+	flush := func() {
+		if current.Len() > 0 {
+			tokens = append(tokens, current.String())
+			current.Reset()
+		}
+	}
+
+	for _, r := range expression {
+		switch {
+		case unicode.IsSpace(r):
+			flush()
+		case r == '(' || r == ')':
+			flush()
+			tokens = append(tokens, string(r))
+		default:
+			current.WriteRune(r)
+		}
+	}
+	flush()
+
+	return tokens
+}
+
+type sigmaConditionParser struct {
+	tokens     []string
+	pos        int
+	selections map[string]sigmaExpr
+}
+
+func (p *sigmaConditionParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return strings.ToLower(p.tokens[p.pos])
+	}
+	return ""
+}
+
+func (p *sigmaConditionParser) parseOr() (sigmaExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	or := sigmaOr{left}
+	for p.peek() == "or" {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		or = append(or, right)
+	}
+
+	if len(or) == 1 {
+		return left, nil
+	}
+	return or, nil
+}
+
+func (p *sigmaConditionParser) parseAnd() (sigmaExpr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	and := sigmaAnd{left}
+	for p.peek() == "and" {
+		p.pos++
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		and = append(and, right)
+	}
+
+	if len(and) == 1 {
+		return left, nil
+	}
+	return and, nil
+}
+
+func (p *sigmaConditionParser) parseNot() (sigmaExpr, error) {
+	if p.peek() == "not" {
+		p.pos++
+		expr, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return sigmaNot{expr}, nil
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *sigmaConditionParser) parsePrimary() (sigmaExpr, error) {
+	token := p.peek()
+	switch token {
+	case "":
+		return nil, fmt.Errorf("unexpected end of condition")
+	case "(":
+		p.pos++
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		p.pos++
+		return expr, nil
+	case "1", "all":
+		if p.pos+2 < len(p.tokens) && strings.ToLower(p.tokens[p.pos+1]) == "of" {
+			pattern := p.tokens[p.pos+2]
+			p.pos += 3
+			return p.resolveOf(pattern, token == "all")
+		}
+	}
+
+	name := p.tokens[p.pos]
+	selection, ok := p.selections[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown selection '%s'", name)
+	}
+	p.pos++
+
+	return selection, nil
+}
+
+// Resolves "1 of pattern" and "all of pattern", "them" refers to every selection
+func (p *sigmaConditionParser) resolveOf(pattern string, all bool) (sigmaExpr, error) {
+	var names []string
+	for name := range p.selections {
+		if pattern == "them" {
+			// By convention selections starting with an underscore are excluded from "them"
+			if !strings.HasPrefix(name, "_") {
+				names = append(names, name)
+			}
+			continue
+		}
+
+		if matched, _ := path.Match(pattern, name); matched {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no selection matches '%s'", pattern)
+	}
+	sort.Strings(names)
+
+	exprs := make([]sigmaExpr, 0, len(names))
+	for _, name := range names {
+		exprs = append(exprs, p.selections[name])
+	}
+
+	if all {
+		return sigmaAnd(exprs), nil
+	}
+	return sigmaOr(exprs), nil
+}
+
+// Parses "count() > 5", "count(field) > 5", "count() by field >= 5" and "count(field) by field > 5"
+func parseSigmaAggregation(aggregation string) (*sigmaAggregation, error) {
+	fields := strings.Fields(aggregation)
+	if len(fields) < 3 || !strings.HasPrefix(strings.ToLower(fields[0]), "count(") || !strings.HasSuffix(fields[0], ")") {
+		return nil, fmt.Errorf("only count() aggregations are supported")
+	}
+
+	agg := &sigmaAggregation{
+		field: strings.TrimSuffix(fields[0][len("count("):], ")"),
+	}
+
+	rest := fields[1:]
+	if strings.ToLower(rest[0]) == "by" {
+		if len(rest) < 4 {
+			return nil, fmt.Errorf("incomplete aggregation '%s'", aggregation)
+		}
+		agg.groupBy = rest[1]
+		rest = rest[2:]
+	}
+
+	if len(rest) != 2 {
+		return nil, fmt.Errorf("incomplete aggregation '%s'", aggregation)
+	}
+
+	switch rest[0] {
+	case ">", ">=", "<", "<=", "=", "==":
+		agg.operator = rest[0]
+	default:
+		return nil, fmt.Errorf("unknown aggregation operator '%s'", rest[0])
+	}
+
+	value, convertErr := strconv.Atoi(rest[1])
+	if convertErr != nil {
+		return nil, fmt.Errorf("aggregation threshold must be an integer: %w", convertErr)
+	}
+	agg.value = value
+
+	return agg, nil
+}
@@ -0,0 +1,400 @@
+package parser
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/config"
+)
+
+const testSigmaRule = `title: Inbound RDP Connection
+id: 5b0e4f8a-2d4c-4c61-9a57-0f3c1e9b2d10
+level: low
+logsource:
+  product: windows
+  category: network_connection
+detection:
+  selection:
+    DestinationPort: 3389
+  condition: selection
+`
+
+// Loads the rules from a directory of files named after their position, with the network logsource mapped
+func loadTestSigmaRules(t *testing.T, documents ...string) []*sigmaRule {
+	t.Helper()
+
+	dir := t.TempDir()
+	for i, document := range documents {
+		if writeErr := os.WriteFile(filepath.Join(dir, fmt.Sprintf("rule%d.yml", i)), []byte(document), 0600); writeErr != nil {
+			t.Fatal(writeErr)
+		}
+	}
+	rules, loadErr := loadSigmaRules(config.SigmaConfig{
+		RulesDir:      dir,
+		ProvidersFile: filepath.Join(testConfigDir, "providers.yml"),
+		LogSources:    []config.SigmaLogSource{{Product: "windows", Category: "network_connection", Providers: []string{"TCIP-IP"}}},
+		FieldMapping: map[string][]string{
+			"SourceIp":        {"RemoteSockAddr_IP"},
+			"DestinationPort": {"LocalSockAddr_PORT"},
+		},
+	})
+	if loadErr != nil || len(rules) != len(documents) {
+		t.Fatalf("loaded %d rules: %v", len(rules), loadErr)
+	}
+	return rules
+}
+
+func TestSigmaFindingPerSource(t *testing.T) {
+	rules := loadTestSigmaRules(t, testSigmaRule)
+
+	var le LogEntries
+	now := time.Now()
+	for i, source := range []string{"10.0.0.9", "10.0.0.10", "10.0.0.9", "10.0.0.11"} {
+		port := uint16(3389)
+		if source == "10.0.0.11" {
+			port = 445
+		}
+		le.Insert(LogEntry{Time: now.Add(time.Duration(i) * time.Second), EventID: 1017, Fields: map[string]interface{}{
+			"RemoteSockAddr_IP":  netip.MustParseAddr(source),
+			"LocalSockAddr_PORT": port,
+		}})
+	}
+
+	var sources []string
+	var counts []int
+	for _, finding := range rules[0].evaluate(le) {
+		sources = append(sources, finding.Source)
+		counts = append(counts, finding.Count)
+	}
+	if !reflect.DeepEqual(sources, []string{"10.0.0.9", "10.0.0.10"}) || !reflect.DeepEqual(counts, []int{2, 1}) {
+		t.Errorf("findings for %q with counts %v", sources, counts)
+	}
+}
+
+func TestSigmaFindingPerHost(t *testing.T) {
+	rules := loadTestSigmaRules(t, testSigmaRule)
+
+	var le LogEntries
+	now := time.Now()
+	for i, host := range []string{"host-a", "host-b", "host-a", ""} {
+		le.Insert(LogEntry{Time: now.Add(time.Duration(i) * time.Second), EventID: 1017, Fields: map[string]interface{}{
+			"RemoteSockAddr_IP":  netip.MustParseAddr("10.0.0.9"),
+			"LocalSockAddr_PORT": uint16(3389),
+			"Host":               host,
+		}})
+	}
+
+	var sources []string
+	var counts []int
+	for _, finding := range perHost(le, rules[0].evaluate) {
+		sources = append(sources, finding.Source)
+		counts = append(counts, finding.Count)
+		if _, host, ok := strings.Cut(finding.Source, "@"); ok && !strings.HasPrefix(finding.Message, host+": ") {
+			t.Errorf("%s: message %q does not start with its host", finding.Source, finding.Message)
+		}
+	}
+	if !reflect.DeepEqual(sources, []string{"10.0.0.9@host-a", "10.0.0.9", "10.0.0.9@host-b"}) || !reflect.DeepEqual(counts, []int{2, 1, 1}) {
+		t.Errorf("findings for %q with counts %v", sources, counts)
+	}
+}
+
+func TestSigmaRulesNamedByID(t *testing.T) {
+	withoutID := strings.Replace(testSigmaRule, "id: 5b0e4f8a-2d4c-4c61-9a57-0f3c1e9b2d10\n", "", 1)
+	otherID := strings.Replace(testSigmaRule, "5b0e4f8a", "6c1f5a9b", 1)
+
+	var p Parser
+	var names []string
+	for _, rule := range loadTestSigmaRules(t, testSigmaRule, otherID, withoutID) {
+		names = append(names, p.newScheduledSigmaRule(rule, 0).name)
+	}
+
+	want := []string{
+		"sigma:5b0e4f8a-2d4c-4c61-9a57-0f3c1e9b2d10",
+		"sigma:6c1f5a9b-2d4c-4c61-9a57-0f3c1e9b2d10",
+		"sigma:Inbound RDP Connection",
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("rules named %q, want %q", names, want)
+	}
+}
+
+func TestSigmaAggregationThreshold(t *testing.T) {
+	tests := []struct {
+		condition string
+		threshold int
+		fires     []int // counts the aggregation fires at, among 19 to 22
+	}{
+		{"selection | count() > 20", 21, []int{21, 22}},
+		{"selection | count() >= 20", 20, []int{20, 21, 22}},
+		{"selection | count() < 20", 19, []int{19}},
+		{"selection | count() <= 20", 20, []int{19, 20}},
+		{"selection | count() = 20", 20, []int{20}},
+		{"selection | count(DestinationPort) by SourceIp == 20", 20, []int{20}},
+	}
+
+	for _, test := range tests {
+		_, aggregation, parseErr := parseSigmaCondition(test.condition, map[string]sigmaExpr{"selection": sigmaAnd{}})
+		if parseErr != nil {
+			t.Errorf("%s: %v", test.condition, parseErr)
+			continue
+		}
+
+		if threshold := aggregation.threshold(); threshold != test.threshold {
+			t.Errorf("%s: threshold %d, want %d", test.condition, threshold, test.threshold)
+		}
+		var fires []int
+		for count := 19; count <= 22; count++ {
+			if aggregation.compare(count) {
+				fires = append(fires, count)
+			}
+		}
+		if !reflect.DeepEqual(fires, test.fires) {
+			t.Errorf("%s: fires at %v, want %v", test.condition, fires, test.fires)
+		}
+	}
+}
+
+// sigmaPresent is a selection matching the entries carrying the field
+type sigmaPresent string
+
+func (p sigmaPresent) match(entry LogEntry) bool {
+	_, ok := entry.Fields[string(p)]
+	return ok
+}
+
+func TestSigmaCondition(t *testing.T) {
+	selections := map[string]sigmaExpr{
+		"sel_a":    sigmaPresent("a"),
+		"sel_b":    sigmaPresent("b"),
+		"filter_c": sigmaPresent("c"),
+		"filter_d": sigmaPresent("d"),
+		"_hidden":  sigmaPresent("hidden"),
+	}
+
+	tests := []struct {
+		condition string
+		fields    []string // the fields of the entry, i.e. the selections it matches
+		want      bool
+	}{
+		{"sel_a", []string{"a"}, true},
+		{"sel_a", []string{"b"}, false},
+		{"sel_a and sel_b", []string{"a"}, false},
+		{"sel_a and sel_b", []string{"a", "b"}, true},
+		{"sel_a or sel_b", []string{"b"}, true},
+		{"sel_a AND NOT sel_b", []string{"a"}, true},
+		{"sel_a and not sel_b", []string{"a", "b"}, false},
+		{"not sel_a", nil, true},
+		{"not not sel_a", []string{"a"}, true},
+
+		// not binds tighter than and, and tighter than or
+		{"not sel_a or sel_b", []string{"a", "b"}, true},
+		{"not sel_a or sel_b", []string{"a"}, false},
+		{"not (sel_a or sel_b)", []string{"b"}, false},
+		{"not (sel_a or sel_b)", nil, true},
+		{"sel_a or sel_b and filter_c", []string{"a"}, true},
+		{"sel_a or sel_b and filter_c", []string{"b"}, false},
+		{"(sel_a or sel_b) and filter_c", []string{"a"}, false},
+		{"(sel_a or sel_b) and filter_c", []string{"b", "c"}, true},
+
+		{"1 of sel_*", []string{"b"}, true},
+		{"1 of sel_*", []string{"c"}, false},
+		{"all of sel_*", []string{"a"}, false},
+		{"all of sel_*", []string{"a", "b"}, true},
+		{"sel_a and not 1 of filter_*", []string{"a"}, true},
+		{"sel_a and not 1 of filter_*", []string{"a", "d"}, false},
+		{"1 of them", []string{"d"}, true},
+		{"1 of them", []string{"hidden"}, false},
+		{"all of them", []string{"a", "b", "c", "d"}, true},
+		{"all of them", []string{"a", "b", "c"}, false},
+		{"1 of _hidden", []string{"hidden"}, true},
+	}
+
+	for _, test := range tests {
+		expr, aggregation, parseErr := parseSigmaCondition(test.condition, selections)
+		if parseErr != nil {
+			t.Errorf("%s: %v", test.condition, parseErr)
+			continue
+		}
+		if aggregation != nil {
+			t.Errorf("%s: aggregation %+v", test.condition, aggregation)
+		}
+
+		entry := LogEntry{Fields: make(map[string]interface{})}
+		for _, field := range test.fields {
+			entry.Fields[field] = "x"
+		}
+		if got := expr.match(entry); got != test.want {
+			t.Errorf("%s: %v matched %t, want %t", test.condition, test.fields, got, test.want)
+		}
+	}
+}
+
+func TestSigmaConditionErrors(t *testing.T) {
+	selections := map[string]sigmaExpr{"selection": sigmaPresent("a"), "filter": sigmaPresent("b")}
+
+	for _, condition := range []string{
+		"",
+		"unknown",
+		"selection and",
+		"selection or or filter",
+		"not",
+		"(selection",
+		"selection)",
+		"()",
+		"selection filter",
+		"1 of",
+		"1 of missing_*",
+		"all of [",
+		"| count() > 5",
+		"selection | count()",
+		"selection | count() >",
+		"selection | count() > five",
+		"selection | count() ~ 5",
+		"selection | count() by",
+		"selection | count() by SourceIp",
+		"selection | count() by SourceIp > 5 6",
+		"selection | sum(Bytes) > 5",
+		"selection | count( > 5",
+	} {
+		if _, _, parseErr := parseSigmaCondition(condition, selections); parseErr == nil {
+			t.Errorf("%q: no error", condition)
+		}
+	}
+}
+
+func FuzzSigmaCondition(f *testing.F) {
+	f.Add("selection and not 1 of filter_* | count() by SourceIp > 20")
+	f.Add("(selection or not (filter)) and all of them")
+	f.Add("1 of | count(")
+	f.Add("not ( ( (")
+
+	selections := map[string]sigmaExpr{"selection": sigmaPresent("a"), "filter_local": sigmaPresent("b")}
+	f.Fuzz(func(t *testing.T, condition string) {
+		expr, _, parseErr := parseSigmaCondition(condition, selections)
+		if parseErr == nil {
+			expr.match(LogEntry{Fields: map[string]interface{}{"a": "x"}})
+		}
+	})
+}
+
+func TestSigmaModifiers(t *testing.T) {
+	tests := []struct {
+		name      string
+		selection map[string]interface{}
+		value     interface{} // the value of Field, nil leaves it out
+		want      bool
+	}{
+		{"plain", map[string]interface{}{"Field": "administrator"}, "administrator", true},
+		{"plain is case insensitive", map[string]interface{}{"Field": "Administrator"}, "ADMINISTRATOR", true},
+		{"plain is the whole value", map[string]interface{}{"Field": "admin"}, "administrator", false},
+		{"plain on a port", map[string]interface{}{"Field": 3389}, uint16(3389), true},
+		{"list is any value", map[string]interface{}{"Field": []interface{}{445, 3389}}, uint16(3389), true},
+		{"missing field", map[string]interface{}{"Field": "administrator"}, nil, false},
+		{"null on a missing field", map[string]interface{}{"Field": nil}, nil, true},
+		{"null on an empty field", map[string]interface{}{"Field": nil}, "", true},
+		{"null on a value", map[string]interface{}{"Field": nil}, "administrator", false},
+
+		{"wildcard *", map[string]interface{}{"Field": `CORP\admin*`}, `CORP\administrator`, true},
+		{"backslash before a letter", map[string]interface{}{"Field": `CORP\administrator`}, `CORP\administrator`, true},
+		{"wildcard ?", map[string]interface{}{"Field": "HOST0?"}, "HOST01", true},
+		{"wildcard ? is one character", map[string]interface{}{"Field": "HOST0?"}, "HOST012", false},
+		{"escaped *", map[string]interface{}{"Field": `a\*b`}, "a*b", true},
+		{"escaped * is literal", map[string]interface{}{"Field": `a\*b`}, "axxb", false},
+		{"escaped ?", map[string]interface{}{"Field": `what\?`}, "what?", true},
+		{"escaped backslash", map[string]interface{}{"Field": `CORP\\*`}, `CORP\admin`, true},
+		{"escaped backslash is one", map[string]interface{}{"Field": `CORP\\admin`}, `CORP\\admin`, false},
+		{"trailing backslash", map[string]interface{}{"Field": `CORP\`}, `CORP\`, true},
+		{"regex characters are literal", map[string]interface{}{"Field": "10.0.0.9"}, "10a0b0c9", false},
+
+		{"contains", map[string]interface{}{"Field|contains": "admin"}, `CORP\Administrator`, true},
+		{"contains not", map[string]interface{}{"Field|contains": "guest"}, `CORP\Administrator`, false},
+		{"startswith", map[string]interface{}{"Field|startswith": "corp"}, `CORP\administrator`, true},
+		{"startswith not", map[string]interface{}{"Field|startswith": "admin"}, `CORP\administrator`, false},
+		{"endswith", map[string]interface{}{"Field|endswith": "$"}, "HOST01$", true},
+		{"endswith wildcard", map[string]interface{}{"Field|endswith": "0?$"}, "HOST01$", true},
+
+		{"contains any", map[string]interface{}{"Field|contains": []interface{}{"admin", "guest"}}, "guest01", true},
+		{"contains all", map[string]interface{}{"Field|contains|all": []interface{}{"admin", "corp"}}, `CORP\administrator`, true},
+		{"contains all missing one", map[string]interface{}{"Field|contains|all": []interface{}{"admin", "guest"}}, `CORP\administrator`, false},
+		{"all before contains", map[string]interface{}{"Field|all|contains": []interface{}{"admin", "corp"}}, `CORP\administrator`, true},
+
+		{"re", map[string]interface{}{"Field|re": `^10\.0\.0\.\d+$`}, netip.MustParseAddr("10.0.0.9"), true},
+		{"re is case sensitive", map[string]interface{}{"Field|re": "^admin"}, "Administrator", false},
+		{"re unanchored", map[string]interface{}{"Field|re": "min"}, "administrator", true},
+
+		{"cidr", map[string]interface{}{"Field|cidr": "10.0.0.0/8"}, netip.MustParseAddr("10.20.9.66"), true},
+		{"cidr outside", map[string]interface{}{"Field|cidr": "10.0.0.0/8"}, netip.MustParseAddr("192.168.1.5"), false},
+		{"cidr any", map[string]interface{}{"Field|cidr": []interface{}{"127.0.0.0/8", "::1/128"}}, netip.MustParseAddr("::1"), true},
+		{"cidr ipv4-mapped", map[string]interface{}{"Field|cidr": "127.0.0.0/8"}, netip.MustParseAddr("::ffff:127.0.0.1"), true},
+		{"cidr on address text", map[string]interface{}{"Field|cidr": "10.0.0.0/8"}, "10.20.9.66", true},
+		{"cidr on text", map[string]interface{}{"Field|cidr": "10.0.0.0/8"}, "administrator", false},
+
+		{"gt", map[string]interface{}{"Field|gt": 1023}, uint16(1024), true},
+		{"gt equal", map[string]interface{}{"Field|gt": 1023}, uint16(1023), false},
+		{"gte", map[string]interface{}{"Field|gte": 1023}, uint16(1023), true},
+		{"lt", map[string]interface{}{"Field|lt": 1024}, int64(1023), true},
+		{"lt equal", map[string]interface{}{"Field|lt": 1024}, int64(1024), false},
+		{"lte", map[string]interface{}{"Field|lte": 1024}, int64(1024), true},
+		{"gt on numeric text", map[string]interface{}{"Field|gt": 10}, "11", true},
+		{"gt on text", map[string]interface{}{"Field|gt": 10}, "eleven", false},
+
+		{"every field must hold", map[string]interface{}{"Field": "administrator", "Other": "x"}, "administrator", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			selection, selectionErr := newSigmaSelection(test.selection, nil)
+			if selectionErr != nil {
+				t.Fatal(selectionErr)
+			}
+
+			entry := LogEntry{Fields: make(map[string]interface{})}
+			if test.value != nil {
+				entry.Fields["Field"] = test.value
+			}
+			if got := selection.match(entry); got != test.want {
+				t.Errorf("%v (%T) matched %t, want %t", test.value, test.value, got, test.want)
+			}
+		})
+	}
+}
+
+func TestSigmaKeywords(t *testing.T) {
+	selection, selectionErr := newSigmaSelection([]interface{}{"mimikatz", "psexe?"}, nil)
+	if selectionErr != nil {
+		t.Fatal(selectionErr)
+	}
+
+	for value, want := range map[string]bool{
+		`C:\Tools\Mimikatz.exe`: true,
+		"psexec -s cmd":         true,
+		"notepad.exe":           false,
+	} {
+		entry := LogEntry{Fields: map[string]interface{}{"Image": value, "User": "administrator"}}
+		if got := selection.match(entry); got != want {
+			t.Errorf("%s matched %t, want %t", value, got, want)
+		}
+	}
+}
+
+func TestSigmaModifierErrors(t *testing.T) {
+	for _, selection := range []map[string]interface{}{
+		{"Field|contains|startswith": "x"},
+		{"Field|base64": "x"},
+		{"Field|re": "("},
+		{"Field|cidr": "10.0.0.0"},
+		{"Field|cidr": []interface{}{"10.0.0.0/8", "not a prefix"}},
+		{"Field|gt": "ten"},
+		{"Field|lte": 1.5},
+	} {
+		if _, selectionErr := newSigmaSelection(selection, nil); selectionErr == nil {
+			t.Errorf("%v: no error", selection)
+		}
+	}
+}
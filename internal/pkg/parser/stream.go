@@ -0,0 +1,138 @@
+package parser
+
+import (
+	"sync"
+	"time"
+
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/bus"
+)
+
+// entrySource provides the log entries of the given provider log files that fall within a rule window
+type entrySource interface {
+	Entries(fileNames []string, startTime, endTime time.Time) LogEntries
+	// Like Entries, limited to the entries that arrived after the given arrival, and the last arrival so far
+	// to pass on the next call. Arrivals are counted from 1 in the order entries reached the source
+	EntriesSince(fileNames []string, arrival uint64, startTime, endTime time.Time) (LogEntries, uint64)
+}
+
+// streamWindow keeps the events published on the bus in memory, per log file, for as long as the
+// largest rule window needs them
+type streamWindow struct {
+	mu        sync.Mutex
+	retention time.Duration
+	entries   map[string][]streamedEntry
+	updated   map[string]time.Time // when the last event of each log file arrived, lets rules skip passes with no new events
+	arrivals  uint64
+
+	eventClock bool      // replays run on the timeline of their events, see Parser.UseEventClock
+	latest     time.Time // time of the latest event inserted, the clock of a replay
+}
+
+// streamedEntry is an entry with the time it arrived on this host. Forwarded events carry the clock of their
+// agent, so the window is kept by arrival and the event time is only used to select entries for a rule
+type streamedEntry struct {
+	LogEntry
+	arrived time.Time
+	arrival uint64
+}
+
+func newStreamWindow(retention time.Duration) *streamWindow {
+	return &streamWindow{
+		retention: retention,
+		entries:   make(map[string][]streamedEntry),
+		updated:   make(map[string]time.Time),
+	}
+}
+
+func (w *streamWindow) Insert(event bus.Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if event.Time.After(w.latest) {
+		w.latest = event.Time
+	}
+
+	// The arrival time, as rule passes are, an event raised before the last pass may arrive after it
+	now := w.now()
+	w.arrivals++
+	w.entries[event.LogFile] = append(w.prune(w.entries[event.LogFile], now), streamedEntry{LogEntry: entryFromEvent(event), arrived: now, arrival: w.arrivals})
+	w.updated[event.LogFile] = now
+}
+
+func (w *streamWindow) Entries(fileNames []string, startTime, endTime time.Time) LogEntries {
+	logEntries, _ := w.EntriesSince(fileNames, 0, startTime, endTime)
+	return logEntries
+}
+
+func (w *streamWindow) EntriesSince(fileNames []string, arrival uint64, startTime, endTime time.Time) (LogEntries, uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var logEntries LogEntries
+	for _, fileName := range fileNames {
+		w.entries[fileName] = w.prune(w.entries[fileName], w.now())
+		for _, entry := range w.entries[fileName] {
+			if entry.arrival > arrival && inWindow(entry.Time, startTime, endTime) {
+				logEntries.Insert(entry.LogEntry)
+			}
+		}
+	}
+
+	logEntries.Sort()
+	return logEntries, w.arrivals
+}
+
+// The clock rules run on, the time of the latest event during a replay
+func (w *streamWindow) Now() time.Time {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.now()
+}
+
+func (w *streamWindow) now() time.Time {
+	if w.eventClock {
+		return w.latest
+	}
+	return time.Now()
+}
+
+// Reports whether an event of any of the files arrived after the given time
+func (w *streamWindow) UpdatedSince(fileNames []string, since time.Time) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, fileName := range fileNames {
+		if w.updated[fileName].After(since) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Drops the entries that arrived before the retention window, entries are kept in arrival order
+func (w *streamWindow) prune(entries []streamedEntry, now time.Time) []streamedEntry {
+	cutoff := now.Add(-w.retention)
+	idx := 0
+	for idx < len(entries) && entries[idx].arrived.Before(cutoff) {
+		idx++
+	}
+
+	return entries[idx:]
+}
+
+// Mirrors processLogLine so rules see the same entries whether they come from the bus or the log files
+func entryFromEvent(event bus.Event) LogEntry {
+	entry := LogEntry{
+		Time:    event.Time,
+		EventID: event.EventID,
+		Fields:  typedFields(event.Fields),
+	}
+
+	// Events forwarded by agents carry their host, so rules can group by it
+	if event.Host != "" {
+		entry.Fields["Host"] = event.Host
+	}
+
+	return entry
+}
@@ -0,0 +1,141 @@
+package parser
+
+import (
+	"context"
+	"net/netip"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	alert "github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/alerting"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/bus"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/config"
+)
+
+func TestStreamRunsRulesOnLateTimestampedEvents(t *testing.T) {
+	suppressor, suppressorErr := alert.NewSuppressor(filepath.Join(t.TempDir(), "alert_state.json"), time.Minute, 0, time.Minute)
+	if suppressorErr != nil {
+		t.Fatal(suppressorErr)
+	}
+	window := newStreamWindow(time.Hour)
+	p := &Parser{source: window, suppressor: suppressor}
+
+	runs := 0
+	rule := &scheduledRule{name: "test", fileNames: []string{"network.log"}, window: time.Hour, run: func() { runs++ }}
+
+	// The agent clock lags, every event is stamped before the pass that precedes its arrival
+	lagging := time.Now().Add(-10 * time.Minute)
+	window.Insert(bus.Event{Time: lagging, LogFile: "network.log", EventID: 1017})
+	p.tryRun(rule)
+	if runs != 1 {
+		t.Fatalf("%d runs after the first event, want 1", runs)
+	}
+
+	p.tryRun(rule)
+	if runs != 1 {
+		t.Fatalf("%d runs without a new event, want 1", runs)
+	}
+
+	window.Insert(bus.Event{Time: lagging.Add(time.Second), LogFile: "network.log", EventID: 1017})
+	window.Insert(bus.Event{Time: lagging.Add(time.Second), LogFile: "other.log", EventID: 1017})
+	p.tryRun(rule)
+	if runs != 2 {
+		t.Errorf("%d runs after a late event, want 2", runs)
+	}
+
+	window.Insert(bus.Event{Time: time.Now(), LogFile: "other.log", EventID: 1017})
+	p.tryRun(rule)
+	if runs != 2 {
+		t.Errorf("%d runs after an event of another file, want 2", runs)
+	}
+}
+
+func TestStreamWindowPrunesByArrival(t *testing.T) {
+	window := newStreamWindow(time.Minute)
+	now := time.Now()
+
+	// One agent clock runs ahead, another lags behind the retention, neither decides what the others keep
+	window.Insert(bus.Event{Time: now, LogFile: "network.log", EventID: 1017, Host: "host-a"})
+	window.Insert(bus.Event{Time: now.Add(10 * time.Minute), LogFile: "network.log", EventID: 1017, Host: "host-b"})
+	window.Insert(bus.Event{Time: now.Add(-10 * time.Minute), LogFile: "network.log", EventID: 1017, Host: "host-c"})
+
+	var hosts []string
+	for _, entry := range window.Entries([]string{"network.log"}, now.Add(-time.Hour), now.Add(time.Hour)).Entries {
+		host, _ := entry.Text("Host")
+		hosts = append(hosts, host)
+	}
+	if !reflect.DeepEqual(hosts, []string{"host-c", "host-a", "host-b"}) {
+		t.Errorf("window holds %q, want every host", hosts)
+	}
+
+	// Entries that arrived before the retention are dropped whatever their event time
+	for i := range window.entries["network.log"] {
+		window.entries["network.log"][i].arrived = now.Add(-2 * time.Minute)
+	}
+	if entries := window.Entries([]string{"network.log"}, time.Time{}, time.Time{}).Entries; len(entries) != 0 {
+		t.Errorf("%d entries kept past the retention", len(entries))
+	}
+}
+
+func TestSigmaRuleOnForwardedEvents(t *testing.T) {
+	sigmaRule := loadTestSigmaRules(t, testSigmaRule)[0]
+	// Without a cooldown an event evaluated twice would alert twice
+	suppressor, suppressorErr := alert.NewSuppressor(filepath.Join(t.TempDir(), "alert_state.json"), time.Nanosecond, 0, time.Hour)
+	if suppressorErr != nil {
+		t.Fatal(suppressorErr)
+	}
+	dispatcher, dispatcherErr := alert.NewDispatcher([]config.NotifierConfig{})
+	if dispatcherErr != nil {
+		t.Fatal(dispatcherErr)
+	}
+	notifier := &recordingNotifier{}
+	dispatcher.Add("test", notifier)
+
+	p := &Parser{suppressor: suppressor, dispatcher: dispatcher}
+	rule := p.newScheduledSigmaRule(sigmaRule, 0)
+	p.schedule = []*scheduledRule{rule}
+
+	// Published the way the collector publishes the batches of its agents
+	b := bus.New()
+	p.Subscribe(b)
+	ctx, cancel := context.WithCancel(context.Background())
+	streamEnded := make(chan struct{})
+	go func() {
+		defer close(streamEnded)
+		p.runStream(ctx)
+	}()
+	defer func() {
+		cancel()
+		b.Close()
+		<-streamEnded
+	}()
+
+	rule.evaluate()
+
+	// The agent batched the event before the last collector pass, it still has to be evaluated once
+	b.Publish(bus.Event{
+		Time:    time.Now().Add(-5 * time.Second),
+		Host:    "host-a",
+		LogFile: sigmaRule.fileNames[0],
+		EventID: 1017,
+		Fields: map[string]interface{}{
+			"RemoteSockAddr_IP":  netip.MustParseAddr("10.0.0.9"),
+			"LocalSockAddr_PORT": uint16(3389),
+		},
+	})
+	window := p.source.(*streamWindow)
+	for deadline := time.Now().Add(5 * time.Second); !window.UpdatedSince(sigmaRule.fileNames, time.Time{}); {
+		if time.Now().After(deadline) {
+			t.Fatal("the event never reached the stream window")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	rule.evaluate()
+	rule.evaluate()
+	want := []string{"sigma:5b0e4f8a-2d4c-4c61-9a57-0f3c1e9b2d10 10.0.0.9@host-a"}
+	if firing := notifier.firing(); !reflect.DeepEqual(firing, want) {
+		t.Errorf("fired %q, want %q", firing, want)
+	}
+}
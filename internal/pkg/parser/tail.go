@@ -0,0 +1,432 @@
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	hook "github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/logger"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultTailStateFile = "logs/tail_state.json"
+
+	// The start of a log file identifies it, a file rotated or replaced under the same name starts differently
+	fingerprintSize = 1024
+)
+
+// tailState is where reading a log file stopped, persisted so restarts resume instead of re-reading
+type tailState struct {
+	Offset         int64     `json:"offset"`
+	Fingerprint    string    `json:"fingerprint"`
+	FingerprintLen int       `json:"fingerprint_len"`
+	Checked        time.Time `json:"checked"` // last pass, segments rotated since are not read yet
+}
+
+type tailedFile struct {
+	state   tailState
+	entries []tailedEntry // in file order, pruned to the retention
+}
+
+// tailedEntry is an entry with its position among the lines the tailer read, in the order it read them
+type tailedEntry struct {
+	LogEntry
+	arrival uint64
+}
+
+// fileTailer reads the provider log files incrementally, keeping the entries the largest rule window needs
+type fileTailer struct {
+	mu        sync.Mutex
+	retention time.Duration
+	stateFile string
+	files     map[string]*tailedFile
+	saved     map[string]tailState // offsets of the previous run, used when a file is first read
+	dirty     bool
+	arrivals  uint64
+}
+
+func newFileTailer(retention time.Duration, stateFile string) (*fileTailer, error) {
+	t := &fileTailer{
+		retention: retention,
+		stateFile: stateFile,
+		files:     make(map[string]*tailedFile),
+		saved:     make(map[string]tailState),
+	}
+
+	content, readFileErr := os.ReadFile(stateFile)
+	if errors.Is(readFileErr, os.ErrNotExist) {
+		return t, nil
+	}
+	if readFileErr != nil {
+		return nil, fmt.Errorf("unable to read tail state: %w", readFileErr)
+	}
+	if unmarshalErr := json.Unmarshal(content, &t.saved); unmarshalErr != nil {
+		return nil, fmt.Errorf("unable to parse tail state '%s': %w", stateFile, unmarshalErr)
+	}
+
+	return t, nil
+}
+
+func (t *fileTailer) Entries(fileNames []string, startTime, endTime time.Time) LogEntries {
+	logEntries, _ := t.entries(fileNames, 0, true, startTime, endTime)
+	return logEntries
+}
+
+// Entries reloaded from the previous run are left out, they arrived before any arrival
+func (t *fileTailer) EntriesSince(fileNames []string, arrival uint64, startTime, endTime time.Time) (LogEntries, uint64) {
+	return t.entries(fileNames, arrival, false, startTime, endTime)
+}
+
+func (t *fileTailer) entries(fileNames []string, arrival uint64, reloaded bool, startTime, endTime time.Time) (LogEntries, uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cutoff := time.Now().Add(-t.retention)
+
+	var logEntries LogEntries
+	for _, fileName := range fileNames {
+		file, exists := t.files[fileName]
+		if !exists {
+			file = &tailedFile{}
+			t.files[fileName] = file
+			t.resume(fileName, file, cutoff)
+		}
+
+		if catchUpErr := t.catchUp(fileName, file); catchUpErr != nil {
+			log.WithError(catchUpErr).Warnf("error processing file: %s", fileName)
+		}
+
+		idx := 0
+		for idx < len(file.entries) && file.entries[idx].Time.Before(cutoff) {
+			idx++
+		}
+		file.entries = file.entries[idx:]
+
+		for _, entry := range file.entries {
+			if (entry.arrival > arrival || reloaded && entry.arrival == 0) && inWindow(entry.Time, startTime, endTime) {
+				logEntries.Insert(entry.LogEntry)
+			}
+		}
+	}
+
+	if t.dirty {
+		if saveErr := t.save(); saveErr != nil {
+			log.WithError(saveErr).Warn("unable to save tail state")
+		}
+	}
+
+	logEntries.Sort()
+	return logEntries, t.arrivals
+}
+
+// Picks up where the previous run stopped, or reads the rotated segments within the retention on first use
+func (t *fileTailer) resume(fileName string, file *tailedFile, cutoff time.Time) {
+	if saved, ok := t.saved[fileName]; ok {
+		file.state = saved
+		t.reload(fileName, file, cutoff)
+		return
+	}
+
+	t.readRotatedSince(fileName, file, cutoff)
+}
+
+// Reloads the entries within the retention read by the previous run, up to the saved offset, so the windows of
+// the rules span the restart. They keep arrival 0, the previous run already evaluated them once
+func (t *fileTailer) reload(fileName string, file *tailedFile, cutoff time.Time) {
+	if file.state.Offset == 0 {
+		return
+	}
+
+	segments, segmentsErr := hook.Segments(logPath(fileName), cutoff)
+	if segmentsErr != nil {
+		log.WithError(segmentsErr).Warnf("error processing file: %s", fileName)
+		return
+	}
+
+	// The offset is in the active file, or in the segment it was rotated to since, catchUp reads on from there
+	for i := len(segments) - 1; i >= 0; i-- {
+		if fingerprint, _ := fingerprintOf(segments[i], file.state.FingerprintLen); fingerprint != file.state.Fingerprint {
+			continue
+		}
+
+		for _, rotatedBefore := range segments[:i] {
+			t.reloadSegment(fileName, file, rotatedBefore, -1)
+		}
+		t.reloadSegment(fileName, file, segments[i], file.state.Offset)
+		return
+	}
+}
+
+// Reads a segment up to the offset, or whole when the offset is negative, without counting arrivals
+func (t *fileTailer) reloadSegment(fileName string, file *tailedFile, segment string, offset int64) {
+	source, openErr := hook.OpenSegment(segment)
+	if openErr != nil {
+		log.WithError(openErr).Warnf("error processing file: %s", segment)
+		return
+	}
+	defer source.Close()
+
+	var reader io.Reader = source
+	if offset >= 0 {
+		reader = io.LimitReader(source, offset)
+	}
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		if entry, ok := t.parseLine(fileName, scanner.Bytes()); ok {
+			file.entries = append(file.entries, tailedEntry{LogEntry: entry})
+		}
+	}
+	if scanErr := scanner.Err(); scanErr != nil {
+		log.WithError(scanErr).Warnf("error processing file: %s", segment)
+	}
+}
+
+// Reads what was appended since the last pass. A file that no longer starts like the one read so far was
+// rotated, the rest of it is read from its segment, and a file shorter than the offset was truncated
+func (t *fileTailer) catchUp(fileName string, file *tailedFile) error {
+	path := logPath(fileName)
+	checked := time.Now()
+
+	info, statErr := os.Stat(path)
+	if statErr != nil {
+		return statErr
+	}
+
+	// Only a pass that moved the offset or read a segment needs saving, Checked alone does not
+	previous := file.state
+	defer func() {
+		if file.state.Offset != previous.Offset || file.state.Fingerprint != previous.Fingerprint {
+			t.dirty = true
+		}
+	}()
+
+	// Nothing was read from the file yet, whatever was rotated since the last pass was never seen
+	if file.state.Offset == 0 && !file.state.Checked.IsZero() {
+		if t.readRotatedSince(fileName, file, file.state.Checked) > 0 {
+			t.dirty = true
+		}
+	}
+	file.state.Checked = checked
+
+	if file.state.Offset > 0 {
+		fingerprint, _ := fingerprintOf(path, file.state.FingerprintLen)
+		switch {
+		case fingerprint != file.state.Fingerprint:
+			t.readRotated(fileName, file)
+			file.state = tailState{Checked: checked}
+		case info.Size() < file.state.Offset:
+			log.Warnf("Log file %s was truncated, reading it from the start", fileName)
+			file.state = tailState{Checked: checked}
+		}
+	}
+
+	if info.Size() == file.state.Offset {
+		return nil
+	}
+
+	source, openFileErr := os.Open(path)
+	if openFileErr != nil {
+		return openFileErr
+	}
+	defer source.Close()
+
+	if _, seekErr := source.Seek(file.state.Offset, io.SeekStart); seekErr != nil {
+		return seekErr
+	}
+
+	// A line still being written is left for the next pass
+	reader := bufio.NewReader(source)
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return readErr
+		}
+
+		file.state.Offset += int64(len(line))
+		t.addLine(fileName, file, line)
+	}
+
+	if file.state.FingerprintLen < fingerprintSize && file.state.Offset > int64(file.state.FingerprintLen) {
+		length := fingerprintSize
+		if file.state.Offset < int64(length) {
+			length = int(file.state.Offset)
+		}
+
+		fingerprint, fingerprintErr := fingerprintOf(path, length)
+		if fingerprintErr != nil {
+			return fingerprintErr
+		}
+		file.state.Fingerprint = fingerprint
+		file.state.FingerprintLen = length
+	}
+
+	return nil
+}
+
+// Finds the segment the file read so far was rotated to and reads it from the offset, followed by any segment
+// rotated after it
+func (t *fileTailer) readRotated(fileName string, file *tailedFile) {
+	segments, segmentsErr := hook.Segments(logPath(fileName), time.Time{})
+	if segmentsErr != nil {
+		log.WithError(segmentsErr).Warnf("error processing file: %s", fileName)
+		return
+	}
+	segments = segments[:len(segments)-1]
+
+	for i, segment := range segments {
+		if fingerprint, _ := fingerprintOf(segment, file.state.FingerprintLen); fingerprint != file.state.Fingerprint {
+			continue
+		}
+
+		t.readSegment(fileName, file, segment, file.state.Offset)
+		for _, rotatedAfter := range segments[i+1:] {
+			t.readSegment(fileName, file, rotatedAfter, 0)
+		}
+		return
+	}
+
+	log.Warnf("Log file %s was replaced and the previous one is gone, reading the new one from the start", fileName)
+}
+
+// Reads every segment rotated since the given time and returns how many, the active file is left to catchUp
+func (t *fileTailer) readRotatedSince(fileName string, file *tailedFile, since time.Time) int {
+	segments, segmentsErr := hook.Segments(logPath(fileName), since)
+	if segmentsErr != nil {
+		log.WithError(segmentsErr).Warnf("error processing file: %s", fileName)
+		return 0
+	}
+
+	for _, segment := range segments[:len(segments)-1] {
+		t.readSegment(fileName, file, segment, 0)
+	}
+	return len(segments) - 1
+}
+
+// Reads a rotated segment from the offset, segments are complete so an unterminated last line is read too
+func (t *fileTailer) readSegment(fileName string, file *tailedFile, segment string, offset int64) {
+	source, openErr := hook.OpenSegment(segment)
+	if openErr != nil {
+		log.WithError(openErr).Warnf("error processing file: %s", segment)
+		return
+	}
+	defer source.Close()
+
+	if _, skipErr := io.CopyN(io.Discard, source, offset); skipErr != nil {
+		log.WithError(skipErr).Warnf("error processing file: %s", segment)
+		return
+	}
+
+	scanner := bufio.NewScanner(source)
+	for scanner.Scan() {
+		t.addLine(fileName, file, scanner.Bytes())
+	}
+	if scanErr := scanner.Err(); scanErr != nil {
+		log.WithError(scanErr).Warnf("error processing file: %s", segment)
+	}
+}
+
+func (t *fileTailer) addLine(fileName string, file *tailedFile, line []byte) {
+	entry, ok := t.parseLine(fileName, line)
+	if !ok {
+		return
+	}
+
+	t.arrivals++
+	file.entries = append(file.entries, tailedEntry{LogEntry: entry, arrival: t.arrivals})
+}
+
+// Parses a log line, lines that are blank, malformed or older than the retention are left out
+func (t *fileTailer) parseLine(fileName string, line []byte) (LogEntry, bool) {
+	line = bytes.TrimRight(line, "\r\n")
+	if len(line) == 0 {
+		return LogEntry{}, false
+	}
+
+	var le LogEntries
+	entry, processLineErr := le.processLogLine(string(line))
+	if processLineErr != nil {
+		log.WithError(processLineErr).Warnf("could not process line: (%s) from logfile: %s", line, fileName)
+		return LogEntry{}, false
+	}
+	if entry.Time.Before(time.Now().Add(-t.retention)) {
+		return LogEntry{}, false
+	}
+
+	return entry, true
+}
+
+// Written to a temporary file first so a crash never leaves a partial state behind
+func (t *fileTailer) save() error {
+	states := make(map[string]tailState, len(t.saved)+len(t.files))
+	for fileName, state := range t.saved {
+		states[fileName] = state
+	}
+	for fileName, file := range t.files {
+		states[fileName] = file.state
+	}
+
+	content, marshalErr := json.MarshalIndent(states, "", "  ")
+	if marshalErr != nil {
+		return marshalErr
+	}
+
+	if mkdirErr := os.MkdirAll(filepath.Dir(t.stateFile), 0755); mkdirErr != nil {
+		return mkdirErr
+	}
+	temporary := t.stateFile + ".tmp"
+	if writeFileErr := os.WriteFile(temporary, content, 0644); writeFileErr != nil {
+		return writeFileErr
+	}
+	if renameErr := os.Rename(temporary, t.stateFile); renameErr != nil {
+		return renameErr
+	}
+
+	t.dirty = false
+	return nil
+}
+
+func logPath(fileName string) string {
+	return "logs/" + fileName
+}
+
+// Hash of the first length bytes of the file, a file shorter than that has no fingerprint
+func fingerprintOf(path string, length int) (string, error) {
+	source, openErr := hook.OpenSegment(path)
+	if openErr != nil {
+		return "", openErr
+	}
+	defer source.Close()
+
+	prefix := make([]byte, length)
+	if _, readErr := io.ReadFull(source, prefix); readErr != nil {
+		return "", fmt.Errorf("unable to fingerprint %s: %w", path, readErr)
+	}
+
+	sum := sha256.Sum256(prefix)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// The largest window of the rules reading the file, entries older than that are not needed
+func retentionOf(schedule []*scheduledRule) time.Duration {
+	var retention time.Duration
+	for _, rule := range schedule {
+		if rule.window > retention {
+			retention = rule.window
+		}
+	}
+	return retention
+}
@@ -0,0 +1,135 @@
+package parser
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Runs the test from an empty directory with a logs directory, the provider logs are read relative to it
+func chdirTemp(t *testing.T) {
+	t.Helper()
+
+	dir := t.TempDir()
+	previous, getwdErr := os.Getwd()
+	if getwdErr != nil {
+		t.Fatal(getwdErr)
+	}
+	if chdirErr := os.Chdir(dir); chdirErr != nil {
+		t.Fatal(chdirErr)
+	}
+	t.Cleanup(func() { os.Chdir(previous) })
+
+	if mkdirErr := os.Mkdir("logs", 0755); mkdirErr != nil {
+		t.Fatal(mkdirErr)
+	}
+}
+
+func appendLogLines(t *testing.T, fileName string, count int) {
+	t.Helper()
+
+	file, openErr := os.OpenFile(logPath(fileName), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer file.Close()
+
+	for i := 0; i < count; i++ {
+		line := formatLogLine(t, 1017, log.Fields{"RemoteSockAddr_IP": "10.0.0.9", "LocalSockAddr_PORT": 1000 + i})
+		if _, writeErr := file.WriteString(line + "\n"); writeErr != nil {
+			t.Fatal(writeErr)
+		}
+	}
+}
+
+func TestTailSavesOnlyChangedOffsets(t *testing.T) {
+	chdirTemp(t)
+	const stateFile = "logs/tail_state.json"
+	savedOffset := func() (int64, bool) {
+		content, readErr := os.ReadFile(stateFile)
+		if errors.Is(readErr, os.ErrNotExist) {
+			return 0, false
+		}
+		if readErr != nil {
+			t.Fatal(readErr)
+		}
+		os.Remove(stateFile)
+
+		var states map[string]tailState
+		if unmarshalErr := json.Unmarshal(content, &states); unmarshalErr != nil {
+			t.Fatal(unmarshalErr)
+		}
+		return states["tcp-ip.log"].Offset, true
+	}
+
+	tailer, tailerErr := newFileTailer(time.Hour, stateFile)
+	if tailerErr != nil {
+		t.Fatal(tailerErr)
+	}
+	entries := func() int {
+		return len(tailer.Entries([]string{"tcp-ip.log"}, time.Now().Add(-time.Hour), time.Now().Add(time.Hour)).Entries)
+	}
+
+	appendLogLines(t, "tcp-ip.log", 2)
+	if count := entries(); count != 2 {
+		t.Fatalf("%d entries, want 2", count)
+	}
+	info, _ := os.Stat(logPath("tcp-ip.log"))
+	if offset, saved := savedOffset(); !saved || offset != info.Size() {
+		t.Fatalf("saved offset %d (%t), want %d", offset, saved, info.Size())
+	}
+
+	// Nothing new was appended, the state is left alone
+	if count := entries(); count != 2 {
+		t.Fatalf("%d entries, want 2", count)
+	}
+	if offset, saved := savedOffset(); saved {
+		t.Fatalf("saved offset %d without changes", offset)
+	}
+
+	appendLogLines(t, "tcp-ip.log", 1)
+	if count := entries(); count != 3 {
+		t.Fatalf("%d entries, want 3", count)
+	}
+	info, _ = os.Stat(logPath("tcp-ip.log"))
+	if offset, saved := savedOffset(); !saved || offset != info.Size() {
+		t.Fatalf("saved offset %d (%t), want %d", offset, saved, info.Size())
+	}
+}
+
+func TestTailReloadsWindowOnResume(t *testing.T) {
+	chdirTemp(t)
+	const stateFile = "logs/tail_state.json"
+	window := func() (time.Time, time.Time) { return time.Now().Add(-time.Hour), time.Now().Add(time.Hour) }
+
+	tailer, tailerErr := newFileTailer(time.Hour, stateFile)
+	if tailerErr != nil {
+		t.Fatal(tailerErr)
+	}
+	appendLogLines(t, "tcp-ip.log", 3)
+	startTime, endTime := window()
+	if count := len(tailer.Entries([]string{"tcp-ip.log"}, startTime, endTime).Entries); count != 3 {
+		t.Fatalf("%d entries, want 3", count)
+	}
+
+	// Restarted, the lines read before the saved offset are still within the windows of the rules
+	restarted, restartedErr := newFileTailer(time.Hour, stateFile)
+	if restartedErr != nil {
+		t.Fatal(restartedErr)
+	}
+	appendLogLines(t, "tcp-ip.log", 1)
+	startTime, endTime = window()
+	if count := len(restarted.Entries([]string{"tcp-ip.log"}, startTime, endTime).Entries); count != 4 {
+		t.Errorf("%d entries after the restart, want 4", count)
+	}
+
+	// Only the line appended since arrived, the others were evaluated by the previous run
+	arrived, _ := restarted.EntriesSince([]string{"tcp-ip.log"}, 0, time.Time{}, time.Time{})
+	if count := len(arrived.Entries); count != 1 {
+		t.Errorf("%d entries arrived after the restart, want 1", count)
+	}
+}
@@ -0,0 +1,299 @@
+package parser
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/config"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/eventfield"
+)
+
+// thresholdRule is a declarative rule from rules.yml, compiled once at Init
+type thresholdRule struct {
+	name     string
+	rule     config.Rule
+	eventIDs map[int]bool
+	matchers []func(fields map[string]interface{}) bool
+	message  *template.Template
+}
+
+// Data available to the message template of a threshold rule
+type thresholdMessage struct {
+	Rule      string
+	Group     map[string]string // group_by field values of the offending group
+	Count     int
+	Threshold int
+	Window    time.Duration
+}
+
+func newThresholdRule(name string, rule config.Rule) (*thresholdRule, error) {
+	if rule.Window <= 0 {
+		return nil, fmt.Errorf("rule %s: window must be greater than 0", name)
+	}
+
+	switch rule.Aggregation.Function {
+	case "count":
+	case "distinct_count":
+		if rule.Aggregation.Field == "" {
+			return nil, fmt.Errorf("rule %s: distinct_count requires an aggregation field", name)
+		}
+	default:
+		return nil, fmt.Errorf("rule %s: unknown aggregation function '%s'", name, rule.Aggregation.Function)
+	}
+
+	tr := &thresholdRule{
+		name:     name,
+		rule:     rule,
+		eventIDs: make(map[int]bool),
+	}
+
+	for _, eventID := range rule.EventIDs {
+		tr.eventIDs[eventID] = true
+	}
+
+	for _, condition := range rule.Conditions {
+		matcher, conditionErr := newConditionMatcher(condition)
+		if conditionErr != nil {
+			return nil, fmt.Errorf("rule %s: %w", name, conditionErr)
+		}
+		tr.matchers = append(tr.matchers, matcher)
+	}
+
+	messageText := rule.Message
+	if messageText == "" {
+		messageText = "Rule {{.Rule}} triggered by {{.Group}} ({{.Count}} in {{.Window}})"
+	}
+
+	message, templateErr := template.New(name).Option("missingkey=zero").Parse(messageText)
+	if templateErr != nil {
+		return nil, fmt.Errorf("rule %s: invalid message template: %w", name, templateErr)
+	}
+	tr.message = message
+
+	return tr, nil
+}
+
+// String operators compare the text of the field, the numeric operators (gt, gte, lt, lte, between) its integer
+// value and cidr its address, a field without such a value does not match them
+func newConditionMatcher(condition config.RuleCondition) (func(fields map[string]interface{}) bool, error) {
+	var match func(value interface{}) bool
+
+	switch condition.Operator {
+	case "equals", "":
+		match = textMatcher(func(value string) bool { return value == condition.Value })
+	case "not_equals":
+		match = textMatcher(func(value string) bool { return value != condition.Value })
+	case "contains":
+		match = textMatcher(func(value string) bool { return strings.Contains(value, condition.Value) })
+	case "startswith":
+		match = textMatcher(func(value string) bool { return strings.HasPrefix(value, condition.Value) })
+	case "endswith":
+		match = textMatcher(func(value string) bool { return strings.HasSuffix(value, condition.Value) })
+	case "regex":
+		re, compileErr := regexp.Compile(condition.Value)
+		if compileErr != nil {
+			return nil, fmt.Errorf("invalid regex for field %s: %w", condition.Field, compileErr)
+		}
+		match = textMatcher(re.MatchString)
+	case "in":
+		match = textMatcher(func(value string) bool { return contains(condition.Values, value) })
+	case "gt", "gte", "lt", "lte":
+		bound, parseErr := strconv.ParseInt(condition.Value, 10, 64)
+		if parseErr != nil {
+			return nil, fmt.Errorf("operator %s for field %s requires an integer value: %w", condition.Operator, condition.Field, parseErr)
+		}
+		match = intMatcher(condition.Operator, bound)
+	case "between":
+		if len(condition.Values) != 2 {
+			return nil, fmt.Errorf("operator between for field %s requires two values", condition.Field)
+		}
+		low, lowErr := strconv.ParseInt(condition.Values[0], 10, 64)
+		high, highErr := strconv.ParseInt(condition.Values[1], 10, 64)
+		if lowErr != nil || highErr != nil {
+			return nil, fmt.Errorf("operator between for field %s requires integer values", condition.Field)
+		}
+		match = func(value interface{}) bool {
+			n, ok := eventfield.Int(value)
+			return ok && n >= low && n <= high
+		}
+	case "cidr":
+		prefixes, prefixErr := parsePrefixes(append([]string{condition.Value}, condition.Values...))
+		if prefixErr != nil {
+			return nil, fmt.Errorf("operator cidr for field %s: %w", condition.Field, prefixErr)
+		}
+		match = func(value interface{}) bool {
+			addr, ok := eventfield.Addr(value)
+			return ok && prefixesContain(prefixes, addr)
+		}
+	default:
+		return nil, fmt.Errorf("unknown operator '%s' for field %s", condition.Operator, condition.Field)
+	}
+
+	return func(fields map[string]interface{}) bool {
+		value, ok := fields[condition.Field]
+		if !ok {
+			// A missing field only satisfies a negative condition
+			return condition.Operator == "not_equals"
+		}
+		return match(value)
+	}, nil
+}
+
+func textMatcher(match func(value string) bool) func(value interface{}) bool {
+	return func(value interface{}) bool {
+		return match(eventfield.String(value))
+	}
+}
+
+// Compares the integer value of a field against the bound with gt, gte, lt or lte
+func intMatcher(operator string, bound int64) func(value interface{}) bool {
+	return func(value interface{}) bool {
+		n, ok := eventfield.Int(value)
+		if !ok {
+			return false
+		}
+		switch operator {
+		case "gt":
+			return n > bound
+		case "gte":
+			return n >= bound
+		case "lt":
+			return n < bound
+		}
+		return n <= bound
+	}
+}
+
+// Parses the non-empty prefixes, e.g. 10.0.0.0/8
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, value := range values {
+		if value == "" {
+			continue
+		}
+		prefix, parseErr := netip.ParsePrefix(value)
+		if parseErr != nil {
+			return nil, fmt.Errorf("invalid cidr '%s': %w", value, parseErr)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	if len(prefixes) == 0 {
+		return nil, fmt.Errorf("no cidr given")
+	}
+	return prefixes, nil
+}
+
+// IPv4-mapped IPv6 addresses match IPv4 prefixes
+func prefixesContain(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Groups the entries matching the rule filters, every group is a finding with its rendered message
+func (tr *thresholdRule) evaluate(le LogEntries) []Finding {
+	distinct := make(map[string]map[string]bool)
+	groups := make(map[string]map[string]string)
+	groupFindings := make(map[string]*Finding)
+
+	for _, entry := range le.Entries {
+		if !tr.matches(entry) {
+			continue
+		}
+
+		group := make(map[string]string)
+		keyParts := make([]string, 0, len(tr.rule.GroupBy))
+		complete := true
+		for _, field := range tr.rule.GroupBy {
+			value, ok := entry.Text(field)
+			if !ok {
+				complete = false
+				break
+			}
+			group[field] = value
+			keyParts = append(keyParts, value)
+		}
+
+		if !complete {
+			continue
+		}
+
+		key := strings.Join(keyParts, "|")
+		finding, exists := groupFindings[key]
+		if !exists {
+			finding = &Finding{Source: key}
+			groupFindings[key] = finding
+			groups[key] = group
+		}
+
+		if tr.rule.Aggregation.Function == "distinct_count" {
+			value, ok := entry.Text(tr.rule.Aggregation.Field)
+			if !ok {
+				continue
+			}
+			if distinct[key] == nil {
+				distinct[key] = make(map[string]bool)
+			}
+			if !distinct[key][value] {
+				distinct[key][value] = true
+				finding.Count++
+				finding.AddEvidence(entry)
+			}
+		} else {
+			finding.Count++
+			finding.AddEvidence(entry)
+		}
+		finding.Observe(entry.Time)
+	}
+
+	var findings []Finding
+	for key, finding := range groupFindings {
+		if finding.Count == 0 {
+			continue
+		}
+
+		finding.Message = tr.render(thresholdMessage{
+			Rule:      tr.name,
+			Group:     groups[key],
+			Count:     finding.Count,
+			Threshold: tr.rule.AlertThreshold,
+			Window:    tr.rule.Window,
+		})
+		findings = append(findings, *finding)
+	}
+
+	sortFindings(findings)
+	return findings
+}
+
+func (tr *thresholdRule) matches(entry LogEntry) bool {
+	if len(tr.eventIDs) > 0 && !tr.eventIDs[entry.EventID] {
+		return false
+	}
+
+	for _, matcher := range tr.matchers {
+		if !matcher(entry.Fields) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (tr *thresholdRule) render(data thresholdMessage) string {
+	var message strings.Builder
+	if executeErr := tr.message.Execute(&message, data); executeErr != nil {
+		return fmt.Sprintf("Rule %s triggered by %v (%d in %s)", data.Rule, data.Group, data.Count, data.Window)
+	}
+
+	return message.String()
+}
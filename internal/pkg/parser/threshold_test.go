@@ -0,0 +1,265 @@
+package parser
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/config"
+)
+
+func TestConditionOperators(t *testing.T) {
+	tests := []struct {
+		name      string
+		condition config.RuleCondition
+		value     interface{} // nil leaves the field out
+		want      bool
+	}{
+		{"equals", config.RuleCondition{Operator: "equals", Value: "administrator"}, "administrator", true},
+		{"equals is the default", config.RuleCondition{Value: "administrator"}, "administrator", true},
+		{"equals is case sensitive", config.RuleCondition{Operator: "equals", Value: "administrator"}, "Administrator", false},
+		{"equals on the text of a port", config.RuleCondition{Operator: "equals", Value: "3389"}, uint16(3389), true},
+		{"equals on the text of an address", config.RuleCondition{Operator: "equals", Value: "10.0.0.9"}, netip.MustParseAddr("10.0.0.9"), true},
+		{"equals missing", config.RuleCondition{Operator: "equals", Value: "administrator"}, nil, false},
+		{"not_equals", config.RuleCondition{Operator: "not_equals", Value: "administrator"}, "guest", true},
+		{"not_equals same", config.RuleCondition{Operator: "not_equals", Value: "administrator"}, "administrator", false},
+		{"not_equals missing", config.RuleCondition{Operator: "not_equals", Value: "administrator"}, nil, true},
+		{"contains", config.RuleCondition{Operator: "contains", Value: "admin"}, `CORP\administrator`, true},
+		{"contains not", config.RuleCondition{Operator: "contains", Value: "guest"}, `CORP\administrator`, false},
+		{"startswith", config.RuleCondition{Operator: "startswith", Value: `CORP\`}, `CORP\administrator`, true},
+		{"startswith not", config.RuleCondition{Operator: "startswith", Value: "admin"}, `CORP\administrator`, false},
+		{"endswith", config.RuleCondition{Operator: "endswith", Value: "$"}, "HOST01$", true},
+		{"endswith not", config.RuleCondition{Operator: "endswith", Value: "$"}, "HOST01", false},
+		{"regex", config.RuleCondition{Operator: "regex", Value: `^10\.0\.0\.\d+$`}, netip.MustParseAddr("10.0.0.9"), true},
+		{"regex not", config.RuleCondition{Operator: "regex", Value: `^10\.0\.0\.\d+$`}, netip.MustParseAddr("10.0.1.9"), false},
+		{"in", config.RuleCondition{Operator: "in", Values: []string{"445", "3389"}}, uint16(3389), true},
+		{"in not", config.RuleCondition{Operator: "in", Values: []string{"445", "3389"}}, uint16(22), false},
+		{"gt", config.RuleCondition{Operator: "gt", Value: "1023"}, uint16(1024), true},
+		{"gt equal", config.RuleCondition{Operator: "gt", Value: "1023"}, uint16(1023), false},
+		{"gte equal", config.RuleCondition{Operator: "gte", Value: "1023"}, int64(1023), true},
+		{"lt", config.RuleCondition{Operator: "lt", Value: "1024"}, int64(1023), true},
+		{"lt equal", config.RuleCondition{Operator: "lt", Value: "1024"}, int64(1024), false},
+		{"lte equal", config.RuleCondition{Operator: "lte", Value: "1024"}, int64(1024), true},
+		{"lte above", config.RuleCondition{Operator: "lte", Value: "1024"}, int64(1025), false},
+		{"gt on numeric text", config.RuleCondition{Operator: "gt", Value: "10"}, "11", true},
+		{"gt on text", config.RuleCondition{Operator: "gt", Value: "10"}, "eleven", false},
+		{"gt missing", config.RuleCondition{Operator: "gt", Value: "10"}, nil, false},
+		{"between low bound", config.RuleCondition{Operator: "between", Values: []string{"1", "1023"}}, uint16(1), true},
+		{"between high bound", config.RuleCondition{Operator: "between", Values: []string{"1", "1023"}}, uint16(1023), true},
+		{"between above", config.RuleCondition{Operator: "between", Values: []string{"1", "1023"}}, uint16(1024), false},
+		{"between on an address", config.RuleCondition{Operator: "between", Values: []string{"1", "1023"}}, netip.MustParseAddr("10.0.0.9"), false},
+		{"cidr", config.RuleCondition{Operator: "cidr", Value: "10.0.0.0/8"}, netip.MustParseAddr("10.20.9.66"), true},
+		{"cidr outside", config.RuleCondition{Operator: "cidr", Value: "10.0.0.0/8"}, netip.MustParseAddr("192.168.1.5"), false},
+		{"cidr any of the values", config.RuleCondition{Operator: "cidr", Values: []string{"10.0.0.0/8", "192.168.0.0/16"}}, netip.MustParseAddr("192.168.1.5"), true},
+		{"cidr on address text", config.RuleCondition{Operator: "cidr", Value: "10.0.0.0/8"}, "10.20.9.66", true},
+		{"cidr ipv4-mapped", config.RuleCondition{Operator: "cidr", Value: "10.0.0.0/8"}, netip.MustParseAddr("::ffff:10.20.9.66"), true},
+		{"cidr ipv6", config.RuleCondition{Operator: "cidr", Value: "fe80::/10"}, netip.MustParseAddr("fe80::1"), true},
+		{"cidr on a port", config.RuleCondition{Operator: "cidr", Value: "10.0.0.0/8"}, uint16(3389), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.condition.Field = "Field"
+			matcher, conditionErr := newConditionMatcher(test.condition)
+			if conditionErr != nil {
+				t.Fatal(conditionErr)
+			}
+
+			fields := map[string]interface{}{"Other": "value"}
+			if test.value != nil {
+				fields["Field"] = test.value
+			}
+			if got := matcher(fields); got != test.want {
+				t.Errorf("%v (%T) matched %t, want %t", test.value, test.value, got, test.want)
+			}
+		})
+	}
+}
+
+func TestConditionOperatorErrors(t *testing.T) {
+	for _, condition := range []config.RuleCondition{
+		{Operator: "matches", Value: "x"},
+		{Operator: "regex", Value: "("},
+		{Operator: "gt", Value: "ten"},
+		{Operator: "gte"},
+		{Operator: "between", Values: []string{"1"}},
+		{Operator: "between", Values: []string{"1", "high"}},
+		{Operator: "cidr"},
+		{Operator: "cidr", Value: "10.0.0.0"},
+		{Operator: "cidr", Values: []string{"10.0.0.0/8", "not a prefix"}},
+	} {
+		condition.Field = "Field"
+		if _, conditionErr := newConditionMatcher(condition); conditionErr == nil {
+			t.Errorf("%+v: no error", condition)
+		}
+	}
+}
+
+func TestThresholdRuleErrors(t *testing.T) {
+	valid := config.Rule{Window: time.Minute, Aggregation: config.RuleAggregation{Function: "count"}}
+
+	tests := map[string]func(rule *config.Rule){
+		"no window":                        func(rule *config.Rule) { rule.Window = 0 },
+		"unknown aggregation":              func(rule *config.Rule) { rule.Aggregation.Function = "sum" },
+		"distinct_count without its field": func(rule *config.Rule) { rule.Aggregation.Function = "distinct_count" },
+		"invalid condition":                func(rule *config.Rule) { rule.Conditions = []config.RuleCondition{{Field: "Field", Operator: "gt"}} },
+		"invalid message template":         func(rule *config.Rule) { rule.Message = "{{.Count" },
+	}
+	for name, change := range tests {
+		rule := valid
+		change(&rule)
+		if _, ruleErr := newThresholdRule("test", rule); ruleErr == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+
+	if _, ruleErr := newThresholdRule("test", valid); ruleErr != nil {
+		t.Errorf("valid rule: %v", ruleErr)
+	}
+}
+
+// A scan from 10.0.0.9 of 4 ports on web01 and 1 on db01, and two connections from 10.0.0.10 to the same port
+func thresholdTestEntries() LogEntries {
+	var le LogEntries
+	now := time.Now()
+	add := func(eventID int, fields map[string]interface{}) {
+		le.Insert(LogEntry{Time: now.Add(time.Duration(len(le.Entries)) * time.Second), EventID: eventID, Fields: fields})
+	}
+	connection := func(source, host string, port uint16) map[string]interface{} {
+		return map[string]interface{}{
+			"RemoteSockAddr_IP":  netip.MustParseAddr(source),
+			"LocalSockAddr_PORT": port,
+			"Host":               host,
+		}
+	}
+
+	for _, port := range []uint16{22, 80, 443, 3389} {
+		add(1017, connection("10.0.0.9", "web01", port))
+	}
+	add(1017, connection("10.0.0.9", "web01", 80))
+	add(1017, connection("10.0.0.9", "db01", 1433))
+	add(1017, connection("10.0.0.10", "web01", 443))
+	add(1017, connection("10.0.0.10", "web01", 443))
+
+	// Another event and an entry without a source address are never grouped
+	add(1033, connection("10.0.0.9", "web01", 8080))
+	add(1017, map[string]interface{}{"LocalSockAddr_PORT": uint16(8443), "Host": "web01"})
+	return le
+}
+
+func TestThresholdRuleEvaluate(t *testing.T) {
+	type result struct {
+		Source  string
+		Count   int
+		Message string
+	}
+
+	tests := []struct {
+		name string
+		rule config.Rule
+		want []result
+	}{
+		{
+			name: "count per source",
+			rule: config.Rule{
+				EventIDs:    []int{1017},
+				GroupBy:     []string{"RemoteSockAddr_IP"},
+				Aggregation: config.RuleAggregation{Function: "count"},
+			},
+			want: []result{
+				{"10.0.0.9", 6, "Rule test triggered by map[RemoteSockAddr_IP:10.0.0.9] (6 in 1m0s)"},
+				{"10.0.0.10", 2, "Rule test triggered by map[RemoteSockAddr_IP:10.0.0.10] (2 in 1m0s)"},
+			},
+		},
+		{
+			name: "distinct ports per source",
+			rule: config.Rule{
+				EventIDs:    []int{1017},
+				GroupBy:     []string{"RemoteSockAddr_IP"},
+				Aggregation: config.RuleAggregation{Function: "distinct_count", Field: "LocalSockAddr_PORT"},
+				Message:     "{{.Group.RemoteSockAddr_IP}} connected to {{.Count}} ports (threshold {{.Threshold}}) in {{.Window}}",
+			},
+			want: []result{
+				{"10.0.0.9", 5, "10.0.0.9 connected to 5 ports (threshold 3) in 1m0s"},
+				{"10.0.0.10", 1, "10.0.0.10 connected to 1 ports (threshold 3) in 1m0s"},
+			},
+		},
+		{
+			name: "grouped by source and host",
+			rule: config.Rule{
+				EventIDs:    []int{1017},
+				GroupBy:     []string{"RemoteSockAddr_IP", "Host"},
+				Aggregation: config.RuleAggregation{Function: "distinct_count", Field: "LocalSockAddr_PORT"},
+				Message:     "{{.Rule}}: {{.Group.RemoteSockAddr_IP}} on {{.Group.Host}}{{.Group.Missing}}",
+			},
+			want: []result{
+				{"10.0.0.9|web01", 4, "test: 10.0.0.9 on web01"},
+				{"10.0.0.10|web01", 1, "test: 10.0.0.10 on web01"},
+				{"10.0.0.9|db01", 1, "test: 10.0.0.9 on db01"},
+			},
+		},
+		{
+			name: "conditions",
+			rule: config.Rule{
+				Conditions: []config.RuleCondition{
+					{Field: "RemoteSockAddr_IP", Operator: "cidr", Value: "10.0.0.0/24"},
+					{Field: "LocalSockAddr_PORT", Operator: "between", Values: []string{"1", "1023"}},
+					{Field: "Host", Operator: "in", Values: []string{"web01"}},
+				},
+				GroupBy:     []string{"RemoteSockAddr_IP"},
+				Aggregation: config.RuleAggregation{Function: "count"},
+				Message:     "{{.Count}}",
+			},
+			want: []result{
+				{"10.0.0.9", 4, "4"},
+				{"10.0.0.10", 2, "2"},
+			},
+		},
+		{
+			name: "every event without an event id filter",
+			rule: config.Rule{
+				GroupBy:     []string{"Host"},
+				Aggregation: config.RuleAggregation{Function: "count"},
+				Message:     "{{.Count}}",
+			},
+			want: []result{
+				{"web01", 9, "9"},
+				{"db01", 1, "1"},
+			},
+		},
+		{
+			name: "no match",
+			rule: config.Rule{
+				EventIDs:    []int{4625},
+				GroupBy:     []string{"RemoteSockAddr_IP"},
+				Aggregation: config.RuleAggregation{Function: "count"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.rule.Window = time.Minute
+			test.rule.AlertThreshold = 3
+			tr, ruleErr := newThresholdRule("test", test.rule)
+			if ruleErr != nil {
+				t.Fatal(ruleErr)
+			}
+
+			var got []result
+			for _, finding := range tr.evaluate(thresholdTestEntries()) {
+				got = append(got, result{finding.Source, finding.Count, finding.Message})
+				if len(finding.Evidence) != finding.Count {
+					t.Errorf("%s: %d evidence entries for a count of %d", finding.Source, len(finding.Evidence), finding.Count)
+				}
+				if finding.FirstSeen.IsZero() || finding.LastSeen.Before(finding.FirstSeen) {
+					t.Errorf("%s: seen from %s to %s", finding.Source, finding.FirstSeen, finding.LastSeen)
+				}
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("findings %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package session
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/0xrawsec/golang-etw/etw"
+)
+
+// RecordingSource wraps another source and writes every event it yields, before any provider or
+// field filtering, to a newline delimited JSON capture file that a FileSource can replay
+type RecordingSource struct {
+	Source EventSource
+	Path   string
+
+	events  chan *etw.Event
+	stopped chan struct{}
+	file    *os.File
+	writer  *bufio.Writer
+	mu      sync.Mutex
+	err     error
+}
+
+func NewRecordingSource(source EventSource, path string) *RecordingSource {
+	return &RecordingSource{
+		Source:  source,
+		Path:    path,
+		events:  make(chan *etw.Event),
+		stopped: make(chan struct{}),
+	}
+}
+
+func (r *RecordingSource) Start() error {
+	file, openFileErr := os.OpenFile(r.Path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if openFileErr != nil {
+		return fmt.Errorf("unable to open capture file '%s': %w", r.Path, openFileErr)
+	}
+	r.file = file
+	r.writer = bufio.NewWriter(file)
+
+	if startSourceErr := r.Source.Start(); startSourceErr != nil {
+		r.file.Close()
+		return startSourceErr
+	}
+
+	go func() {
+		defer close(r.stopped)
+		defer close(r.events)
+
+		encoder := json.NewEncoder(r.writer)
+		for event := range r.Source.Events() {
+			if encodeErr := encoder.Encode(event); encodeErr != nil {
+				r.setErr(fmt.Errorf("unable to record event to '%s': %w", r.Path, encodeErr))
+			}
+			r.events <- event
+		}
+	}()
+
+	return nil
+}
+
+func (r *RecordingSource) Events() <-chan *etw.Event { return r.events }
+
+// Stops the wrapped source, waits for in-flight events to be written and closes the capture file.
+// Events must keep being drained by the caller until the channel is closed
+func (r *RecordingSource) Stop() error {
+	stopErr := r.Source.Stop()
+	<-r.stopped
+
+	if flushErr := r.writer.Flush(); flushErr != nil && stopErr == nil {
+		stopErr = flushErr
+	}
+	if closeErr := r.file.Close(); closeErr != nil && stopErr == nil {
+		stopErr = closeErr
+	}
+
+	return stopErr
+}
+
+func (r *RecordingSource) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil {
+		return r.err
+	}
+	return r.Source.Err()
+}
+
+func (r *RecordingSource) setErr(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		r.err = err
+	}
+}
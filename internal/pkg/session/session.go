@@ -4,17 +4,24 @@ import (
 	"context"
 	"fmt"
 	"reflect"
+	"strconv"
 	"time"
 
 	"github.com/0xrawsec/golang-etw/etw"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/bus"
 	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/config"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/eventfield"
+	hook "github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/logger"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/metrics"
 	log "github.com/sirupsen/logrus"
 )
 
 type Session struct {
 	Providers []Provider
-	Session   *etw.RealTimeSession
-	Consumer  *etw.Consumer
+	LogFormat string             // format of the provider logs, text or json
+	Rotation  config.LogRotation // rotation and retention of the provider logs
+	Source    EventSource
+	Bus       *bus.Bus // optional, receives every logged event for in-process rule evaluation
 }
 
 func (s *Session) Init(providerConfigFilePath string) error {
@@ -24,6 +31,16 @@ func (s *Session) Init(providerConfigFilePath string) error {
 		return fmt.Errorf("unable to parse provider config, cannot continue")
 	}
 
+	s.LogFormat = providersConfig.LogFormat
+	s.Rotation = providersConfig.Rotation
+	switch s.LogFormat {
+	case "":
+		s.LogFormat = hook.FormatText
+	case hook.FormatText, hook.FormatJSON:
+	default:
+		return fmt.Errorf("invalid provider log format '%s', expected text or json", s.LogFormat)
+	}
+
 	//Populating the Session struct with the providers, events, and fields specified in the config file
 	for _, provider := range providersConfig.Providers {
 		s.Providers = append(s.Providers, Provider{
@@ -37,82 +54,129 @@ func (s *Session) Init(providerConfigFilePath string) error {
 	return nil
 }
 
-// Starts ETW session and consumer
-func (s *Session) Run(captureTime time.Duration) error {
-	s.Session = etw.NewRealTimeSession("ETW-Go")
-	defer s.Session.Stop()
+// Starts the event source (the live ETW consumer unless another source was set) and logs matching
+// events until the context is cancelled or the source runs out of events. In-flight events are
+// drained before returning
+func (s *Session) Run(ctx context.Context) error {
+	if s.Source == nil {
+		source, sourceErr := NewRealTimeSource(s.Providers)
+		if sourceErr != nil {
+			return fmt.Errorf("unable to create event source, cannot continue: %w", sourceErr)
+		}
+		s.Source = source
+	}
 
-	minSingleProviderSuccess := false
+	if startSourceErr := s.Source.Start(); startSourceErr != nil {
+		return fmt.Errorf("unable to start event source, cannot continue: %w", startSourceErr)
+	}
 
-	//Enabling the providers inside the Provider Struct
-	for _, provider := range s.Providers {
-		if resolveProviderErr := s.Session.EnableProvider(etw.ResolveProvider(provider.Id)); resolveProviderErr != nil {
-			log.WithError(resolveProviderErr).Errorf("Cannot resolve provider... continuing")
-			continue
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		for event := range s.Source.Events() {
+			s.HandleEvent(event)
 		}
-		minSingleProviderSuccess = true
+	}()
+
+	select {
+	case <-ctx.Done():
+	case <-drained:
 	}
 
-	if !minSingleProviderSuccess {
-		return fmt.Errorf("unable to resolve a single provider, cannot continue")
+	// Stopping closes the event channel, wait for the events already received to be logged
+	if stopSourceErr := s.Source.Stop(); stopSourceErr != nil {
+		log.WithError(stopSourceErr).Warn("unable to cleanly stop the event source")
 	}
+	<-drained
 
-	s.Consumer = etw.NewRealTimeConsumer(context.Background())
-	defer s.Consumer.Stop()
+	if sourceErr := s.Source.Err(); sourceErr != nil {
+		return fmt.Errorf("the event source ran into an error while capturing from session: %w", sourceErr)
+	}
 
-	s.Consumer.FromSessions(s.Session)
+	return nil
+}
 
-	go func() {
-		for event := range s.Consumer.Events {
-			// Only log events from valid map
-			idx := -1
-			for k, v := range s.Providers {
-				if v.Id == event.System.Provider.Guid || v.Id == event.System.Provider.Name {
-					idx = k
-				}
-			}
+// Filters a single event against the configured providers and logs the fields of interest
+func (s *Session) HandleEvent(event *etw.Event) {
+	// Only log events from valid map
+	idx := -1
+	for k, v := range s.Providers {
+		if v.Id == event.System.Provider.Guid || v.Id == event.System.Provider.Name {
+			idx = k
+		}
+	}
 
-			if idx == -1 {
-				//provider not found?? This statement should never happen, if it does, something seriously wrong has happened that deems investigation
-				log.Warnf("Event from unknown provider. Name: %s GUID: %s", event.System.Provider.Name, event.System.Provider.Guid)
-				continue
-			}
+	if idx == -1 {
+		//provider not found?? This statement should never happen, if it does, something seriously wrong has happened that deems investigation
+		log.Warnf("Event from unknown provider. Name: %s GUID: %s", event.System.Provider.Name, event.System.Provider.Guid)
+		metrics.EventsUnknownProvider.Inc()
+		return
+	}
 
-			lookupEventTypes := s.Providers[idx].TrackableEvents
+	metrics.EventsReceived.Inc(s.Providers[idx].Id, strconv.Itoa(int(event.System.EventID)))
+	metrics.LastEventTimestamp.SetToCurrentTime(s.Providers[idx].Id)
 
-			// Deep copy of Trackable fields as we are modifying fields
-			lookupFields := make(map[string]interface{})
-			AddProviderToLog(lookupFields, s.Providers[idx])
-			for k, v := range s.Providers[idx].TrackableFields {
-				lookupFields[k] = v
-			}
+	lookupEventTypes := s.Providers[idx].TrackableEvents
 
-			if lookupEventTypes[event.System.EventID] {
+	// Deep copy of Trackable fields as we are modifying fields
+	lookupFields := make(map[string]interface{})
+	AddProviderToLog(lookupFields, s.Providers[idx])
+	for k, v := range s.Providers[idx].TrackableFields {
+		lookupFields[k] = v
+	}
 
-				if _, ok := s.Providers[idx].TrackableFields["*"]; ok {
-					// If * is present, capture all fields
-					ExtractLogFields(reflect.ValueOf(event), lookupFields, true)
+	if lookupEventTypes[event.System.EventID] {
 
-				} else {
-					//We only want to log specific fields defined in provider fields #lookupFields
-					ExtractLogFields(reflect.ValueOf(event), lookupFields, false)
-				}
+		if _, ok := s.Providers[idx].TrackableFields["*"]; ok {
+			// If * is present, capture all fields
+			ExtractLogFields(reflect.ValueOf(event), lookupFields, true)
 
-				ExtractIPFields(lookupFields)
-				log.WithFields(lookupFields).Infof("Event ID: %d", event.System.EventID)
+		} else {
+			//We only want to log specific fields defined in provider fields #lookupFields
+			ExtractLogFields(reflect.ValueOf(event), lookupFields, false)
+
+			// Fields are configured per provider so most events miss a few, an event matching none of them
+			// usually means the provider changed its schema
+			extracted := false
+			for field := range s.Providers[idx].TrackableFields {
+				if lookupFields[field] != config.FieldNotFound {
+					extracted = true
+					break
+				}
+			}
+			if !extracted {
+				metrics.FieldExtractionErrors.Inc(s.Providers[idx].Id, strconv.Itoa(int(event.System.EventID)))
 			}
 		}
-	}()
 
-	if startConsumerErr := s.Consumer.Start(); startConsumerErr != nil {
-		return fmt.Errorf("unable to start consumer, cannot continue: %w", startConsumerErr)
-	}
-
-	time.Sleep(captureTime * time.Second)
+		// Fields the event does not have are left out of the log rather than written as a placeholder
+		for field, value := range lookupFields {
+			if value == config.FieldNotFound {
+				delete(lookupFields, field)
+			}
+		}
 
-	if s.Consumer.Err() != nil {
-		log.WithError(s.Consumer.Err()).Warn("the consumer ran into an error while capturing from session")
+		ExtractIPFields(lookupFields)
+		eventfield.TypeAll(lookupFields)
+		hook.WithEvent(log.WithFields(lookupFields), hook.EventMeta{
+			ID:   int(event.System.EventID),
+			Time: event.System.TimeCreated.SystemTime,
+		}).Infof("Event ID: %d", event.System.EventID)
+
+		if s.Bus != nil {
+			// Stamped with the receive time like the provider log line, so rule windows behave the same for both.
+			// Replayed events keep the time they were captured at, whatever the replay speed
+			received := time.Now()
+			if timed, ok := s.Source.(timedSource); ok {
+				received = timed.EventTime(event)
+			}
+			s.Bus.Publish(bus.Event{
+				Time:     received,
+				Provider: s.Providers[idx].Id,
+				LogFile:  s.Providers[idx].LogFile,
+				EventID:  int(event.System.EventID),
+				Fields:   lookupFields,
+			})
+		}
 	}
-
-	return nil
 }
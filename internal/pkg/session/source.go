@@ -0,0 +1,177 @@
+package session
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/0xrawsec/golang-etw/etw"
+)
+
+// EventSource yields the raw ETW events a Session filters and logs.
+// The channel returned by Events is closed once the source is exhausted or stopped,
+// events still buffered when Stop is called remain readable until then
+type EventSource interface {
+	Start() error
+	Events() <-chan *etw.Event
+	Stop() error
+	Err() error
+}
+
+// timedSource replays events on the timeline they were captured on, rather than yielding them as they happen
+type timedSource interface {
+	EventTime(event *etw.Event) time.Time
+}
+
+// MemorySource replays a fixed slice of events, mainly useful for exercising the pipeline without ETW
+type MemorySource struct {
+	Input []*etw.Event
+
+	events chan *etw.Event
+	done   chan struct{}
+	once   sync.Once
+}
+
+func NewMemorySource(events []*etw.Event) *MemorySource {
+	return &MemorySource{
+		Input:  events,
+		events: make(chan *etw.Event),
+		done:   make(chan struct{}),
+	}
+}
+
+func (m *MemorySource) Start() error {
+	go func() {
+		defer close(m.events)
+		for _, event := range m.Input {
+			select {
+			case m.events <- event:
+			case <-m.done:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (m *MemorySource) Events() <-chan *etw.Event { return m.events }
+
+func (m *MemorySource) Stop() error {
+	m.once.Do(func() { close(m.done) })
+	return nil
+}
+
+func (m *MemorySource) Err() error { return nil }
+
+func (m *MemorySource) EventTime(event *etw.Event) time.Time { return createdAt(event) }
+
+// FileSource reads events from a newline delimited JSON file, one etw.Event per line.
+// A Speed of 0 replays as fast as possible, otherwise the gaps between the original event
+// timestamps are honoured and divided by Speed (2 replays twice as fast as the capture)
+type FileSource struct {
+	Path  string
+	Speed float64
+
+	events chan *etw.Event
+	done   chan struct{}
+	once   sync.Once
+	mu     sync.Mutex
+	err    error
+}
+
+func NewFileSource(path string) *FileSource {
+	return &FileSource{
+		Path:   path,
+		events: make(chan *etw.Event),
+		done:   make(chan struct{}),
+	}
+}
+
+func (f *FileSource) Start() error {
+	file, openFileErr := os.Open(f.Path)
+	if openFileErr != nil {
+		return fmt.Errorf("unable to open event file '%s': %w", f.Path, openFileErr)
+	}
+
+	go func() {
+		defer close(f.events)
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		// ETW events with many properties can exceed the default 64KB token size
+		scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+
+		var previous time.Time
+		lineNumber := 0
+		for scanner.Scan() {
+			lineNumber++
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+
+			event := etw.NewEvent()
+			if unmarshalErr := json.Unmarshal(scanner.Bytes(), event); unmarshalErr != nil {
+				f.setErr(fmt.Errorf("unable to decode event on line %d of '%s': %w", lineNumber, f.Path, unmarshalErr))
+				return
+			}
+
+			if f.Speed > 0 {
+				created := event.System.TimeCreated.SystemTime
+				if !previous.IsZero() && created.After(previous) {
+					select {
+					case <-time.After(time.Duration(float64(created.Sub(previous)) / f.Speed)):
+					case <-f.done:
+						return
+					}
+				}
+				previous = created
+			}
+
+			select {
+			case f.events <- event:
+			case <-f.done:
+				return
+			}
+		}
+
+		if scanErr := scanner.Err(); scanErr != nil {
+			f.setErr(fmt.Errorf("unable to read event file '%s': %w", f.Path, scanErr))
+		}
+	}()
+
+	return nil
+}
+
+func (f *FileSource) Events() <-chan *etw.Event { return f.events }
+
+func (f *FileSource) Stop() error {
+	f.once.Do(func() { close(f.done) })
+	return nil
+}
+
+// The time the event was captured at, the speed only changes how fast the replay goes through them
+func (f *FileSource) EventTime(event *etw.Event) time.Time { return createdAt(event) }
+
+func (f *FileSource) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+func (f *FileSource) setErr(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+// An event recorded without a creation time is stamped when it is replayed
+func createdAt(event *etw.Event) time.Time {
+	if created := event.System.TimeCreated.SystemTime; !created.IsZero() {
+		return created
+	}
+	return time.Now()
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+
+package session
+
+import "fmt"
+
+// ETW only exists on Windows, other platforms have to use a MemorySource or FileSource
+func NewRealTimeSource(providers []Provider) (EventSource, error) {
+	return nil, fmt.Errorf("live ETW capture is only supported on Windows")
+}
@@ -0,0 +1,226 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/0xrawsec/golang-etw/etw"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/bus"
+	"github.com/OhZedTee/ETW-Network-Scanner-Go/internal/pkg/eventfield"
+	log "github.com/sirupsen/logrus"
+)
+
+const testProvidersFile = "../../../config/providers.yml"
+
+// A TCPIP connection event as the live consumer yields it, created at the given time
+func tcpEvent(provider string, eventID uint16, local, remote string, created time.Time) *etw.Event {
+	event := etw.NewEvent()
+	event.System.Provider.Name = provider
+	event.System.EventID = eventID
+	event.System.TimeCreated.SystemTime = created
+	event.EventData["LocalSockAddr"] = local
+	event.EventData["RemoteSockAddr"] = remote
+	return event
+}
+
+// Reads the source until it closes its channel
+func drain(t *testing.T, source EventSource) []*etw.Event {
+	t.Helper()
+
+	var events []*etw.Event
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case event, ok := <-source.Events():
+			if !ok {
+				return events
+			}
+			events = append(events, event)
+		case <-timeout:
+			t.Fatalf("source still open after %d events", len(events))
+		}
+	}
+}
+
+// Records the events to a capture file the way --record does and returns its path
+func record(t *testing.T, events []*etw.Event) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "capture.ndjson")
+	recorder := NewRecordingSource(NewMemorySource(events), path)
+	if startErr := recorder.Start(); startErr != nil {
+		t.Fatal(startErr)
+	}
+	if recorded := drain(t, recorder); len(recorded) != len(events) {
+		t.Fatalf("recorder yielded %d events, want %d", len(recorded), len(events))
+	}
+	if stopErr := recorder.Stop(); stopErr != nil {
+		t.Fatal(stopErr)
+	}
+	if recordErr := recorder.Err(); recordErr != nil {
+		t.Fatal(recordErr)
+	}
+	return path
+}
+
+func TestMemorySource(t *testing.T) {
+	created := time.Date(2020, 3, 1, 9, 0, 0, 0, time.UTC)
+	var events []*etw.Event
+	for port := 1000; port < 1005; port++ {
+		events = append(events, tcpEvent("Microsoft-Windows-TCPIP", 1017, fmt.Sprintf("10.0.0.5:%d", port), "10.0.0.9:4444", created))
+	}
+
+	source := NewMemorySource(events)
+	if startErr := source.Start(); startErr != nil {
+		t.Fatal(startErr)
+	}
+	if replayed := drain(t, source); !reflect.DeepEqual(replayed, events) {
+		t.Errorf("replayed %d events, want the %d given in order", len(replayed), len(events))
+	}
+	if eventTime := source.EventTime(events[0]); !eventTime.Equal(created) {
+		t.Errorf("event time %s, want %s", eventTime, created)
+	}
+
+	// Stopping closes the channel without yielding the rest
+	stopped := NewMemorySource(events)
+	if startErr := stopped.Start(); startErr != nil {
+		t.Fatal(startErr)
+	}
+	<-stopped.Events()
+	stopped.Stop()
+	if rest := drain(t, stopped); len(rest) > 1 {
+		t.Errorf("%d events yielded after stop", len(rest))
+	}
+}
+
+func TestRecordThenReplay(t *testing.T) {
+	// Captured long ago, replayed events keep their time whatever the clock says now
+	created := time.Date(2020, 3, 1, 9, 0, 0, 123456789, time.UTC)
+	var events []*etw.Event
+	for i := 0; i < 5; i++ {
+		event := tcpEvent("Microsoft-Windows-TCPIP", 1017, fmt.Sprintf("10.0.0.5:%d", 1000+i), "[fe80::9]:4444", created.Add(time.Duration(i)*time.Second))
+		event.System.Correlation.ActivityID = "{6F1B4C2A-0000-0000-0000-3A9D1E7C5B10}"
+		events = append(events, event)
+	}
+	// Recorded before any filtering, left out when replayed through the session
+	events = append(events, tcpEvent("Microsoft-Windows-Unknown", 1017, "10.0.0.5:2000", "10.0.0.9:4444", created))
+	events = append(events, tcpEvent("Microsoft-Windows-TCPIP", 9999, "10.0.0.5:2001", "10.0.0.9:4444", created))
+
+	path := record(t, events)
+
+	// The provider log lines would otherwise go to stderr, there is no provider hook
+	output := log.StandardLogger().Out
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(output) })
+
+	var sessionObj Session
+	if initErr := sessionObj.Init(testProvidersFile); initErr != nil {
+		t.Fatal(initErr)
+	}
+	sessionObj.Source = NewFileSource(path)
+	sessionObj.Bus = bus.New()
+	published := sessionObj.Bus.Subscribe("test", len(events))
+
+	if runErr := sessionObj.Run(context.Background()); runErr != nil {
+		t.Fatal(runErr)
+	}
+	sessionObj.Bus.Close()
+
+	var replayed []bus.Event
+	for event := range published {
+		replayed = append(replayed, event)
+	}
+	if len(replayed) != 5 {
+		t.Fatalf("replayed %d events, want 5", len(replayed))
+	}
+
+	for i, event := range replayed {
+		if want := created.Add(time.Duration(i) * time.Second); !event.Time.Equal(want) {
+			t.Errorf("event %d at %s, want the captured %s", i, event.Time, want)
+		}
+		if event.Provider != "Microsoft-Windows-TCPIP" || event.LogFile != "tcp-ip.log" || event.EventID != 1017 {
+			t.Errorf("event %d %+v", i, event)
+		}
+
+		want := map[string]interface{}{
+			"provider":            "Microsoft-Windows-TCPIP",
+			"LocalSockAddr_IP":    netip.MustParseAddr("10.0.0.5"),
+			"LocalSockAddr_PORT":  uint16(1000 + i),
+			"RemoteSockAddr_IP":   netip.MustParseAddr("fe80::9"),
+			"RemoteSockAddr_PORT": uint16(4444),
+			"ActivityID":          eventfield.GUID("{6F1B4C2A-0000-0000-0000-3A9D1E7C5B10}"),
+		}
+		if !reflect.DeepEqual(event.Fields, want) {
+			t.Errorf("event %d fields %#v, want %#v", i, event.Fields, want)
+		}
+	}
+}
+
+func TestFileSourceSpeed(t *testing.T) {
+	created := time.Now()
+	var events []*etw.Event
+	for i := 0; i < 5; i++ {
+		events = append(events, tcpEvent("Microsoft-Windows-TCPIP", 1017, fmt.Sprintf("10.0.0.5:%d", 1000+i), "10.0.0.9:4444", created.Add(time.Duration(i)*100*time.Millisecond)))
+	}
+	path := record(t, events)
+
+	// The capture spans 400ms, replayed four times as fast
+	source := NewFileSource(path)
+	source.Speed = 4
+	if startErr := source.Start(); startErr != nil {
+		t.Fatal(startErr)
+	}
+	start := time.Now()
+	if replayed := drain(t, source); len(replayed) != len(events) {
+		t.Errorf("replayed %d events, want %d", len(replayed), len(events))
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond/4 {
+		t.Errorf("replayed in %s, faster than the capture allows", elapsed)
+	}
+
+	// Stopping does not wait for the gap to the next event
+	events[1].System.TimeCreated.SystemTime = created.Add(time.Hour)
+	slow := NewFileSource(record(t, events[:2]))
+	slow.Speed = 1
+	if startErr := slow.Start(); startErr != nil {
+		t.Fatal(startErr)
+	}
+	<-slow.Events()
+	slow.Stop()
+	select {
+	case _, ok := <-slow.Events():
+		if ok {
+			t.Error("the event an hour later was replayed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("still waiting for the next event after stop")
+	}
+}
+
+func TestFileSourceErrors(t *testing.T) {
+	if startErr := NewFileSource(filepath.Join(t.TempDir(), "missing.ndjson")).Start(); startErr == nil {
+		t.Error("started on a missing capture file")
+	}
+
+	path := filepath.Join(t.TempDir(), "capture.ndjson")
+	if writeErr := os.WriteFile(path, []byte("{\"System\":{\"EventID\":1017}}\n{\"System\":\n"), 0600); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	source := NewFileSource(path)
+	if startErr := source.Start(); startErr != nil {
+		t.Fatal(startErr)
+	}
+	if replayed := drain(t, source); len(replayed) != 1 {
+		t.Errorf("replayed %d events before the malformed line, want 1", len(replayed))
+	}
+	if source.Err() == nil {
+		t.Error("no error for a malformed line")
+	}
+}
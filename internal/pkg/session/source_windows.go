@@ -0,0 +1,64 @@
+package session
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/0xrawsec/golang-etw/etw"
+	log "github.com/sirupsen/logrus"
+)
+
+// RealTimeSource is the live ETW consumer, it enables every configured provider on a real time session
+type RealTimeSource struct {
+	Providers []Provider
+	Session   *etw.RealTimeSession
+	Consumer  *etw.Consumer
+}
+
+func NewRealTimeSource(providers []Provider) (EventSource, error) {
+	return &RealTimeSource{Providers: providers}, nil
+}
+
+func (r *RealTimeSource) Start() error {
+	r.Session = etw.NewRealTimeSession("ETW-Go")
+
+	minSingleProviderSuccess := false
+
+	//Enabling the providers inside the Provider Struct
+	for _, provider := range r.Providers {
+		if resolveProviderErr := r.Session.EnableProvider(etw.ResolveProvider(provider.Id)); resolveProviderErr != nil {
+			log.WithError(resolveProviderErr).Errorf("Cannot resolve provider... continuing")
+			continue
+		}
+		minSingleProviderSuccess = true
+	}
+
+	if !minSingleProviderSuccess {
+		r.Session.Stop()
+		return fmt.Errorf("unable to resolve a single provider, cannot continue")
+	}
+
+	r.Consumer = etw.NewRealTimeConsumer(context.Background())
+	r.Consumer.FromSessions(r.Session)
+
+	if startConsumerErr := r.Consumer.Start(); startConsumerErr != nil {
+		r.Consumer.Stop()
+		r.Session.Stop()
+		return fmt.Errorf("unable to start consumer, cannot continue: %w", startConsumerErr)
+	}
+
+	return nil
+}
+
+func (r *RealTimeSource) Events() <-chan *etw.Event { return r.Consumer.Events }
+
+func (r *RealTimeSource) Stop() error {
+	consumerErr := r.Consumer.Stop()
+	if sessionErr := r.Session.Stop(); sessionErr != nil {
+		return sessionErr
+	}
+
+	return consumerErr
+}
+
+func (r *RealTimeSource) Err() error { return r.Consumer.Err() }